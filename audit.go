@@ -0,0 +1,216 @@
+package sqlds
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Audited operations.
+const (
+	AuditPut    = "put"
+	AuditDelete = "delete"
+)
+
+// AuditQueries are the queries of the audit table of an AuditedDatastore.
+type AuditQueries interface {
+	// InsertAudit records the operation $2 on key $1, $3 being the SHA-256
+	// hash of the value put, NULL for deletions.
+	InsertAudit() string
+	// QueryAudit selects the operation, timestamp and hash of the entries
+	// of key $1 in chronological order.
+	QueryAudit() string
+}
+
+// AuditEntry is a recorded mutation of a key.
+type AuditEntry struct {
+	Key       ds.Key
+	Operation string
+	Timestamp time.Time
+	DataHash  []byte // SHA-256 of the value put, nil for deletions
+}
+
+// AuditedDatastore records every Put and Delete of a Datastore in an audit
+// table, in the same transaction as the mutation.
+type AuditedDatastore struct {
+	ds      *Datastore
+	queries AuditQueries
+}
+
+// WithAudit wraps d so that its mutations are recorded with queries.
+func WithAudit(d *Datastore, queries AuditQueries) *AuditedDatastore {
+	return &AuditedDatastore{ds: d, queries: queries}
+}
+
+func (a *AuditedDatastore) put(ctx context.Context, tx *sql.Tx, key ds.Key, value []byte) error {
+	if err := a.ds.checkValueSize(key, value); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, a.ds.putQuery(), a.ds.putArgs(key, value)...); err != nil {
+		return err
+	}
+	hash := sha256.Sum256(value)
+	_, err := tx.ExecContext(ctx, a.queries.InsertAudit(), key.String(), AuditPut, hash[:])
+	return err
+}
+
+// delete deletes key, recording the deletion only if the key existed.
+func (a *AuditedDatastore) delete(ctx context.Context, tx *sql.Tx, key ds.Key) error {
+	res, err := tx.ExecContext(ctx, a.ds.queries.Delete(), a.ds.keyArg(key))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, a.queries.InsertAudit(), key.String(), AuditDelete, nil)
+	return err
+}
+
+// QueryAudit returns the recorded mutations of key, oldest first.
+func (a *AuditedDatastore) QueryAudit(ctx context.Context, key ds.Key) ([]AuditEntry, error) {
+	rows, err := a.ds.db.QueryContext(ctx, a.queries.QueryAudit(), key.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		e := AuditEntry{Key: key}
+		if err := rows.Scan(&e.Operation, &e.Timestamp, &e.DataHash); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// Get retrieves a value from the wrapped datastore.
+func (a *AuditedDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	return a.ds.Get(ctx, key)
+}
+
+// Has determines if a value for the given key exists in the wrapped datastore.
+func (a *AuditedDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return a.ds.Has(ctx, key)
+}
+
+// GetSize determines the size of the value of the given key.
+func (a *AuditedDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	return a.ds.GetSize(ctx, key)
+}
+
+// Put stores a value and records the operation.
+func (a *AuditedDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	if err := a.ds.inTx(ctx, func(tx *sql.Tx) error {
+		return a.put(ctx, tx, key, value)
+	}); err != nil {
+		return err
+	}
+	a.ds.replicate(key, value, false)
+	return nil
+}
+
+// Delete removes a value and records the operation.
+func (a *AuditedDatastore) Delete(ctx context.Context, key ds.Key) error {
+	if err := a.ds.inTx(ctx, func(tx *sql.Tx) error {
+		return a.delete(ctx, tx, key)
+	}); err != nil {
+		return err
+	}
+	a.ds.replicate(key, nil, true)
+	return nil
+}
+
+// Query queries the wrapped datastore.
+func (a *AuditedDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	return a.ds.Query(ctx, q)
+}
+
+// Sync flushes the wrapped datastore.
+func (a *AuditedDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return a.ds.Sync(ctx, prefix)
+}
+
+// Close closes the wrapped datastore.
+func (a *AuditedDatastore) Close() error {
+	return a.ds.Close()
+}
+
+// Batch creates a batch whose operations are committed and recorded in a
+// single transaction.
+func (a *AuditedDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	if a.ds.readOnly {
+		return nil, ErrReadOnly
+	}
+	return &auditedBatch{a: a, ops: make(map[ds.Key]op)}, nil
+}
+
+type auditedBatch struct {
+	a         *AuditedDatastore
+	ops       map[ds.Key]op
+	committed bool
+	discarded bool
+}
+
+func (ab *auditedBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	if err := checkUsable(ab.committed, ab.discarded); err != nil {
+		return err
+	}
+	ab.ops[key] = op{value: val}
+	return nil
+}
+
+func (ab *auditedBatch) Delete(ctx context.Context, key ds.Key) error {
+	if err := checkUsable(ab.committed, ab.discarded); err != nil {
+		return err
+	}
+	ab.ops[key] = op{delete: true}
+	return nil
+}
+
+func (ab *auditedBatch) Commit(ctx context.Context) error {
+	if err := checkUsable(ab.committed, ab.discarded); err != nil {
+		return err
+	}
+
+	err := ab.a.ds.inTx(ctx, func(tx *sql.Tx) error {
+		for k, op := range ab.ops {
+			var err error
+			if op.delete {
+				err = ab.a.delete(ctx, tx, k)
+			} else {
+				err = ab.a.put(ctx, tx, k, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, op := range ab.ops {
+		ab.a.ds.replicate(k, op.value, op.delete)
+	}
+	ab.committed = true
+	return nil
+}
+
+// Discard drops the operations of the batch, see DiscardableBatch.
+func (ab *auditedBatch) Discard(ctx context.Context) {
+	ab.discarded = true
+	ab.ops = nil
+}
+
+var (
+	_ ds.Batching      = (*AuditedDatastore)(nil)
+	_ DiscardableBatch = (*auditedBatch)(nil)
+)
@@ -2,18 +2,63 @@ package sqlds
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	ds "github.com/ipfs/go-datastore"
 )
 
+// ErrAlreadyCommitted is returned when using a batch which has been committed.
+var ErrAlreadyCommitted = errors.New("batch already committed")
+
+// ErrBatchDiscarded is returned when using a batch which has been discarded.
+var ErrBatchDiscarded = errors.New("batch discarded")
+
+// DiscardableBatch is a batch whose operations can be abandoned before it is
+// committed, like a ds.Txn. The batches of the datastore and of its wrappers
+// implement it, the wrappers forwarding Discard to the batch they wrap.
+type DiscardableBatch interface {
+	ds.Batch
+	// Discard drops the operations which are not committed yet, the batch
+	// can not be used afterwards. Nothing is written to the database until
+	// Commit, so there is nothing to roll back.
+	Discard(ctx context.Context)
+}
+
+// discardBatch discards b if it is a DiscardableBatch, for the wrapper
+// batches.
+func discardBatch(ctx context.Context, b ds.Batch) {
+	if db, ok := b.(DiscardableBatch); ok {
+		db.Discard(ctx)
+	}
+}
+
 type op struct {
 	delete bool
 	value  []byte
 }
 
 type batch struct {
-	ds  *Datastore
-	ops map[ds.Key]op
+	ds        *Datastore
+	ops       map[ds.Key]op
+	committed bool
+	discarded bool
+	txOpts    *sql.TxOptions
+}
+
+// checkUsable returns an error if the batch has been committed or
+// discarded.
+func checkUsable(committed, discarded bool) error {
+	switch {
+	case discarded:
+		return ErrBatchDiscarded
+	case committed:
+		return ErrAlreadyCommitted
+	}
+	return nil
 }
 
 // Batch creates a set of deferred updates to the database.
@@ -21,18 +66,40 @@ type batch struct {
 // operations are buffered and then executed sequentially
 // over a single connection when Commit is called.
 func (d *Datastore) Batch(ctx context.Context) (ds.Batch, error) {
+	return d.BatchWithOptions(nil)
+}
+
+// BatchWithOptions creates a set of deferred updates executed in a
+// transaction started with opts when Commit is called, to choose its
+// isolation level. A nil opts executes the updates without a transaction,
+// like Batch.
+func (d *Datastore) BatchWithOptions(opts *sql.TxOptions) (ds.Batch, error) {
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+
 	return &batch{
-		ds:  d,
-		ops: make(map[ds.Key]op),
+		ds:     d,
+		ops:    make(map[ds.Key]op),
+		txOpts: opts,
 	}, nil
 }
 
 func (bt *batch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	if err := checkUsable(bt.committed, bt.discarded); err != nil {
+		return err
+	}
+	if err := bt.ds.checkValueSize(key, val); err != nil {
+		return err
+	}
 	bt.ops[key] = op{value: val}
 	return nil
 }
 
 func (bt *batch) Delete(ctx context.Context, key ds.Key) error {
+	if err := checkUsable(bt.committed, bt.discarded); err != nil {
+		return err
+	}
 	bt.ops[key] = op{delete: true}
 	return nil
 }
@@ -41,25 +108,307 @@ func (bt *batch) Commit(ctx context.Context) error {
 	return bt.CommitContext(ctx)
 }
 
-func (bt *batch) CommitContext(ctx context.Context) error {
-	conn, err := bt.ds.db.Conn(ctx)
-	if err != nil {
+// CommitContext executes the operations of the batch, a committed batch can
+// not be committed again nor reused. A failed commit can be retried.
+func (bt *batch) CommitContext(ctx context.Context) (err error) {
+	defer func(start time.Time) { bt.ds.log(ctx, "Batch.Commit", "", nil, start, err) }(time.Now())
+	if err := checkUsable(bt.committed, bt.discarded); err != nil {
 		return err
 	}
-	defer conn.Close()
+	if len(bt.ops) == 0 {
+		bt.committed = true
+		return nil
+	}
+
+	if bt.txOpts != nil {
+		tx, err := bt.ds.db.BeginTx(ctx, bt.txOpts)
+		if err != nil {
+			return err
+		}
+		if err := bt.exec(ctx, tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	} else {
+		conn, err := bt.ds.db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if err := bt.exec(ctx, conn); err != nil {
+			return err
+		}
+	}
 
+	for k, op := range bt.ops {
+		bt.ds.replicate(k, op.value, op.delete)
+	}
+	bt.committed = true
+	bt.ops = nil
+	return nil
+}
+
+// Discard drops the operations of the batch, see DiscardableBatch.
+func (bt *batch) Discard(ctx context.Context) {
+	bt.discarded = true
+	bt.ops = nil
+}
+
+// exec executes the operations of the batch with e.
+func (bt *batch) exec(ctx context.Context, e execer) error {
+	var deletes []ds.Key
 	for k, op := range bt.ops {
 		if op.delete {
-			_, err = conn.ExecContext(ctx, bt.ds.queries.Delete(), k.String())
-		} else {
-			_, err = conn.ExecContext(ctx, bt.ds.queries.Put(), k.String(), op.value)
+			deletes = append(deletes, k)
+			continue
 		}
-		if err != nil {
-			break
+		if _, err := e.ExecContext(ctx, bt.ds.putQuery(), bt.ds.putArgs(k, op.value)...); err != nil {
+			return err
 		}
 	}
 
+	_, err := deleteMany(ctx, e, bt.ds, deletes)
 	return err
 }
 
-var _ ds.Batching = (*Datastore)(nil)
+// BoundedBatch is a set of deferred updates committed in transactions of at
+// most maxOps operations: the Put or Delete adding the maxOps-th operation
+// commits them before returning. Commit only commits the remaining ones.
+//
+// Unlike a batch, a bounded batch is not atomic, it is meant for bulk loads
+// which would otherwise hold too many operations in memory or lock the
+// database for too long. A failed commit leaves the operations buffered, the
+// one which triggered it included, to be committed by the next Put, Delete
+// or Commit.
+type BoundedBatch struct {
+	b         *batch
+	maxOps    int
+	committed bool
+	discarded bool
+}
+
+// BatchWithMaxSize creates a bounded batch committing its operations in
+// transactions of at most maxOps operations.
+func (d *Datastore) BatchWithMaxSize(maxOps int) (*BoundedBatch, error) {
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+	if maxOps < 1 {
+		return nil, fmt.Errorf("invalid maximum number of operations %d", maxOps)
+	}
+
+	return &BoundedBatch{b: d.newBoundedShare(), maxOps: maxOps}, nil
+}
+
+// newBoundedShare returns the batch of the next operations of a bounded
+// batch.
+func (d *Datastore) newBoundedShare() *batch {
+	return &batch{ds: d, ops: make(map[ds.Key]op), txOpts: &sql.TxOptions{}}
+}
+
+// flush commits the operations if there are maxOps of them.
+func (bb *BoundedBatch) flush(ctx context.Context) error {
+	if len(bb.b.ops) < bb.maxOps {
+		return nil
+	}
+	if err := bb.b.CommitContext(ctx); err != nil {
+		return err
+	}
+	bb.b = bb.b.ds.newBoundedShare()
+	return nil
+}
+
+// Put adds a value to the batch, committing the operations if there are
+// maxOps of them.
+func (bb *BoundedBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	if err := checkUsable(bb.committed, bb.discarded); err != nil {
+		return err
+	}
+	if err := bb.b.Put(ctx, key, val); err != nil {
+		return err
+	}
+	return bb.flush(ctx)
+}
+
+// Delete adds a deletion to the batch, committing the operations if there
+// are maxOps of them.
+func (bb *BoundedBatch) Delete(ctx context.Context, key ds.Key) error {
+	if err := checkUsable(bb.committed, bb.discarded); err != nil {
+		return err
+	}
+	if err := bb.b.Delete(ctx, key); err != nil {
+		return err
+	}
+	return bb.flush(ctx)
+}
+
+// Commit commits the operations which are not committed yet.
+func (bb *BoundedBatch) Commit(ctx context.Context) error {
+	if err := checkUsable(bb.committed, bb.discarded); err != nil {
+		return err
+	}
+	if err := bb.b.CommitContext(ctx); err != nil {
+		return err
+	}
+	bb.committed = true
+	return nil
+}
+
+// Discard drops the operations which are not committed yet, those committed
+// when maxOps operations were reached are kept.
+func (bb *BoundedBatch) Discard(ctx context.Context) {
+	bb.discarded = true
+	bb.b.Discard(ctx)
+}
+
+var _ DiscardableBatch = (*BoundedBatch)(nil)
+
+type parallelBatch struct {
+	ds        *Datastore
+	nWorkers  int
+	ops       map[ds.Key]op
+	committed bool
+	discarded bool
+}
+
+// ParallelBatch creates a set of deferred updates executed by nWorkers
+// goroutines on Commit, each in its own transaction, so that backends
+// accepting concurrent writers make progress on several of them at once.
+// Keys of the batch are not guaranteed to be written in the same
+// transaction.
+func (d *Datastore) ParallelBatch(nWorkers int) (ds.Batch, error) {
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+	if nWorkers < 1 {
+		return nil, fmt.Errorf("invalid number of workers %d", nWorkers)
+	}
+
+	return &parallelBatch{
+		ds:       d,
+		nWorkers: nWorkers,
+		ops:      make(map[ds.Key]op),
+	}, nil
+}
+
+func (pb *parallelBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	if err := checkUsable(pb.committed, pb.discarded); err != nil {
+		return err
+	}
+	if err := pb.ds.checkValueSize(key, val); err != nil {
+		return err
+	}
+	pb.ops[key] = op{value: val}
+	return nil
+}
+
+func (pb *parallelBatch) Delete(ctx context.Context, key ds.Key) error {
+	if err := checkUsable(pb.committed, pb.discarded); err != nil {
+		return err
+	}
+	pb.ops[key] = op{delete: true}
+	return nil
+}
+
+// Commit executes the operations of the batch and returns the errors of the
+// failed transactions joined. As soon as one transaction fails the ones
+// which are not committed yet are rolled back, but the committed ones are
+// kept: a failed commit may be partially applied and can be retried.
+func (pb *parallelBatch) Commit(ctx context.Context) error {
+	if err := checkUsable(pb.committed, pb.discarded); err != nil {
+		return err
+	}
+
+	shares := make([]map[ds.Key]op, min(pb.nWorkers, len(pb.ops)))
+	i := 0
+	for k, o := range pb.ops {
+		if shares[i] == nil {
+			shares[i] = make(map[ds.Key]op)
+		}
+		shares[i][k] = o
+		i = (i + 1) % len(shares)
+	}
+
+	// cancelled on the first failure to roll back the pending transactions
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]error, len(shares))
+	var wg sync.WaitGroup
+	for i, ops := range shares {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = pb.commitShare(wctx, ops); errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		// rolled back because of another failure
+		if err == nil || (errors.Is(err, context.Canceled) && ctx.Err() == nil) {
+			continue
+		}
+		failed = append(failed, err)
+	}
+	if len(failed) != 0 {
+		return errors.Join(failed...)
+	}
+
+	for k, op := range pb.ops {
+		pb.ds.replicate(k, op.value, op.delete)
+	}
+	pb.committed = true
+	pb.ops = nil
+	return nil
+}
+
+// Discard drops the operations of the batch, see DiscardableBatch.
+func (pb *parallelBatch) Discard(ctx context.Context) {
+	pb.discarded = true
+	pb.ops = nil
+}
+
+// commitShare executes ops in a transaction.
+func (pb *parallelBatch) commitShare(ctx context.Context, ops map[ds.Key]op) error {
+	tx, err := pb.ds.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var deletes []ds.Key
+	for k, op := range ops {
+		if op.delete {
+			deletes = append(deletes, k)
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, pb.ds.putQuery(), pb.ds.putArgs(k, op.value)...); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := deleteMany(ctx, tx, pb.ds, deletes); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+var (
+	_ ds.Batching      = (*Datastore)(nil)
+	_ DiscardableBatch = (*batch)(nil)
+	_ DiscardableBatch = (*parallelBatch)(nil)
+)
@@ -0,0 +1,217 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// PutMany upserts the rows of keys with values, values[i] being the value of
+// keys[i], in a single transaction. The rows are written with multi-row
+// variants of the put query of the datastore, repeating its VALUES list, so
+// that blocks are ingested with one round trip per statement rather than
+// per row. Put queries using their parameters outside of the VALUES list,
+// such as upserts setting data = $2 instead of excluded.data, are run once
+// per row instead. The last value of a key given several times is kept.
+func (d *Datastore) PutMany(ctx context.Context, keys []ds.Key, values [][]byte) (err error) {
+	defer func(start time.Time) { d.log(ctx, "PutMany", d.putQuery(), nil, start, err) }(time.Now())
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if len(keys) != len(values) {
+		return fmt.Errorf("PutMany: %d keys for %d values", len(keys), len(values))
+	}
+	for i, k := range keys {
+		if err := d.checkValueSize(k, values[i]); err != nil {
+			return err
+		}
+	}
+	keys, values = lastValues(keys, values)
+	if d.stats != nil {
+		d.stats.puts.Add(int64(len(keys)))
+	}
+
+	if err := d.inTx(ctx, func(tx *sql.Tx) error { return putMany(ctx, tx, d, keys, values) }); err != nil {
+		return err
+	}
+	for i, k := range keys {
+		d.replicate(k, values[i], false)
+	}
+	return nil
+}
+
+// lastValues returns keys without duplicates, in order of their last
+// occurrence, and their last values, a statement not being able to upsert a
+// row twice in postgres.
+func lastValues(keys []ds.Key, values [][]byte) ([]ds.Key, [][]byte) {
+	last := make(map[ds.Key]int, len(keys))
+	for i, k := range keys {
+		last[k] = i
+	}
+	if len(last) == len(keys) {
+		return keys, values
+	}
+
+	uk := make([]ds.Key, 0, len(last))
+	uv := make([][]byte, 0, len(last))
+	for i, k := range keys {
+		if last[k] == i {
+			uk = append(uk, k)
+			uv = append(uv, values[i])
+		}
+	}
+	return uk, uv
+}
+
+// putMany upserts keys with values in statements of at most
+// maxDeleteManyKeys parameters.
+func putMany(ctx context.Context, e execer, d *Datastore, keys []ds.Key, values [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	query := d.putQuery()
+	width := len(d.putArgs(keys[0], values[0]))
+	rows := max(maxDeleteManyKeys/width, 1)
+	if repeatValues(query, 1) == "" {
+		rows = 1
+	}
+
+	for len(keys) > 0 {
+		n := min(len(keys), rows)
+		args := make([]any, 0, n*width)
+		for i, k := range keys[:n] {
+			args = append(args, d.putArgs(k, values[i])...)
+		}
+		stmt := query
+		if n > 1 {
+			stmt = repeatValues(query, n)
+		}
+		if _, err := e.ExecContext(ctx, stmt, args...); err != nil {
+			return err
+		}
+		keys, values = keys[n:], values[n:]
+	}
+	return nil
+}
+
+// paramRe matches the $N parameters of the queries.
+var paramRe = regexp.MustCompile(`\$(\d+)`)
+
+// repeatValues returns query inserting n rows, its VALUES list being
+// repeated with the parameters of the i-th row shifted by i times their
+// number. It returns "" if query has no VALUES list or uses parameters
+// outside of it.
+func repeatValues(query string, n int) string {
+	i := strings.Index(query, "VALUES")
+	if i < 0 {
+		return ""
+	}
+	start := i + len("VALUES")
+	for start < len(query) && query[start] == ' ' {
+		start++
+	}
+	if start == len(query) || query[start] != '(' {
+		return ""
+	}
+	end, depth := start, 0
+	for ; end < len(query); end++ {
+		if query[end] == '(' {
+			depth++
+		} else if query[end] == ')' {
+			if depth--; depth == 0 {
+				break
+			}
+		}
+	}
+	if end == len(query) {
+		return ""
+	}
+	head, list, tail := query[:start], query[start:end+1], query[end+1:]
+	if paramRe.MatchString(head) || paramRe.MatchString(tail) {
+		return ""
+	}
+
+	width := 0
+	for _, m := range paramRe.FindAllStringSubmatch(list, -1) {
+		p, _ := strconv.Atoi(m[1])
+		width = max(width, p)
+	}
+	lists := make([]string, n)
+	for row := range lists {
+		lists[row] = paramRe.ReplaceAllStringFunc(list, func(param string) string {
+			p, _ := strconv.Atoi(param[1:])
+			return "$" + strconv.Itoa(row*width+p)
+		})
+	}
+	return head + strings.Join(lists, ", ") + tail
+}
+
+// GetMany retrieves the values of keys with as few statements as possible.
+// The keys without a row are absent from the returned map. The values of the
+// tables with a checksum column, verified one by one, are read with Get.
+func (d *Datastore) GetMany(ctx context.Context, keys []ds.Key) (values map[ds.Key][]byte, err error) {
+	defer func(start time.Time) { d.log(ctx, "GetMany", d.queries.GetMany(1), nil, start, err) }(time.Now())
+	ctx, done := d.withQueryTimeout(ctx, &err)
+	defer done()
+
+	values = make(map[ds.Key][]byte, len(keys))
+	if d.queries.GetWithChecksum() != "" || d.queries.GetMany(1) == "" {
+		for _, k := range keys {
+			v, err := d.Get(ctx, k)
+			switch err {
+			case ds.ErrNotFound:
+			case nil:
+				values[k] = v
+			default:
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	if d.stats != nil {
+		d.stats.gets.Add(int64(len(keys)))
+	}
+
+	for len(keys) > 0 {
+		chunk := keys[:min(len(keys), maxDeleteManyKeys)]
+		keys = keys[len(chunk):]
+		if err := d.getMany(ctx, chunk, values); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// getMany reads the values of keys with a single statement into values.
+func (d *Datastore) getMany(ctx context.Context, keys []ds.Key, values map[ds.Key][]byte) error {
+	args := make([]any, len(keys))
+	for i, k := range keys {
+		args[i] = d.keyArg(k)
+	}
+
+	rows, err := d.db.QueryContext(ctx, d.queries.GetMany(len(keys)), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		k, err := d.keys.Decode(key)
+		if err != nil {
+			return err
+		}
+		values[k] = value
+	}
+	return rows.Err()
+}
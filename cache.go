@@ -0,0 +1,222 @@
+package sqlds
+
+import (
+	"context"
+	"hash/fnv"
+	"slices"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// CacheOptions configures the cache of a CachedDatastore.
+type CacheOptions struct {
+	// Capacity is the maximum number of cached values, 1024 by default.
+	Capacity int
+	// MaxValueSize is the size above which values are not cached, so that
+	// a few large blocks do not evict many small ones. Zero caches values
+	// of any size.
+	MaxValueSize int
+}
+
+// cacheLocks is the number of locks serializing the writes and cache fills
+// of the keys.
+const cacheLocks = 64
+
+// CachedDatastore serves Get, Has and GetSize from an in-memory LRU cache of
+// the values of the wrapped datastore. Put and Delete update the cache while
+// holding a lock of their key, so that a concurrent Get missing the cache
+// can not fill it with the value they replace.
+//
+// Queries are not cached, and the cache does not see the writes made to the
+// database by other processes or other datastores.
+type CachedDatastore struct {
+	child        ds.Batching
+	cache        *lru.Cache[ds.Key, []byte]
+	maxValueSize int
+	locks        [cacheLocks]sync.RWMutex
+}
+
+// WithCache wraps d so that values are cached according to opts.
+func WithCache(d ds.Batching, opts CacheOptions) (*CachedDatastore, error) {
+	if opts.Capacity == 0 {
+		opts.Capacity = 1024
+	}
+
+	cache, err := lru.New[ds.Key, []byte](opts.Capacity)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedDatastore{child: d, cache: cache, maxValueSize: opts.MaxValueSize}, nil
+}
+
+// lockIndex returns the index of the lock of key.
+func lockIndex(key ds.Key) int {
+	h := fnv.New32a()
+	_, _ = h.Write(key.Bytes())
+	return int(h.Sum32() % cacheLocks)
+}
+
+func (c *CachedDatastore) lock(key ds.Key) *sync.RWMutex {
+	return &c.locks[lockIndex(key)]
+}
+
+// add caches a copy of value unless it is too large.
+func (c *CachedDatastore) add(key ds.Key, value []byte) {
+	if c.maxValueSize > 0 && len(value) > c.maxValueSize {
+		c.cache.Remove(key)
+		return
+	}
+	c.cache.Add(key, slices.Clone(value))
+}
+
+// Get retrieves the value of the given key from the cache, or from the
+// wrapped datastore in which case it is cached.
+func (c *CachedDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	if v, ok := c.cache.Get(key); ok {
+		return slices.Clone(v), nil
+	}
+
+	l := c.lock(key)
+	l.RLock()
+	defer l.RUnlock()
+
+	v, err := c.child.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, v)
+	return v, nil
+}
+
+// Has determines if a value for the given key exists, missing keys are not
+// cached.
+func (c *CachedDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	if c.cache.Contains(key) {
+		return true, nil
+	}
+	return c.child.Has(ctx, key)
+}
+
+// GetSize returns the size of the value of the given key.
+func (c *CachedDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	if v, ok := c.cache.Peek(key); ok {
+		return len(v), nil
+	}
+	return c.child.GetSize(ctx, key)
+}
+
+// Put stores a value and caches it.
+func (c *CachedDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	l := c.lock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	if err := c.child.Put(ctx, key, value); err != nil {
+		// the write may have happened
+		c.cache.Remove(key)
+		return err
+	}
+	c.add(key, value)
+	return nil
+}
+
+// Delete removes the value of the given key and evicts it from the cache.
+func (c *CachedDatastore) Delete(ctx context.Context, key ds.Key) error {
+	l := c.lock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	err := c.child.Delete(ctx, key)
+	c.cache.Remove(key)
+	return err
+}
+
+// Query returns the entries matching the query from the wrapped datastore.
+func (c *CachedDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	return c.child.Query(ctx, q)
+}
+
+// Sync flushes the given prefix of the wrapped datastore.
+func (c *CachedDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return c.child.Sync(ctx, prefix)
+}
+
+// Close purges the cache and closes the wrapped datastore.
+func (c *CachedDatastore) Close() error {
+	c.cache.Purge()
+	return c.child.Close()
+}
+
+// Batch creates a set of deferred updates whose keys are evicted from the
+// cache on Commit.
+func (c *CachedDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := c.child.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedBatch{b: b, c: c, keys: make(map[ds.Key]struct{})}, nil
+}
+
+type cachedBatch struct {
+	b    ds.Batch
+	c    *CachedDatastore
+	keys map[ds.Key]struct{}
+}
+
+func (cb *cachedBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	if err := cb.b.Put(ctx, key, val); err != nil {
+		return err
+	}
+	cb.keys[key] = struct{}{}
+	return nil
+}
+
+func (cb *cachedBatch) Delete(ctx context.Context, key ds.Key) error {
+	if err := cb.b.Delete(ctx, key); err != nil {
+		return err
+	}
+	cb.keys[key] = struct{}{}
+	return nil
+}
+
+// Commit commits the wrapped batch and evicts its keys from the cache, while
+// holding their locks.
+func (cb *cachedBatch) Commit(ctx context.Context) error {
+	// locked in order to not deadlock with other batches
+	var indexes []int
+	for k := range cb.keys {
+		indexes = append(indexes, lockIndex(k))
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+
+	for _, i := range indexes {
+		cb.c.locks[i].Lock()
+	}
+	defer func() {
+		for _, i := range indexes {
+			cb.c.locks[i].Unlock()
+		}
+	}()
+
+	err := cb.b.Commit(ctx)
+	for k := range cb.keys {
+		cb.c.cache.Remove(k)
+	}
+	return err
+}
+
+// Discard discards the wrapped batch, see DiscardableBatch. Nothing is
+// evicted from the cache.
+func (cb *cachedBatch) Discard(ctx context.Context) {
+	discardBatch(ctx, cb.b)
+	cb.keys = make(map[ds.Key]struct{})
+}
+
+var (
+	_ ds.Batching      = (*CachedDatastore)(nil)
+	_ DiscardableBatch = (*cachedBatch)(nil)
+)
@@ -0,0 +1,52 @@
+package sqlds
+
+import (
+	"log/slog"
+
+	ds "github.com/ipfs/go-datastore"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware wraps a datastore, see Chain.
+type Middleware func(ds.Batching) (ds.Batching, error)
+
+// Chain wraps d with the middlewares in order, each one wrapping the previous
+// one: Chain(d, a, b) returns b(a(d)), so the calls go through b, then a,
+// then d. The datastore d is not closed if a middleware fails.
+func Chain(d ds.Batching, middlewares ...Middleware) (ds.Batching, error) {
+	for _, m := range middlewares {
+		var err error
+		if d, err = m(d); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// TracingMiddleware wraps datastores with WithTracing.
+func TracingMiddleware(tracer trace.Tracer) Middleware {
+	return func(d ds.Batching) (ds.Batching, error) {
+		return WithTracing(d, tracer), nil
+	}
+}
+
+// CacheMiddleware wraps datastores with WithCache, caching up to size values.
+func CacheMiddleware(size int) Middleware {
+	return func(d ds.Batching) (ds.Batching, error) {
+		return WithCache(d, CacheOptions{Capacity: size})
+	}
+}
+
+// RetryMiddleware wraps datastores with WithRetry.
+func RetryMiddleware(policy RetryPolicy) Middleware {
+	return func(d ds.Batching) (ds.Batching, error) {
+		return WithRetry(d, policy), nil
+	}
+}
+
+// LoggingMiddleware wraps datastores with WithLogging.
+func LoggingMiddleware(logger *slog.Logger) Middleware {
+	return func(d ds.Batching) (ds.Batching, error) {
+		return WithLogging(d, logger), nil
+	}
+}
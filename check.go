@@ -0,0 +1,98 @@
+package sqlds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrInvalidSchema is returned by Check when the table does not have the
+// columns or indexes needed by the datastore.
+var ErrInvalidSchema = errors.New("invalid table schema")
+
+// textType and binaryType match the types of the text and binary columns,
+// sqlite giving the BLOB affinity to the columns without a type.
+var (
+	textType   = regexp.MustCompile(`(?i)text|char|clob`)
+	binaryType = regexp.MustCompile(`(?i)^$|blob|bytea`)
+)
+
+// column is a column of the table listed by the Columns query.
+type column struct {
+	typ    string
+	unique bool
+}
+
+// Check verifies that the table exists with the columns needed by the
+// options of the datastore: a text key column which is the primary key, or
+// uniquely indexed along with the hash primary key of WithHashedKeys, and a
+// binary data column, plus the size, expires_at, checksum and created_at
+// columns when they are used. It returns an error wrapping ErrInvalidSchema
+// for every problem found, and nothing if the Columns query of the backend
+// is empty.
+func (d *Datastore) Check(ctx context.Context) error {
+	q := d.queries.Columns()
+	if q == "" {
+		return nil
+	}
+
+	rows, err := d.db.QueryContext(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]column)
+	for rows.Next() {
+		var name string
+		var c column
+		if err := rows.Scan(&name, &c.typ, &c.unique); err != nil {
+			return err
+		}
+		columns[name] = c
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("%w: the table does not exist", ErrInvalidSchema)
+	}
+
+	var errs []error
+	expect := func(name string, typ *regexp.Regexp, kind string, unique bool) {
+		c, ok := columns[name]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("%w: the %s column is missing", ErrInvalidSchema, name))
+		case typ != nil && !typ.MatchString(c.typ):
+			errs = append(errs, fmt.Errorf("%w: the %s column is %s, expected a %s column", ErrInvalidSchema, name, c.typ, kind))
+		case unique && !c.unique:
+			errs = append(errs, fmt.Errorf("%w: the %s column is neither the primary key nor uniquely indexed", ErrInvalidSchema, name))
+		}
+	}
+
+	if d.hashKeys {
+		expect("hash", binaryType, "binary", true)
+	}
+	expect("key", textType, "text", true)
+	expect("data", binaryType, "binary", false)
+	if d.sizeColumn {
+		expect("size", nil, "", false)
+	}
+	if d.expirations {
+		expect("expires_at", nil, "", false)
+	}
+	if d.queries.SetChecksum() != "" {
+		expect("checksum", binaryType, "binary", false)
+	}
+	if d.queries.OrderByCreatedAt() != "" {
+		expect("created_at", nil, "", false)
+	}
+
+	return errors.Join(errs...)
+}
+
+var _ ds.CheckedDatastore = (*Datastore)(nil)
@@ -0,0 +1,180 @@
+package sqlds
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrChecksumMismatch is returned by Get when the value read does not match
+// the checksum stored by PutWithChecksum.
+var ErrChecksumMismatch = errors.New("value does not match its checksum")
+
+// PutWithChecksum upserts a row along with the SHA-256 checksum of its value
+// in the checksum column, verified by the subsequent Gets. The checksum is
+// cleared by the other writes of the row. It returns ErrNotImplemented if the
+// table has no checksum column, see the UsesChecksumColumn option of the
+// backends.
+func (d *Datastore) PutWithChecksum(ctx context.Context, key ds.Key, value []byte) (err error) {
+	defer func(start time.Time) { d.log(ctx, "PutWithChecksum", d.queries.SetChecksum(), &key, start, err) }(time.Now())
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if d.queries.SetChecksum() == "" {
+		return fmt.Errorf("checksums: %w", ErrNotImplemented)
+	}
+	if err := d.checkValueSize(key, value); err != nil {
+		return err
+	}
+	if d.stats != nil {
+		d.stats.puts.Add(1)
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, d.putQuery(), d.putArgs(key, value)...); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(value)
+	if _, err := tx.ExecContext(ctx, d.queries.SetChecksum(), d.keyArg(key), sum[:]); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	d.replicate(key, value, false)
+	return nil
+}
+
+// verifyChecksum returns ErrChecksumMismatch if value does not match the
+// non-nil checksum.
+func verifyChecksum(value, checksum []byte) error {
+	if checksum == nil {
+		return nil
+	}
+	if sum := sha256.Sum256(value); !bytes.Equal(sum[:], checksum) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// getWithChecksum reads the value of key, verifying its checksum.
+func (d *Datastore) getWithChecksum(ctx context.Context, key ds.Key) ([]byte, error) {
+	var value, checksum []byte
+	err := d.db.QueryRowContext(ctx, d.queries.GetWithChecksum(), d.keyArg(key)).Scan(&value, &checksum)
+	switch err {
+	case sql.ErrNoRows:
+		return nil, ds.ErrNotFound
+	case nil:
+	default:
+		return nil, err
+	}
+
+	if err := verifyChecksum(value, checksum); err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return value, nil
+}
+
+// Repair deletes the rows whose value does not match their checksum, and
+// returns the number of deleted rows. The rows without a checksum are kept.
+// It returns ErrNotImplemented if the table has no checksum column.
+func (d *Datastore) Repair(ctx context.Context) (int, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	if d.queries.QueryChecksums() == "" {
+		return 0, fmt.Errorf("checksums: %w", ErrNotImplemented)
+	}
+
+	// deleted once the cursor is closed, the connection of a database
+	// limited to one being busy until then
+	corrupt, err := d.corruptRows(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := deleteMany(ctx, d.db, d, corrupt)
+	return int(n), err
+}
+
+// corruptRows returns the keys of the rows whose value does not match their
+// checksum.
+func (d *Datastore) corruptRows(ctx context.Context) ([]ds.Key, error) {
+	rows, err := d.db.QueryContext(ctx, d.queries.QueryChecksums())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var corrupt []ds.Key
+	for rows.Next() {
+		var key string
+		var value, checksum sql.RawBytes
+		if err := rows.Scan(&key, &value, &checksum); err != nil {
+			return nil, err
+		}
+		if verifyChecksum(value, checksum) == nil {
+			continue
+		}
+		k, err := d.keys.Decode(key)
+		if err != nil {
+			return nil, err
+		}
+		corrupt = append(corrupt, k)
+	}
+	return corrupt, rows.Err()
+}
+
+// Scrub reads every row of the table, reporting the keys which can not be
+// decoded by the key encoder and, with the checksum column, the values which
+// do not match their checksum, in an error joining an error per row. The
+// rows are left untouched, Repair deletes the corrupt values. It implements
+// ds.ScrubbedDatastore.
+func (d *Datastore) Scrub(ctx context.Context) error {
+	rows, err := d.db.QueryContext(ctx, d.queries.Query())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var errs []error
+	for rows.Next() {
+		var key string
+		var value sql.RawBytes
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		if _, err := d.keys.Decode(key); err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", key, err))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if d.queries.QueryChecksums() != "" {
+		corrupt, err := d.corruptRows(ctx)
+		if err != nil {
+			return err
+		}
+		for _, k := range corrupt {
+			errs = append(errs, fmt.Errorf("%s: %w", k, ErrChecksumMismatch))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var _ ds.ScrubbedDatastore = (*Datastore)(nil)
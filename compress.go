@@ -0,0 +1,219 @@
+package sqlds
+
+import (
+	"context"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses and decompresses values.
+type Codec interface {
+	Compress([]byte) ([]byte, error)
+	Decompress([]byte) ([]byte, error)
+}
+
+type snappyCodec struct{}
+
+// NewSnappyCodec returns a Codec using the snappy block format.
+func NewSnappyCodec() Codec {
+	return snappyCodec{}
+}
+
+func (snappyCodec) Compress(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+func (snappyCodec) Decompress(b []byte) ([]byte, error) {
+	return snappy.Decode(nil, b)
+}
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// NewZstdCodec returns a Codec using zstd with the default compression level.
+func NewZstdCodec() (Codec, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCodec{enc: enc, dec: dec}, nil
+}
+
+func (c *zstdCodec) Compress(b []byte) ([]byte, error) {
+	return c.enc.EncodeAll(b, nil), nil
+}
+
+func (c *zstdCodec) Decompress(b []byte) ([]byte, error) {
+	return c.dec.DecodeAll(b, nil)
+}
+
+// CompressedDatastore transparently compresses values before they are
+// written to the wrapped datastore and decompresses them when read.
+//
+// Values written before the wrapper was introduced are not readable through
+// it. To migrate an existing table, query every entry from the wrapped
+// datastore and Put it again through the CompressedDatastore, which rewrites
+// the rows in place.
+type CompressedDatastore struct {
+	child ds.Batching
+	codec Codec
+}
+
+// WithCompression wraps d so that values are compressed using codec.
+func WithCompression(d ds.Batching, codec Codec) *CompressedDatastore {
+	return &CompressedDatastore{child: d, codec: codec}
+}
+
+func (c *CompressedDatastore) decompress(key string, b []byte) ([]byte, error) {
+	out, err := c.codec.Decompress(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress value of %s: %w", key, err)
+	}
+	return out, nil
+}
+
+// Get retrieves and decompresses the value of the given key.
+func (c *CompressedDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	b, err := c.child.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return c.decompress(key.String(), b)
+}
+
+// Has determines if a value for the given key exists.
+func (c *CompressedDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return c.child.Has(ctx, key)
+}
+
+// GetSize returns the decompressed size of the value of the given key, which
+// requires fetching and decompressing the value.
+func (c *CompressedDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	v, err := c.Get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+	return len(v), nil
+}
+
+// Put compresses and stores a value.
+func (c *CompressedDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	b, err := c.codec.Compress(value)
+	if err != nil {
+		return err
+	}
+	return c.child.Put(ctx, key, b)
+}
+
+// Delete removes the value of the given key.
+func (c *CompressedDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return c.child.Delete(ctx, key)
+}
+
+// Query returns the entries matching the query with their values decompressed.
+func (c *CompressedDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	// sizes of the stored values are those of the compressed blobs
+	needsValues := !q.KeysOnly || q.ReturnsSizes
+
+	cq := q
+	cq.KeysOnly = !needsValues
+	if needsValues {
+		// value filters and orders must see the decompressed values
+		cq.Filters = nil
+		cq.Orders = nil
+		cq.Limit = 0
+		cq.Offset = 0
+	}
+
+	res, err := c.child.Query(ctx, cq)
+	if err != nil {
+		return nil, err
+	}
+	if !needsValues {
+		return res, nil
+	}
+
+	decompressed := dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := res.NextSync()
+			if !ok || r.Error != nil {
+				return r, ok
+			}
+			v, err := c.decompress(r.Key, r.Value)
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			r.Size = len(v)
+			r.Value = v
+			if q.KeysOnly {
+				r.Value = nil
+			}
+			return r, true
+		},
+		Close: res.Close,
+	})
+
+	nq := q
+	nq.Prefix = ""
+	return dsq.NaiveQueryApply(nq, decompressed), nil
+}
+
+// Sync flushes the given prefix of the wrapped datastore.
+func (c *CompressedDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return c.child.Sync(ctx, prefix)
+}
+
+// Close closes the wrapped datastore.
+func (c *CompressedDatastore) Close() error {
+	return c.child.Close()
+}
+
+// Batch creates a set of deferred updates whose values are compressed.
+func (c *CompressedDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := c.child.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedBatch{b: b, c: c}, nil
+}
+
+type compressedBatch struct {
+	b ds.Batch
+	c *CompressedDatastore
+}
+
+func (cb *compressedBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	b, err := cb.c.codec.Compress(val)
+	if err != nil {
+		return err
+	}
+	return cb.b.Put(ctx, key, b)
+}
+
+func (cb *compressedBatch) Delete(ctx context.Context, key ds.Key) error {
+	return cb.b.Delete(ctx, key)
+}
+
+func (cb *compressedBatch) Commit(ctx context.Context) error {
+	return cb.b.Commit(ctx)
+}
+
+// Discard discards the wrapped batch, see DiscardableBatch.
+func (cb *compressedBatch) Discard(ctx context.Context) {
+	discardBatch(ctx, cb.b)
+}
+
+var (
+	_ ds.Batching      = (*CompressedDatastore)(nil)
+	_ DiscardableBatch = (*compressedBatch)(nil)
+)
@@ -0,0 +1,106 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// CRDBOptions configures the retries of a CRDBBatch.
+type CRDBOptions struct {
+	// MaxRetries is the maximum number of retries of a commit, 5 by
+	// default.
+	MaxRetries int
+	// BaseDelay bounds the random delay before the first retry, doubled on
+	// every following retry up to MaxDelay. They are 10ms and 1s by
+	// default.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// CRDBBatch is a batch for CockroachDB, used through the postgres package.
+// CockroachDB runs transactions with the serializable isolation level and
+// aborts the ones conflicting with concurrent transactions with
+// serialization failures (SQLSTATE 40001), which the application has to
+// retry: Commit replays the operations of the batch in a new transaction
+// after such failures, up to MaxRetries times with random exponential
+// backoff.
+type CRDBBatch struct {
+	// log records the operations of the batch, replayed by every attempt
+	log  *batch
+	opts CRDBOptions
+}
+
+// CRDBBatch creates a batch retrying the transactions aborted by
+// serialization failures, see CRDBBatch.
+func (d *Datastore) CRDBBatch(opts CRDBOptions) (*CRDBBatch, error) {
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 5
+	}
+	if opts.BaseDelay == 0 {
+		opts.BaseDelay = 10 * time.Millisecond
+	}
+	if opts.MaxDelay == 0 {
+		opts.MaxDelay = time.Second
+	}
+
+	return &CRDBBatch{
+		log:  &batch{ds: d, ops: make(map[ds.Key]op), txOpts: &sql.TxOptions{}},
+		opts: opts,
+	}, nil
+}
+
+// IsSerializationFailure reports whether err is a serialization failure,
+// aborting a transaction which must be retried.
+func IsSerializationFailure(err error) bool {
+	var state interface{ SQLState() string }
+	return errors.As(err, &state) && state.SQLState() == "40001"
+}
+
+// Put adds a value to the batch.
+func (cb *CRDBBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	return cb.log.Put(ctx, key, val)
+}
+
+// Delete adds a deletion to the batch.
+func (cb *CRDBBatch) Delete(ctx context.Context, key ds.Key) error {
+	return cb.log.Delete(ctx, key)
+}
+
+// Discard drops the operations of the batch, see DiscardableBatch.
+func (cb *CRDBBatch) Discard(ctx context.Context) {
+	cb.log.Discard(ctx)
+}
+
+// Commit executes the operations of the batch in a transaction, retried
+// from scratch while it fails with a serialization failure, up to
+// MaxRetries times. Other errors are returned right away.
+func (cb *CRDBBatch) Commit(ctx context.Context) error {
+	delay := cb.opts.BaseDelay
+	for retry := 0; ; retry++ {
+		// the operations are kept until the commit succeeds
+		err := cb.log.CommitContext(ctx)
+		if err == nil || retry >= cb.opts.MaxRetries || !IsSerializationFailure(err) {
+			return err
+		}
+
+		t := time.NewTimer(rand.N(delay) + 1)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+
+		delay = min(delay*2, cb.opts.MaxDelay)
+	}
+}
+
+var _ DiscardableBatch = (*CRDBBatch)(nil)
@@ -0,0 +1,63 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// cursorName is the name of the cursors of WithCursor, each declared in its
+// own transaction.
+const cursorName = "sqlds_cursor"
+
+// WithCursor makes Query read the rows of its statement from a server-side
+// cursor, fetchSize rows at a time, so that iterating over a large table
+// does not buffer the whole result set in the driver. The cursor is declared
+// in a read-only transaction, with the isolation level of
+// WithReadOnlyIsolation, holding a connection until the results are closed.
+// The option is ignored by the backends whose DeclareCursor query is empty,
+// such as sqlite which reads the rows as the statement is stepped through.
+func WithCursor(fetchSize int) Option {
+	return func(d *Datastore) {
+		d.cursorFetchSize = fetchSize
+	}
+}
+
+// usesCursor reports whether the queries are read from a cursor.
+func (d *Datastore) usesCursor() bool {
+	return d.cursorFetchSize > 0 && d.queries.DeclareCursor() != "" && d.queries.FetchCursor(d.cursorFetchSize) != ""
+}
+
+// cursor is a QueryExecutor declaring a cursor for the query in its
+// transaction and returning the rows of its first fetch.
+type cursor struct {
+	d  *Datastore
+	tx *sql.Tx
+}
+
+// newCursor begins the transaction of a cursor.
+func (d *Datastore) newCursor(ctx context.Context) (*cursor, error) {
+	tx, err := d.db.BeginTx(ctx, d.txOptions(true))
+	if err != nil {
+		return nil, err
+	}
+	return &cursor{d: d, tx: tx}, nil
+}
+
+func (c *cursor) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	if _, err := c.tx.ExecContext(ctx, fmt.Sprintf(c.d.queries.DeclareCursor(), cursorName, query), args...); err != nil {
+		return nil, err
+	}
+	return c.fetch(ctx)
+}
+
+// fetch returns the next rows of the cursor, none once they have all been
+// read.
+func (c *cursor) fetch(ctx context.Context) (*sql.Rows, error) {
+	return c.tx.QueryContext(ctx, fmt.Sprintf(c.d.queries.FetchCursor(c.d.cursorFetchSize), cursorName))
+}
+
+// close ends the transaction, closing the cursor.
+func (c *cursor) close() error {
+	return c.tx.Rollback()
+}
@@ -72,29 +72,202 @@ func (fakeQueries) Get() string {
 }
 
 func (fakeQueries) Put() string {
-	return `INSERT INTO blocks (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = $2`
+	return `INSERT INTO blocks (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = excluded.data`
 }
 
 func (fakeQueries) Query() string {
 	return `SELECT key, data FROM blocks`
 }
 
+func (fakeQueries) QueryWithExpiry() string {
+	return `SELECT key, data, expires_at FROM blocks`
+}
+
+func (fakeQueries) QueryKeysAndSizes() string {
+	return `SELECT key, octet_length(data) FROM blocks`
+}
+
+func (fakeQueries) QueryKeys() string {
+	return `SELECT key FROM blocks`
+}
+
 func (fakeQueries) Prefix() string {
-	return ` WHERE key LIKE '%s%%' ORDER BY key`
+	return `key LIKE %s`
+}
+
+func (fakeQueries) PatternMatch() string {
+	return ` WHERE key LIKE $1 ORDER BY key`
+}
+
+func (fakeQueries) EscapePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (q fakeQueries) PrefixPattern(prefix string) string {
+	return q.EscapePattern(prefix) + "%"
 }
 
 func (fakeQueries) Limit() string {
-	return ` LIMIT %d`
+	return ` LIMIT %s`
 }
 
 func (fakeQueries) Offset() string {
-	return ` OFFSET %d`
+	return ` OFFSET %s`
 }
 
 func (fakeQueries) GetSize() string {
 	return `SELECT octet_length(data) FROM blocks WHERE key = $1`
 }
 
+func (fakeQueries) Count() string {
+	return `SELECT count(*) FROM (%s) AS q`
+}
+
+func (fakeQueries) GetForUpdate() string {
+	return `SELECT data FROM blocks WHERE key = $1 FOR UPDATE`
+}
+
+func (fakeQueries) EstimateCount() string {
+	return `SELECT reltuples::bigint FROM pg_class WHERE oid = 'blocks'::regclass`
+}
+
+func (fakeQueries) DiskUsage() string {
+	return `SELECT pg_total_relation_size('blocks')`
+}
+
+func (fakeQueries) Columns() string {
+	return ""
+}
+
+func (fakeQueries) DeletePrefix() string {
+	return `DELETE FROM blocks WHERE key LIKE $1`
+}
+
+func (fakeQueries) QueryPage() string {
+	return `SELECT key, data FROM blocks WHERE key COLLATE "C" > $1 ORDER BY key COLLATE "C" LIMIT $2`
+}
+
+func (fakeQueries) PutWithSize() string {
+	return `INSERT INTO blocks (key, data, size) VALUES ($1, $2, octet_length($2::bytea)) ON CONFLICT (key) DO UPDATE SET data = excluded.data, size = excluded.size`
+}
+
+func (fakeQueries) GetSizeFromColumn() string {
+	return `SELECT coalesce(size, octet_length(data)) FROM blocks WHERE key = $1`
+}
+
+func (fakeQueries) OrderByValue(desc bool) string {
+	if desc {
+		return ` ORDER BY data DESC, key DESC`
+	}
+	return ` ORDER BY data ASC, key ASC`
+}
+
+func (fakeQueries) OrderByKey(desc bool) string {
+	if desc {
+		return ` ORDER BY key COLLATE "C" DESC`
+	}
+	return ` ORDER BY key COLLATE "C" ASC`
+}
+
+func (fakeQueries) KeyCompare(op dsq.Op) string {
+	return `key COLLATE "C" ` + string(op) + ` %s`
+}
+
+func (fakeQueries) OrderByCreatedAt() string {
+	return ` ORDER BY created_at ASC, key COLLATE "C" ASC`
+}
+
+func (fakeQueries) OrderByCreatedAtDesc() string {
+	return ` ORDER BY created_at DESC, key COLLATE "C" DESC`
+}
+
+func (fakeQueries) SetChecksum() string {
+	return ""
+}
+
+func (fakeQueries) GetWithChecksum() string {
+	return ""
+}
+
+func (fakeQueries) QueryChecksums() string {
+	return ""
+}
+
+func (fakeQueries) DeleteMany(n int) string {
+	params := make([]string, n)
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return `DELETE FROM blocks WHERE key IN (` + strings.Join(params, ", ") + `)`
+}
+
+func (fakeQueries) GetMany(n int) string {
+	params := make([]string, n)
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return `SELECT key, data FROM blocks WHERE key IN (` + strings.Join(params, ", ") + `)`
+}
+
+func (fakeQueries) Sync() string {
+	return ""
+}
+
+func (fakeQueries) PutIfAbsent() string {
+	return `INSERT INTO blocks (key, data) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`
+}
+
+func (fakeQueries) ListNamespaces() string {
+	return `SELECT DISTINCT '/' || split_part(key, '/', 2) FROM blocks WHERE position('/' in substr(key, 2)) > 0 ORDER BY 1`
+}
+
+func (fakeQueries) Vacuum() string {
+	return `VACUUM ANALYZE blocks`
+}
+
+func (fakeQueries) Optimize() string {
+	return ""
+}
+
+func (fakeQueries) Capabilities() QueryCapabilities {
+	return AllCapabilities
+}
+
+func (fakeQueries) Stat() string {
+	return `SELECT count(*), coalesce(sum(octet_length(data)), 0), coalesce(min(octet_length(data)), 0), coalesce(max(octet_length(data)), 0) FROM blocks`
+}
+
+func (fakeQueries) TableStats() string {
+	return `SELECT n_live_tup, n_dead_tup, last_autovacuum FROM pg_stat_user_tables WHERE relid = 'blocks'::regclass`
+}
+
+func (fakeQueries) SetAutovacuum(enabled bool) string {
+	if enabled {
+		return `ALTER TABLE blocks RESET (autovacuum_enabled)`
+	}
+	return `ALTER TABLE blocks SET (autovacuum_enabled = false)`
+}
+
+func (fakeQueries) TableSchema() string {
+	return `CREATE TABLE IF NOT EXISTS blocks (key TEXT NOT NULL UNIQUE, data BYTEA NOT NULL)`
+}
+
+func (fakeQueries) Explain() string {
+	return `EXPLAIN (ANALYZE, FORMAT JSON) %s`
+}
+
+func (fakeQueries) ZeroValue() string {
+	return `UPDATE blocks SET data = decode(repeat('00', octet_length(data)), 'hex') WHERE key = $1`
+}
+
+func (fakeQueries) DeclareCursor() string {
+	return `DECLARE %s NO SCROLL CURSOR FOR %s`
+}
+
+func (fakeQueries) FetchCursor(n int) string {
+	return fmt.Sprintf("FETCH FORWARD %d FROM %%s", n)
+}
+
 // returns datastore, and a function to call on exit.
 //
 //	d, close := newDS(t)
@@ -109,7 +282,7 @@ func newDS(t *testing.T) (*Datastore, func()) {
 		t.Fatal(err)
 	}
 	db.SetMaxIdleConns(0)
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS blocks (key TEXT NOT NULL UNIQUE, data BYTEA NOT NULL)")
+	_, err = db.Exec(fakeQueries{}.TableSchema())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1,9 +1,19 @@
 package sqlds
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	dsextensions "github.com/textileio/go-datastore-extensions"
 
@@ -18,41 +28,478 @@ type Queries interface {
 	Get() string
 	Put() string
 	Query() string
+	QueryWithExpiry() string
+	QueryKeysAndSizes() string
+	QueryKeys() string
 	Prefix() string
+	PatternMatch() string
+	EscapePattern(s string) string
+	PrefixPattern(prefix string) string
 	Limit() string
 	Offset() string
 	GetSize() string
+	Count() string
+	EstimateCount() string
+	GetForUpdate() string
+	DeletePrefix() string
+	QueryPage() string
+	PutWithSize() string
+	GetSizeFromColumn() string
+	OrderByValue(desc bool) string
+	OrderByKey(desc bool) string
+	KeyCompare(op dsq.Op) string
+	OrderByCreatedAt() string
+	OrderByCreatedAtDesc() string
+	SetChecksum() string
+	GetWithChecksum() string
+	QueryChecksums() string
+	DeleteMany(n int) string
+	GetMany(n int) string
+	Sync() string
+	PutIfAbsent() string
+	ListNamespaces() string
+	Vacuum() string
+	Optimize() string
+	Stat() string
+	TableStats() string
+	DiskUsage() string
+	SetAutovacuum(enabled bool) string
+	TableSchema() string
+	Columns() string
+	Explain() string
+	ZeroValue() string
+	DeclareCursor() string
+	FetchCursor(n int) string
+	Capabilities() QueryCapabilities
 }
 
+// QueryCapabilities are the optional SQL features of a backend, the datastore
+// falls back to naive equivalents for the unsupported ones.
+type QueryCapabilities struct {
+	// SupportsPrefix reports whether the Prefix fragment matches key
+	// prefixes, otherwise prefixes are matched on the results.
+	SupportsPrefix bool
+	// SupportsLimit and SupportsOffset report whether the Limit and Offset
+	// fragments can be used, otherwise rows are skipped from the results.
+	SupportsLimit  bool
+	SupportsOffset bool
+	// SupportsSize reports whether the GetSize queries can be used,
+	// otherwise the values are read to get their sizes.
+	SupportsSize bool
+	// SupportsPushdownFilters reports whether the filters which have an
+	// equivalent fragment, such as dsq.FilterKeyPrefix with the Prefix
+	// fragment, can be evaluated in SQL.
+	SupportsPushdownFilters bool
+}
+
+// AllCapabilities supports every optional SQL feature.
+var AllCapabilities = QueryCapabilities{
+	SupportsPrefix:          true,
+	SupportsLimit:           true,
+	SupportsOffset:          true,
+	SupportsSize:            true,
+	SupportsPushdownFilters: true,
+}
+
+// ErrCASFailed is returned by CompareAndSwap when the current value does not
+// match the expected one.
+var ErrCASFailed = errors.New("compare and swap failed: value mismatch")
+
+// ErrReadOnly is returned by the write operations of a read-only datastore.
+var ErrReadOnly = errors.New("datastore is read-only")
+
+// ErrValueTooLarge is returned by the writes of values larger than the limit
+// set with WithMaxValueSize.
+var ErrValueTooLarge = errors.New("value too large")
+
 // Datastore is a SQL backed datastore.
 type Datastore struct {
 	db      *sql.DB
 	queries Queries
+
+	sizeColumn bool
+	readOnly   bool
+	keys       KeyEncoder
+	hashKeys   bool
+	sharedDB   bool
+
+	importBatchSize int
+	maxValueSize    int
+	queryTimeout    time.Duration
+	queryPlans      bool
+	expirations     bool
+	cursorFetchSize int
+	// readOnlyIsolation is the isolation level of read-only transactions
+	readOnlyIsolation sql.IsolationLevel
+
+	stats   *opStats
+	pinger  *pinger
+	sweeper *sweeper
+	logger  *slog.Logger
+	// replication is shared by the copies of the datastore, see CopyTo
+	replication *atomic.Pointer[replication]
+}
+
+// Option configures a Datastore.
+type Option func(*Datastore)
+
+// WithSizeColumn makes the datastore maintain the size of the values in a
+// size column on Put, so that GetSize does not need to read the values.
+func WithSizeColumn() Option {
+	return func(d *Datastore) {
+		d.sizeColumn = true
+	}
+}
+
+// WithReadOnly makes every write operation fail with ErrReadOnly without
+// hitting the database.
+func WithReadOnly() Option {
+	return func(d *Datastore) {
+		d.readOnly = true
+	}
+}
+
+// WithKeyEncoder makes the datastore store keys encoded with enc instead of
+// their string representation.
+func WithKeyEncoder(enc KeyEncoder) Option {
+	return func(d *Datastore) {
+		d.keys = enc
+	}
+}
+
+// WithHashedKeys makes the datastore look rows up by the SHA-256 hash of
+// their encoded key, for tables whose primary key is the hash (see the
+// HashKeys option of the backends). The put queries take the encoded key as
+// a third parameter, stored in the key column read by queries.
+func WithHashedKeys() Option {
+	return func(d *Datastore) {
+		d.hashKeys = true
+	}
+}
+
+// WithSharedDB makes Close a noop, for a database shared with other
+// datastores and closed by its owner.
+func WithSharedDB() Option {
+	return func(d *Datastore) {
+		d.sharedDB = true
+	}
+}
+
+// WithMaxValueSize returns a copy of d whose Put, PutIfAbsent and
+// CompareAndSwap, and the Put of its batches and transactions, fail with
+// ErrValueTooLarge for values larger than maxBytes. Values already stored are
+// still readable. The copy shares the database of d.
+func WithMaxValueSize(d *Datastore, maxBytes int) *Datastore {
+	md := *d
+	md.maxValueSize = maxBytes
+	return &md
+}
+
+// checkValueSize returns ErrValueTooLarge if value is larger than the limit
+// of the datastore.
+func (d *Datastore) checkValueSize(key ds.Key, value []byte) error {
+	if d.maxValueSize > 0 && len(value) > d.maxValueSize {
+		return fmt.Errorf("%w: %d bytes for %s, the limit is %d", ErrValueTooLarge, len(value), key, d.maxValueSize)
+	}
+	return nil
+}
+
+// WithExpirationColumn makes the queries with ReturnExpirations return the
+// expirations of the entries, for tables with a nullable expires_at column
+// (TIMESTAMP in sqlite, TIMESTAMPTZ in postgres). The other queries do not
+// select the column.
+func WithExpirationColumn() Option {
+	return func(d *Datastore) {
+		d.expirations = true
+	}
 }
 
 // NewDatastore returns a new SQL datastore.
-func NewDatastore(db *sql.DB, queries Queries) *Datastore {
-	return &Datastore{db: db, queries: queries}
+func NewDatastore(db *sql.DB, queries Queries, opts ...Option) *Datastore {
+	d := &Datastore{
+		db:          db,
+		queries:     queries,
+		keys:        StringKeyEncoder{},
+		replication: new(atomic.Pointer[replication]),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// putQuery returns the query upserting a row.
+func (d *Datastore) putQuery() string {
+	if d.sizeColumn {
+		return d.queries.PutWithSize()
+	}
+	return d.queries.Put()
 }
 
-// Close closes the underying SQL database.
+// keyArg returns the query parameter identifying the row of key.
+func (d *Datastore) keyArg(key ds.Key) any {
+	k := d.keys.Encode(key)
+	if d.hashKeys {
+		h := sha256.Sum256([]byte(k))
+		return h[:]
+	}
+	return k
+}
+
+// putArgs returns the parameters of the put queries.
+func (d *Datastore) putArgs(key ds.Key, value []byte) []any {
+	if d.hashKeys {
+		return []any{d.keyArg(key), value, d.keys.Encode(key)}
+	}
+	return []any{d.keys.Encode(key), value}
+}
+
+// sqlPrefixes reports whether key prefixes can be matched in SQL, which
+// requires keys to be stored as strings.
+func (d *Datastore) sqlPrefixes() bool {
+	_, ok := d.keys.(StringKeyEncoder)
+	return ok
+}
+
+// getSizeQuery returns the query selecting the size of a value.
+func (d *Datastore) getSizeQuery() string {
+	if d.sizeColumn {
+		return d.queries.GetSizeFromColumn()
+	}
+	return d.queries.GetSize()
+}
+
+// DB returns the underlying SQL database, an escape hatch for running custom
+// statements (VACUUM, ANALYZE, joins...) on the connection pool of the
+// datastore. Callers are responsible for keeping the table schema intact.
+func (d *Datastore) DB() *sql.DB {
+	return d.db
+}
+
+// HealthCheck returns an error describing why the datastore is unusable: the
+// database is unreachable or the table does not exist.
+func (d *Datastore) HealthCheck(ctx context.Context) error {
+	if err := d.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("database is unreachable: %w", err)
+	}
+
+	// a lookup by primary key fails if the table was dropped
+	var exists bool
+	if err := d.db.QueryRowContext(ctx, d.queries.Exists(), d.keyArg(ds.RawKey("/"))).Scan(&exists); err != nil {
+		return fmt.Errorf("table is unreadable: %w", err)
+	}
+	return nil
+}
+
+// HealthChecker returns HealthCheck as a function, to be registered as the
+// check of a health endpoint such as those of github.com/alexliesenfeld/health.
+func (d *Datastore) HealthChecker() func(ctx context.Context) error {
+	return d.HealthCheck
+}
+
+// Close closes the underying SQL database, unless it is shared.
 func (d *Datastore) Close() error {
+	d.stopReplication()
+	d.stopStats()
+	d.stopPing()
+	d.stopSweeper()
+	if d.sharedDB {
+		return nil
+	}
 	return d.db.Close()
 }
 
 // Delete removes a row from the SQL database by the given key.
-func (d *Datastore) Delete(ctx context.Context, key ds.Key) error {
-	_, err := d.db.ExecContext(ctx, d.queries.Delete(), key.String())
+func (d *Datastore) Delete(ctx context.Context, key ds.Key) (err error) {
+	defer func(start time.Time) { d.log(ctx, "Delete", d.queries.Delete(), &key, start, err) }(time.Now())
+	ctx, done := d.withQueryTimeout(ctx, &err)
+	defer done()
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if d.stats != nil {
+		d.stats.deletes.Add(1)
+	}
+
+	d.explain(ctx, "Delete", d.queries.Delete(), d.keyArg(key))
+	if _, err = d.db.ExecContext(ctx, d.queries.Delete(), d.keyArg(key)); err != nil {
+		return err
+	}
+	d.replicate(key, nil, true)
+	return nil
+}
+
+// SecureDelete removes a row after overwriting its value with zeros, in a
+// transaction, so that the value does not remain in the freed space of the
+// database file. PostgreSQL keeps the previous versions of the row until the
+// table is vacuumed. It returns ErrNotImplemented if the queries have no
+// ZeroValue query.
+func (d *Datastore) SecureDelete(ctx context.Context, key ds.Key) (err error) {
+	defer func(start time.Time) { d.log(ctx, "SecureDelete", d.queries.ZeroValue(), &key, start, err) }(time.Now())
+	ctx, done := d.withQueryTimeout(ctx, &err)
+	defer done()
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if d.queries.ZeroValue() == "" {
+		return fmt.Errorf("secure delete: %w", ErrNotImplemented)
+	}
+	if d.stats != nil {
+		d.stats.deletes.Add(1)
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, d.queries.ZeroValue(), d.keyArg(key)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, d.queries.Delete(), d.keyArg(key)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 
+	d.replicate(key, nil, true)
 	return nil
 }
 
+// DeletePrefix removes all the rows whose key is under the given prefix, the
+// row of the prefix key itself is kept, like Query does with a prefix. The
+// rows are deleted by a single statement matching the keys against the
+// PrefixPattern of the prefix, which uses the index of the keys. It returns
+// the number of deleted rows.
+func (d *Datastore) DeletePrefix(ctx context.Context, prefix ds.Key) (int64, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if !d.sqlPrefixes() || !d.queries.Capabilities().SupportsPrefix {
+		return d.deletePrefixNaive(ctx, prefix)
+	}
+
+	p := prefix.String()
+	if p != "/" {
+		p += "/"
+	}
+
+	res, err := d.db.ExecContext(ctx, d.queries.DeletePrefix(), d.queries.PrefixPattern(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// deletePrefixNaive deletes the keys under prefix found by a query, for key
+// encoders not preserving prefixes.
+func (d *Datastore) deletePrefixNaive(ctx context.Context, prefix ds.Key) (int64, error) {
+	res, err := d.Query(ctx, dsq.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]ds.Key, len(entries))
+	for i, e := range entries {
+		keys[i] = ds.RawKey(e.Key)
+	}
+
+	return d.DeleteMany(ctx, keys)
+}
+
+// maxDeleteManyKeys is the number of keys deleted by a single statement of
+// DeleteMany, older sqlite versions allowing at most 999 bind parameters.
+const maxDeleteManyKeys = 999
+
+// DeleteMany removes the rows of the given keys with as few statements as
+// possible and returns the number of deleted rows. The keys are deleted in a
+// single transaction when they do not fit in a single statement.
+func (d *Datastore) DeleteMany(ctx context.Context, keys []ds.Key) (int64, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	var n int64
+	if len(keys) <= maxDeleteManyKeys {
+		var err error
+		if n, err = deleteMany(ctx, d.db, d, keys); err != nil {
+			return n, err
+		}
+	} else {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		if n, err = deleteMany(ctx, tx, d, keys); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return n, err
+		}
+	}
+
+	for _, k := range keys {
+		d.replicate(k, nil, true)
+	}
+	return n, nil
+}
+
+// execer is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// deleteMany deletes keys in chunks of maxDeleteManyKeys.
+func deleteMany(ctx context.Context, e execer, d *Datastore, keys []ds.Key) (int64, error) {
+	var deleted int64
+	for len(keys) > 0 {
+		chunk := keys[:min(len(keys), maxDeleteManyKeys)]
+		keys = keys[len(chunk):]
+
+		args := make([]any, len(chunk))
+		for i, k := range chunk {
+			args[i] = d.keyArg(k)
+		}
+
+		res, err := e.ExecContext(ctx, d.queries.DeleteMany(len(chunk)), args...)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+
+	return deleted, nil
+}
+
 // Get retrieves a value from the SQL database by the given key.
 func (d *Datastore) Get(ctx context.Context, key ds.Key) (value []byte, err error) {
-	row := d.db.QueryRowContext(ctx, d.queries.Get(), key.String())
+	defer func(start time.Time) { d.log(ctx, "Get", d.queries.Get(), &key, start, err) }(time.Now())
+	ctx, done := d.withQueryTimeout(ctx, &err)
+	defer done()
+	if d.stats != nil {
+		d.stats.gets.Add(1)
+	}
+
+	if d.queries.GetWithChecksum() != "" {
+		return d.getWithChecksum(ctx, key)
+	}
+
+	d.explain(ctx, "Get", d.queries.Get(), d.keyArg(key))
+	row := d.db.QueryRowContext(ctx, d.queries.Get(), d.keyArg(key))
 	var out []byte
 
 	switch err := row.Scan(&out); err {
@@ -67,7 +514,10 @@ func (d *Datastore) Get(ctx context.Context, key ds.Key) (value []byte, err erro
 
 // Has determines if a value for the given key exists in the SQL database.
 func (d *Datastore) Has(ctx context.Context, key ds.Key) (exists bool, err error) {
-	row := d.db.QueryRowContext(ctx, d.queries.Exists(), key.String())
+	defer func(start time.Time) { d.log(ctx, "Has", d.queries.Exists(), &key, start, err) }(time.Now())
+	ctx, done := d.withQueryTimeout(ctx, &err)
+	defer done()
+	row := d.db.QueryRowContext(ctx, d.queries.Exists(), d.keyArg(key))
 
 	switch err := row.Scan(&exists); err {
 	case sql.ErrNoRows:
@@ -80,18 +530,175 @@ func (d *Datastore) Has(ctx context.Context, key ds.Key) (exists bool, err error
 }
 
 // Put "upserts" a row into the SQL database.
-func (d *Datastore) Put(ctx context.Context, key ds.Key, value []byte) error {
-	_, err := d.db.ExecContext(ctx, d.queries.Put(), key.String(), value)
+func (d *Datastore) Put(ctx context.Context, key ds.Key, value []byte) (err error) {
+	defer func(start time.Time) { d.log(ctx, "Put", d.putQuery(), &key, start, err) }(time.Now())
+	ctx, done := d.withQueryTimeout(ctx, &err)
+	defer done()
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if err := d.checkValueSize(key, value); err != nil {
+		return err
+	}
+	if d.stats != nil {
+		d.stats.puts.Add(1)
+	}
+
+	d.explain(ctx, "Put", d.putQuery(), d.putArgs(key, value)...)
+	if _, err = d.db.ExecContext(ctx, d.putQuery(), d.putArgs(key, value)...); err != nil {
+		return err
+	}
+	d.replicate(key, value, false)
+	return nil
+}
+
+// PutIfAbsent inserts a row only if the key does not exist yet, it reports
+// whether the row was inserted. With WithSizeColumn the size of the inserted
+// value is left to be computed by GetSize.
+func (d *Datastore) PutIfAbsent(ctx context.Context, key ds.Key, value []byte) (bool, error) {
+	if d.readOnly {
+		return false, ErrReadOnly
+	}
+	if err := d.checkValueSize(key, value); err != nil {
+		return false, err
+	}
+
+	res, err := d.db.ExecContext(ctx, d.queries.PutIfAbsent(), d.putArgs(key, value)...)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
 	if err != nil {
+		return false, err
+	}
+
+	if n > 0 {
+		d.replicate(key, value, false)
+	}
+	return n > 0, nil
+}
+
+// CompareAndSwap sets the value of key to newValue only if its current value
+// is oldValue. It returns ds.ErrNotFound if the key does not exist and
+// ErrCASFailed if the current value differs. The row is locked between the
+// read and the write where the backend supports it.
+func (d *Datastore) CompareAndSwap(ctx context.Context, key ds.Key, oldValue, newValue []byte) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if err := d.checkValueSize(key, newValue); err != nil {
+		return err
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var cur []byte
+	switch err := tx.QueryRowContext(ctx, d.queries.GetForUpdate(), d.keyArg(key)).Scan(&cur); err {
+	case sql.ErrNoRows:
+		_ = tx.Rollback()
+		return ds.ErrNotFound
+	case nil:
+	default:
+		_ = tx.Rollback()
+		return err
+	}
+
+	if !bytes.Equal(cur, oldValue) {
+		_ = tx.Rollback()
+		return ErrCASFailed
+	}
+
+	if _, err := tx.ExecContext(ctx, d.putQuery(), d.putArgs(key, newValue)...); err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.replicate(key, newValue, false)
 	return nil
 }
 
+// ListNamespaces returns the sorted distinct top-level namespaces of the keys,
+// such as /blocks for /blocks/foo. Keys without a parent, such as /foo, do
+// not belong to a namespace.
+func (d *Datastore) ListNamespaces(ctx context.Context) ([]string, error) {
+	if !d.sqlPrefixes() {
+		return d.listNamespacesNaive(ctx)
+	}
+
+	rows, err := d.db.QueryContext(ctx, d.queries.ListNamespaces())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var namespaces []string
+	for rows.Next() {
+		var ns string
+		if err := rows.Scan(&ns); err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, ns)
+	}
+
+	return namespaces, rows.Err()
+}
+
+// listNamespacesNaive lists the namespaces from all the keys, for key
+// encoders not preserving prefixes.
+func (d *Datastore) listNamespacesNaive(ctx context.Context) ([]string, error) {
+	res, err := d.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	seen := make(map[string]bool)
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		if ns := ds.RawKey(r.Key).List(); len(ns) > 1 {
+			seen["/"+ns[0]] = true
+		}
+	}
+
+	namespaces := make([]string, 0, len(seen))
+	for ns := range seen {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// inTx runs the writes of fn in a transaction.
+func (d *Datastore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 // Query returns multiple rows from the SQL database based on the passed query parameters.
+// The statement and the iteration of the results are interrupted when ctx is
+// done, the results then ending with the error of ctx.
 func (d *Datastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
-	eq := dsextensions.QueryExt{q, ""}
+	eq := dsextensions.QueryExt{Query: q}
 	return d.query(ctx, eq)
 }
 
@@ -99,84 +706,487 @@ func (d *Datastore) QueryExtended(ctx context.Context, q dsextensions.QueryExt)
 	return d.query(ctx, q)
 }
 
-func (d *Datastore) query(ctx context.Context, q dsextensions.QueryExt) (dsq.Results, error) {
-	raw, err := d.rawQuery(ctx, q.Query)
-	if err != nil {
-		return nil, err
+func (d *Datastore) query(ctx context.Context, q dsextensions.QueryExt) (_ dsq.Results, err error) {
+	// the duration only covers the execution of the query
+	defer func(start time.Time) { d.log(ctx, "Query", d.queries.Query(), nil, start, err) }(time.Now())
+	if d.stats != nil {
+		d.stats.queries.Add(1)
 	}
 
-	// TODO: Try to understand what's the purpose of the extended parameter "SeekPrefix" and implement it here
+	res, err := d.queryWithTimeout(ctx, func(ctx context.Context) (dsq.Results, error) {
+		var db QueryExecutor = explainer{d: d, op: "Query"}
+		if d.usesCursor() {
+			c, err := d.newCursor(ctx)
+			if err != nil {
+				return nil, err
+			}
+			db = c
+		}
 
-	for _, f := range q.Filters {
-		raw = dsq.NaiveFilter(raw, f)
+		raw, naive, err := d.rawQuery(ctx, db, seekQuery(q))
+		if err != nil {
+			if c, ok := db.(*cursor); ok {
+				_ = c.close()
+			}
+			return nil, err
+		}
+
+		// apply whatever could not be expressed in SQL
+		return dsq.NaiveQueryApply(naive, raw), nil
+	})
+	return res, err
+}
+
+// seekQuery returns the query of q starting from its SeekPrefix, like the
+// iterators of go-ds-badger seeking to it: the entries whose key sorts from
+// it in the order of q, backwards for descending keys.
+func seekQuery(q dsextensions.QueryExt) dsq.Query {
+	if q.SeekPrefix == "" {
+		return q.Query
 	}
 
-	raw = dsq.NaiveOrder(raw, q.Orders...)
+	op := dsq.GreaterThanOrEqual
+	if desc, ok := orderByKey(q.Orders); ok && desc {
+		op = dsq.LessThanOrEqual
+	}
+	sq := q.Query
+	sq.Filters = append(q.Filters[:len(q.Filters):len(q.Filters)], dsq.FilterKeyCompare{Op: op, Key: q.SeekPrefix})
+	return sq
+}
 
-	// if we have filters or orders, offset and limit won't have been applied in the query
-	if len(q.Filters) > 0 || len(q.Orders) > 0 {
-		if q.Offset != 0 {
-			raw = dsq.NaiveOffset(raw, q.Offset)
-		}
-		if q.Limit != 0 {
-			raw = dsq.NaiveLimit(raw, q.Limit)
+// StartAfter returns the filter of the entries whose key sorts after key.
+// Along with dsq.OrderByKey and a limit, the query of the next page of a
+// scan, starting after the last key of the previous page, is run as
+// WHERE key > $1 ORDER BY key LIMIT $2, costing the same whatever the
+// position of the page unlike offsets, see also QueryPage.
+func StartAfter(key ds.Key) dsq.Filter {
+	return dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: key.String()}
+}
+
+// rawQuery runs the statement of q with db, and returns its results along
+// with the part of q left to be applied to them.
+func (d *Datastore) rawQuery(ctx context.Context, db QueryExecutor, q dsq.Query) (dsq.Results, dsq.Query, error) {
+	// tables without the column have no expirations to return
+	q.ReturnExpirations = q.ReturnExpirations && d.expirations && d.queries.QueryWithExpiry() != ""
+
+	// only the keys, or the keys and the sizes of the values, are selected
+	// for keys-only queries unless the values are filtered or sorted on the
+	// results
+	queries, sel := d.queries, selectValues
+	if q.KeysOnly && !q.ReturnExpirations {
+		if _, _, naive := buildQuery(d.queries, q, d.sqlPrefixes()); !needsValues(naive) {
+			switch {
+			case q.ReturnsSizes && d.queries.QueryKeysAndSizes() != "":
+				queries, sel = sizesQueries{d.queries}, selectSizes
+			case !q.ReturnsSizes && d.queries.QueryKeys() != "":
+				queries, sel = keysQueries{d.queries}, selectKeys
+			}
 		}
 	}
 
-	return raw, nil
+	rows, naive, err := queryWithParams(ctx, db, queries, q, d.sqlPrefixes())
+	if err != nil {
+		return nil, naive, err
+	}
+
+	rc := &rowsCloser{rows: rows}
+	if c, ok := db.(*cursor); ok {
+		rc.fetch = func() (*sql.Rows, error) { return c.fetch(ctx) }
+		rc.release = c.close
+	}
+	return d.results(q, rc, sel), naive, nil
 }
 
-func (d *Datastore) rawQuery(ctx context.Context, q dsq.Query) (dsq.Results, error) {
-	var rows *sql.Rows
-	var err error
+// selection is the column selected along with the keys by a query.
+type selection int
 
-	rows, err = queryWithParams(ctx, d, q)
-	if err != nil {
-		return nil, err
+const (
+	selectValues selection = iota
+	selectSizes
+	// selectKeys selects the keys only
+	selectKeys
+)
+
+// sizesQueries are queries selecting the keys and the sizes of the values
+// rather than the values.
+type sizesQueries struct {
+	Queries
+}
+
+// Query returns the query selecting the keys and the sizes of the values.
+func (q sizesQueries) Query() string {
+	return q.QueryKeysAndSizes()
+}
+
+// keysQueries are queries selecting the keys only.
+type keysQueries struct {
+	Queries
+}
+
+// Query returns the query selecting the keys only.
+func (q keysQueries) Query() string {
+	return q.QueryKeys()
+}
+
+// needsValues reports whether the filters or orders of q read the values of
+// the entries.
+func needsValues(q dsq.Query) bool {
+	for _, f := range q.Filters {
+		switch f.(type) {
+		case dsq.FilterKeyCompare, *dsq.FilterKeyCompare, dsq.FilterKeyPrefix, *dsq.FilterKeyPrefix:
+		default:
+			return true
+		}
 	}
+	for _, o := range q.Orders {
+		switch o.(type) {
+		case dsq.OrderByKey, *dsq.OrderByKey, dsq.OrderByKeyDescending, *dsq.OrderByKeyDescending,
+			OrderByCreatedAt, OrderByCreatedAtDesc:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// results returns the entries of rows selecting the keys along with the
+// column of sel.
+func (d *Datastore) results(q dsq.Query, rc *rowsCloser, sel selection) dsq.Results {
+	// database/sql closes the rows when ctx is done, releasing the
+	// connection even if the results are abandoned. The finalizer is a last
+	// resort for abandoned results of a context which is never done.
+	runtime.SetFinalizer(rc, (*rowsCloser).close)
 
 	it := dsq.Iterator{
 		Next: func() (dsq.Result, bool) {
-			if !rows.Next() {
+			if rc.done || !rc.next() {
+				// report an interrupted iteration, once
+				if err := rc.err(); err != nil && !rc.done {
+					rc.done = true
+					return dsq.Result{Error: err}, true
+				}
 				return dsq.Result{}, false
 			}
 
 			var key string
 			var out []byte
+			var size sql.NullInt64
+			var expiration sql.NullTime
 
-			err := rows.Scan(&key, &out)
+			dest := []any{&key, &out}
+			switch sel {
+			case selectSizes:
+				dest = []any{&key, &size}
+			case selectKeys:
+				dest = []any{&key}
+			}
+			if q.ReturnExpirations {
+				dest = append(dest, &expiration)
+			}
+			err := rc.rows.Scan(dest...)
 			if err != nil {
 				return dsq.Result{Error: err}, false
 			}
 
-			entry := dsq.Entry{Key: key}
+			k, err := d.keys.Decode(key)
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			entry := dsq.Entry{Key: k.String()}
 
 			if !q.KeysOnly {
 				entry.Value = out
 			}
 			if q.ReturnsSizes {
 				entry.Size = len(out)
+				if sel == selectSizes {
+					entry.Size = int(size.Int64)
+				}
+			}
+			if expiration.Valid {
+				entry.Expiration = expiration.Time
 			}
 
 			return dsq.Result{Entry: entry}, true
 		},
 		Close: func() error {
-			return rows.Close()
+			runtime.SetFinalizer(rc, nil)
+			return rc.close()
 		},
 	}
 
-	return dsq.ResultsFromIterator(q, it), nil
+	return dsq.ResultsFromIterator(q, it)
+}
+
+// QueryWithGlob returns the entries whose key matches pattern, ordered by
+// key. It is meant for expert use: the pattern is passed as is to the
+// PatternMatch fragment of the backend, a GLOB pattern (* and ?) for sqlite
+// and a LIKE pattern (% and _) for postgres, so that /pins/*/recursive finds
+// the recursive pins of any CID with sqlite. The pattern is always a bind
+// parameter, never interpolated in the SQL statement.
+func (d *Datastore) QueryWithGlob(ctx context.Context, pattern string) (dsq.Results, error) {
+	if !d.sqlPrefixes() || d.queries.PatternMatch() == "" {
+		return nil, fmt.Errorf("key pattern matching: %w", ErrNotImplemented)
+	}
+
+	rows, err := d.db.QueryContext(ctx, d.queries.Query()+d.queries.PatternMatch(), pattern)
+	if err != nil {
+		return nil, err
+	}
+	return d.results(dsq.Query{}, &rowsCloser{rows: rows}, selectValues), nil
+}
+
+// rowsCloser holds the rows of query results so that they can be closed by
+// a finalizer.
+type rowsCloser struct {
+	rows *sql.Rows
+	done bool
+
+	// fetch returns the next rows of a cursor, see WithCursor, and release
+	// closes it
+	fetch   func() (*sql.Rows, error)
+	release func() error
+	// fetched counts the rows read from the last fetch
+	fetched  int
+	fetchErr error
+}
+
+// next advances to the next row, fetching the next rows of a cursor once
+// those of the previous fetch have been read.
+func (rc *rowsCloser) next() bool {
+	for {
+		if rc.rows.Next() {
+			rc.fetched++
+			return true
+		}
+		// the cursor is exhausted once a fetch returns no rows
+		if rc.fetch == nil || rc.rows.Err() != nil || rc.fetched == 0 {
+			return false
+		}
+
+		if err := rc.rows.Close(); err != nil {
+			rc.fetchErr = err
+			return false
+		}
+		rows, err := rc.fetch()
+		if err != nil {
+			rc.fetchErr = err
+			return false
+		}
+		rc.rows, rc.fetched = rows, 0
+	}
 }
 
-// Sync is noop for SQL databases.
+// err returns the error interrupting the iteration, if any.
+func (rc *rowsCloser) err() error {
+	if rc.fetchErr != nil {
+		return rc.fetchErr
+	}
+	return rc.rows.Err()
+}
+
+func (rc *rowsCloser) close() error {
+	err := rc.rows.Close()
+	if rc.release != nil {
+		if rerr := rc.release(); err == nil {
+			err = rerr
+		}
+		rc.release = nil
+	}
+	return err
+}
+
+// ForEach calls fn with the key and value of every row of the table, in no
+// particular order, streaming them from a cursor without building query
+// results. The value is only valid until fn returns and must be copied to be
+// kept. ForEach stops at the first error returned by fn or when ctx is done,
+// and returns that error.
+func (d *Datastore) ForEach(ctx context.Context, fn func(key ds.Key, value []byte) error) (err error) {
+	defer func(start time.Time) { d.log(ctx, "ForEach", d.queries.Query(), nil, start, err) }(time.Now())
+
+	rows, err := d.db.QueryContext(ctx, d.queries.Query())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var key string
+	// reused by the driver from one row to the next
+	var value sql.RawBytes
+	for rows.Next() {
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		k, err := d.keys.Decode(key)
+		if err != nil {
+			return err
+		}
+		if err := fn(k, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// QueryPage returns up to limit entries whose key sorts after the cursor key
+// in ascending order, along with the cursor of the next page. The returned
+// cursor is the last key of the page, or an empty key once all the entries
+// have been returned. An empty after key starts from the first entry.
+//
+// Unlike OFFSET based pagination each page costs the same whatever its
+// position, and pages stay stable when rows are inserted concurrently.
+func (d *Datastore) QueryPage(ctx context.Context, after ds.Key, limit int) (dsq.Results, ds.Key, error) {
+	if limit < 0 {
+		return nil, ds.Key{}, fmt.Errorf("QueryPage: invalid limit %d", limit)
+	}
+
+	rows, err := d.db.QueryContext(ctx, d.queries.QueryPage(), d.keys.Encode(after), limit)
+	if err != nil {
+		return nil, ds.Key{}, err
+	}
+	defer rows.Close()
+
+	entries := make([]dsq.Entry, 0, limit)
+	for rows.Next() {
+		var key string
+		var out []byte
+		if err := rows.Scan(&key, &out); err != nil {
+			return nil, ds.Key{}, err
+		}
+		k, err := d.keys.Decode(key)
+		if err != nil {
+			return nil, ds.Key{}, err
+		}
+		entries = append(entries, dsq.Entry{Key: k.String(), Value: out, Size: len(out)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, ds.Key{}, err
+	}
+
+	var next ds.Key
+	if len(entries) == limit && limit > 0 {
+		next = ds.RawKey(entries[len(entries)-1].Key)
+	}
+
+	return dsq.ResultsWithEntries(dsq.Query{}, entries), next, nil
+}
+
+// QueryCount returns the number of entries matching the prefix and filters of
+// the query, its orders, limit and offset are ignored. The rows are counted by
+// the database unless some filters have to be applied naively.
+func (d *Datastore) QueryCount(ctx context.Context, q dsq.Query) (int, error) {
+	cq := dsq.Query{Prefix: q.Prefix, Filters: q.Filters, KeysOnly: true}
+	sel, args, naive := buildQuery(d.queries, cq, d.sqlPrefixes())
+
+	if len(naive.Filters) == 0 && naive.Prefix == "" {
+		var count int
+		if err := d.db.QueryRowContext(ctx, fmt.Sprintf(d.queries.Count(), sel), args...).Scan(&count); err != nil {
+			return 0, err
+		}
+		return count, nil
+	}
+
+	// filters may need the values
+	cq.KeysOnly = false
+	res, err := d.Query(ctx, cq)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	var count int
+	for r := range res.Next() {
+		if r.Error != nil {
+			return 0, r.Error
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Count returns the number of keys under prefix, like those of a query with
+// the prefix, counted with a count(*) statement.
+func (d *Datastore) Count(ctx context.Context, prefix ds.Key) (int, error) {
+	return d.QueryCount(ctx, dsq.Query{Prefix: prefix.String()})
+}
+
+// EstimateCount returns the approximate number of keys of the table with the
+// EstimateCount query of the backend, which reads the statistics of the
+// database instead of the rows. The keys are counted exactly by Count when
+// the query is empty or the statistics are not collected yet.
+func (d *Datastore) EstimateCount(ctx context.Context) (int, error) {
+	q := d.queries.EstimateCount()
+	if q == "" {
+		return d.Count(ctx, ds.NewKey("/"))
+	}
+
+	var count int
+	switch err := d.db.QueryRowContext(ctx, q).Scan(&count); {
+	case err != nil:
+		return 0, err
+	case count < 0:
+		return d.Count(ctx, ds.NewKey("/"))
+	}
+	return count, nil
+}
+
+// Sync flushes the writes of the database to durable storage with the Sync
+// query of the backend, it is a noop when the query is empty. The whole
+// database is flushed whatever the key.
 func (d *Datastore) Sync(ctx context.Context, key ds.Key) error {
+	q := d.queries.Sync()
+	if q == "" {
+		return nil
+	}
+
+	_, err := d.db.ExecContext(ctx, q)
+	return err
+}
+
+// CollectGarbage reclaims the space of the deleted rows with the Vacuum query
+// of the backend, then updates the statistics of the query planner with its
+// Optimize query, skipping the empty ones.
+func (d *Datastore) CollectGarbage(ctx context.Context) error {
+	if d.readOnly {
+		return nil
+	}
+
+	for _, q := range []string{d.queries.Vacuum(), d.queries.Optimize()} {
+		if q == "" {
+			continue
+		}
+		// the incremental vacuum of sqlite reclaims a page on every step,
+		// the rows must be drained
+		rows, err := d.db.QueryContext(ctx, q)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // GetSize determines the size in bytes of the value for a given key.
-func (d *Datastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
-	row := d.db.QueryRowContext(ctx, d.queries.GetSize(), key.String())
-	var size int
+func (d *Datastore) GetSize(ctx context.Context, key ds.Key) (size int, err error) {
+	defer func(start time.Time) { d.log(ctx, "GetSize", d.getSizeQuery(), &key, start, err) }(time.Now())
+	ctx, done := d.withQueryTimeout(ctx, &err)
+	defer done()
+	if !d.queries.Capabilities().SupportsSize {
+		v, err := d.Get(ctx, key)
+		if err != nil {
+			return -1, err
+		}
+		return len(v), nil
+	}
+
+	d.explain(ctx, "GetSize", d.getSizeQuery(), d.keyArg(key))
+	row := d.db.QueryRowContext(ctx, d.getSizeQuery(), d.keyArg(key))
 
 	switch err := row.Scan(&size); err {
 	case sql.ErrNoRows:
@@ -188,30 +1198,185 @@ func (d *Datastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
 	}
 }
 
-// queryWithParams applies prefix, limit, and offset params in pg query
-func queryWithParams(ctx context.Context, d *Datastore, q dsq.Query) (*sql.Rows, error) {
-	var qNew = d.queries.Query()
+// QueryExecutor runs queries, it is implemented by *sql.DB, *sql.Conn and
+// *sql.Tx.
+type QueryExecutor interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// QueryWithParams runs the statement selecting the keys and values of the
+// rows matching q with db, the statement being built from queries for keys
+// stored as strings. It also returns the part of q that could not be
+// expressed in SQL and must be applied naively to the results.
+func QueryWithParams(ctx context.Context, db QueryExecutor, queries Queries, q dsq.Query) (*sql.Rows, dsq.Query, error) {
+	return queryWithParams(ctx, db, queries, q, true)
+}
+
+// queryWithParams is QueryWithParams matching and sorting keys in SQL only
+// if sqlKeys is true, see buildQuery.
+func queryWithParams(ctx context.Context, db QueryExecutor, queries Queries, q dsq.Query, sqlKeys bool) (*sql.Rows, dsq.Query, error) {
+	qNew, args, naive := buildQuery(queries, q, sqlKeys)
+	rows, err := db.QueryContext(ctx, qNew, args...)
+	return rows, naive, err
+}
 
+// buildQuery returns the SQL statement for q and its arguments, along with
+// the part of the query left to be applied naively. Keys are matched and
+// sorted in SQL if sqlKeys is true and the backend supports it. The prefix,
+// keys, limit and offset are bound to the $N parameters formatted into the
+// fragments, never interpolated.
+func buildQuery(queries Queries, q dsq.Query, sqlKeys bool) (string, []any, dsq.Query) {
+	var args []any
+	bind := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	var qNew = queries.Query()
+	if q.ReturnExpirations {
+		qNew = queries.QueryWithExpiry()
+	}
+	var naive = dsq.Query{Filters: q.Filters, Orders: q.Orders}
+
+	caps := queries.Capabilities()
+	sqlPrefix := sqlKeys && caps.SupportsPrefix
+
+	// the prefix and the key filters are the predicates of the WHERE clause
+	var where []string
 	if q.Prefix != "" {
 		// normalize
 		prefix := ds.NewKey(q.Prefix).String()
-		if prefix != "/" {
-			qNew += fmt.Sprintf(d.queries.Prefix(), prefix+"/")
+		switch {
+		case prefix == "/":
+		case !sqlPrefix:
+			naive.Prefix = prefix
+		default:
+			where = append(where, fmt.Sprintf(queries.Prefix(), bind(queries.PrefixPattern(prefix+"/"))))
+		}
+	}
+
+	// key prefix filters are matched like the prefix, without the separator,
+	// and key comparisons compare the keys byte-wise like go-datastore
+	if sqlKeys && caps.SupportsPushdownFilters {
+		var filters []dsq.Filter
+		for _, f := range q.Filters {
+			pred := ""
+			if p, ok := keyPrefixFilter(f); ok && sqlPrefix {
+				pred = fmt.Sprintf(queries.Prefix(), bind(queries.PrefixPattern(p)))
+			} else if kc, ok := keyCompareFilter(f); ok && queries.KeyCompare(kc.Op) != "" {
+				pred = fmt.Sprintf(queries.KeyCompare(kc.Op), bind(kc.Key))
+			}
+
+			if pred == "" {
+				filters = append(filters, f)
+				continue
+			}
+			where = append(where, pred)
 		}
+		naive.Filters = filters
+	}
+	if len(where) > 0 {
+		qNew += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	createdAt := ""
+	if desc, ok := orderByCreatedAt(q.Orders); ok {
+		createdAt = queries.OrderByCreatedAt()
+		if desc {
+			createdAt = queries.OrderByCreatedAtDesc()
+		}
+	}
+	if createdAt != "" {
+		qNew += createdAt
+		naive.Orders = nil
+	} else if desc, ok := orderByValue(q.Orders); ok {
+		qNew += queries.OrderByValue(desc)
+		naive.Orders = nil
+	} else if desc, ok := orderByKey(q.Orders); ok && sqlKeys {
+		// encoded keys do not sort like the keys
+		if o := queries.OrderByKey(desc); o != "" {
+			qNew += o
+			naive.Orders = nil
+		}
+	} else if len(where) > 0 && len(q.Orders) == 0 {
+		// the rows matching a prefix or a key range are listed in key order
+		qNew += queries.OrderByKey(false)
 	}
 
 	// only apply limit and offset if we do not have to naive filter/order the results
-	if len(q.Filters) == 0 && len(q.Orders) == 0 {
+	sqlLimit := (q.Limit == 0 || caps.SupportsLimit) && (q.Offset == 0 || caps.SupportsOffset)
+	if sqlLimit && naive.Prefix == "" && len(naive.Filters) == 0 && len(naive.Orders) == 0 {
 		if q.Limit != 0 {
-			qNew += fmt.Sprintf(d.queries.Limit(), q.Limit)
-		}
-		if q.Offset != 0 {
-			qNew += fmt.Sprintf(d.queries.Offset(), q.Offset)
+			qNew += fmt.Sprintf(queries.Limit(), bind(q.Limit))
+			if q.Offset != 0 {
+				qNew += fmt.Sprintf(queries.Offset(), bind(q.Offset))
+			}
+		} else {
+			// sqlite does not accept an OFFSET without a LIMIT
+			naive.Offset = q.Offset
 		}
+	} else {
+		naive.Limit = q.Limit
+		naive.Offset = q.Offset
 	}
 
-	return d.db.QueryContext(ctx, qNew)
+	return qNew, args, naive
+}
+
+// keyPrefixFilter returns the prefix of f, if it is a key prefix filter.
+func keyPrefixFilter(f dsq.Filter) (string, bool) {
+	switch f := f.(type) {
+	case dsq.FilterKeyPrefix:
+		return f.Prefix, true
+	case *dsq.FilterKeyPrefix:
+		return f.Prefix, true
+	}
+	return "", false
+}
 
+// keyCompareFilter returns the key comparison of f, if it is one.
+func keyCompareFilter(f dsq.Filter) (dsq.FilterKeyCompare, bool) {
+	switch f := f.(type) {
+	case dsq.FilterKeyCompare:
+		return f, true
+	case *dsq.FilterKeyCompare:
+		return *f, true
+	}
+	return dsq.FilterKeyCompare{}, false
+}
+
+// orderByKey reports whether orders sorts by key only, and whether the
+// order is descending.
+func orderByKey(orders []dsq.Order) (desc bool, ok bool) {
+	if len(orders) != 1 {
+		return false, false
+	}
+	switch orders[0].(type) {
+	case dsq.OrderByKey, *dsq.OrderByKey:
+		return false, true
+	case dsq.OrderByKeyDescending, *dsq.OrderByKeyDescending:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// orderByValue reports whether orders sorts by value only, and whether the
+// order is descending.
+func orderByValue(orders []dsq.Order) (desc bool, ok bool) {
+	if len(orders) != 1 {
+		return false, false
+	}
+	switch orders[0].(type) {
+	case dsq.OrderByValue, *dsq.OrderByValue:
+		return false, true
+	case dsq.OrderByValueDescending, *dsq.OrderByValueDescending:
+		return true, true
+	default:
+		return false, false
+	}
 }
 
 var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.GCDatastore = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
@@ -0,0 +1,363 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteQueries are the queries of the sqlite package, which can not be
+// imported here, for the statements built by buildQuery.
+type sqliteQueries struct {
+	fakeQueries
+}
+
+func (sqliteQueries) Put() string {
+	return `INSERT OR REPLACE INTO blocks(key, data) VALUES($1, $2)`
+}
+
+func (sqliteQueries) Prefix() string {
+	return `key GLOB %s`
+}
+
+func (sqliteQueries) EscapePattern(s string) string {
+	return strings.NewReplacer("[", "[[]", "*", "[*]", "?", "[?]").Replace(s)
+}
+
+func (q sqliteQueries) PrefixPattern(prefix string) string {
+	return q.EscapePattern(prefix) + "*"
+}
+
+func (sqliteQueries) OrderByKey(desc bool) string {
+	if desc {
+		return ` ORDER BY key DESC`
+	}
+	return ` ORDER BY key ASC`
+}
+
+func (sqliteQueries) KeyCompare(op dsq.Op) string {
+	return `key ` + string(op) + ` %s`
+}
+
+// fuzzOrders are the orders of the fuzzed queries.
+var fuzzOrders = [][]dsq.Order{
+	nil,
+	{dsq.OrderByKey{}},
+	{dsq.OrderByKeyDescending{}},
+	{dsq.OrderByValue{}},
+	{dsq.OrderByValueDescending{}},
+	{dsq.OrderByValue{}, dsq.OrderByKeyDescending{}},
+}
+
+func FuzzQueryWithParams(f *testing.F) {
+	f.Add("/a", "", uint8(0), uint16(0), uint16(0), false)
+	f.Add("/a/b", "/a", uint8(1), uint16(10), uint16(2), true)
+	f.Add("/", "/b", uint8(3), uint16(1), uint16(0), false)
+	f.Add("/a'b", "", uint8(0), uint16(0), uint16(0), false)
+	f.Add("/x' OR '1'='1", "", uint8(2), uint16(5), uint16(1), false)
+	f.Add("/a'; DROP TABLE blocks; --", "/a'", uint8(0), uint16(0), uint16(0), true)
+	f.Add("/a*", "/[a?", uint8(4), uint16(3), uint16(3), false)
+	f.Add("/%_\\", "%", uint8(5), uint16(0), uint16(7), true)
+	f.Add("/a/%d/%s", "/a/%!", uint8(2), uint16(2), uint16(0), false)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		f.Fatal(err)
+	}
+	// every connection to :memory: is a different database
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE blocks (key TEXT PRIMARY KEY, data BLOB) WITHOUT ROWID"); err != nil {
+		f.Fatal(err)
+	}
+	d := NewDatastore(db, sqliteQueries{})
+	defer d.Close()
+
+	ctx := context.Background()
+	for _, k := range []string{"/a", "/a/b", "/a'b", "/a'b/c", "/a*/b", "/b", "/b/c'", "/x' OR '1'='1/y"} {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			f.Fatal(err)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, prefix, filterPrefix string, order uint8, limit, offset uint16, keysOnly bool) {
+		if strings.ContainsRune(prefix+filterPrefix, 0) {
+			// neither sqlite nor postgres can store keys with NUL bytes
+			t.Skip()
+		}
+
+		q := dsq.Query{
+			Prefix:   prefix,
+			Orders:   fuzzOrders[int(order)%len(fuzzOrders)],
+			Limit:    int(limit),
+			Offset:   int(offset),
+			KeysOnly: keysOnly,
+		}
+		if filterPrefix != "" {
+			q.Filters = []dsq.Filter{dsq.FilterKeyPrefix{Prefix: filterPrefix}}
+		}
+
+		stmt, args, _ := buildQuery(d.queries, q, true)
+		// the prefixes, limits and offsets are bound, never interpolated
+		if strings.ContainsRune(stmt, '\'') {
+			t.Fatalf("interpolated literal in %s", stmt)
+		}
+		if n := strings.Count(stmt, "$"); n != len(args) {
+			t.Fatalf("%s: expected %d parameters, got %d", stmt, len(args), n)
+		}
+
+		res, err := d.Query(ctx, q)
+		if err != nil {
+			t.Fatalf("query %s failed: %v", stmt, err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatalf("query %s failed: %v", stmt, err)
+		}
+
+		want := ds.NewKey(prefix).String()
+		for _, e := range entries {
+			if want != "/" && !strings.HasPrefix(e.Key, want+"/") {
+				t.Fatalf("%s: key %s does not have the prefix %s", stmt, e.Key, want)
+			}
+			if filterPrefix != "" && !strings.HasPrefix(e.Key, filterPrefix) {
+				t.Fatalf("%s: key %s does not have the prefix %s", stmt, e.Key, filterPrefix)
+			}
+		}
+		if q.Limit != 0 && len(entries) > q.Limit {
+			t.Fatalf("%s: expected at most %d entries, got %d", stmt, q.Limit, len(entries))
+		}
+	})
+}
+
+func TestQueryWithParams(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("CREATE TABLE blocks (key TEXT PRIMARY KEY, data BLOB) WITHOUT ROWID"); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/a/b", "/a/c", "/b"} {
+		if _, err := tx.Exec(sqliteQueries{}.Put(), k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the rows of the transaction are visible to the queries run with it
+	rows, naive, err := QueryWithParams(ctx, tx, sqliteQueries{}, dsq.Query{
+		Prefix:  "/a",
+		Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.NotEqual, Value: []byte("/a/c")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		var data []byte
+		if err := rows.Scan(&key, &data); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "/a/b,/a/c" {
+		t.Fatalf("expected the rows of /a, got %v", keys)
+	}
+	// value filters are left to be applied naively
+	if len(naive.Filters) != 1 || naive.Prefix != "" {
+		t.Fatalf("unexpected naive query %v", naive)
+	}
+}
+
+func TestBuildQueryPushdown(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE blocks (key TEXT PRIMARY KEY, data BLOB) WITHOUT ROWID"); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDatastore(db, sqliteQueries{})
+	defer d.Close()
+
+	ctx := context.Background()
+	for _, k := range []string{"/a/1", "/a/2", "/a/3", "/a/4", "/b/5"} {
+		if err := d.Put(ctx, ds.NewKey(k), []byte("v"+k[3:])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		q        dsq.Query
+		expected string
+	}{
+		{dsq.Query{Prefix: "/a", Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 2}, "/a/4,/a/3"},
+		{dsq.Query{Prefix: "/a", Orders: []dsq.Order{dsq.OrderByKey{}}, Limit: 2, Offset: 1}, "/a/2,/a/3"},
+		{dsq.Query{Prefix: "/a", Orders: []dsq.Order{dsq.OrderByValueDescending{}}, Limit: 1}, "/a/4"},
+		{dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/"}}, Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 1}, "/a/4"},
+		{dsq.Query{Prefix: "/a", Limit: 2}, "/a/1,/a/2"},
+		{dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/a/2"}, &dsq.FilterKeyCompare{Op: dsq.LessThanOrEqual, Key: "/b/5"}}, Orders: []dsq.Order{dsq.OrderByKey{}}, Limit: 2}, "/a/3,/a/4"},
+		{dsq.Query{Prefix: "/a", Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.NotEqual, Key: "/a/1"}}, Limit: 1}, "/a/2"},
+		{dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.Equal, Key: "/b/5"}}}, "/b/5"},
+		{dsq.Query{Prefix: "/a", Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/3"}}, Limit: 1}, "/a/3"},
+		{dsq.Query{Filters: []dsq.Filter{&dsq.FilterKeyPrefix{Prefix: "/a"}, dsq.FilterKeyPrefix{Prefix: "/a/"}, dsq.FilterKeyCompare{Op: dsq.LessThan, Key: "/a/3"}}, Limit: 5, Offset: 1}, "/a/2"},
+	} {
+		// the filters, orders, limits and offsets are applied by the database
+		stmt, _, naive := buildQuery(d.queries, c.q, true)
+		if naive.Prefix != "" || len(naive.Filters) != 0 || len(naive.Orders) != 0 || naive.Limit != 0 || naive.Offset != 0 {
+			t.Fatalf("%s: unexpected naive query %v", stmt, naive)
+		}
+
+		res, err := d.Query(ctx, c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		if strings.Join(keys, ",") != c.expected {
+			t.Fatalf("%s: expected %s, got %v", stmt, c.expected, keys)
+		}
+	}
+}
+
+// cursorQueries emulate the cursors of WithCursor with a temporary table,
+// drained by the fetches.
+type cursorQueries struct {
+	sqliteQueries
+}
+
+func (cursorQueries) DeclareCursor() string {
+	return `CREATE TEMP TABLE %s AS %s`
+}
+
+func (cursorQueries) FetchCursor(n int) string {
+	return fmt.Sprintf("DELETE FROM %%[1]s WHERE rowid IN (SELECT rowid FROM %%[1]s ORDER BY rowid LIMIT %d) RETURNING key, data", n)
+}
+
+func TestQueryCursor(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE blocks (key TEXT PRIMARY KEY, data BLOB) WITHOUT ROWID"); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDatastore(db, cursorQueries{}, WithCursor(3))
+	defer d.Close()
+
+	ctx := context.Background()
+	const count = 10
+	for i := 0; i < count; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/cursor/%02d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, n := range []int{count, 9, 1, 0} {
+		res, err := d.Query(ctx, dsq.Query{Prefix: "/cursor", Limit: n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := n
+		if n == 0 {
+			want = count
+		}
+		if len(entries) != want {
+			t.Fatalf("expected %d entries with a limit of %d, got %d", want, n, len(entries))
+		}
+		for i, e := range entries {
+			if want := fmt.Sprintf("/cursor/%02d", i); e.Key != want {
+				t.Fatalf("expected %s, got %s", want, e.Key)
+			}
+		}
+	}
+
+	// the transaction of the cursor is released with the results
+	res, err := d.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := res.NextSync(); !ok || r.Error != nil {
+		t.Fatalf("unexpected result %v", r)
+	}
+	if err := res.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/cursor/00")); err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelling the context interrupts the iteration between two fetches,
+	// rolling the transaction back
+	qctx, cancel := context.WithCancel(ctx)
+	res, err = d.Query(qctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if r, ok := res.NextSync(); !ok || r.Error != nil {
+			t.Fatalf("unexpected result %v", r)
+		}
+	}
+	cancel()
+	if r, ok := res.NextSync(); !ok || !errors.Is(r.Error, context.Canceled) {
+		t.Fatalf("expected a cancellation error, got %v, %v", r, ok)
+	}
+	if _, ok := res.NextSync(); ok {
+		t.Fatal("expected the results to be exhausted")
+	}
+	for i := 0; db.Stats().InUse != 0; i++ {
+		if i == 100 {
+			t.Fatalf("%d connections still in use", db.Stats().InUse)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRepeatValues(t *testing.T) {
+	for query, expected := range map[string]string{
+		`INSERT INTO blocks (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = excluded.data`: `INSERT INTO blocks (key, data) VALUES ($1, $2), ($3, $4), ($5, $6) ON CONFLICT (key) DO UPDATE SET data = excluded.data`,
+		`INSERT OR REPLACE INTO blocks(hash, data, key, size) VALUES($1, $2, $3, length($2))`:                 `INSERT OR REPLACE INTO blocks(hash, data, key, size) VALUES($1, $2, $3, length($2)), ($4, $5, $6, length($5)), ($7, $8, $9, length($8))`,
+		`INSERT INTO blocks (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = $2`:            ``,
+		`UPDATE blocks SET data = $2 WHERE key = $1`:                                                          ``,
+	} {
+		if q := repeatValues(query, 3); q != expected {
+			t.Errorf("expected %s, got %s", expected, q)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package sqlds
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// nonceSize is the size of the random nonce prepended to encrypted values.
+const nonceSize = 12
+
+// DeriveKey derives an encryption key from a passphrase with HKDF-SHA256.
+// The salt should be random and stored along with the database, the same
+// passphrase and salt always deriving the same key.
+func DeriveKey(passphrase, salt []byte) [32]byte {
+	var key [32]byte
+	// only fails for keys longer than 255 hashes
+	b, _ := hkdf.Key(sha256.New, passphrase, salt, "go-ds-sql encryption key", len(key))
+	copy(key[:], b)
+	return key
+}
+
+// EncryptedDatastore transparently encrypts values with AES-256-GCM before
+// they are written to the wrapped datastore and decrypts them when read.
+// Each stored value is the random nonce followed by the sealed value, keys
+// are stored in clear.
+//
+// Like CompressedDatastore, values written before the wrapper was introduced
+// are not readable through it and have to be Put again through it.
+type EncryptedDatastore struct {
+	child ds.Batching
+	aead  cipher.AEAD
+}
+
+// WithEncryption wraps d so that values are encrypted with key, see
+// DeriveKey to derive it from a passphrase.
+func WithEncryption(d ds.Batching, key [32]byte) *EncryptedDatastore {
+	// neither fails with a 32 bytes key
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &EncryptedDatastore{child: d, aead: aead}
+}
+
+// overhead is the number of bytes added to the values by the encryption.
+func (e *EncryptedDatastore) overhead() int {
+	return nonceSize + e.aead.Overhead()
+}
+
+func (e *EncryptedDatastore) encrypt(value []byte) ([]byte, error) {
+	out := make([]byte, nonceSize, nonceSize+len(value)+e.aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(out, out, value, nil), nil
+}
+
+func (e *EncryptedDatastore) decrypt(key string, b []byte) ([]byte, error) {
+	if len(b) < e.overhead() {
+		return nil, fmt.Errorf("failed to decrypt value of %s: value too short", key)
+	}
+	out, err := e.aead.Open(nil, b[:nonceSize], b[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value of %s: %w", key, err)
+	}
+	return out, nil
+}
+
+// Get retrieves and decrypts the value of the given key.
+func (e *EncryptedDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	b, err := e.child.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return e.decrypt(key.String(), b)
+}
+
+// Has determines if a value for the given key exists.
+func (e *EncryptedDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return e.child.Has(ctx, key)
+}
+
+// GetSize returns the cleartext size of the value of the given key, computed
+// from the stored size without decrypting the value.
+func (e *EncryptedDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	size, err := e.child.GetSize(ctx, key)
+	if err != nil {
+		return size, err
+	}
+	return max(size-e.overhead(), 0), nil
+}
+
+// Put encrypts and stores a value.
+func (e *EncryptedDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	b, err := e.encrypt(value)
+	if err != nil {
+		return err
+	}
+	return e.child.Put(ctx, key, b)
+}
+
+// Delete removes the value of the given key.
+func (e *EncryptedDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return e.child.Delete(ctx, key)
+}
+
+// Query returns the entries matching the query with their values decrypted,
+// keys only queries do not decrypt anything.
+func (e *EncryptedDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	cq := q
+	if !q.KeysOnly {
+		// value filters and orders must see the decrypted values
+		cq.Filters = nil
+		cq.Orders = nil
+		cq.Limit = 0
+		cq.Offset = 0
+	}
+
+	res, err := e.child.Query(ctx, cq)
+	if err != nil {
+		return nil, err
+	}
+	if q.KeysOnly && !q.ReturnsSizes {
+		return res, nil
+	}
+
+	decrypted := dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := res.NextSync()
+			if !ok || r.Error != nil {
+				return r, ok
+			}
+			r.Size = max(r.Size-e.overhead(), 0)
+			if q.KeysOnly {
+				return r, true
+			}
+			v, err := e.decrypt(r.Key, r.Value)
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			r.Value = v
+			return r, true
+		},
+		Close: res.Close,
+	})
+	if q.KeysOnly {
+		return decrypted, nil
+	}
+
+	nq := q
+	nq.Prefix = ""
+	return dsq.NaiveQueryApply(nq, decrypted), nil
+}
+
+// Sync flushes the given prefix of the wrapped datastore.
+func (e *EncryptedDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return e.child.Sync(ctx, prefix)
+}
+
+// Close closes the wrapped datastore.
+func (e *EncryptedDatastore) Close() error {
+	return e.child.Close()
+}
+
+// Batch creates a set of deferred updates whose values are encrypted.
+func (e *EncryptedDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := e.child.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedBatch{b: b, e: e}, nil
+}
+
+type encryptedBatch struct {
+	b ds.Batch
+	e *EncryptedDatastore
+}
+
+func (eb *encryptedBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	b, err := eb.e.encrypt(val)
+	if err != nil {
+		return err
+	}
+	return eb.b.Put(ctx, key, b)
+}
+
+func (eb *encryptedBatch) Delete(ctx context.Context, key ds.Key) error {
+	return eb.b.Delete(ctx, key)
+}
+
+func (eb *encryptedBatch) Commit(ctx context.Context) error {
+	return eb.b.Commit(ctx)
+}
+
+// Discard discards the wrapped batch, see DiscardableBatch.
+func (eb *encryptedBatch) Discard(ctx context.Context) {
+	discardBatch(ctx, eb.b)
+}
+
+var (
+	_ ds.Batching      = (*EncryptedDatastore)(nil)
+	_ DiscardableBatch = (*encryptedBatch)(nil)
+)
@@ -0,0 +1,92 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// WithQueryPlans makes the datastore log the plan of the statements of Get,
+// Put, Delete, GetSize and Query at the debug level before running them,
+// with the logger set by WithLogger or the default one. The plans are
+// obtained with the Explain query in a transaction which is rolled back.
+//
+// It is a debugging aid doubling the round trips to the database: the option
+// is ignored unless the binary is built with the debug build tag.
+func WithQueryPlans() Option {
+	return func(d *Datastore) {
+		d.queryPlans = true
+	}
+}
+
+// explain logs the plan of stmt executed with args, if query plans are
+// logged.
+func (d *Datastore) explain(ctx context.Context, op, stmt string, args ...any) {
+	if !debugBuild || !d.queryPlans || d.queries.Explain() == "" {
+		return
+	}
+
+	logger := d.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	plan, err := d.queryPlan(ctx, stmt, args...)
+	if err != nil {
+		logger.DebugContext(ctx, "failed to explain query", "db.operation", op, "db.statement", stmt, "error", err)
+		return
+	}
+	logger.DebugContext(ctx, "query plan", "db.operation", op, "db.statement", stmt, "db.plan", plan)
+}
+
+// explainer is a QueryExecutor logging the plans of the queries before
+// running them with the database of the datastore.
+type explainer struct {
+	d  *Datastore
+	op string
+}
+
+func (e explainer) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	e.d.explain(ctx, e.op, query, args...)
+	return e.d.db.QueryContext(ctx, query, args...)
+}
+
+// queryPlan returns the plan of stmt executed with args, one line per row of
+// the Explain query.
+func (d *Datastore) queryPlan(ctx context.Context, stmt string, args ...any) (string, error) {
+	// EXPLAIN ANALYZE executes the statement
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(d.queries.Explain(), stmt), args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	values := make([]any, len(cols))
+	for rows.Next() {
+		// the plan is in the last column, after the node ids of sqlite
+		var line sql.NullString
+		for i := range values {
+			values[i] = new(any)
+		}
+		values[len(values)-1] = &line
+		if err := rows.Scan(values...); err != nil {
+			return "", err
+		}
+		lines = append(lines, line.String)
+	}
+	return strings.Join(lines, "\n"), rows.Err()
+}
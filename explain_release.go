@@ -0,0 +1,6 @@
+//go:build !debug
+
+package sqlds
+
+// debugBuild enables the debugging aids, see WithQueryPlans.
+const debugBuild = false
@@ -0,0 +1,207 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// defaultImportBatchSize is the number of rows inserted per transaction by
+// Import.
+const defaultImportBatchSize = 1000
+
+// WithImportBatchSize sets the number of rows inserted per transaction by
+// Import, 1000 by default.
+func WithImportBatchSize(n int) Option {
+	return func(d *Datastore) {
+		d.importBatchSize = n
+	}
+}
+
+// exportEntry is a line of the export format, the value being encoded in
+// base64 by encoding/json.
+type exportEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Export writes all the entries of the datastore to w as newline delimited
+// JSON objects {"key": "/foo", "value": "<base64>"}, ordered by key. The
+// format is stable and can be restored with Import into any backend.
+func (d *Datastore) Export(ctx context.Context, w io.Writer) error {
+	res, err := d.Query(ctx, dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	enc := json.NewEncoder(w)
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		if err := enc.Encode(exportEntry{Key: r.Key, Value: r.Value}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Import puts the entries read from r in the format written by Export,
+// overwriting existing keys, and returns the number of imported entries.
+// Entries are inserted in transactions of WithImportBatchSize rows, the
+// transactions committed before an error are kept.
+func (d *Datastore) Import(ctx context.Context, r io.Reader) (int64, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	batchSize := d.importBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	var imported int64
+	var tx *sql.Tx
+	var pending int
+
+	commit := func() error {
+		if tx == nil {
+			return nil
+		}
+		err := tx.Commit()
+		tx = nil
+		if err == nil {
+			imported += int64(pending)
+		}
+		pending = 0
+		return err
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		var e exportEntry
+		if err := dec.Decode(&e); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			if tx != nil {
+				_ = tx.Rollback()
+			}
+			return imported, fmt.Errorf("invalid entry %d: %w", imported+int64(pending)+1, err)
+		}
+
+		if tx == nil {
+			var err error
+			if tx, err = d.db.BeginTx(ctx, nil); err != nil {
+				return imported, err
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, d.putQuery(), d.putArgs(ds.NewKey(e.Key), e.Value)...); err != nil {
+			_ = tx.Rollback()
+			return imported, err
+		}
+
+		if pending++; pending == batchSize {
+			if err := commit(); err != nil {
+				return imported, err
+			}
+		}
+	}
+
+	return imported, commit()
+}
+
+// MigrateData copies every entry of src to dst, such as from a SQLite
+// datastore to a PostgreSQL one, streaming them from a single query and
+// committing a dst batch every batchSize entries (1000 if not positive). It
+// returns the number of committed entries.
+//
+// When ctx is canceled, the entries read so far are committed before
+// returning the error of ctx. When dst is a Datastore, the autovacuum of its
+// table is disabled during the copy where the backend has one.
+func MigrateData(ctx context.Context, src ds.Datastore, dst ds.Batching, batchSize int) (int64, error) {
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	if d, ok := dst.(*Datastore); ok {
+		if q := d.queries.SetAutovacuum(false); q != "" {
+			if _, err := d.db.ExecContext(ctx, q); err != nil {
+				return 0, fmt.Errorf("failed to disable autovacuum: %w", err)
+			}
+			defer func() {
+				_, _ = d.db.ExecContext(context.WithoutCancel(ctx), d.queries.SetAutovacuum(true))
+			}()
+		}
+	}
+
+	res, err := src.Query(ctx, dsq.Query{})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	var migrated int64
+	var b ds.Batch
+	var pending int
+
+	commit := func(ctx context.Context) error {
+		if b == nil {
+			return nil
+		}
+		err := b.Commit(ctx)
+		b = nil
+		if err == nil {
+			migrated += int64(pending)
+		}
+		pending = 0
+		return err
+	}
+	canceled := func() (int64, error) {
+		// keep what has been read
+		err := commit(context.WithoutCancel(ctx))
+		return migrated, errors.Join(ctx.Err(), err)
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return canceled()
+		}
+
+		r, ok := res.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			if ctx.Err() != nil {
+				return canceled()
+			}
+			return migrated, r.Error
+		}
+
+		if b == nil {
+			if b, err = dst.Batch(ctx); err != nil {
+				return migrated, err
+			}
+		}
+		if err := b.Put(ctx, ds.RawKey(r.Key), r.Value); err != nil {
+			return migrated, err
+		}
+
+		if pending++; pending == batchSize {
+			if err := commit(ctx); err != nil {
+				return migrated, err
+			}
+		}
+	}
+
+	return migrated, commit(ctx)
+}
@@ -0,0 +1,115 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatsOptions configures the statistics published by a datastore created
+// with NewDatastoreWithStats.
+type StatsOptions struct {
+	// Table names the expvar map of the statistics, sqlds.<Table>.
+	Table string
+	// Interval is the period of the connection pool statistics updates, 10
+	// seconds if it is not positive.
+	Interval time.Duration
+}
+
+// opStats counts the operations of a datastore.
+type opStats struct {
+	gets    atomic.Int64
+	puts    atomic.Int64
+	deletes atomic.Int64
+	queries atomic.Int64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDatastoreWithStats returns a new SQL datastore publishing the statistics
+// of its connection pool, updated every opts.Interval until it is closed, and
+// the number of its Get, Put, Delete and Query calls to expvar. Datastores of
+// the same table share the expvar map, the last one created publishing its
+// statistics.
+func NewDatastoreWithStats(db *sql.DB, queries Queries, opts StatsOptions, options ...Option) *Datastore {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+
+	d := NewDatastore(db, queries, options...)
+	ctx, cancel := context.WithCancel(context.Background())
+	d.stats = &opStats{cancel: cancel}
+
+	m := statsMap("sqlds." + opts.Table)
+	for name, c := range map[string]*atomic.Int64{
+		"Get":    &d.stats.gets,
+		"Put":    &d.stats.puts,
+		"Delete": &d.stats.deletes,
+		"Query":  &d.stats.queries,
+	} {
+		m.Set(name, expvar.Func(func() any { return c.Load() }))
+	}
+
+	publish := func() {
+		st := db.Stats()
+		for name, v := range map[string]int64{
+			"OpenConnections": int64(st.OpenConnections),
+			"InUse":           int64(st.InUse),
+			"Idle":            int64(st.Idle),
+			"WaitCount":       st.WaitCount,
+			"WaitDuration":    int64(st.WaitDuration),
+			"MaxIdleClosed":   st.MaxIdleClosed,
+		} {
+			i := new(expvar.Int)
+			i.Set(v)
+			m.Set(name, i)
+		}
+	}
+	publish()
+
+	d.stats.wg.Add(1)
+	go func() {
+		defer d.stats.wg.Done()
+
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				publish()
+			}
+		}
+	}()
+
+	return d
+}
+
+// statsMu serializes the creation of the expvar maps.
+var statsMu sync.Mutex
+
+// statsMap returns the expvar map published under name, creating it if
+// needed.
+func statsMap(name string) *expvar.Map {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	if m, ok := expvar.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	return expvar.NewMap(name)
+}
+
+// stopStats stops the updates of the statistics.
+func (d *Datastore) stopStats() {
+	if d.stats != nil {
+		d.stats.cancel()
+		d.stats.wg.Wait()
+	}
+}
@@ -0,0 +1,44 @@
+package sqlds
+
+import (
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Features returns the go-datastore features supported by the datastore, so
+// that wrappers can forward them without their type assertions succeeding on
+// a datastore which does not support them. Unlike ds.FeaturesForDatastore,
+// which only looks at the methods of the type, it leaves out the features
+// which are noops for the instance: garbage collection when the datastore is
+// read-only or the backend has neither a Vacuum nor an Optimize query, and
+// Check when the backend has no Columns query.
+func (d *Datastore) Features() []ds.Feature {
+	return d.features(d)
+}
+
+// Features returns the go-datastore features supported by the datastore,
+// those of Datastore.Features plus TTL.
+func (d *TTLDatastore) Features() []ds.Feature {
+	return d.features(d)
+}
+
+// features returns the features of dstore, a datastore built on d, which
+// are supported by d.
+func (d *Datastore) features(dstore ds.Datastore) []ds.Feature {
+	var features []ds.Feature
+	for _, f := range ds.FeaturesForDatastore(dstore) {
+		switch f.Name {
+		case ds.FeatureNameGC:
+			if d.readOnly || d.queries.Vacuum() == "" && d.queries.Optimize() == "" {
+				continue
+			}
+		case ds.FeatureNameChecked:
+			if d.queries.Columns() == "" {
+				continue
+			}
+		}
+		features = append(features, f)
+	}
+	return features
+}
+
+var _ ds.TxnDatastore = (*Datastore)(nil)
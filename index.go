@@ -0,0 +1,252 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"runtime"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// IndexQueries are the queries maintaining the secondary index of an
+// IndexedDatastore, the indexed values being JSON encoded.
+type IndexQueries interface {
+	// DeleteIndex removes the indexed fields of key $1.
+	DeleteIndex() string
+	// InsertIndex indexes the field $2 of key $1 with the value $3.
+	InsertIndex() string
+	// QueryIndex selects the key and data of the rows whose field $1 has the
+	// value $2.
+	QueryIndex() string
+}
+
+// IndexExtractor returns the fields of a value to index, the field values
+// must be encodable in JSON.
+type IndexExtractor func(value []byte) (map[string]any, error)
+
+// IndexedDatastore maintains a secondary index of the fields extracted from
+// the values of a Datastore, updated in the same transaction as the values.
+type IndexedDatastore struct {
+	ds      *Datastore
+	queries IndexQueries
+	extract IndexExtractor
+}
+
+// WithIndex wraps d so that the fields returned by extract for every value
+// put are indexed with queries.
+func WithIndex(d *Datastore, queries IndexQueries, extract IndexExtractor) *IndexedDatastore {
+	return &IndexedDatastore{ds: d, queries: queries, extract: extract}
+}
+
+func (x *IndexedDatastore) put(ctx context.Context, tx *sql.Tx, key ds.Key, value []byte) error {
+	if err := x.ds.checkValueSize(key, value); err != nil {
+		return err
+	}
+	fields, err := x.extract(value)
+	if err != nil {
+		return fmt.Errorf("failed to extract the indexed fields of %s: %w", key, err)
+	}
+
+	k := x.ds.keys.Encode(key)
+	if _, err := tx.ExecContext(ctx, x.ds.putQuery(), x.ds.putArgs(key, value)...); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, x.queries.DeleteIndex(), k); err != nil {
+		return err
+	}
+
+	for field, v := range fields {
+		enc, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to encode the indexed field %s of %s: %w", field, key, err)
+		}
+		if _, err := tx.ExecContext(ctx, x.queries.InsertIndex(), k, field, string(enc)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *IndexedDatastore) delete(ctx context.Context, tx *sql.Tx, key ds.Key) error {
+	k := x.ds.keys.Encode(key)
+	if _, err := tx.ExecContext(ctx, x.queries.DeleteIndex(), k); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, x.ds.queries.Delete(), x.ds.keyArg(key))
+	return err
+}
+
+// QueryByIndex returns the entries whose indexed field has the given value.
+func (x *IndexedDatastore) QueryByIndex(ctx context.Context, field string, value any) (dsq.Results, error) {
+	enc, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := x.ds.db.QueryContext(ctx, x.queries.QueryIndex(), field, string(enc))
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &rowsCloser{rows: rows}
+	runtime.SetFinalizer(rc, (*rowsCloser).close)
+
+	return dsq.ResultsFromIterator(dsq.Query{}, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			if rc.done || !rc.rows.Next() {
+				if err := rc.rows.Err(); err != nil && !rc.done {
+					rc.done = true
+					return dsq.Result{Error: err}, true
+				}
+				return dsq.Result{}, false
+			}
+
+			var key string
+			var out []byte
+			if err := rc.rows.Scan(&key, &out); err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			k, err := x.ds.keys.Decode(key)
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+
+			return dsq.Result{Entry: dsq.Entry{Key: k.String(), Value: out, Size: len(out)}}, true
+		},
+		Close: func() error {
+			runtime.SetFinalizer(rc, nil)
+			return rc.close()
+		},
+	}), nil
+}
+
+// Get retrieves a value from the wrapped datastore.
+func (x *IndexedDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	return x.ds.Get(ctx, key)
+}
+
+// Has determines if a value for the given key exists in the wrapped datastore.
+func (x *IndexedDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return x.ds.Has(ctx, key)
+}
+
+// GetSize determines the size of the value of the given key.
+func (x *IndexedDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	return x.ds.GetSize(ctx, key)
+}
+
+// Put stores a value and indexes its fields.
+func (x *IndexedDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	if err := x.ds.inTx(ctx, func(tx *sql.Tx) error {
+		return x.put(ctx, tx, key, value)
+	}); err != nil {
+		return err
+	}
+	x.ds.replicate(key, value, false)
+	return nil
+}
+
+// Delete removes a value and its indexed fields.
+func (x *IndexedDatastore) Delete(ctx context.Context, key ds.Key) error {
+	if err := x.ds.inTx(ctx, func(tx *sql.Tx) error {
+		return x.delete(ctx, tx, key)
+	}); err != nil {
+		return err
+	}
+	x.ds.replicate(key, nil, true)
+	return nil
+}
+
+// Query queries the wrapped datastore.
+func (x *IndexedDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	return x.ds.Query(ctx, q)
+}
+
+// Sync flushes the wrapped datastore.
+func (x *IndexedDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return x.ds.Sync(ctx, prefix)
+}
+
+// Close closes the wrapped datastore.
+func (x *IndexedDatastore) Close() error {
+	return x.ds.Close()
+}
+
+// Batch creates a batch whose operations and index updates are committed in
+// a single transaction.
+func (x *IndexedDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	if x.ds.readOnly {
+		return nil, ErrReadOnly
+	}
+	return &indexedBatch{x: x, ops: make(map[ds.Key]op)}, nil
+}
+
+type indexedBatch struct {
+	x         *IndexedDatastore
+	ops       map[ds.Key]op
+	committed bool
+	discarded bool
+}
+
+func (xb *indexedBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	if err := checkUsable(xb.committed, xb.discarded); err != nil {
+		return err
+	}
+	if err := xb.x.ds.checkValueSize(key, val); err != nil {
+		return err
+	}
+	xb.ops[key] = op{value: val}
+	return nil
+}
+
+func (xb *indexedBatch) Delete(ctx context.Context, key ds.Key) error {
+	if err := checkUsable(xb.committed, xb.discarded); err != nil {
+		return err
+	}
+	xb.ops[key] = op{delete: true}
+	return nil
+}
+
+func (xb *indexedBatch) Commit(ctx context.Context) error {
+	if err := checkUsable(xb.committed, xb.discarded); err != nil {
+		return err
+	}
+
+	err := xb.x.ds.inTx(ctx, func(tx *sql.Tx) error {
+		for k, op := range xb.ops {
+			var err error
+			if op.delete {
+				err = xb.x.delete(ctx, tx, k)
+			} else {
+				err = xb.x.put(ctx, tx, k, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, op := range xb.ops {
+		xb.x.ds.replicate(k, op.value, op.delete)
+	}
+	xb.committed = true
+	return nil
+}
+
+// Discard drops the operations of the batch, see DiscardableBatch.
+func (xb *indexedBatch) Discard(ctx context.Context) {
+	xb.discarded = true
+	xb.ops = nil
+}
+
+var (
+	_ ds.Batching      = (*IndexedDatastore)(nil)
+	_ DiscardableBatch = (*indexedBatch)(nil)
+)
@@ -0,0 +1,49 @@
+package sqlds
+
+import (
+	"encoding/base32"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// KeyEncoder converts datastore keys to and from the values stored in the
+// key column.
+type KeyEncoder interface {
+	Encode(key ds.Key) string
+	Decode(s string) (ds.Key, error)
+}
+
+// StringKeyEncoder stores keys as their string representation, it is the
+// default encoder and the only one for which key prefixes are matched in SQL.
+type StringKeyEncoder struct{}
+
+// Encode returns the string representation of key.
+func (StringKeyEncoder) Encode(key ds.Key) string {
+	return key.String()
+}
+
+// Decode returns the key of the given string representation.
+func (StringKeyEncoder) Decode(s string) (ds.Key, error) {
+	return ds.NewKey(s), nil
+}
+
+var base32Keys = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// Base32KeyEncoder stores keys as unpadded base32 strings of the extended hex
+// alphabet, which preserves the ordering of the keys but not their prefixes:
+// prefix queries are filtered in Go.
+type Base32KeyEncoder struct{}
+
+// Encode returns the base32 encoding of key.
+func (Base32KeyEncoder) Encode(key ds.Key) string {
+	return base32Keys.EncodeToString(key.Bytes())
+}
+
+// Decode returns the key of the given base32 encoding.
+func (Base32KeyEncoder) Decode(s string) (ds.Key, error) {
+	b, err := base32Keys.DecodeString(s)
+	if err != nil {
+		return ds.Key{}, err
+	}
+	return ds.NewKey(string(b)), nil
+}
@@ -0,0 +1,152 @@
+package sqlds
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// LoggedDatastore logs every operation of the wrapped datastore with slog,
+// at the debug level when it succeeds and at the error level when it fails.
+type LoggedDatastore struct {
+	child  ds.Batching
+	logger *slog.Logger
+}
+
+// WithLogging wraps d so that its operations are logged with logger.
+func WithLogging(d ds.Batching, logger *slog.Logger) *LoggedDatastore {
+	return &LoggedDatastore{child: d, logger: logger}
+}
+
+// WithLogger returns a copy of d logging its operations with logger, at the
+// debug level when they succeed and at the error level when they fail,
+// including failed batch and transaction commits. The copy shares the
+// database of d. Retried errors are logged by RetryDatastore, see
+// RetryPolicy.Logger.
+func WithLogger(d *Datastore, logger *slog.Logger) *Datastore {
+	ld := *d
+	ld.logger = logger
+	return &ld
+}
+
+// log logs the outcome of an operation of the datastore, if it has a logger.
+func (d *Datastore) log(ctx context.Context, op, stmt string, key *ds.Key, start time.Time, err error) {
+	if d.logger != nil {
+		logOperation(ctx, d.logger, op, stmt, key, start, err)
+	}
+}
+
+// log logs the outcome of an operation.
+func (l *LoggedDatastore) log(ctx context.Context, op string, key *ds.Key, start time.Time, err error) {
+	logOperation(ctx, l.logger, op, "", key, start, err)
+}
+
+// logOperation logs the outcome of an operation with the OpenTelemetry
+// attribute names, ds.ErrNotFound is not an error.
+func logOperation(ctx context.Context, logger *slog.Logger, op, stmt string, key *ds.Key, start time.Time, err error) {
+	attrs := []slog.Attr{
+		slog.String("db.operation", op),
+		slog.Duration("duration", time.Since(start)),
+	}
+	if stmt != "" {
+		attrs = append(attrs, slog.String("db.statement", stmt))
+	}
+	if key != nil {
+		attrs = append(attrs, slog.String("datastore.key", key.String()))
+	}
+
+	if err != nil && err != ds.ErrNotFound {
+		attrs = append(attrs, slog.Any("error", err))
+		logger.LogAttrs(ctx, slog.LevelError, "datastore operation failed", attrs...)
+		return
+	}
+	logger.LogAttrs(ctx, slog.LevelDebug, "datastore operation", attrs...)
+}
+
+// Get retrieves a value from the wrapped datastore.
+func (l *LoggedDatastore) Get(ctx context.Context, key ds.Key) (value []byte, err error) {
+	defer func(start time.Time) { l.log(ctx, "Get", &key, start, err) }(time.Now())
+	return l.child.Get(ctx, key)
+}
+
+// Has determines if a value for the given key exists in the wrapped datastore.
+func (l *LoggedDatastore) Has(ctx context.Context, key ds.Key) (exists bool, err error) {
+	defer func(start time.Time) { l.log(ctx, "Has", &key, start, err) }(time.Now())
+	return l.child.Has(ctx, key)
+}
+
+// GetSize determines the size of the value of the given key.
+func (l *LoggedDatastore) GetSize(ctx context.Context, key ds.Key) (size int, err error) {
+	defer func(start time.Time) { l.log(ctx, "GetSize", &key, start, err) }(time.Now())
+	return l.child.GetSize(ctx, key)
+}
+
+// Put stores a value in the wrapped datastore.
+func (l *LoggedDatastore) Put(ctx context.Context, key ds.Key, value []byte) (err error) {
+	defer func(start time.Time) { l.log(ctx, "Put", &key, start, err) }(time.Now())
+	return l.child.Put(ctx, key, value)
+}
+
+// Delete removes a value from the wrapped datastore.
+func (l *LoggedDatastore) Delete(ctx context.Context, key ds.Key) (err error) {
+	defer func(start time.Time) { l.log(ctx, "Delete", &key, start, err) }(time.Now())
+	return l.child.Delete(ctx, key)
+}
+
+// Query queries the wrapped datastore, the duration only covers the
+// execution of the query, not the iteration of the results.
+func (l *LoggedDatastore) Query(ctx context.Context, q dsq.Query) (_ dsq.Results, err error) {
+	defer func(start time.Time) { l.log(ctx, "Query", nil, start, err) }(time.Now())
+	return l.child.Query(ctx, q)
+}
+
+// Sync flushes the given prefix of the wrapped datastore.
+func (l *LoggedDatastore) Sync(ctx context.Context, prefix ds.Key) (err error) {
+	defer func(start time.Time) { l.log(ctx, "Sync", &prefix, start, err) }(time.Now())
+	return l.child.Sync(ctx, prefix)
+}
+
+// Close closes the wrapped datastore.
+func (l *LoggedDatastore) Close() error {
+	return l.child.Close()
+}
+
+// Batch creates a batch whose commits are logged.
+func (l *LoggedDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := l.child.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &loggedBatch{b: b, l: l}, nil
+}
+
+type loggedBatch struct {
+	b ds.Batch
+	l *LoggedDatastore
+}
+
+func (lb *loggedBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	return lb.b.Put(ctx, key, val)
+}
+
+func (lb *loggedBatch) Delete(ctx context.Context, key ds.Key) error {
+	return lb.b.Delete(ctx, key)
+}
+
+func (lb *loggedBatch) Commit(ctx context.Context) (err error) {
+	defer func(start time.Time) { lb.l.log(ctx, "Batch.Commit", nil, start, err) }(time.Now())
+	return lb.b.Commit(ctx)
+}
+
+// Discard discards the wrapped batch, see DiscardableBatch.
+func (lb *loggedBatch) Discard(ctx context.Context) {
+	discardBatch(ctx, lb.b)
+}
+
+var (
+	_ ds.Batching      = (*LoggedDatastore)(nil)
+	_ DiscardableBatch = (*loggedBatch)(nil)
+)
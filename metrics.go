@@ -0,0 +1,160 @@
+//go:build !nometrics
+
+package sqlds
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsDatastore records Prometheus metrics for every operation of the
+// wrapped datastore. Build with the nometrics tag to leave it out along with
+// the Prometheus dependency.
+type MetricsDatastore struct {
+	child    ds.Batching
+	duration *prometheus.HistogramVec
+	total    *prometheus.CounterVec
+}
+
+// WithMetrics wraps d so that the duration and count of every operation are
+// registered in reg, labeled by operation and status (ok or error). Wrapping
+// several datastores with the same registerer shares the collectors.
+func WithMetrics(d ds.Batching, reg prometheus.Registerer) (*MetricsDatastore, error) {
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sqlds_operation_duration_seconds",
+		Help:    "Duration of datastore operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "status"})
+	total := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sqlds_operations_total",
+		Help: "Number of datastore operations.",
+	}, []string{"operation", "status"})
+
+	var err error
+	if duration, err = register(reg, duration); err != nil {
+		return nil, err
+	}
+	if total, err = register(reg, total); err != nil {
+		return nil, err
+	}
+
+	return &MetricsDatastore{child: d, duration: duration, total: total}, nil
+}
+
+// MetricsMiddleware wraps datastores with WithMetrics, see Chain.
+func MetricsMiddleware(reg prometheus.Registerer) Middleware {
+	return func(d ds.Batching) (ds.Batching, error) {
+		return WithMetrics(d, reg)
+	}
+}
+
+// register registers c, returning the already registered collector if any.
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) (C, error) {
+	err := reg.Register(c)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(C); ok {
+			return existing, nil
+		}
+	}
+	return c, err
+}
+
+func (m *MetricsDatastore) observe(op string, start time.Time, err error) {
+	status := "ok"
+	if err != nil && err != ds.ErrNotFound {
+		status = "error"
+	}
+	m.duration.WithLabelValues(op, status).Observe(time.Since(start).Seconds())
+	m.total.WithLabelValues(op, status).Inc()
+}
+
+// Get retrieves a value from the wrapped datastore.
+func (m *MetricsDatastore) Get(ctx context.Context, key ds.Key) (value []byte, err error) {
+	defer func(start time.Time) { m.observe("get", start, err) }(time.Now())
+	return m.child.Get(ctx, key)
+}
+
+// Has determines if a value for the given key exists in the wrapped datastore.
+func (m *MetricsDatastore) Has(ctx context.Context, key ds.Key) (exists bool, err error) {
+	defer func(start time.Time) { m.observe("has", start, err) }(time.Now())
+	return m.child.Has(ctx, key)
+}
+
+// GetSize determines the size of the value of the given key.
+func (m *MetricsDatastore) GetSize(ctx context.Context, key ds.Key) (size int, err error) {
+	defer func(start time.Time) { m.observe("get_size", start, err) }(time.Now())
+	return m.child.GetSize(ctx, key)
+}
+
+// Put stores a value in the wrapped datastore.
+func (m *MetricsDatastore) Put(ctx context.Context, key ds.Key, value []byte) (err error) {
+	defer func(start time.Time) { m.observe("put", start, err) }(time.Now())
+	return m.child.Put(ctx, key, value)
+}
+
+// Delete removes a value from the wrapped datastore.
+func (m *MetricsDatastore) Delete(ctx context.Context, key ds.Key) (err error) {
+	defer func(start time.Time) { m.observe("delete", start, err) }(time.Now())
+	return m.child.Delete(ctx, key)
+}
+
+// Query queries the wrapped datastore, the duration only covers the
+// execution of the query, not the iteration of the results.
+func (m *MetricsDatastore) Query(ctx context.Context, q dsq.Query) (_ dsq.Results, err error) {
+	defer func(start time.Time) { m.observe("query", start, err) }(time.Now())
+	return m.child.Query(ctx, q)
+}
+
+// Sync flushes the given prefix of the wrapped datastore.
+func (m *MetricsDatastore) Sync(ctx context.Context, prefix ds.Key) (err error) {
+	defer func(start time.Time) { m.observe("sync", start, err) }(time.Now())
+	return m.child.Sync(ctx, prefix)
+}
+
+// Close closes the wrapped datastore.
+func (m *MetricsDatastore) Close() error {
+	return m.child.Close()
+}
+
+// Batch creates a batch whose commits are measured.
+func (m *MetricsDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := m.child.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsBatch{b: b, m: m}, nil
+}
+
+type metricsBatch struct {
+	b ds.Batch
+	m *MetricsDatastore
+}
+
+func (mb *metricsBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	return mb.b.Put(ctx, key, val)
+}
+
+func (mb *metricsBatch) Delete(ctx context.Context, key ds.Key) error {
+	return mb.b.Delete(ctx, key)
+}
+
+func (mb *metricsBatch) Commit(ctx context.Context) (err error) {
+	defer func(start time.Time) { mb.m.observe("batch_commit", start, err) }(time.Now())
+	return mb.b.Commit(ctx)
+}
+
+// Discard discards the wrapped batch, see DiscardableBatch.
+func (mb *metricsBatch) Discard(ctx context.Context) {
+	discardBatch(ctx, mb.b)
+}
+
+var (
+	_ ds.Batching      = (*MetricsDatastore)(nil)
+	_ DiscardableBatch = (*metricsBatch)(nil)
+)
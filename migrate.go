@@ -0,0 +1,84 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// ColumnDef defines an extra column of a datastore table, added after the
+// key and data columns.
+type ColumnDef struct {
+	Name    string
+	Type    string
+	Default string // SQL expression, empty for no default
+}
+
+// String returns the definition of the column in a CREATE TABLE statement.
+func (c ColumnDef) String() string {
+	def := c.Name + " " + c.Type
+	if c.Default != "" {
+		def += " DEFAULT " + c.Default
+	}
+	return def
+}
+
+// Migration is a single schema change. Migrations are applied in order and
+// the position of a migration in its slice (starting at 1) is the schema
+// version it brings the database to.
+type Migration func(*sql.Tx) error
+
+// SchemaVersioner reads and records the schema version of a database.
+type SchemaVersioner interface {
+	// SchemaVersion returns the current schema version, 0 if none was recorded.
+	SchemaVersion(tx *sql.Tx) (int, error)
+	// SetSchemaVersion records the given schema version.
+	SetSchemaVersion(tx *sql.Tx, version int) error
+}
+
+// Migrate brings the database schema up to date by running every migration
+// that has not been applied yet. All pending migrations and the new version
+// are applied in a single transaction, so a failing migration leaves the
+// database untouched.
+func Migrate(db *sql.DB, v SchemaVersioner, migrations []Migration) error {
+	return MigrateContext(context.Background(), db, v, migrations)
+}
+
+// MigrateContext is Migrate with the transaction of the migrations bound to
+// ctx: it is rolled back if ctx is done before it is committed.
+func MigrateContext(ctx context.Context, db *sql.DB, v SchemaVersioner, migrations []Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	version, err := v.SchemaVersion(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	if version > len(migrations) {
+		_ = tx.Rollback()
+		return fmt.Errorf("schema version %d is newer than the latest known version %d", version, len(migrations))
+	}
+
+	if version == len(migrations) {
+		// nothing to do
+		return tx.Rollback()
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if err := migrations[i](tx); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration to version %d failed: %w", i+1, err)
+		}
+	}
+
+	if err := v.SetSchemaVersion(tx, len(migrations)); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to record schema version: %w", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,57 @@
+package sqlds
+
+import (
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// OrderByCreatedAt orders the entries by insertion time, oldest first, in
+// tables tracking it in a created_at column (see the TrackCreatedAt option
+// of the backends). Entries inserted at the same time are ordered by key.
+//
+// The insertion time is not part of the entries: on tables without the
+// column, and when combined with other orders, the entries are ordered by
+// key.
+type OrderByCreatedAt struct{}
+
+// Compare compares the keys of a and b, see OrderByCreatedAt.
+func (OrderByCreatedAt) Compare(a, b dsq.Entry) int {
+	return dsq.OrderByKey{}.Compare(a, b)
+}
+
+func (OrderByCreatedAt) String() string {
+	return "CREATED_AT"
+}
+
+// OrderByCreatedAtDesc orders the entries by insertion time, newest first,
+// see OrderByCreatedAt.
+type OrderByCreatedAtDesc struct{}
+
+// Compare compares the keys of a and b in reverse, see OrderByCreatedAt.
+func (OrderByCreatedAtDesc) Compare(a, b dsq.Entry) int {
+	return dsq.OrderByKeyDescending{}.Compare(a, b)
+}
+
+func (OrderByCreatedAtDesc) String() string {
+	return "desc(CREATED_AT)"
+}
+
+// orderByCreatedAt reports whether orders sorts by insertion time only, and
+// whether the order is descending.
+func orderByCreatedAt(orders []dsq.Order) (desc bool, ok bool) {
+	if len(orders) != 1 {
+		return false, false
+	}
+	switch orders[0].(type) {
+	case OrderByCreatedAt, *OrderByCreatedAt:
+		return false, true
+	case OrderByCreatedAtDesc, *OrderByCreatedAtDesc:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+var (
+	_ dsq.Order = OrderByCreatedAt{}
+	_ dsq.Order = OrderByCreatedAtDesc{}
+)
@@ -0,0 +1,72 @@
+package sqlds
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// pinger pings the database of a datastore in the background.
+type pinger struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// defaultPingInterval is the interval of WithPing when it is not positive.
+const defaultPingInterval = 30 * time.Second
+
+// WithPing returns a copy of d pinging its database every interval, 30
+// seconds if it is not positive, until it is closed, to keep the connections
+// warm: database/sql discards a connection dropped by the server while idle
+// when a ping finds it, instead of the next query failing. Failed pings are
+// logged at the warning level, with the logger set by WithLogger or the
+// default one, and are not reported otherwise. The copy shares the database
+// of d.
+func WithPing(d *Datastore, interval time.Duration) *Datastore {
+	if interval <= 0 {
+		interval = defaultPingInterval
+	}
+
+	pd := *d
+	ctx, cancel := context.WithCancel(context.Background())
+	pd.pinger = &pinger{cancel: cancel}
+
+	logger := pd.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	pd.pinger.wg.Add(1)
+	go func() {
+		defer pd.pinger.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := pd.db.PingContext(ctx); err != nil && ctx.Err() == nil {
+				logger.LogAttrs(ctx, slog.LevelWarn, "failed to ping database",
+					slog.String("db.operation", "Ping"),
+					slog.Any("error", err),
+				)
+			}
+		}
+	}()
+
+	return &pd
+}
+
+// stopPing stops the pings of the database.
+func (d *Datastore) stopPing() {
+	if d.pinger != nil {
+		d.pinger.cancel()
+		d.pinger.wg.Wait()
+	}
+}
@@ -0,0 +1,54 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// AuditQueries are the postgres queries of the <table>_audit table of an
+// audited datastore.
+type AuditQueries struct {
+	insertQuery string
+	selectQuery string
+}
+
+// NewAuditQueries creates a new PostgreSQL set of audit queries for the
+// passed datastore table, see AddAuditTable.
+func NewAuditQueries(tbl string) AuditQueries {
+	return AuditQueries{
+		insertQuery: fmt.Sprintf("INSERT INTO %s_audit (key, operation, data_hash) VALUES ($1, $2, $3)", tbl),
+		selectQuery: fmt.Sprintf("SELECT operation, timestamp, data_hash FROM %s_audit WHERE key = $1 ORDER BY id", tbl),
+	}
+}
+
+// InsertAudit returns the postgres query for recording an operation.
+func (q AuditQueries) InsertAudit() string {
+	return q.insertQuery
+}
+
+// QueryAudit returns the postgres query for getting the operations of a key.
+func (q AuditQueries) QueryAudit() string {
+	return q.selectQuery
+}
+
+// AddAuditTable returns a migration creating the <table>_audit table used by
+// audited datastores.
+func AddAuditTable(table string) sqlds.Migration {
+	return func(tx *sql.Tx) error {
+		if _, err := tx.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_audit (
+			id SERIAL PRIMARY KEY,
+			key TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			timestamp TIMESTAMPTZ NOT NULL DEFAULT now(),
+			data_hash BYTEA
+		)`, table)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_audit_key ON %s_audit (key)", table, table))
+		return err
+	}
+}
+
+var _ sqlds.AuditQueries = AuditQueries{}
@@ -0,0 +1,117 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/lib/pq"
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// copyChunkSize is the number of rows sent per COPY by CopyFrom.
+const copyChunkSize = 4096
+
+// copyStagingTable returns the temporary table the rows of CopyFrom are
+// copied into before being merged into table.
+func copyStagingTable(table string) string {
+	return table + "_copy"
+}
+
+// copyMergeQuery returns the statement merging the staging table of CopyFrom
+// into table, the last row copied for a key winning.
+func (opts *Options) copyMergeQuery(table string) string {
+	keyColumn := "key"
+	columns := []string{"key", "data"}
+	values := []string{"key", "data"}
+	updates := []string{"data = excluded.data"}
+	if opts.HashKeys {
+		keyColumn = "hash"
+		columns = append(columns, "hash")
+		values = append(values, "sha256(convert_to(key, 'UTF8'))")
+	}
+	if opts.UsesSizeColumn {
+		columns = append(columns, "size")
+		values = append(values, "octet_length(data)")
+		updates = append(updates, "size = excluded.size")
+	}
+	if opts.UsesChecksumColumn {
+		updates = append(updates, "checksum = NULL")
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT DISTINCT ON (key) %s FROM %s ORDER BY key, seq DESC ON CONFLICT (%s) DO UPDATE SET %s",
+		table, strings.Join(columns, ", "), strings.Join(values, ", "), copyStagingTable(table), keyColumn, strings.Join(updates, ", "))
+}
+
+// CopyFrom upserts the entries received from entries until it is closed,
+// and returns the number of entries received. The entries are streamed with
+// the COPY protocol, in the text format of lib/pq, by chunks of 4096 rows
+// into a temporary table, which is then merged into the table: the value of
+// a key received more than once is the last one. Nothing is written unless
+// every entry is copied, in a single transaction.
+//
+// CopyFrom is much faster than batches for bulk imports, see
+// BenchmarkCopyFrom, but the entries are neither checked against the value
+// size limit nor replicated.
+func (ed *ExtendedDatastore) CopyFrom(ctx context.Context, entries <-chan dsq.Entry) (int64, error) {
+	if ed.readOnly {
+		return 0, sqlds.ErrReadOnly
+	}
+
+	tx, err := ed.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	staging := copyStagingTable(ed.table)
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TEMPORARY TABLE %s (seq BIGSERIAL, key TEXT, data BYTEA) ON COMMIT DROP", staging)); err != nil {
+		return 0, fmt.Errorf("failed to create the staging table: %w", err)
+	}
+
+	var n int64
+	for done := false; !done; {
+		stmt, err := tx.PrepareContext(ctx, pq.CopyIn(staging, "key", "data"))
+		if err != nil {
+			return n, err
+		}
+
+		rows := 0
+		for ; rows < copyChunkSize; rows++ {
+			var e dsq.Entry
+			var ok bool
+			select {
+			case <-ctx.Done():
+				_ = stmt.Close()
+				return n, ctx.Err()
+			case e, ok = <-entries:
+			}
+			if !ok {
+				done = true
+				break
+			}
+
+			if _, err := stmt.ExecContext(ctx, ds.NewKey(e.Key).String(), e.Value); err != nil {
+				_ = stmt.Close()
+				return n, err
+			}
+			n++
+		}
+
+		// flushes the rows of the chunk
+		if _, err := stmt.ExecContext(ctx); err != nil {
+			_ = stmt.Close()
+			return n, err
+		}
+		if err := stmt.Close(); err != nil {
+			return n, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, ed.copyMergeQuery); err != nil {
+		return n, fmt.Errorf("failed to merge the copied rows: %w", err)
+	}
+	return n, tx.Commit()
+}
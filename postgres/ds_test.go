@@ -0,0 +1,738 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+	"github.com/ory/dockertest/v3"
+	sqlds "github.com/vkost/go-ds-sql"
+	"github.com/vkost/go-ds-sql/test"
+)
+
+// testOptions are the options of the PostgreSQL container started by
+// TestMain, nil when Docker is unavailable.
+var testOptions *Options
+
+func TestMain(m *testing.M) {
+	os.Exit(runWithPostgres(m))
+}
+
+// runWithPostgres runs the tests against a PostgreSQL container, the tests
+// needing it are skipped when Docker is unavailable.
+func runWithPostgres(m *testing.M) int {
+	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
+	if err != nil {
+		fmt.Printf("docker is unavailable, skipping postgres integration tests: %s\n", err)
+		return m.Run()
+	}
+
+	resource, err := pool.Run("postgres", "16-alpine", []string{
+		"POSTGRES_PASSWORD=password",
+		"POSTGRES_DB=datastore",
+	})
+	if err != nil {
+		fmt.Printf("failed to start postgres: %s\n", err)
+		return 1
+	}
+	defer pool.Purge(resource)
+	_ = resource.Expire(600)
+
+	opts := &Options{Password: "password", Port: resource.GetPort("5432/tcp")}
+	opts.setDefaults()
+
+	var db *sql.DB
+	if err := pool.Retry(func() error {
+		if db, err = sql.Open("postgres", opts.connString()); err != nil {
+			return err
+		}
+		return db.Ping()
+	}); err != nil {
+		fmt.Printf("failed to connect to postgres: %s\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(NewQueries(opts.Table).TableSchema()); err != nil {
+		fmt.Printf("failed to create table: %s\n", err)
+		return 1
+	}
+	defer db.Exec(fmt.Sprintf("DROP TABLE %s", opts.Table))
+
+	testOptions = opts
+	return m.Run()
+}
+
+// newDS returns a datastore connected to the test container, after removing
+// the rows left by previous tests.
+func newDS(tb testing.TB) *sqlds.Datastore {
+	tb.Helper()
+
+	if testOptions == nil {
+		tb.Skip("docker is unavailable")
+	}
+
+	opts := *testOptions
+	d, err := opts.Create()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { d.Close() })
+
+	if _, err := d.DeletePrefix(context.Background(), ds.RawKey("/")); err != nil {
+		tb.Fatal(err)
+	}
+
+	return d
+}
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, newDS(t))
+}
+
+func TestQueryLimitOffset(t *testing.T) {
+	d := newDS(t)
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/limit/%d", i)), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		limit, offset int
+		expect        []string
+	}{
+		{limit: 3, expect: []string{"/limit/0", "/limit/1", "/limit/2"}},
+		{limit: 2, offset: 4, expect: []string{"/limit/4", "/limit/5"}},
+		{offset: 8, expect: []string{"/limit/8", "/limit/9"}},
+		{limit: 5, offset: 9, expect: []string{"/limit/9"}},
+		{offset: 10},
+	} {
+		rs, err := d.Query(ctx, dsq.Query{
+			Prefix: "/limit",
+			Orders: []dsq.Order{dsq.OrderByKey{}},
+			Limit:  tc.limit,
+			Offset: tc.offset,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(tc.expect) {
+			t.Errorf("limit %d offset %d: expected %v, got %v", tc.limit, tc.offset, tc.expect, keys)
+		}
+	}
+}
+
+func TestCursorFetchSize(t *testing.T) {
+	newDS(t)
+
+	opts := *testOptions
+	opts.CursorFetchSize = 7
+	d, err := opts.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	const count = 50
+	for i := 0; i < count; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/cursor/%02d", i)), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/cursor", Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 20 {
+		t.Fatalf("expected 20 entries, got %d", len(entries))
+	}
+	for i, e := range entries {
+		if want := fmt.Sprintf("/cursor/%02d", count-1-i); e.Key != want {
+			t.Fatalf("expected %s, got %s", want, e.Key)
+		}
+	}
+}
+
+func TestEstimateCount(t *testing.T) {
+	d := newDS(t)
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/estimate/%d", i)), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the statistics are up to date once the table is analyzed
+	if _, err := d.DB().ExecContext(ctx, "ANALYZE "+testOptions.Table); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := d.EstimateCount(ctx); err != nil || count != 100 {
+		t.Fatalf("expected an estimate of 100 keys, got %d, %v", count, err)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	d := newDS(t)
+	ctx := context.Background()
+
+	if err := d.Put(ctx, ds.NewKey("/big"), make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := d.DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the value is compressed by TOAST, the relation has at least a page
+	if usage == 0 {
+		t.Fatal("expected the size of the table")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	d := newDS(t)
+	ctx := context.Background()
+
+	if err := d.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	md := sqlds.NewDatastore(d.DB(), NewQueries("missing_table"))
+	if err := md.Check(ctx); !errors.Is(err, sqlds.ErrInvalidSchema) {
+		t.Fatalf("expected ErrInvalidSchema, got %v", err)
+	}
+}
+
+func TestQueryWithGlob(t *testing.T) {
+	d := newDS(t)
+	ctx := context.Background()
+
+	for _, k := range []string{"/pins/a/recursive", "/pins/a/direct", "/pins/b/recursive", "/pins/it's/recursive"} {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for pattern, expect := range map[string][]string{
+		"/pins/%/recursive": {"/pins/a/recursive", "/pins/b/recursive", "/pins/it's/recursive"},
+		"/pins/_/recursive": {"/pins/a/recursive", "/pins/b/recursive"},
+		// * is not a wildcard in a LIKE pattern
+		"/pins/*/recursive": nil,
+		// the pattern is a parameter, its quotes are not SQL
+		"/pins/it's/%": {"/pins/it's/recursive"},
+		"' OR 1=1 --":  nil,
+	} {
+		rs, err := d.QueryWithGlob(ctx, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(expect) {
+			t.Errorf("pattern %q: expected %v, got %v", pattern, expect, keys)
+		}
+	}
+}
+
+func TestConcurrentBatches(t *testing.T) {
+	d := newDS(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			b, err := d.Batch(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			// every batch writes the same keys
+			for i := 0; i < 100; i++ {
+				if err := b.Put(ctx, ds.NewKey(fmt.Sprintf("/batch/%d", i)), []byte{byte(w)}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- b.Commit(ctx)
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	d := newDS(b)
+	ctx := context.Background()
+	value := make([]byte, 256)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/bench/%d", i)), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBatchPut(b *testing.B) {
+	d := newDS(b)
+	ctx := context.Background()
+	value := make([]byte, 256)
+
+	b.ResetTimer()
+	batch, err := d.Batch(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		if err := batch.Put(ctx, ds.NewKey(fmt.Sprintf("/bench/%d", i)), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// newExtendedDS returns an extended datastore connected to the test
+// container, after removing the rows left by previous tests.
+func newExtendedDS(tb testing.TB) *ExtendedDatastore {
+	tb.Helper()
+	newDS(tb)
+
+	opts := *testOptions
+	d, err := opts.CreateExtended()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { d.Close() })
+	return d
+}
+
+// sendEntries sends n entries of value to a channel closed afterwards.
+func sendEntries(n int, value []byte) <-chan dsq.Entry {
+	entries := make(chan dsq.Entry, 1024)
+	go func() {
+		defer close(entries)
+		for i := 0; i < n; i++ {
+			entries <- dsq.Entry{Key: fmt.Sprintf("/copy/%d", i), Value: value}
+		}
+	}()
+	return entries
+}
+
+func TestCopyFrom(t *testing.T) {
+	d := newExtendedDS(t)
+	ctx := context.Background()
+
+	if err := d.Put(ctx, ds.NewKey("/copy/1"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 100000
+	n, err := d.CopyFrom(ctx, sendEntries(count, []byte("value")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != count {
+		t.Fatalf("expected %d entries, got %d", count, n)
+	}
+
+	res, err := d.Query(ctx, dsq.Query{Prefix: "/copy", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != count {
+		t.Fatalf("expected %d rows, got %d", count, len(entries))
+	}
+	// existing keys are updated
+	if v, err := d.Get(ctx, ds.NewKey("/copy/1")); err != nil || string(v) != "value" {
+		t.Fatalf("expected the copied value, got %q, %v", v, err)
+	}
+
+	// the last entry of a key wins
+	entries2 := make(chan dsq.Entry, 3)
+	entries2 <- dsq.Entry{Key: "/copy/dup", Value: []byte("a")}
+	entries2 <- dsq.Entry{Key: "/copy/dup", Value: []byte("b")}
+	close(entries2)
+	if _, err := d.CopyFrom(ctx, entries2); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(ctx, ds.NewKey("/copy/dup")); err != nil || string(v) != "b" {
+		t.Fatalf("expected the last value, got %q, %v", v, err)
+	}
+
+	// nothing is written when the copy is interrupted
+	cctx, cancel := context.WithCancel(ctx)
+	blocked := make(chan dsq.Entry, 1)
+	blocked <- dsq.Entry{Key: "/copy/cancelled", Value: []byte("x")}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := d.CopyFrom(cctx, blocked); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if has, err := d.Has(ctx, ds.NewKey("/copy/cancelled")); err != nil || has {
+		t.Fatalf("expected nothing to be written, got %v, %v", has, err)
+	}
+}
+
+func BenchmarkCopyFrom(b *testing.B) {
+	d := newExtendedDS(b)
+	ctx := context.Background()
+	value := make([]byte, 256)
+
+	b.ResetTimer()
+	if _, err := d.CopyFrom(ctx, sendEntries(b.N, value)); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	newDS(t)
+
+	opts := *testOptions
+	opts.EnableNotifications = true
+	d, err := opts.CreateExtended()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	events, err := d.Watch(ctx, ds.NewKey("/watched"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Put(ctx, ds.NewKey("/other"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/watched/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := <-events
+	if ev.Err != nil || ev.Key.String() != "/watched/a" || ev.Operation != sqlds.WatchPut || string(ev.Value) != "a" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	if err := d.Delete(ctx, ds.NewKey("/watched/a")); err != nil {
+		t.Fatal(err)
+	}
+	ev = <-events
+	if ev.Err != nil || ev.Key.String() != "/watched/a" || ev.Operation != sqlds.WatchDelete {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestMultiDatastore(t *testing.T) {
+	newDS(t)
+
+	opts := *testOptions
+	opts.Table = ""
+	opts.Tables = []string{"multi_blocks", "multi_pins"}
+	opts.ExtraColumns = []sqlds.ColumnDef{{Name: "created_at", Type: "TIMESTAMPTZ", Default: "now()"}}
+	md, err := opts.CreateMulti()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer md.Close()
+
+	blocks, err := md.Shard("multi_blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins, err := md.Shard("multi_pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := blocks.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pins.Get(ctx, ds.NewKey("/a")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// the shared database stays open
+	if err := pins.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blocks.Get(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range opts.Tables {
+		if _, err := md.DB().Exec("DROP TABLE " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	d := newDS(t)
+
+	ctx := context.Background()
+	for i, v := range []string{"a", "bb", "cccccc"} {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprint(i)), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.CollectGarbage(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := d.Stat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Count != 3 || st.TotalSize != 9 || st.MinSize != 1 || st.MaxSize != 6 || st.AvgSize != 3 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	// VACUUM ANALYZE updates the tuple counts
+	if st.LiveTuples != 3 {
+		t.Fatalf("expected 3 live tuples, got %+v", st)
+	}
+}
+
+func TestTxOptions(t *testing.T) {
+	d := newDS(t)
+	ctx := context.Background()
+
+	if err := d.Put(ctx, ds.NewKey("/counter"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := d.NewTransactionWithOptions(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ro.Get(ctx, ds.NewKey("/counter")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.Put(ctx, ds.NewKey("/counter"), []byte("1")); !errors.Is(err, sqlds.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	ro.Discard(ctx)
+
+	// the writes of a read-only batch are rejected by the database
+	b, err := d.BatchWithOptions(&sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/counter"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err == nil {
+		t.Fatal("expected a read-only batch to fail")
+	}
+
+	// two serializable read-modify-write transactions conflict
+	serializable := &sql.TxOptions{Isolation: sql.LevelSerializable}
+	t1, err := d.NewTransactionWithOptions(ctx, serializable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := d.NewTransactionWithOptions(ctx, serializable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, txn := range []ds.Txn{t1, t2} {
+		if _, err := txn.Get(ctx, ds.NewKey("/counter")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := t1.Put(ctx, ds.NewKey("/counter"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := t1.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err = t2.Put(ctx, ds.NewKey("/counter"), []byte("1"))
+	if err == nil {
+		err = t2.Commit(ctx)
+	}
+	if err == nil {
+		t.Fatal("expected a serialization failure")
+	}
+}
+
+func TestGetForUpdate(t *testing.T) {
+	d := newDS(t)
+	ctx := context.Background()
+	key := ds.NewKey("/counter")
+
+	if err := d.Put(ctx, key, []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second transaction blocks on the row until the first one commits
+	locked := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for i := range 2 {
+		go func() {
+			defer wg.Done()
+			if i == 1 {
+				<-locked
+			}
+
+			txn, err := d.NewTransaction(ctx, false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer txn.Discard(ctx)
+
+			v, err := d.GetForUpdate(ctx, key, txn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if i == 0 {
+				close(locked)
+				time.Sleep(50 * time.Millisecond)
+			}
+			n, err := strconv.Atoi(string(v))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := txn.Put(ctx, key, []byte(strconv.Itoa(n+1))); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := txn.Commit(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := d.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "2" {
+		t.Fatalf("expected both updates, got %s", v)
+	}
+}
+
+func TestHashKeysSuite(t *testing.T) {
+	newDS(t)
+
+	opts := *testOptions
+	opts.Table = "hashed_blocks"
+	opts.HashKeys = true
+	d, err := opts.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	defer d.DB().Exec("DROP TABLE hashed_blocks")
+
+	dstest.SubtestAll(t, d)
+}
+
+func TestTTL(t *testing.T) {
+	d := newDS(t)
+	ctx := context.Background()
+
+	q := NewTTLQueries("ttl_blocks")
+	if _, err := d.DB().Exec(q.TableSchema()); err != nil {
+		t.Fatal(err)
+	}
+	defer d.DB().Exec("DROP TABLE ttl_blocks")
+
+	td := sqlds.NewTTLDatastore(d.DB(), q)
+	if err := td.PutWithTTL(ctx, ds.NewKey("/short"), []byte("short"), 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := td.Put(ctx, ds.NewKey("/forever"), []byte("forever")); err != nil {
+		t.Fatal(err)
+	}
+	if exp, err := td.GetExpiration(ctx, ds.NewKey("/short")); err != nil || exp.IsZero() {
+		t.Fatalf("expected an expiration, got %v, %v", exp, err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := td.Get(ctx, ds.NewKey("/short")); err != ds.ErrNotFound {
+		t.Fatalf("expected the entry to expire, got %v", err)
+	}
+	if err := td.SetTTL(ctx, ds.NewKey("/forever"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := td.Put(ctx, ds.NewKey("/forever"), []byte("forever")); err != nil {
+		t.Fatal(err)
+	}
+	if exp, err := td.GetExpiration(ctx, ds.NewKey("/forever")); err != nil || !exp.IsZero() {
+		t.Fatalf("expected the put to clear the expiration, got %v, %v", exp, err)
+	}
+	if n, err := td.DeleteExpired(ctx, 10); err != nil || n != 1 {
+		t.Fatalf("expected 1 deleted row, got %d, %v", n, err)
+	}
+	if _, err := td.Get(ctx, ds.NewKey("/forever")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxnSuite(t *testing.T) {
+	test.RunTxnDatastoreTests(t, newDS(t))
+}
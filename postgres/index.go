@@ -0,0 +1,55 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// IndexQueries are the postgres queries of the meta jsonb column of an
+// indexed datastore.
+type IndexQueries struct {
+	deleteQuery string
+	insertQuery string
+	selectQuery string
+}
+
+// NewIndexQueries creates a new PostgreSQL set of index queries for the
+// passed datastore table, see Options.EnableJSONIndex.
+func NewIndexQueries(tbl string) IndexQueries {
+	return IndexQueries{
+		deleteQuery: fmt.Sprintf("UPDATE %s SET meta = NULL WHERE key = $1", tbl),
+		insertQuery: fmt.Sprintf("UPDATE %s SET meta = coalesce(meta, '{}'::jsonb) || jsonb_build_object($2::text, $3::jsonb) WHERE key = $1", tbl),
+		selectQuery: fmt.Sprintf("SELECT key, data FROM %s WHERE meta @> jsonb_build_object($1::text, $2::jsonb) ORDER BY key", tbl),
+	}
+}
+
+// DeleteIndex returns the postgres query for removing the indexed fields of
+// a key.
+func (q IndexQueries) DeleteIndex() string {
+	return q.deleteQuery
+}
+
+// InsertIndex returns the postgres query for indexing a field of a key.
+func (q IndexQueries) InsertIndex() string {
+	return q.insertQuery
+}
+
+// QueryIndex returns the postgres query for getting the rows by indexed
+// field.
+func (q IndexQueries) QueryIndex() string {
+	return q.selectQuery
+}
+
+// addMetaColumn adds the meta jsonb column used by indexed datastores and
+// its GIN index to table if they do not exist.
+func addMetaColumn(db *sql.DB, table string) error {
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS meta JSONB", table)); err != nil {
+		return err
+	}
+	_, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_meta ON %s USING GIN (meta jsonb_path_ops)", table, table))
+	return err
+}
+
+var _ sqlds.IndexQueries = IndexQueries{}
@@ -0,0 +1,64 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// schemaVersion stores the schema version of a table in a shared
+// schema_version table, one row per datastore table.
+type schemaVersion struct {
+	table string
+}
+
+// SchemaVersion returns the recorded schema version of the table, creating the
+// schema_version table if necessary.
+func (v schemaVersion) SchemaVersion(tx *sql.Tx) (int, error) {
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema_version (tbl TEXT PRIMARY KEY, version INTEGER NOT NULL)"); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := tx.QueryRow("SELECT version FROM schema_version WHERE tbl = $1", v.table).Scan(&version)
+	switch err {
+	case sql.ErrNoRows:
+		return 0, nil
+	case nil:
+		return version, nil
+	default:
+		return 0, err
+	}
+}
+
+// SetSchemaVersion records the schema version of the table.
+func (v schemaVersion) SetSchemaVersion(tx *sql.Tx, version int) error {
+	_, err := tx.Exec("INSERT INTO schema_version (tbl, version) VALUES ($1, $2) ON CONFLICT (tbl) DO UPDATE SET version = $2", v.table, version)
+	if err != nil {
+		return fmt.Errorf("failed to update schema_version: %w", err)
+	}
+	return nil
+}
+
+// AddSizeColumn returns a migration adding the size column used by
+// Options.UsesSizeColumn to the table and backfilling it from the values.
+func AddSizeColumn(table string) sqlds.Migration {
+	return func(tx *sql.Tx) error {
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS size INTEGER", table)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET size = octet_length(data) WHERE size IS NULL", table))
+		return err
+	}
+}
+
+// AddChecksumColumn returns a migration adding the checksum column used by
+// Options.UsesChecksumColumn to the table. The existing rows have no
+// checksum.
+func AddChecksumColumn(table string) sqlds.Migration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", table, checksumColumn))
+		return err
+	}
+}
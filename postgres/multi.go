@@ -0,0 +1,69 @@
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// MultiDatastore is a set of datastores stored in different tables of one
+// database, sharing a connection pool.
+type MultiDatastore struct {
+	db     *sql.DB
+	shards map[string]*sqlds.Datastore
+}
+
+// CreateMulti returns the datastores of Options.Tables, the tables being
+// created and migrated like the table of Create.
+func (opts *Options) CreateMulti() (*MultiDatastore, error) {
+	if len(opts.Tables) == 0 {
+		return nil, errors.New("no tables")
+	}
+	if opts.Table != "" {
+		return nil, errors.New("the Table and Tables options are mutually exclusive")
+	}
+	if opts.CreateTableSQL != "" {
+		return nil, errors.New("the CreateTableSQL option is not supported with Tables")
+	}
+
+	opts.setDefaults()
+	db, err := sql.Open("postgres", opts.connString())
+	if err != nil {
+		return nil, err
+	}
+
+	// the shards do not close the shared database
+	dsOpts := append(opts.datastoreOptions(), sqlds.WithSharedDB())
+
+	md := &MultiDatastore{db: db, shards: make(map[string]*sqlds.Datastore, len(opts.Tables))}
+	for _, table := range opts.Tables {
+		if err := opts.setupTable(db, table); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("table %s: %w", table, err)
+		}
+		md.shards[table] = sqlds.NewDatastore(db, opts.queries(table), dsOpts...)
+	}
+
+	return md, nil
+}
+
+// Shard returns the datastore of the given table.
+func (md *MultiDatastore) Shard(table string) (*sqlds.Datastore, error) {
+	d, ok := md.shards[table]
+	if !ok {
+		return nil, fmt.Errorf("unknown table %s", table)
+	}
+	return d, nil
+}
+
+// DB returns the database shared by the shards.
+func (md *MultiDatastore) DB() *sql.DB {
+	return md.db
+}
+
+// Close closes the shared database, closing the shards is a noop.
+func (md *MultiDatastore) Close() error {
+	return md.db.Close()
+}
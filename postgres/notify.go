@@ -0,0 +1,160 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/lib/pq"
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// ErrWatchInterrupted is the error of the last event of a watch whose
+// connection dropped.
+var ErrWatchInterrupted = errors.New("watch interrupted: connection lost")
+
+// ExtendedDatastore is a postgres datastore with postgres specific operations.
+type ExtendedDatastore struct {
+	*sqlds.Datastore
+
+	connString string
+	channel    string
+
+	table          string
+	readOnly       bool
+	copyMergeQuery string
+}
+
+// CreateExtended returns an extended datastore connected to postgres.
+func (opts *Options) CreateExtended() (*ExtendedDatastore, error) {
+	d, err := opts.Create()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExtendedDatastore{
+		Datastore:      d,
+		connString:     opts.connString(),
+		channel:        notifyChannel(opts.Table),
+		table:          opts.Table,
+		readOnly:       opts.ReadOnly,
+		copyMergeQuery: opts.copyMergeQuery(opts.Table),
+	}, nil
+}
+
+// notifyChannel returns the channel notified of the changes of table.
+func notifyChannel(table string) string {
+	return table + "_changes"
+}
+
+// installNotifyTrigger installs the trigger notifying the changes of the
+// table, their payload being the JSON object {"key": ..., "op": TG_OP}.
+func installNotifyTrigger(db *sql.DB, table string) error {
+	for _, stmt := range []string{
+		fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s_notify() RETURNS trigger AS $$
+		BEGIN
+			IF TG_OP = 'DELETE' THEN
+				PERFORM pg_notify('%s', json_build_object('key', OLD.key, 'op', TG_OP)::text);
+			ELSE
+				PERFORM pg_notify('%s', json_build_object('key', NEW.key, 'op', TG_OP)::text);
+			END IF;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql`, table, notifyChannel(table), notifyChannel(table)),
+		fmt.Sprintf("DROP TRIGGER IF EXISTS %s_notify ON %s", table, table),
+		fmt.Sprintf("CREATE TRIGGER %s_notify AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE FUNCTION %s_notify()", table, table, table),
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseNotification returns the event of a notification payload, without
+// its value.
+func parseNotification(payload string) (sqlds.WatchEvent, error) {
+	var n struct {
+		Key string `json:"key"`
+		Op  string `json:"op"`
+	}
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return sqlds.WatchEvent{}, fmt.Errorf("invalid notification %q: %w", payload, err)
+	}
+
+	ev := sqlds.WatchEvent{Key: ds.NewKey(n.Key), Operation: sqlds.WatchPut}
+	if n.Op == "DELETE" {
+		ev.Operation = sqlds.WatchDelete
+	}
+	return ev, nil
+}
+
+// Watch returns the changes made by any process to the keys under prefix,
+// the table must have been created with Options.EnableNotifications. The
+// values are read when the notifications are received, so put events carry
+// the latest value of their key.
+//
+// The channel is closed when ctx is done or the connection drops, in which
+// case the last event carries ErrWatchInterrupted.
+func (ed *ExtendedDatastore) Watch(ctx context.Context, prefix ds.Key) (<-chan sqlds.WatchEvent, error) {
+	l := pq.NewListener(ed.connString, time.Second, time.Minute, nil)
+	if err := l.Listen(ed.channel); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	events := make(chan sqlds.WatchEvent)
+	go func() {
+		defer close(events)
+		defer l.Close()
+
+		send := func(ev sqlds.WatchEvent) bool {
+			select {
+			case events <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-l.Notify:
+				if n == nil {
+					// the connection dropped, notifications may have been missed
+					send(sqlds.WatchEvent{Err: ErrWatchInterrupted})
+					return
+				}
+
+				ev, err := parseNotification(n.Extra)
+				if err != nil {
+					send(sqlds.WatchEvent{Err: err})
+					return
+				}
+				if !sqlds.IsUnder(ev.Key, prefix) {
+					continue
+				}
+				if ev.Operation == sqlds.WatchPut {
+					if ev.Value, err = ed.Get(ctx, ev.Key); err == ds.ErrNotFound {
+						// deleted since, a delete event follows
+						continue
+					} else if err != nil {
+						send(sqlds.WatchEvent{Err: err})
+						return
+					}
+				}
+				if !send(ev) {
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
@@ -3,7 +3,11 @@ package postgres
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
+	"slices"
+	"strings"
 
+	dsq "github.com/ipfs/go-datastore/query"
 	sqlds "github.com/vkost/go-ds-sql"
 
 	_ "github.com/lib/pq" //postgres driver
@@ -17,36 +21,238 @@ type Options struct {
 	Password string
 	Database string
 	Table    string
+	// Tables are the tables of the datastores created by CreateMulti,
+	// sharing a connection pool. Table must be empty when Tables is set.
+	Tables []string
+
+	// SSLMode is one of disable, require, verify-ca or verify-full,
+	// defaults to disable.
+	SSLMode     string
+	SSLRootCert string // path to the CA certificate
+	SSLCert     string // path to the client certificate
+	SSLKey      string // path to the client private key
+
+	// CreateTableSQL is executed verbatim by Create when set, typically a
+	// CREATE TABLE IF NOT EXISTS statement with custom columns.
+	CreateTableSQL string
+	// ExtraColumns makes Create create the table if it does not exist, with
+	// these columns after the key and data columns. Create does not create
+	// the table when both fields are empty, unless HashKeys, TrackCreatedAt
+	// or UsesChecksumColumn is set.
+	ExtraColumns []sqlds.ColumnDef
+
+	// UsesSizeColumn stores the size of the values in a size INTEGER column
+	// so that GetSize does not have to detoast compressed values, the table
+	// must have the column, see AddSizeColumn.
+	UsesSizeColumn bool
+
+	// Migrations are applied in order by Create to bring the table schema
+	// up to date, the schema version is stored in the schema_version table.
+	Migrations []sqlds.Migration
+
+	// EnableNotifications makes Create install a trigger notifying the
+	// changes of the table, needed by ExtendedDatastore.Watch.
+	EnableNotifications bool
+
+	// EnableJSONIndex makes Create add the meta jsonb column and its GIN
+	// index used by sqlds.IndexedDatastore with NewIndexQueries.
+	EnableJSONIndex bool
+
+	// ReadOnly makes the write operations fail with sqlds.ErrReadOnly and
+	// sets every session to read only transactions, migrations are not
+	// applied.
+	ReadOnly bool
+
+	// ReadOnlyIsolation is the isolation level of the read-only
+	// transactions of NewTransaction, REPEATABLE READ by default so that
+	// their reads see a single snapshot of the database, see
+	// sqlds.WithReadOnlyIsolation.
+	ReadOnlyIsolation sql.IsolationLevel
+
+	// HashKeys makes Create create the table with the SHA-256 hash of the
+	// keys as its primary key and the keys in a unique key column, rows
+	// being looked up by hash with NewHashedQueries. The index entries of
+	// the primary key have a fixed width, but the key column keeps a
+	// variable width index for prefix queries.
+	HashKeys bool
+
+	// TrackCreatedAt makes Create create the table with a created_at column
+	// holding the insertion time of the rows, so that queries can be
+	// ordered with sqlds.OrderByCreatedAt. Existing tables need the column.
+	TrackCreatedAt bool
+
+	// UsesChecksumColumn makes Create create the table with a checksum
+	// column holding the SHA-256 checksums of the values written by
+	// sqlds.Datastore.PutWithChecksum, verified by Get. The other writes
+	// clear the checksum. Existing tables need the AddChecksumColumn
+	// migration.
+	UsesChecksumColumn bool
+
+	// LogQueryPlans logs the plan of the statements before running them,
+	// with EXPLAIN ANALYZE in a transaction rolled back, in binaries built
+	// with the debug build tag, see sqlds.WithQueryPlans.
+	LogQueryPlans bool
+
+	// CursorFetchSize makes the queries read their rows from a server-side
+	// cursor, this many rows at a time, rather than buffering the whole
+	// result set, see sqlds.WithCursor.
+	CursorFetchSize int
+
+	// Replicas are the read replicas of the database, used by
+	// CreateReplicated.
+	Replicas []ReplicaOptions
 }
 
 // Queries are the postgres queries for a given table.
 type Queries struct {
-	deleteQuery  string
-	existsQuery  string
-	getQuery     string
-	putQuery     string
-	queryQuery   string
-	prefixQuery  string
-	limitQuery   string
-	offsetQuery  string
-	getSizeQuery string
+	deleteQuery       string
+	existsQuery       string
+	getQuery          string
+	putQuery          string
+	queryQuery        string
+	queryExpiryQuery  string
+	querySizesQuery   string
+	queryKeysQuery    string
+	prefixQuery       string
+	patternQuery      string
+	limitQuery        string
+	offsetQuery       string
+	getSizeQuery      string
+	countQuery        string
+	estimateQuery     string
+	getForUpdateQuery string
+	deletePrefixQuery string
+	queryPageQuery    string
+	putWithSizeQuery  string
+	sizeColumnQuery   string
+	deleteManyQuery   string
+	getManyQuery      string
+	putIfAbsentQuery  string
+	namespacesQuery   string
+	vacuumQuery       string
+	statQuery         string
+	tableStatsQuery   string
+	diskUsageQuery    string
+	tableSchemaQuery  string
+	columnsQuery      string
+	explainQuery      string
+	zeroValueQuery    string
+
+	disableAutovacuumQuery string
+	enableAutovacuumQuery  string
+
+	orderByCreatedAtQuery     string
+	orderByCreatedAtDescQuery string
+	setChecksumQuery          string
+	getChecksumQuery          string
+	queryChecksumsQuery       string
+}
+
+// tableColumns are the columns of the tables of NewQueries, and
+// hashedTableColumns those of the tables of NewHashedQueries.
+var (
+	tableColumns       = []string{"key TEXT PRIMARY KEY", "data BYTEA"}
+	hashedTableColumns = []string{"hash BYTEA PRIMARY KEY", "key TEXT NOT NULL UNIQUE", "data BYTEA"}
+)
+
+// createdAtColumn is the column of the tables of Options.TrackCreatedAt, and
+// checksumColumn that of Options.UsesChecksumColumn.
+const (
+	createdAtColumn = "created_at TIMESTAMPTZ DEFAULT NOW()"
+	checksumColumn  = "checksum BYTEA"
+)
+
+// tableSchema returns the statement creating tbl with columns if it does not
+// exist.
+func tableSchema(tbl string, columns []string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", tbl, strings.Join(columns, ", "))
 }
 
 // NewQueries creates a new PostgreSQL set of queries for the passed table
 func NewQueries(tbl string) Queries {
 	return Queries{
-		deleteQuery:  fmt.Sprintf("DELETE FROM %s WHERE key = $1", tbl),
-		existsQuery:  fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE key=$1)", tbl),
-		getQuery:     fmt.Sprintf("SELECT data FROM %s WHERE key = $1", tbl),
-		putQuery:     fmt.Sprintf("INSERT INTO %s (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = $2", tbl),
-		queryQuery:   fmt.Sprintf("SELECT key, data FROM %s", tbl),
-		prefixQuery:  ` WHERE key LIKE '%s%%' ORDER BY key`,
-		limitQuery:   ` LIMIT %d`,
-		offsetQuery:  ` OFFSET %d`,
-		getSizeQuery: fmt.Sprintf("SELECT octet_length(data) FROM %s WHERE key = $1", tbl),
+		deleteQuery:       fmt.Sprintf("DELETE FROM %s WHERE key = $1", tbl),
+		existsQuery:       fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE key=$1)", tbl),
+		getQuery:          fmt.Sprintf("SELECT data FROM %s WHERE key = $1", tbl),
+		putQuery:          fmt.Sprintf("INSERT INTO %s (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = excluded.data", tbl),
+		queryQuery:        fmt.Sprintf("SELECT key, data FROM %s", tbl),
+		queryExpiryQuery:  fmt.Sprintf("SELECT key, data, expires_at FROM %s", tbl),
+		querySizesQuery:   fmt.Sprintf("SELECT key, octet_length(data) FROM %s", tbl),
+		queryKeysQuery:    fmt.Sprintf("SELECT key FROM %s", tbl),
+		prefixQuery:       `key LIKE %s`,
+		patternQuery:      ` WHERE key LIKE $1 ORDER BY key`,
+		limitQuery:        ` LIMIT %s`,
+		offsetQuery:       ` OFFSET %s`,
+		getSizeQuery:      fmt.Sprintf("SELECT octet_length(data) FROM %s WHERE key = $1", tbl),
+		countQuery:        `SELECT count(*) FROM (%s) AS q`,
+		deletePrefixQuery: fmt.Sprintf("DELETE FROM %s WHERE key LIKE $1", tbl),
+		queryPageQuery:    fmt.Sprintf(`SELECT key, data FROM %s WHERE key COLLATE "C" > $1 ORDER BY key COLLATE "C" LIMIT $2`, tbl),
+		putWithSizeQuery:  fmt.Sprintf("INSERT INTO %s (key, data, size) VALUES ($1, $2, octet_length($2::bytea)) ON CONFLICT (key) DO UPDATE SET data = excluded.data, size = excluded.size", tbl),
+		sizeColumnQuery:   fmt.Sprintf("SELECT coalesce(size, octet_length(data)) FROM %s WHERE key = $1", tbl),
+		deleteManyQuery:   fmt.Sprintf("DELETE FROM %s WHERE key IN (%%s)", tbl),
+		getManyQuery:      fmt.Sprintf("SELECT key, data FROM %s WHERE key IN (%%s)", tbl),
+		putIfAbsentQuery:  fmt.Sprintf("INSERT INTO %s (key, data) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING", tbl),
+		namespacesQuery:   fmt.Sprintf("SELECT DISTINCT '/' || split_part(key, '/', 2) FROM %s WHERE position('/' in substr(key, 2)) > 0 ORDER BY 1", tbl),
+		vacuumQuery:       fmt.Sprintf("VACUUM ANALYZE %s", tbl),
+		statQuery:         fmt.Sprintf("SELECT count(*), coalesce(sum(octet_length(data)), 0), coalesce(min(octet_length(data)), 0), coalesce(max(octet_length(data)), 0) FROM %s", tbl),
+		estimateQuery:     fmt.Sprintf("SELECT reltuples::bigint FROM pg_class WHERE oid = '%s'::regclass", tbl),
+		tableStatsQuery:   fmt.Sprintf("SELECT n_live_tup, n_dead_tup, last_autovacuum FROM pg_stat_user_tables WHERE relid = '%s'::regclass", tbl),
+		diskUsageQuery:    fmt.Sprintf("SELECT pg_total_relation_size('%s')", tbl),
+		getForUpdateQuery: fmt.Sprintf("SELECT data FROM %s WHERE key = $1 FOR UPDATE", tbl),
+		tableSchemaQuery:  tableSchema(tbl, tableColumns),
+		columnsQuery:      fmt.Sprintf("SELECT a.attname, format_type(a.atttypid, a.atttypmod), EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = a.attrelid AND i.indisunique AND i.indnatts = 1 AND i.indkey[0] = a.attnum) FROM pg_attribute a WHERE a.attrelid = to_regclass('%s') AND a.attnum > 0 AND NOT a.attisdropped", tbl),
+		explainQuery:      "EXPLAIN (ANALYZE, FORMAT JSON) %s",
+		zeroValueQuery:    fmt.Sprintf("UPDATE %s SET data = decode(repeat('00', octet_length(data)), 'hex') WHERE key = $1", tbl),
+
+		disableAutovacuumQuery: fmt.Sprintf("ALTER TABLE %s SET (autovacuum_enabled = false)", tbl),
+		enableAutovacuumQuery:  fmt.Sprintf("ALTER TABLE %s RESET (autovacuum_enabled)", tbl),
 	}
 }
 
+// NewHashedQueries creates a new PostgreSQL set of queries for the passed
+// table whose primary key is the SHA-256 hash of the keys, see
+// Options.HashKeys.
+func NewHashedQueries(tbl string) Queries {
+	q := NewQueries(tbl)
+	q.deleteQuery = fmt.Sprintf("DELETE FROM %s WHERE hash = $1", tbl)
+	q.existsQuery = fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE hash = $1)", tbl)
+	q.getQuery = fmt.Sprintf("SELECT data FROM %s WHERE hash = $1", tbl)
+	q.putQuery = fmt.Sprintf("INSERT INTO %s (hash, data, key) VALUES ($1, $2, $3) ON CONFLICT (hash) DO UPDATE SET data = excluded.data", tbl)
+	q.getSizeQuery = fmt.Sprintf("SELECT octet_length(data) FROM %s WHERE hash = $1", tbl)
+	q.putWithSizeQuery = fmt.Sprintf("INSERT INTO %s (hash, data, key, size) VALUES ($1, $2, $3, octet_length($2::bytea)) ON CONFLICT (hash) DO UPDATE SET data = excluded.data, size = excluded.size", tbl)
+	q.sizeColumnQuery = fmt.Sprintf("SELECT coalesce(size, octet_length(data)) FROM %s WHERE hash = $1", tbl)
+	q.deleteManyQuery = fmt.Sprintf("DELETE FROM %s WHERE hash IN (%%s)", tbl)
+	q.getManyQuery = fmt.Sprintf("SELECT key, data FROM %s WHERE hash IN (%%s)", tbl)
+	q.putIfAbsentQuery = fmt.Sprintf("INSERT INTO %s (hash, data, key) VALUES ($1, $2, $3) ON CONFLICT (hash) DO NOTHING", tbl)
+	q.getForUpdateQuery = fmt.Sprintf("SELECT data FROM %s WHERE hash = $1 FOR UPDATE", tbl)
+	q.zeroValueQuery = fmt.Sprintf("UPDATE %s SET data = decode(repeat('00', octet_length(data)), 'hex') WHERE hash = $1", tbl)
+	q.tableSchemaQuery = tableSchema(tbl, hashedTableColumns)
+	return q
+}
+
+// trackCreatedAt sets the queries of q for the created_at column of
+// Options.TrackCreatedAt. The puts leave the column to its default, the
+// insertion time of the rows being kept by the upserts.
+func (q *Queries) trackCreatedAt() {
+	q.orderByCreatedAtQuery = ` ORDER BY created_at ASC, key COLLATE "C" ASC`
+	q.orderByCreatedAtDescQuery = ` ORDER BY created_at DESC, key COLLATE "C" DESC`
+}
+
+// trackChecksums sets the queries of q for tbl with the checksum column of
+// Options.UsesChecksumColumn, hashed being true for the queries of
+// NewHashedQueries. The upserts clear the checksum of the rows.
+func (q *Queries) trackChecksums(tbl string, hashed bool) {
+	keyColumn := "key"
+	if hashed {
+		keyColumn = "hash"
+	}
+	q.putQuery += ", checksum = NULL"
+	q.putWithSizeQuery += ", checksum = NULL"
+	q.setChecksumQuery = fmt.Sprintf("UPDATE %s SET checksum = $2 WHERE %s = $1", tbl, keyColumn)
+	q.getChecksumQuery = fmt.Sprintf("SELECT data, checksum FROM %s WHERE %s = $1", tbl, keyColumn)
+	q.queryChecksumsQuery = fmt.Sprintf("SELECT key, data, checksum FROM %s WHERE checksum IS NOT NULL", tbl)
+}
+
 // Delete returns the postgres query for deleting a row.
 func (q Queries) Delete() string {
 	return q.deleteQuery
@@ -72,17 +278,60 @@ func (q Queries) Query() string {
 	return q.queryQuery
 }
 
-// Prefix returns the postgres query fragment for getting a rows with a key prefix.
+// QueryWithExpiry returns the postgres query for getting multiple rows along with
+// their expiration.
+func (q Queries) QueryWithExpiry() string {
+	return q.queryExpiryQuery
+}
+
+// QueryKeysAndSizes returns the postgres query for getting multiple rows
+// along with the sizes of their values, without the values.
+func (q Queries) QueryKeysAndSizes() string {
+	return q.querySizesQuery
+}
+
+// QueryKeys returns the postgres query for getting the keys of multiple rows,
+// without the values.
+func (q Queries) QueryKeys() string {
+	return q.queryKeysQuery
+}
+
+// Prefix returns the postgres predicate matching the keys with a prefix, given
+// as the parameter formatted into it, see PrefixPattern.
 func (q Queries) Prefix() string {
 	return q.prefixQuery
 }
 
-// Limit returns the postgres query fragment for limiting results.
+// PatternMatch returns the postgres query fragment for matching the keys
+// with a LIKE pattern, given as a parameter.
+func (q Queries) PatternMatch() string {
+	return q.patternQuery
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns with the default escape
+// character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// EscapePattern returns s with the LIKE wildcards escaped, so that the
+// DeletePrefix pattern matches it literally.
+func (q Queries) EscapePattern(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// PrefixPattern returns the LIKE pattern matching the keys starting with
+// prefix, bound to the parameter of the Prefix fragment.
+func (q Queries) PrefixPattern(prefix string) string {
+	return likeEscaper.Replace(prefix) + "%"
+}
+
+// Limit returns the postgres query fragment for limiting results, given as the
+// parameter formatted into it.
 func (q Queries) Limit() string {
 	return q.limitQuery
 }
 
-// Offset returns the postgres query fragment for returning rows from a given offset.
+// Offset returns the postgres query fragment for returning rows from a given
+// offset, given as the parameter formatted into it.
 func (q Queries) Offset() string {
 	return q.offsetQuery
 }
@@ -92,17 +341,376 @@ func (q Queries) GetSize() string {
 	return q.getSizeQuery
 }
 
+// Count returns the postgres query for counting the rows returned by a query, %s
+// being replaced by the query.
+func (q Queries) Count() string {
+	return q.countQuery
+}
+
+// GetForUpdate returns the postgres query for getting a row in a transaction locking it until the end of the transaction.
+func (q Queries) GetForUpdate() string {
+	return q.getForUpdateQuery
+}
+
+// DeletePrefix returns the postgres query for deleting the rows whose key
+// matches the PrefixPattern parameter.
+func (q Queries) DeletePrefix() string {
+	return q.deletePrefixQuery
+}
+
+// QueryPage returns the postgres query for getting a page of rows after a cursor key.
+func (q Queries) QueryPage() string {
+	return q.queryPageQuery
+}
+
+// PutWithSize returns the postgres query for putting a row and the size of its value.
+func (q Queries) PutWithSize() string {
+	return q.putWithSizeQuery
+}
+
+// GetSizeFromColumn returns the postgres query for getting the size of a value
+// from the size column.
+func (q Queries) GetSizeFromColumn() string {
+	return q.sizeColumnQuery
+}
+
+// OrderByValue returns the postgres query fragment for ordering rows by value,
+// ties being ordered by key.
+func (q Queries) OrderByValue(desc bool) string {
+	if desc {
+		return ` ORDER BY data DESC, key DESC`
+	}
+	return ` ORDER BY data ASC, key ASC`
+}
+
+// OrderByKey returns the postgres query fragment for ordering rows by key,
+// with the C collation so that keys sort byte-wise like go-datastore whatever
+// the collation of the database.
+func (q Queries) OrderByKey(desc bool) string {
+	if desc {
+		return ` ORDER BY key COLLATE "C" DESC`
+	}
+	return ` ORDER BY key COLLATE "C" ASC`
+}
+
+// KeyCompare returns the postgres predicate comparing the keys to the
+// parameter formatted into it with op, with the C collation so that keys
+// compare byte-wise like go-datastore, or an empty string for unknown
+// operators.
+func (q Queries) KeyCompare(op dsq.Op) string {
+	switch op {
+	case dsq.Equal, dsq.NotEqual, dsq.GreaterThan, dsq.GreaterThanOrEqual, dsq.LessThan, dsq.LessThanOrEqual:
+		return `key COLLATE "C" ` + string(op) + ` %s`
+	}
+	return ""
+}
+
+// OrderByCreatedAt returns the postgres query fragment for ordering rows by
+// insertion time, oldest first, empty unless the table has the created_at
+// column of Options.TrackCreatedAt.
+func (q Queries) OrderByCreatedAt() string {
+	return q.orderByCreatedAtQuery
+}
+
+// OrderByCreatedAtDesc returns the postgres query fragment for ordering rows
+// by insertion time, newest first, empty unless the table has the created_at
+// column of Options.TrackCreatedAt.
+func (q Queries) OrderByCreatedAtDesc() string {
+	return q.orderByCreatedAtDescQuery
+}
+
+// SetChecksum returns the postgres query for setting the checksum of a row,
+// empty unless the table has the checksum column of
+// Options.UsesChecksumColumn.
+func (q Queries) SetChecksum() string {
+	return q.setChecksumQuery
+}
+
+// GetWithChecksum returns the postgres query for getting a row along with
+// its checksum, empty unless the table has the checksum column.
+func (q Queries) GetWithChecksum() string {
+	return q.getChecksumQuery
+}
+
+// QueryChecksums returns the postgres query for getting the rows which have
+// a checksum, empty unless the table has the checksum column.
+func (q Queries) QueryChecksums() string {
+	return q.queryChecksumsQuery
+}
+
+// GetMany returns the postgres query for getting the keys and values of the rows
+// of n keys.
+func (q Queries) GetMany(n int) string {
+	params := make([]string, n)
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return fmt.Sprintf(q.getManyQuery, strings.Join(params, ", "))
+}
+
+// DeleteMany returns the postgres query for deleting the rows of n keys.
+func (q Queries) DeleteMany(n int) string {
+	params := make([]string, n)
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return fmt.Sprintf(q.deleteManyQuery, strings.Join(params, ", "))
+}
+
+// Sync returns the postgres query for flushing writes to durable storage,
+// empty as committed transactions are already durable.
+func (q Queries) Sync() string {
+	return ""
+}
+
+// PutIfAbsent returns the postgres query for inserting a row unless the key exists.
+func (q Queries) PutIfAbsent() string {
+	return q.putIfAbsentQuery
+}
+
+// ListNamespaces returns the postgres query for listing the distinct top-level
+// namespaces of the keys.
+func (q Queries) ListNamespaces() string {
+	return q.namespacesQuery
+}
+
+// Vacuum returns the postgres query for reclaiming the space of deleted rows
+// and updating the statistics of the table.
+func (q Queries) Vacuum() string {
+	return q.vacuumQuery
+}
+
+// Optimize returns no query, the statistics of the table being updated by
+// Vacuum.
+func (q Queries) Optimize() string {
+	return ""
+}
+
+// Capabilities returns the optional SQL features supported by postgres, all of
+// them.
+func (q Queries) Capabilities() sqlds.QueryCapabilities {
+	return sqlds.AllCapabilities
+}
+
+// Stat returns the postgres query for getting the number of rows and the
+// total, minimum and maximum sizes of their values.
+func (q Queries) Stat() string {
+	return q.statQuery
+}
+
+// EstimateCount returns the postgres query for getting the approximate number
+// of rows of the table from pg_class.reltuples, updated by VACUUM and
+// ANALYZE. It is -1 until the table is first analyzed.
+func (q Queries) EstimateCount() string {
+	return q.estimateQuery
+}
+
+// TableStats returns the postgres query for getting the live and dead tuple
+// counts and the last autovacuum time of the table.
+func (q Queries) TableStats() string {
+	return q.tableStatsQuery
+}
+
+// DiskUsage returns the postgres query for getting the size of the table on
+// disk, including its indexes and TOAST data.
+func (q Queries) DiskUsage() string {
+	return q.diskUsageQuery
+}
+
+// SetAutovacuum returns the postgres query for disabling the autovacuum and
+// autoanalyze of the table, or resetting them to the server settings.
+func (q Queries) SetAutovacuum(enabled bool) string {
+	if enabled {
+		return q.enableAutovacuumQuery
+	}
+	return q.disableAutovacuumQuery
+}
+
+// TableSchema returns the postgres statement creating the table if it does
+// not exist.
+func (q Queries) TableSchema() string {
+	return q.tableSchemaQuery
+}
+
+// Columns returns the postgres query for listing the name and type of the
+// columns of the table, and whether each is the only column of a unique
+// index. It returns no rows if the table does not exist.
+func (q Queries) Columns() string {
+	return q.columnsQuery
+}
+
+// Explain returns the postgres query for executing a statement and getting
+// its plan along with the actual row counts and timings.
+func (q Queries) Explain() string {
+	return q.explainQuery
+}
+
+// ZeroValue returns the postgres query for overwriting the value of a row
+// with zeros of the same length.
+func (q Queries) ZeroValue() string {
+	return q.zeroValueQuery
+}
+
+// DeclareCursor returns the postgres statement declaring a cursor, named by
+// the first verb, for the query of the second one.
+func (q Queries) DeclareCursor() string {
+	return `DECLARE %s NO SCROLL CURSOR FOR %s`
+}
+
+// FetchCursor returns the postgres statement fetching the next n rows of the
+// cursor named by its verb.
+func (q Queries) FetchCursor(n int) string {
+	return fmt.Sprintf("FETCH FORWARD %d FROM %%s", n)
+}
+
 // Create returns a datastore connected to postgres
 func (opts *Options) Create() (*sqlds.Datastore, error) {
 	opts.setDefaults()
-	fmtstr := "postgresql:///%s?host=%s&port=%s&user=%s&password=%s&sslmode=disable"
-	constr := fmt.Sprintf(fmtstr, opts.Database, opts.Host, opts.Port, opts.User, opts.Password)
-	db, err := sql.Open("postgres", constr)
+	db, err := sql.Open("postgres", opts.connString())
 	if err != nil {
 		return nil, err
 	}
 
-	return sqlds.NewDatastore(db, NewQueries(opts.Table)), nil
+	if err := opts.setupTable(db, opts.Table); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return sqlds.NewDatastore(db, opts.queries(opts.Table), opts.datastoreOptions()...), nil
+}
+
+// setupTable creates and migrates table as configured by the options.
+func (opts *Options) setupTable(db *sql.DB, table string) error {
+	if opts.ReadOnly {
+		return nil
+	}
+
+	if stmt := opts.createTableSQL(table); stmt != "" {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to ensure table exists: %w", err)
+		}
+	}
+
+	if len(opts.Migrations) != 0 {
+		if err := sqlds.Migrate(db, schemaVersion{table: table}, opts.Migrations); err != nil {
+			return fmt.Errorf("failed to migrate database: %w", err)
+		}
+	}
+
+	if opts.EnableJSONIndex {
+		if err := addMetaColumn(db, table); err != nil {
+			return fmt.Errorf("failed to add the json index: %w", err)
+		}
+	}
+
+	if opts.EnableNotifications {
+		if err := installNotifyTrigger(db, table); err != nil {
+			return fmt.Errorf("failed to install notification trigger: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// datastoreOptions returns the options of the datastores.
+func (opts *Options) datastoreOptions() []sqlds.Option {
+	var dsOpts []sqlds.Option
+	if opts.UsesSizeColumn {
+		dsOpts = append(dsOpts, sqlds.WithSizeColumn())
+	}
+	if opts.ReadOnly {
+		dsOpts = append(dsOpts, sqlds.WithReadOnly())
+	}
+	if opts.HashKeys {
+		dsOpts = append(dsOpts, sqlds.WithHashedKeys())
+	}
+	if opts.LogQueryPlans {
+		dsOpts = append(dsOpts, sqlds.WithQueryPlans())
+	}
+	if opts.CursorFetchSize > 0 {
+		dsOpts = append(dsOpts, sqlds.WithCursor(opts.CursorFetchSize))
+	}
+
+	isolation := opts.ReadOnlyIsolation
+	if isolation == sql.LevelDefault {
+		isolation = sql.LevelRepeatableRead
+	}
+	dsOpts = append(dsOpts, sqlds.WithReadOnlyIsolation(isolation))
+	return dsOpts
+}
+
+// queries returns the queries of the datastore of table.
+func (opts *Options) queries(table string) Queries {
+	q := NewQueries(table)
+	if opts.HashKeys {
+		q = NewHashedQueries(table)
+	}
+	if opts.TrackCreatedAt {
+		q.trackCreatedAt()
+	}
+	if opts.UsesChecksumColumn {
+		q.trackChecksums(table, opts.HashKeys)
+	}
+	q.tableSchemaQuery = tableSchema(table, opts.columns())
+	return q
+}
+
+// columns returns the columns of the tables created by Create.
+func (opts *Options) columns() []string {
+	columns := tableColumns
+	if opts.HashKeys {
+		columns = hashedTableColumns
+	}
+	columns = slices.Clip(columns)
+
+	if opts.UsesSizeColumn {
+		columns = append(columns, "size INTEGER")
+	}
+	for _, c := range opts.ExtraColumns {
+		columns = append(columns, c.String())
+	}
+	if opts.TrackCreatedAt {
+		columns = append(columns, createdAtColumn)
+	}
+	if opts.UsesChecksumColumn {
+		columns = append(columns, checksumColumn)
+	}
+	return columns
+}
+
+// createTableSQL returns the statement creating table, empty if the table
+// is not managed by Create.
+func (opts *Options) createTableSQL(table string) string {
+	if opts.CreateTableSQL != "" {
+		return opts.CreateTableSQL
+	}
+	if len(opts.ExtraColumns) == 0 && !opts.HashKeys && !opts.TrackCreatedAt && !opts.UsesChecksumColumn {
+		return ""
+	}
+	return opts.queries(table).TableSchema()
+}
+
+// connString builds the connection string from the options.
+func (opts *Options) connString() string {
+	fmtstr := "postgresql:///%s?host=%s&port=%s&user=%s&password=%s&sslmode=%s"
+	constr := fmt.Sprintf(fmtstr, opts.Database, opts.Host, opts.Port, opts.User, opts.Password, opts.SSLMode)
+
+	if opts.SSLRootCert != "" {
+		constr += "&sslrootcert=" + url.QueryEscape(opts.SSLRootCert)
+	}
+	if opts.SSLCert != "" {
+		constr += "&sslcert=" + url.QueryEscape(opts.SSLCert)
+	}
+	if opts.SSLKey != "" {
+		constr += "&sslkey=" + url.QueryEscape(opts.SSLKey)
+	}
+	if opts.ReadOnly {
+		// same as SET SESSION CHARACTERISTICS AS TRANSACTION READ ONLY on
+		// every connection of the pool
+		constr += "&default_transaction_read_only=on"
+	}
+
+	return constr
 }
 
 func (opts *Options) setDefaults() {
@@ -122,7 +730,11 @@ func (opts *Options) setDefaults() {
 		opts.Database = "datastore"
 	}
 
-	if opts.Table == "" {
+	if opts.Table == "" && len(opts.Tables) == 0 {
 		opts.Table = "blocks"
 	}
+
+	if opts.SSLMode == "" {
+		opts.SSLMode = "disable"
+	}
 }
@@ -0,0 +1,194 @@
+package postgres
+
+import (
+	"strings"
+	"testing"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+func TestConnStringSSL(t *testing.T) {
+	opts := &Options{}
+	opts.setDefaults()
+	if !strings.Contains(opts.connString(), "sslmode=disable") {
+		t.Fatalf("expected sslmode to default to disable: %s", opts.connString())
+	}
+	if strings.Contains(opts.connString(), "sslrootcert") {
+		t.Fatalf("unexpected sslrootcert: %s", opts.connString())
+	}
+
+	opts = &Options{
+		SSLMode:     "verify-full",
+		SSLRootCert: "/etc/ssl/ca.pem",
+		SSLCert:     "/etc/ssl/client.pem",
+		SSLKey:      "/etc/ssl/client key.pem",
+	}
+	opts.setDefaults()
+	constr := opts.connString()
+	for _, s := range []string{
+		"sslmode=verify-full",
+		"sslrootcert=%2Fetc%2Fssl%2Fca.pem",
+		"sslcert=%2Fetc%2Fssl%2Fclient.pem",
+		"sslkey=%2Fetc%2Fssl%2Fclient+key.pem",
+	} {
+		if !strings.Contains(constr, s) {
+			t.Errorf("expected %q in %s", s, constr)
+		}
+	}
+}
+
+func TestConnStringReadOnly(t *testing.T) {
+	opts := &Options{}
+	opts.setDefaults()
+	if strings.Contains(opts.connString(), "default_transaction_read_only") {
+		t.Fatalf("unexpected read only session: %s", opts.connString())
+	}
+
+	opts = &Options{ReadOnly: true}
+	opts.setDefaults()
+	if !strings.Contains(opts.connString(), "default_transaction_read_only=on") {
+		t.Fatalf("expected read only session: %s", opts.connString())
+	}
+}
+
+func TestCreateTableSQL(t *testing.T) {
+	opts := &Options{}
+	opts.setDefaults()
+	if stmt := opts.createTableSQL(opts.Table); stmt != "" {
+		t.Fatalf("unexpected create table statement: %s", stmt)
+	}
+
+	opts = &Options{
+		UsesSizeColumn: true,
+		ExtraColumns:   []sqlds.ColumnDef{{Name: "created_at", Type: "TIMESTAMPTZ", Default: "now()"}},
+	}
+	opts.setDefaults()
+	expected := "CREATE TABLE IF NOT EXISTS blocks (key TEXT PRIMARY KEY, data BYTEA, size INTEGER, created_at TIMESTAMPTZ DEFAULT now())"
+	if stmt := opts.createTableSQL(opts.Table); stmt != expected {
+		t.Fatalf("expected %s, got %s", expected, stmt)
+	}
+
+	opts = &Options{HashKeys: true}
+	opts.setDefaults()
+	expected = "CREATE TABLE IF NOT EXISTS blocks (hash BYTEA PRIMARY KEY, key TEXT NOT NULL UNIQUE, data BYTEA)"
+	if stmt := opts.createTableSQL(opts.Table); stmt != expected {
+		t.Fatalf("expected %s, got %s", expected, stmt)
+	}
+
+	opts.CreateTableSQL = "CREATE TABLE custom (key TEXT PRIMARY KEY, data BYTEA)"
+	if stmt := opts.createTableSQL(opts.Table); stmt != opts.CreateTableSQL {
+		t.Fatalf("expected %s, got %s", opts.CreateTableSQL, stmt)
+	}
+}
+
+func TestTableSchema(t *testing.T) {
+	for q, expected := range map[sqlds.Queries]string{
+		NewQueries("blocks"):           "CREATE TABLE IF NOT EXISTS blocks (key TEXT PRIMARY KEY, data BYTEA)",
+		NewHashedQueries("blocks"):     "CREATE TABLE IF NOT EXISTS blocks (hash BYTEA PRIMARY KEY, key TEXT NOT NULL UNIQUE, data BYTEA)",
+		NewSoftDeleteQueries("blocks"): "CREATE TABLE IF NOT EXISTS blocks (key TEXT PRIMARY KEY, data BYTEA, deleted_at TIMESTAMPTZ)",
+	} {
+		if stmt := q.TableSchema(); stmt != expected {
+			t.Fatalf("expected %s, got %s", expected, stmt)
+		}
+	}
+
+	opts := &Options{TrackCreatedAt: true}
+	expected := "CREATE TABLE IF NOT EXISTS blocks (key TEXT PRIMARY KEY, data BYTEA, created_at TIMESTAMPTZ DEFAULT NOW())"
+	if stmt := opts.createTableSQL("blocks"); stmt != expected {
+		t.Fatalf("expected %s, got %s", expected, stmt)
+	}
+	opts.UsesSizeColumn = true
+	expected = "CREATE TABLE IF NOT EXISTS blocks (key TEXT PRIMARY KEY, data BYTEA, size INTEGER, created_at TIMESTAMPTZ DEFAULT NOW())"
+	if stmt := opts.createTableSQL("blocks"); stmt != expected {
+		t.Fatalf("expected %s, got %s", expected, stmt)
+	}
+
+	opts = &Options{HashKeys: true, UsesChecksumColumn: true}
+	expected = "CREATE TABLE IF NOT EXISTS blocks (hash BYTEA PRIMARY KEY, key TEXT NOT NULL UNIQUE, data BYTEA, checksum BYTEA)"
+	if stmt := opts.createTableSQL("blocks"); stmt != expected {
+		t.Fatalf("expected %s, got %s", expected, stmt)
+	}
+	// the upserts clear the checksums
+	if q := opts.queries("blocks").Put(); !strings.HasSuffix(q, "SET data = excluded.data, checksum = NULL") {
+		t.Fatalf("expected the put query to clear the checksum, got %s", q)
+	}
+}
+
+func TestCopyMergeQuery(t *testing.T) {
+	for opts, expected := range map[*Options]string{
+		{}: "INSERT INTO blocks (key, data) SELECT DISTINCT ON (key) key, data FROM blocks_copy ORDER BY key, seq DESC ON CONFLICT (key) DO UPDATE SET data = excluded.data",
+		{HashKeys: true, UsesSizeColumn: true, UsesChecksumColumn: true}: "INSERT INTO blocks (key, data, hash, size) SELECT DISTINCT ON (key) key, data, sha256(convert_to(key, 'UTF8')), octet_length(data) FROM blocks_copy ORDER BY key, seq DESC ON CONFLICT (hash) DO UPDATE SET data = excluded.data, size = excluded.size, checksum = NULL",
+	} {
+		if stmt := opts.copyMergeQuery("blocks"); stmt != expected {
+			t.Fatalf("expected %s, got %s", expected, stmt)
+		}
+	}
+}
+
+func TestParseNotification(t *testing.T) {
+	ev, err := parseNotification(`{"key": "/a/b", "op": "UPDATE"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Key.String() != "/a/b" || ev.Operation != sqlds.WatchPut {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	ev, err = parseNotification(`{"key": "/a", "op": "DELETE"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Key.String() != "/a" || ev.Operation != sqlds.WatchDelete {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	if _, err := parseNotification("not json"); err == nil {
+		t.Fatal("expected an error for an invalid payload")
+	}
+}
+
+func TestCreateMultiOptions(t *testing.T) {
+	if _, err := (&Options{}).CreateMulti(); err == nil {
+		t.Fatal("expected an error without tables")
+	}
+	if _, err := (&Options{Table: "blocks", Tables: []string{"pins"}}).CreateMulti(); err == nil {
+		t.Fatal("expected an error with both Table and Tables")
+	}
+
+	// the database is opened lazily
+	md, err := (&Options{Tables: []string{"blocks", "pins"}}).CreateMulti()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins, err := md.Shard("pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := md.Shard("providers"); err == nil {
+		t.Fatal("expected an error for an unknown table")
+	}
+
+	// closing a shard leaves the shared database open
+	if err := pins.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := md.DB().Ping(); err != nil && strings.Contains(err.Error(), "database is closed") {
+		t.Fatal("closing a shard closed the database")
+	}
+	if err := md.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := md.DB().Ping(); err == nil || !strings.Contains(err.Error(), "database is closed") {
+		t.Fatalf("expected the database to be closed, got %v", err)
+	}
+}
+
+func TestEscapePattern(t *testing.T) {
+	q := NewQueries("blocks")
+	if s := q.EscapePattern(`/a_b%c\d/`); s != `/a\_b\%c\\d/` {
+		t.Fatalf("unexpected escaped pattern %s", s)
+	}
+	if s := q.PrefixPattern(`/a_b/`); s != `/a\_b/%` {
+		t.Fatalf("unexpected prefix pattern %s", s)
+	}
+}
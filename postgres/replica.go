@@ -0,0 +1,61 @@
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// ReplicaOptions are the connection options of a read replica, the other
+// connection options being those of the primary.
+type ReplicaOptions struct {
+	Host string
+	// Port defaults to the port of the primary.
+	Port string
+}
+
+// CreateReplicated returns a datastore writing to the primary and reading
+// from Options.Replicas, whose connections are read only. The table is
+// created and migrated on the primary like by Create.
+func (opts *Options) CreateReplicated() (*sqlds.ReplicaDatastore, error) {
+	if len(opts.Replicas) == 0 {
+		return nil, errors.New("no replicas")
+	}
+
+	opts.setDefaults()
+	primary, err := sql.Open("postgres", opts.connString())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opts.setupTable(primary, opts.Table); err != nil {
+		_ = primary.Close()
+		return nil, err
+	}
+
+	var replicas []*sql.DB
+	closeAll := func() {
+		for _, db := range replicas {
+			_ = db.Close()
+		}
+		_ = primary.Close()
+	}
+	for _, r := range opts.Replicas {
+		ropts := *opts
+		ropts.Host = r.Host
+		if r.Port != "" {
+			ropts.Port = r.Port
+		}
+		ropts.ReadOnly = true
+
+		db, err := sql.Open("postgres", ropts.connString())
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		replicas = append(replicas, db)
+	}
+
+	return sqlds.NewReplicaDatastore(primary, replicas, opts.queries(opts.Table), opts.datastoreOptions()...), nil
+}
@@ -0,0 +1,73 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// SoftDeleteQueries are the postgres queries of a soft delete datastore for a
+// given table.
+type SoftDeleteQueries struct {
+	Queries
+
+	undeleteQuery string
+	purgeQuery    string
+}
+
+// NewSoftDeleteQueries creates a new PostgreSQL set of soft delete queries
+// for the passed table, which needs a deleted_at column (see
+// AddDeletedAtColumn).
+func NewSoftDeleteQueries(tbl string) SoftDeleteQueries {
+	// reads only see the rows which are not deleted
+	q := NewQueries(fmt.Sprintf("(SELECT * FROM %s WHERE deleted_at IS NULL) AS %s", tbl, tbl))
+
+	q.putQuery = fmt.Sprintf("INSERT INTO %s (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = excluded.data, deleted_at = NULL", tbl)
+	q.putWithSizeQuery = fmt.Sprintf("INSERT INTO %s (key, data, size) VALUES ($1, $2, octet_length($2::bytea)) ON CONFLICT (key) DO UPDATE SET data = excluded.data, size = excluded.size, deleted_at = NULL", tbl)
+	// a deleted row is absent
+	q.putIfAbsentQuery = fmt.Sprintf("INSERT INTO %s AS t (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = $2, deleted_at = NULL WHERE t.deleted_at IS NOT NULL", tbl)
+	// the value of a securely deleted row is zeroed before it is marked
+	q.zeroValueQuery = NewQueries(tbl).zeroValueQuery
+
+	q.vacuumQuery = fmt.Sprintf("VACUUM ANALYZE %s", tbl)
+	q.tableStatsQuery = NewQueries(tbl).tableStatsQuery
+	q.diskUsageQuery = NewQueries(tbl).diskUsageQuery
+	q.columnsQuery = NewQueries(tbl).columnsQuery
+	// the statistics of the table count the deleted rows
+	q.estimateQuery = ""
+	q.tableSchemaQuery = tableSchema(tbl, append(slices.Clip(tableColumns), "deleted_at TIMESTAMPTZ"))
+
+	q.deleteQuery = fmt.Sprintf("UPDATE %s SET deleted_at = now() WHERE key = $1 AND deleted_at IS NULL", tbl)
+	q.deletePrefixQuery = fmt.Sprintf("UPDATE %s SET deleted_at = now() WHERE key LIKE $1 AND deleted_at IS NULL", tbl)
+	q.deleteManyQuery = fmt.Sprintf("UPDATE %s SET deleted_at = now() WHERE deleted_at IS NULL AND key IN (%%s)", tbl)
+
+	return SoftDeleteQueries{
+		Queries:       q,
+		undeleteQuery: fmt.Sprintf("UPDATE %s SET deleted_at = NULL WHERE key = $1 AND deleted_at IS NOT NULL", tbl),
+		purgeQuery:    fmt.Sprintf("DELETE FROM %s WHERE deleted_at <= now() - make_interval(secs => $1)", tbl),
+	}
+}
+
+// Undelete returns the postgres query for restoring a deleted row.
+func (q SoftDeleteQueries) Undelete() string {
+	return q.undeleteQuery
+}
+
+// Purge returns the postgres query for removing the rows deleted a given
+// number of seconds ago.
+func (q SoftDeleteQueries) Purge() string {
+	return q.purgeQuery
+}
+
+// AddDeletedAtColumn returns a migration adding the deleted_at column used by
+// soft delete datastores to the table.
+func AddDeletedAtColumn(table string) sqlds.Migration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ", table))
+		return err
+	}
+}
+
+var _ sqlds.SoftDeleteQueries = SoftDeleteQueries{}
@@ -0,0 +1,92 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// TTLQueries are the postgres queries of a TTL datastore for a given table.
+type TTLQueries struct {
+	Queries
+
+	putWithTTLQuery    string
+	setTTLQuery        string
+	getExpirationQuery string
+	deleteExpiredQuery string
+}
+
+// liveRows is the condition of the rows which have not expired.
+const liveRows = "(expires_at IS NULL OR expires_at > now())"
+
+// NewTTLQueries creates a new PostgreSQL set of TTL queries for the passed
+// table, which needs an expires_at column (see AddExpiresAtColumn).
+func NewTTLQueries(tbl string) TTLQueries {
+	// reads only see the rows which have not expired
+	live := fmt.Sprintf("(SELECT * FROM %s WHERE %s) AS %s", tbl, liveRows, tbl)
+	q := NewQueries(live)
+	w := NewQueries(tbl)
+
+	q.putQuery = fmt.Sprintf("INSERT INTO %s (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = excluded.data, expires_at = NULL", tbl)
+	q.putWithSizeQuery = fmt.Sprintf("INSERT INTO %s (key, data, size) VALUES ($1, $2, octet_length($2::bytea)) ON CONFLICT (key) DO UPDATE SET data = excluded.data, size = excluded.size, expires_at = NULL", tbl)
+	// an expired row is absent
+	q.putIfAbsentQuery = fmt.Sprintf("INSERT INTO %s AS t (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = excluded.data, expires_at = NULL WHERE t.expires_at <= now()", tbl)
+	q.zeroValueQuery = w.zeroValueQuery
+
+	q.vacuumQuery = w.vacuumQuery
+	q.tableStatsQuery = w.tableStatsQuery
+	q.diskUsageQuery = w.diskUsageQuery
+	q.columnsQuery = w.columnsQuery
+	// the statistics of the table count the expired rows
+	q.estimateQuery = ""
+	q.tableSchemaQuery = tableSchema(tbl, append(slices.Clip(tableColumns), "expires_at TIMESTAMPTZ"))
+
+	// the expired rows are deleted along with the live ones
+	q.deleteQuery = w.deleteQuery
+	q.deletePrefixQuery = w.deletePrefixQuery
+	q.deleteManyQuery = w.deleteManyQuery
+
+	return TTLQueries{
+		Queries:            q,
+		putWithTTLQuery:    fmt.Sprintf("INSERT INTO %s (key, data, expires_at) VALUES ($1, $2, $3) ON CONFLICT (key) DO UPDATE SET data = excluded.data, expires_at = excluded.expires_at", tbl),
+		setTTLQuery:        fmt.Sprintf("UPDATE %s SET expires_at = $2 WHERE key = $1 AND %s", tbl, liveRows),
+		getExpirationQuery: fmt.Sprintf("SELECT expires_at FROM %s WHERE key = $1", live),
+		deleteExpiredQuery: fmt.Sprintf("DELETE FROM %[1]s WHERE key IN (SELECT key FROM %[1]s WHERE expires_at <= now() LIMIT $1 FOR UPDATE SKIP LOCKED)", tbl),
+	}
+}
+
+// PutWithTTL returns the postgres query for upserting a row with an
+// expiration.
+func (q TTLQueries) PutWithTTL() string {
+	return q.putWithTTLQuery
+}
+
+// SetTTL returns the postgres query for setting the expiration of a live row.
+func (q TTLQueries) SetTTL() string {
+	return q.setTTLQuery
+}
+
+// GetExpiration returns the postgres query for getting the expiration of a
+// live row.
+func (q TTLQueries) GetExpiration() string {
+	return q.getExpirationQuery
+}
+
+// DeleteExpired returns the postgres query for removing a given number of
+// expired rows, skipping those locked by concurrent sweeps.
+func (q TTLQueries) DeleteExpired() string {
+	return q.deleteExpiredQuery
+}
+
+// AddExpiresAtColumn returns a migration adding the expires_at column used by
+// TTL datastores to the table, unless it already exists.
+func AddExpiresAtColumn(table string) sqlds.Migration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ", table))
+		return err
+	}
+}
+
+var _ sqlds.TTLQueries = TTLQueries{}
@@ -0,0 +1,83 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// ReplicaDatastore is a datastore writing to a primary database and serving
+// Get, Has, GetSize and Query from read replicas of it, chosen in turn.
+//
+// The replicas may lag behind the primary, a value just written may not be
+// readable yet. Batches and transactions, including their reads, always use
+// the primary.
+type ReplicaDatastore struct {
+	*Datastore
+
+	replicas []*Datastore
+	next     atomic.Uint64
+}
+
+// NewReplicaDatastore returns a datastore writing to primary and reading from
+// replicas, reading from primary when there are no replicas. The options
+// apply to the datastores of every database, those of the replicas being
+// read-only.
+func NewReplicaDatastore(primary *sql.DB, replicas []*sql.DB, queries Queries, opts ...Option) *ReplicaDatastore {
+	rd := &ReplicaDatastore{Datastore: NewDatastore(primary, queries, opts...)}
+
+	replicaOpts := append(opts[:len(opts):len(opts)], WithReadOnly())
+	for _, db := range replicas {
+		rd.replicas = append(rd.replicas, NewDatastore(db, queries, replicaOpts...))
+	}
+	return rd
+}
+
+// Primary returns the datastore of the primary database.
+func (rd *ReplicaDatastore) Primary() *Datastore {
+	return rd.Datastore
+}
+
+// replica returns the datastore serving the next read.
+func (rd *ReplicaDatastore) replica() *Datastore {
+	if len(rd.replicas) == 0 {
+		return rd.Datastore
+	}
+	return rd.replicas[(rd.next.Add(1)-1)%uint64(len(rd.replicas))]
+}
+
+// Get retrieves the value of the given key from a replica.
+func (rd *ReplicaDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	return rd.replica().Get(ctx, key)
+}
+
+// Has determines if a value for the given key exists in a replica.
+func (rd *ReplicaDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return rd.replica().Has(ctx, key)
+}
+
+// GetSize returns the size of the value of the given key in a replica.
+func (rd *ReplicaDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	return rd.replica().GetSize(ctx, key)
+}
+
+// Query returns the entries of a replica matching the query.
+func (rd *ReplicaDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	return rd.replica().Query(ctx, q)
+}
+
+// Close closes the replicas and the primary database.
+func (rd *ReplicaDatastore) Close() error {
+	var errs []error
+	for _, r := range rd.replicas {
+		errs = append(errs, r.Close())
+	}
+	errs = append(errs, rd.Datastore.Close())
+	return errors.Join(errs...)
+}
+
+var _ ds.Batching = (*ReplicaDatastore)(nil)
@@ -0,0 +1,225 @@
+package sqlds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// copyBatchSize is the number of entries put per batch by CopyTo.
+const copyBatchSize = 1000
+
+// replicatedOp is a write to apply to the replica.
+type replicatedOp struct {
+	key    ds.Key
+	value  []byte
+	delete bool
+}
+
+// replication applies the writes of a datastore to its replica, in the order
+// they were queued, see CopyTo.
+type replication struct {
+	dst    ds.Datastore
+	filter func(ds.Key) bool
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	queue  []replicatedOp
+	closed bool
+	// wake is signaled when ops are queued or the replication is closed
+	wake chan struct{}
+	// copied is closed once the copy is done, successful or not
+	copied  chan struct{}
+	done    chan struct{}
+	pending atomic.Int64
+}
+
+// CopyTo puts every entry of the datastore whose key passes filter, all of
+// them if filter is nil, into dst with its Batch if it is a ds.Batching, then
+// keeps dst in sync: the subsequent Put, Delete, PutMany, DeleteMany,
+// PutIfAbsent, CompareAndSwap and committed batches of the datastore, and
+// the writes of its indexed and audited wrappers, are applied to dst in the
+// background, see ReplicationLag. The
+// writes made during the copy are applied once it is done.
+//
+// The other writes, such as DeletePrefix or transactions, are not
+// replicated, nor are the writes of other processes. Writes of a key from
+// concurrent goroutines may be applied in a different order. Failures to
+// apply a write are logged at the warning level, with the logger set by
+// WithLogger or the default one, and the write is dropped. A datastore can
+// only be copied once, the replication stops when it is closed, after the
+// pending writes have been applied.
+func (d *Datastore) CopyTo(ctx context.Context, dst ds.Datastore, filter func(ds.Key) bool) error {
+	logger := d.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	r := &replication{
+		dst:    dst,
+		filter: filter,
+		logger: logger,
+		wake:   make(chan struct{}, 1),
+		copied: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	// writes are queued from now on, the copy reading those made before
+	if !d.replication.CompareAndSwap(nil, r) {
+		return errors.New("datastore is already replicated")
+	}
+
+	go r.run()
+
+	err := d.copyTo(ctx, dst, filter)
+	if err != nil {
+		d.replication.CompareAndSwap(r, nil)
+		r.mu.Lock()
+		r.queue = nil
+		r.closed = true
+		r.mu.Unlock()
+	}
+	close(r.copied)
+
+	if err != nil {
+		<-r.done
+	}
+	return err
+}
+
+// copyTo puts the entries of the datastore passing filter into dst.
+func (d *Datastore) copyTo(ctx context.Context, dst ds.Datastore, filter func(ds.Key) bool) error {
+	newBatch := func() (ds.Batch, error) {
+		if b, ok := dst.(ds.Batching); ok {
+			return b.Batch(ctx)
+		}
+		return ds.NewBasicBatch(dst), nil
+	}
+
+	b, err := newBatch()
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	err = d.ForEach(ctx, func(key ds.Key, value []byte) error {
+		if filter != nil && !filter(key) {
+			return nil
+		}
+		// ForEach reuses value for the next row
+		if err := b.Put(ctx, key, bytes.Clone(value)); err != nil {
+			return err
+		}
+		if n++; n%copyBatchSize != 0 {
+			return nil
+		}
+
+		if err := b.Commit(ctx); err != nil {
+			return err
+		}
+		b, err = newBatch()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return b.Commit(ctx)
+}
+
+// ReplicationLag returns the number of writes not applied to the replica of
+// CopyTo yet, 0 if the datastore is not replicated.
+func (d *Datastore) ReplicationLag() int64 {
+	if r := d.replication.Load(); r != nil {
+		return r.pending.Load()
+	}
+	return 0
+}
+
+// replicate queues a write for the replica, if any. The value is copied.
+func (d *Datastore) replicate(key ds.Key, value []byte, delete bool) {
+	if r := d.replication.Load(); r != nil {
+		r.enqueue(key, value, delete)
+	}
+}
+
+// stopReplication stops the replication once the pending writes have been
+// applied.
+func (d *Datastore) stopReplication() {
+	if r := d.replication.Swap(nil); r != nil {
+		r.close()
+	}
+}
+
+// enqueue queues a write unless its key is filtered out.
+func (r *replication) enqueue(key ds.Key, value []byte, delete bool) {
+	if r.filter != nil && !r.filter(key) {
+		return
+	}
+
+	r.mu.Lock()
+	r.queue = append(r.queue, replicatedOp{key: key, value: bytes.Clone(value), delete: delete})
+	r.pending.Add(1)
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run applies the queued writes until the replication is closed and the
+// queue is empty.
+func (r *replication) run() {
+	defer close(r.done)
+	<-r.copied
+
+	ctx := context.Background()
+	for {
+		r.mu.Lock()
+		ops, closed := r.queue, r.closed
+		r.queue = nil
+		r.mu.Unlock()
+
+		if len(ops) == 0 {
+			if closed {
+				return
+			}
+			<-r.wake
+			continue
+		}
+
+		for _, o := range ops {
+			var err error
+			if o.delete {
+				err = r.dst.Delete(ctx, o.key)
+			} else {
+				err = r.dst.Put(ctx, o.key, o.value)
+			}
+			if err != nil {
+				r.logger.LogAttrs(ctx, slog.LevelWarn, "failed to replicate",
+					slog.String("datastore.key", o.key.String()),
+					slog.Any("error", err),
+				)
+			}
+			r.pending.Add(-1)
+		}
+	}
+}
+
+// close stops the replication and waits for the pending writes, and for the
+// copy if it is still running.
+func (r *replication) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	<-r.done
+}
@@ -0,0 +1,195 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"strings"
+	"syscall"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// RetryPolicy configures how RetryDatastore retries failed operations.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an operation,
+	// including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled on every
+	// following retry up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Retryable reports whether the operation should be retried after
+	// failing with err on the given attempt (starting at 1), defaults to
+	// IsTransientError.
+	Retryable func(err error, attempt int) bool
+	// Logger logs the retried errors at the warning level when set.
+	Logger *slog.Logger
+}
+
+// DefaultRetryPolicy makes up to 3 attempts, starting with a 50ms delay.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    time.Second,
+}
+
+// transient PostgreSQL error codes
+var transientSQLStates = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"55P03": true, // lock_not_available
+	"57P01": true, // admin_shutdown
+	"08000": true, // connection_exception
+	"08003": true, // connection_does_not_exist
+	"08006": true, // connection_failure
+}
+
+// IsTransientError reports whether err is a temporary database error worth
+// retrying: bad connections, connection resets, deadlocks, serialization
+// failures and busy or locked SQLite databases.
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		return transientSQLStates[state.SQLState()]
+	}
+
+	// sqlite drivers have no common error type
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") ||
+		strings.Contains(msg, "database table is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY")
+}
+
+// RetryDatastore retries the idempotent operations of the wrapped datastore
+// failing with a transient error. Batches are not retried, a failed batch
+// must be retried as a whole by the caller.
+type RetryDatastore struct {
+	child  ds.Batching
+	policy RetryPolicy
+}
+
+// WithRetry wraps d so that operations are retried according to policy.
+func WithRetry(d ds.Batching, policy RetryPolicy) *RetryDatastore {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = func(err error, _ int) bool {
+			return IsTransientError(err)
+		}
+	}
+	return &RetryDatastore{child: d, policy: policy}
+}
+
+func (r *RetryDatastore) retry(ctx context.Context, name string, op func() error) error {
+	delay := r.policy.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || err == ds.ErrNotFound || attempt >= r.policy.MaxAttempts || !r.policy.Retryable(err, attempt) {
+			return err
+		}
+		if r.policy.Logger != nil {
+			r.policy.Logger.LogAttrs(ctx, slog.LevelWarn, "retrying datastore operation",
+				slog.String("db.operation", name),
+				slog.Int("attempt", attempt),
+				slog.Duration("delay", delay),
+				slog.Any("error", err),
+			)
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+
+		delay *= 2
+		if r.policy.MaxDelay > 0 && delay > r.policy.MaxDelay {
+			delay = r.policy.MaxDelay
+		}
+	}
+}
+
+// Get retrieves a value from the wrapped datastore.
+func (r *RetryDatastore) Get(ctx context.Context, key ds.Key) (value []byte, err error) {
+	err = r.retry(ctx, "Get", func() error {
+		value, err = r.child.Get(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+// Has determines if a value for the given key exists in the wrapped datastore.
+func (r *RetryDatastore) Has(ctx context.Context, key ds.Key) (exists bool, err error) {
+	err = r.retry(ctx, "Has", func() error {
+		exists, err = r.child.Has(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+// GetSize determines the size of the value of the given key.
+func (r *RetryDatastore) GetSize(ctx context.Context, key ds.Key) (size int, err error) {
+	err = r.retry(ctx, "GetSize", func() error {
+		size, err = r.child.GetSize(ctx, key)
+		return err
+	})
+	return size, err
+}
+
+// Put stores a value in the wrapped datastore, an upsert being idempotent.
+func (r *RetryDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return r.retry(ctx, "Put", func() error {
+		return r.child.Put(ctx, key, value)
+	})
+}
+
+// Delete removes a value from the wrapped datastore.
+func (r *RetryDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return r.retry(ctx, "Delete", func() error {
+		return r.child.Delete(ctx, key)
+	})
+}
+
+// Query queries the wrapped datastore, only the execution of the query is
+// retried, errors happening while iterating the results are not.
+func (r *RetryDatastore) Query(ctx context.Context, q dsq.Query) (res dsq.Results, err error) {
+	err = r.retry(ctx, "Query", func() error {
+		res, err = r.child.Query(ctx, q)
+		return err
+	})
+	return res, err
+}
+
+// Sync flushes the given prefix of the wrapped datastore.
+func (r *RetryDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return r.retry(ctx, "Sync", func() error {
+		return r.child.Sync(ctx, prefix)
+	})
+}
+
+// Close closes the wrapped datastore.
+func (r *RetryDatastore) Close() error {
+	return r.child.Close()
+}
+
+// Batch returns a batch of the wrapped datastore, which is not retried.
+func (r *RetryDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	return r.child.Batch(ctx)
+}
+
+var _ ds.Batching = (*RetryDatastore)(nil)
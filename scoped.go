@@ -0,0 +1,180 @@
+package sqlds
+
+import (
+	"context"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// ScopedDatastore is a view of a Datastore where every key is transparently
+// prefixed with a namespace, allowing several logical datastores to share one
+// SQL table.
+type ScopedDatastore struct {
+	ds     *Datastore
+	prefix ds.Key
+}
+
+// NewScopedDatastore returns a datastore storing all its keys under prefix in d.
+func NewScopedDatastore(d *Datastore, prefix ds.Key) *ScopedDatastore {
+	return &ScopedDatastore{ds: d, prefix: prefix}
+}
+
+// Prefix returns the namespace of the scoped datastore.
+func (s *ScopedDatastore) Prefix() ds.Key {
+	return s.prefix
+}
+
+func (s *ScopedDatastore) convertKey(key ds.Key) ds.Key {
+	return s.prefix.Child(key)
+}
+
+func (s *ScopedDatastore) invertKey(key string) string {
+	// the keys of the root scope are not prefixed
+	if s.prefix.String() == "/" {
+		return key
+	}
+	k := strings.TrimPrefix(key, s.prefix.String())
+	if k == "" {
+		return "/"
+	}
+	return k
+}
+
+// Get retrieves a value from the scope by the given key.
+func (s *ScopedDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	return s.ds.Get(ctx, s.convertKey(key))
+}
+
+// Has determines if a value for the given key exists in the scope.
+func (s *ScopedDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return s.ds.Has(ctx, s.convertKey(key))
+}
+
+// GetSize determines the size in bytes of the value for a given key in the scope.
+func (s *ScopedDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	return s.ds.GetSize(ctx, s.convertKey(key))
+}
+
+// Put "upserts" a value in the scope.
+func (s *ScopedDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return s.ds.Put(ctx, s.convertKey(key), value)
+}
+
+// Delete removes a value from the scope by the given key.
+func (s *ScopedDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return s.ds.Delete(ctx, s.convertKey(key))
+}
+
+// DeletePrefix removes all the entries of the scope under the given prefix.
+func (s *ScopedDatastore) DeletePrefix(ctx context.Context, prefix ds.Key) (int64, error) {
+	return s.ds.DeletePrefix(ctx, s.convertKey(prefix))
+}
+
+// Count returns the number of entries of the scope under the given prefix.
+func (s *ScopedDatastore) Count(ctx context.Context, prefix ds.Key) (int, error) {
+	return s.ds.Count(ctx, s.convertKey(prefix))
+}
+
+// Query returns the entries of the scope matching the query, with the scope
+// prefix stripped from their keys.
+func (s *ScopedDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	cq := dsq.Query{
+		Prefix:            s.convertKey(ds.NewKey(q.Prefix)).String(),
+		KeysOnly:          q.KeysOnly,
+		ReturnExpirations: q.ReturnExpirations,
+		ReturnsSizes:      q.ReturnsSizes,
+	}
+
+	// filters and orders work on the stripped keys, so they are applied
+	// here and limit and offset with them.
+	naive := len(q.Filters) > 0 || len(q.Orders) > 0
+	if !naive {
+		cq.Limit = q.Limit
+		cq.Offset = q.Offset
+	}
+
+	res, err := s.ds.Query(ctx, cq)
+	if err != nil {
+		return nil, err
+	}
+
+	res = mapResults(q, res, func(e dsq.Entry) dsq.Entry {
+		e.Key = s.invertKey(e.Key)
+		return e
+	})
+
+	if naive {
+		nq := q
+		nq.Prefix = ""
+		res = dsq.NaiveQueryApply(nq, res)
+	}
+
+	return res, nil
+}
+
+// Sync syncs the given prefix of the scope.
+func (s *ScopedDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return s.ds.Sync(ctx, s.convertKey(prefix))
+}
+
+// Close does nothing, the underlying Datastore may be shared with other
+// scopes and must be closed by its owner.
+func (s *ScopedDatastore) Close() error {
+	return nil
+}
+
+// Batch creates a set of deferred updates to the scope, their keys being
+// prefixed with the namespace when they are added to the batch of the
+// underlying Datastore. Batches of different scopes can be committed
+// concurrently.
+func (s *ScopedDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := s.ds.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &scopedBatch{b: b, s: s}, nil
+}
+
+type scopedBatch struct {
+	b ds.Batch
+	s *ScopedDatastore
+}
+
+func (sb *scopedBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	return sb.b.Put(ctx, sb.s.convertKey(key), val)
+}
+
+func (sb *scopedBatch) Delete(ctx context.Context, key ds.Key) error {
+	return sb.b.Delete(ctx, sb.s.convertKey(key))
+}
+
+func (sb *scopedBatch) Commit(ctx context.Context) error {
+	return sb.b.Commit(ctx)
+}
+
+// mapResults applies fn to every entry of res, reporting q as the query.
+func mapResults(q dsq.Query, res dsq.Results, fn func(dsq.Entry) dsq.Entry) dsq.Results {
+	return dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := res.NextSync()
+			if !ok || r.Error != nil {
+				return r, ok
+			}
+			r.Entry = fn(r.Entry)
+			return r, true
+		},
+		Close: res.Close,
+	})
+}
+
+// Discard discards the wrapped batch, see DiscardableBatch.
+func (sb *scopedBatch) Discard(ctx context.Context) {
+	discardBatch(ctx, sb.b)
+}
+
+var (
+	_ ds.Batching      = (*ScopedDatastore)(nil)
+	_ DiscardableBatch = (*scopedBatch)(nil)
+)
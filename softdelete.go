@@ -0,0 +1,71 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// SoftDeleteQueries are the queries of a SoftDeleteDatastore. Their delete
+// queries mark rows as deleted in a deleted_at column instead of removing
+// them, and their read queries skip the deleted rows.
+type SoftDeleteQueries interface {
+	Queries
+	// Undelete clears the deleted mark of the row of key $1.
+	Undelete() string
+	// Purge removes the rows deleted at least $1 seconds ago.
+	Purge() string
+}
+
+// SoftDeleteDatastore is a Datastore whose deletions can be undone until the
+// deleted rows are purged.
+type SoftDeleteDatastore struct {
+	*Datastore
+	queries SoftDeleteQueries
+}
+
+// NewSoftDeleteDatastore returns a new soft delete SQL datastore, the table
+// needs a deleted_at column.
+func NewSoftDeleteDatastore(db *sql.DB, queries SoftDeleteQueries, opts ...Option) *SoftDeleteDatastore {
+	return &SoftDeleteDatastore{Datastore: NewDatastore(db, queries, opts...), queries: queries}
+}
+
+// Undelete restores the deleted row of the given key, it returns
+// ds.ErrNotFound if there is no deleted row for the key.
+func (d *SoftDeleteDatastore) Undelete(ctx context.Context, key ds.Key) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	res, err := d.db.ExecContext(ctx, d.queries.Undelete(), d.keyArg(key))
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ds.ErrNotFound
+	}
+
+	return nil
+}
+
+// Purge permanently removes the rows deleted at least olderThan ago and
+// returns the number of removed rows.
+func (d *SoftDeleteDatastore) Purge(ctx context.Context, olderThan time.Duration) (int64, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	res, err := d.db.ExecContext(ctx, d.queries.Purge(), int64(olderThan.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
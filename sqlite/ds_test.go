@@ -6,17 +6,38 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/failstore"
 	dsq "github.com/ipfs/go-datastore/query"
 	dstest "github.com/ipfs/go-datastore/test"
+	"github.com/prometheus/client_golang/prometheus"
+	dsextensions "github.com/textileio/go-datastore-extensions"
 	sqlds "github.com/vkost/go-ds-sql"
+	"github.com/vkost/go-ds-sql/test"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 var testcases = map[string]string{
@@ -171,548 +192,5723 @@ func TestQuery(t *testing.T) {
 	})
 }
 
-func TestHas(t *testing.T) {
+func TestQueryOrderedLimit(t *testing.T) {
 	d, done := newDS(t)
 	defer done()
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
-
 	addTestCases(t, d, testcases)
 
-	has, err := d.Has(ctx, ds.NewKey("/a/b/c"))
-	if err != nil {
-		t.Error(err)
-	}
+	ctx := context.Background()
 
-	if !has {
-		t.Error("Key should be found")
+	rs, err := d.Query(ctx, dsq.Query{
+		Prefix: "/a",
+		Orders: []dsq.Order{dsq.OrderByKey{}},
+		Offset: 1,
+		Limit:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
+	expectKeyOrderMatches(t, rs, []string{"/a/b/c", "/a/b/d"})
 
-	has, err = d.Has(ctx, ds.NewKey("/a/b/c/d"))
+	rs, err = d.Query(ctx, dsq.Query{
+		Prefix: "/a",
+		Orders: []dsq.Order{dsq.OrderByKeyDescending{}},
+		Offset: 1,
+		Limit:  2,
+	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	expectKeyOrderMatches(t, rs, []string{"/a/c", "/a/b/d"})
+}
 
-	if has {
-		t.Error("Key should not be found")
+func TestQueryCount(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	addTestCases(t, d, testcases)
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name  string
+		q     dsq.Query
+		count int
+	}{
+		{"no prefix", dsq.Query{}, len(testcases)},
+		{"prefix", dsq.Query{Prefix: "/a"}, 5},
+		{"limit ignored", dsq.Query{Prefix: "/a", Limit: 2, Offset: 1}, 5},
+		{"filter", dsq.Query{Prefix: "/a", Filters: []dsq.Filter{
+			dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/a/b/d"},
+		}}, 2},
+		{"value filter", dsq.Query{Filters: []dsq.Filter{
+			dsq.FilterValueCompare{Op: dsq.Equal, Value: []byte("ab")},
+		}}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			count, err := d.QueryCount(ctx, tc.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tc.count {
+				t.Fatalf("expected %d, got %d", tc.count, count)
+			}
+		})
 	}
 }
 
-func TestNotExistGet(t *testing.T) {
+func TestCount(t *testing.T) {
 	d, done := newDS(t)
 	defer done()
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
-
 	addTestCases(t, d, testcases)
 
-	has, err := d.Has(ctx, ds.NewKey("/a/b/c/d"))
-	if err != nil {
-		t.Error(err)
+	ctx := context.Background()
+	for prefix, expected := range map[string]int{"/": len(testcases), "/a": 5, "/a/b": 2, "/nothing": 0} {
+		count, err := d.Count(ctx, ds.NewKey(prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Fatalf("expected %d keys under %s, got %d", expected, prefix, count)
+		}
 	}
 
-	if has {
-		t.Error("Key should not be found")
+	scoped := sqlds.NewScopedDatastore(d, ds.NewKey("/a"))
+	if count, err := scoped.Count(ctx, ds.NewKey("/b")); err != nil || count != 2 {
+		t.Fatalf("expected 2 keys in the scope, got %d, %v", count, err)
 	}
 
-	val, err := d.Get(ctx, ds.NewKey("/a/b/c/d"))
-	if val != nil {
-		t.Error("Key should not be found")
+	// sqlite has no estimate, the keys are counted
+	count, err := d.EstimateCount(ctx)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	if err != ds.ErrNotFound {
-		t.Error("Error was not set to ds.ErrNotFound")
-		if err != nil {
-			t.Error(err)
-		}
+	if count != len(testcases) {
+		t.Fatalf("expected %d, got %d", len(testcases), count)
 	}
 }
 
-func TestDelete(t *testing.T) {
+func TestCompareAndSwap(t *testing.T) {
 	d, done := newDS(t)
 	defer done()
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
+	ctx := context.Background()
+	k := ds.NewKey("/leader")
 
-	addTestCases(t, d, testcases)
+	if err := d.CompareAndSwap(ctx, k, nil, []byte("a")); err != ds.ErrNotFound {
+		t.Fatalf("expected ds.ErrNotFound, got %v", err)
+	}
 
-	has, err := d.Has(ctx, ds.NewKey("/a/b/c"))
-	if err != nil {
-		t.Error(err)
+	if err := d.Put(ctx, k, []byte("a")); err != nil {
+		t.Fatal(err)
 	}
-	if !has {
-		t.Error("Key should be found")
+
+	if err := d.CompareAndSwap(ctx, k, []byte("b"), []byte("c")); err != sqlds.ErrCASFailed {
+		t.Fatalf("expected ErrCASFailed, got %v", err)
 	}
 
-	err = d.Delete(ctx, ds.NewKey("/a/b/c"))
-	if err != nil {
-		t.Error(err)
+	if err := d.CompareAndSwap(ctx, k, []byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
 	}
 
-	has, err = d.Has(ctx, ds.NewKey("/a/b/c"))
+	v, err := d.Get(ctx, k)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if has {
-		t.Error("Key should not be found")
+	if string(v) != "b" {
+		t.Fatalf("expected b, got %s", v)
 	}
 }
 
-func TestGetEmpty(t *testing.T) {
+func TestQueryWithGlob(t *testing.T) {
 	d, done := newDS(t)
 	defer done()
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
+	ctx := context.Background()
+	for _, k := range []string{
+		"/pins/a/recursive",
+		"/pins/a/direct",
+		"/pins/b/recursive",
+		"/pins/b/c/recursive",
+		"/pins/it's/recursive",
+		"/other/recursive",
+	} {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	err := d.Put(ctx, ds.NewKey("/a"), []byte{})
+	rs, err := d.QueryWithGlob(ctx, "/pins/*/recursive")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	// * matches the separator too
+	expectKeyOrderMatches(t, rs, []string{
+		"/pins/a/recursive",
+		"/pins/b/c/recursive",
+		"/pins/b/recursive",
+		"/pins/it's/recursive",
+	})
 
-	v, err := d.Get(ctx, ds.NewKey("/a"))
+	rs, err = d.QueryWithGlob(ctx, "/pins/?/recursive")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{"/pins/a/recursive", "/pins/b/recursive"})
+
+	for pattern, expected := range map[string][]string{
+		// the pattern is a parameter, its quotes are not SQL
+		"/pins/it's/*": {"/pins/it's/recursive"},
+		"' OR 1=1 --":  nil,
+		// % is not a wildcard in a GLOB pattern
+		"/pins/%": nil,
+	} {
+		rs, err = d.QueryWithGlob(ctx, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectKeyOrderMatches(t, rs, expected)
 	}
 
-	if len(v) != 0 {
-		t.Error("expected 0 len []byte form get")
+	encoded := sqlds.NewDatastore(d.DB(), NewQueries("blocks"), sqlds.WithKeyEncoder(sqlds.Base32KeyEncoder{}), sqlds.WithSharedDB())
+	if _, err := encoded.QueryWithGlob(ctx, "/pins/*"); !errors.Is(err, sqlds.ErrNotImplemented) {
+		t.Fatalf("expected ErrNotImplemented with encoded keys, got %v", err)
 	}
 }
 
-func TestBatching(t *testing.T) {
+func TestQueryPrefixGlobCharacters(t *testing.T) {
 	d, done := newDS(t)
 	defer done()
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
+	ctx := context.Background()
+	for _, k := range []string{"/foo[bar]/baz", "/foo*/baz", "/foo?/baz", "/foob/baz", "/fooa/baz", "/foo/baz"} {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	b, err := d.Batch(ctx)
+	for prefix, expected := range map[string][]string{
+		"/foo[bar]": {"/foo[bar]/baz"},
+		"/foo*":     {"/foo*/baz"},
+		"/foo?":     {"/foo?/baz"},
+		"/foo":      {"/foo/baz"},
+	} {
+		rs, err := d.Query(ctx, dsq.Query{Prefix: prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectKeyOrderMatches(t, rs, expected)
+	}
+
+	rs, err := d.Query(ctx, dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/foo["}}})
 	if err != nil {
 		t.Fatal(err)
 	}
+	expectKeyOrderMatches(t, rs, []string{"/foo[bar]/baz"})
 
-	for k, v := range testcases {
-		err := b.Put(ctx, ds.NewKey(k), []byte(v))
+	n, err := d.DeletePrefix(ctx, ds.NewKey("/foo*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 deleted row, got %d", n)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/foo*/baz")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestQueryPrefixBound(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	for _, k := range []string{"/it's/a", "/it's/b", "/it's/c", "/100%/a", "/100/a", "/x' OR '1'='1/y", "/z"} {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		q        dsq.Query
+		expected []string
+	}{
+		{dsq.Query{Prefix: "/it's", Limit: 1, Offset: 1}, []string{"/it's/b"}},
+		{dsq.Query{Prefix: "/100%"}, []string{"/100%/a"}},
+		{dsq.Query{Prefix: "/x' OR '1'='1"}, []string{"/x' OR '1'='1/y"}},
+		{dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/it'"}}, Limit: 2}, []string{"/it's/a", "/it's/b"}},
+	} {
+		rs, err := d.Query(ctx, c.q)
 		if err != nil {
 			t.Fatal(err)
 		}
+		expectKeyOrderMatches(t, rs, c.expected)
 	}
 
-	err = b.Commit(ctx)
-	if err != nil {
+	// the bound pattern still uses the primary key index
+	var id, parent, notused int
+	var detail string
+	plan := "EXPLAIN QUERY PLAN " + NewQueries("blocks").Query() + " WHERE " + fmt.Sprintf(NewQueries("blocks").Prefix(), "$1")
+	if err := d.DB().QueryRowContext(ctx, plan, NewQueries("blocks").PrefixPattern("/it's/")).Scan(&id, &parent, &notused, &detail); err != nil {
 		t.Fatal(err)
 	}
+	if !strings.Contains(detail, "SEARCH") {
+		t.Fatalf("expected an index search, got %s", detail)
+	}
+}
 
-	for k, v := range testcases {
-		val, err := d.Get(ctx, ds.NewKey(k))
+func TestStartAfter(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	const count, pageSize = 1000, 100
+	for i := 0; i < count; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/scan/%04d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := dsq.Query{Prefix: "/scan", KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKey{}}, Limit: pageSize}
+	n := 0
+	for {
+		// the page is read with a keyset scan
+		rows, naive, err := sqlds.QueryWithParams(ctx, d.DB(), NewQueries("blocks"), q)
 		if err != nil {
 			t.Fatal(err)
 		}
+		rows.Close()
+		if len(naive.Filters) != 0 || naive.Limit != 0 {
+			t.Fatalf("unexpected naive query %v", naive)
+		}
 
-		if v != string(val) {
-			t.Fatal("got wrong data!")
+		res, err := d.Query(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if want := fmt.Sprintf("/scan/%04d", n); e.Key != want {
+				t.Fatalf("expected %s, got %s", want, e.Key)
+			}
+			n++
+		}
+		if len(entries) < pageSize {
+			break
 		}
+		q.Filters = []dsq.Filter{sqlds.StartAfter(ds.RawKey(entries[len(entries)-1].Key))}
+	}
+	if n != count {
+		t.Fatalf("expected %d entries, got %d", count, n)
 	}
 
-	//Test delete
-	b, err = d.Batch(ctx)
-	if err != nil {
-		t.Fatal(err)
+	// the extended queries start from their seek prefix
+	for _, c := range []struct {
+		orders   []dsq.Order
+		expected []string
+	}{
+		{nil, []string{"/scan/0998", "/scan/0999"}},
+		{[]dsq.Order{dsq.OrderByKeyDescending{}}, []string{"/scan/0998", "/scan/0997"}},
+	} {
+		res, err := d.QueryExtended(ctx, dsextensions.QueryExt{
+			Query:      dsq.Query{Prefix: "/scan", Orders: c.orders, Limit: 2},
+			SeekPrefix: "/scan/0998",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectKeyOrderMatches(t, res, c.expected)
 	}
+}
 
-	err = b.Delete(ctx, ds.NewKey("/a/b"))
+func TestQueryPage(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	const count = 10000
+
+	b, err := d.Batch(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	err = b.Delete(ctx, ds.NewKey("/a/b/c"))
-	if err != nil {
+	for i := 0; i < count; i++ {
+		if err := b.Put(ctx, ds.NewKey(fmt.Sprintf("/page/%05d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
 		t.Fatal(err)
 	}
 
-	err = b.Commit(ctx)
-	if err != nil {
-		t.Fatal(err)
+	seen := make(map[string]bool, count)
+	var last string
+	var cursor ds.Key
+	for pages := 0; ; pages++ {
+		if pages > count/100 {
+			t.Fatal("pagination did not terminate")
+		}
+
+		rs, next, err := d.QueryPage(ctx, cursor, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if seen[e.Key] {
+				t.Fatalf("duplicate key %s", e.Key)
+			}
+			if e.Key <= last {
+				t.Fatalf("key %s is not after %s", e.Key, last)
+			}
+			seen[e.Key] = true
+			last = e.Key
+		}
+
+		if next.String() == "" {
+			break
+		}
+		cursor = next
 	}
 
-	rs, err := d.Query(ctx, dsq.Query{Prefix: "/"})
-	if err != nil {
-		t.Fatal(err)
+	if len(seen) != count {
+		t.Fatalf("expected %d keys, got %d", count, len(seen))
 	}
 
-	expectMatches(t, []string{
-		"/a",
-		"/a/b/d",
-		"/a/c",
-		"/a/d",
-		"/e",
-		"/f",
-		"/g",
-	}, rs)
+	if _, _, err := d.QueryPage(ctx, ds.Key{}, -1); err == nil {
+		t.Fatal("expected an error for a negative limit")
+	}
 }
 
-func SubtestBasicPutGet(t *testing.T) {
+func TestQueryOrderByKey(t *testing.T) {
 	d, done := newDS(t)
 	defer done()
 
-	k := ds.NewKey("foo")
-	val := []byte("Hello Datastore!")
+	addTestCases(t, d, testcases)
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
+	ctx := context.Background()
 
-	err := d.Put(ctx, k, val)
+	rs, err := d.Query(ctx, dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}, Offset: 2, Limit: 3})
 	if err != nil {
-		t.Fatal("error putting to datastore: ", err)
+		t.Fatal(err)
 	}
+	expectKeyOrderMatches(t, rs, []string{"/a/b/c", "/a/b/d", "/a/c"})
 
-	have, err := d.Has(ctx, k)
+	rs, err = d.Query(ctx, dsq.Query{Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 4})
 	if err != nil {
-		t.Fatal("error calling has on key we just put: ", err)
+		t.Fatal(err)
 	}
+	expectKeyOrderMatches(t, rs, []string{"/g", "/f", "/e", "/a/d"})
 
-	if !have {
-		t.Fatal("should have key foo, has returned false")
+	// an offset without a limit
+	rs, err = d.Query(ctx, dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}, Offset: 7})
+	if err != nil {
+		t.Fatal(err)
 	}
+	expectKeyOrderMatches(t, rs, []string{"/f", "/g"})
 
-	size, err := d.GetSize(ctx, k)
+	// keys stored encoded are sorted naively
+	b32, err := (&Options{}).Create()
 	if err != nil {
-		t.Fatal("error getting size after put: ", err)
-	}
-	if size != len(val) {
-		t.Fatalf("incorrect size: expected %d, got %d", len(val), size)
+		t.Fatal(err)
 	}
+	defer b32.Close()
+	enc := sqlds.NewDatastore(b32.DB(), NewQueries("blocks"), sqlds.WithKeyEncoder(sqlds.Base32KeyEncoder{}))
+	addTestCases(t, enc, testcases)
 
-	out, err := d.Get(ctx, k)
+	rs, err = enc.Query(ctx, dsq.Query{Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 4})
 	if err != nil {
-		t.Fatal("error getting value after put: ", err)
+		t.Fatal(err)
 	}
+	expectKeyOrderMatches(t, rs, []string{"/g", "/f", "/e", "/a/d"})
+}
 
-	if !bytes.Equal(out, val) {
-		t.Fatal("value received on get wasnt what we expected:", out)
-	}
+// limitedQueries are sqlite queries reporting limited capabilities.
+type limitedQueries struct {
+	Queries
+	caps sqlds.QueryCapabilities
+}
 
-	have, err = d.Has(ctx, k)
-	if err != nil {
-		t.Fatal("error calling has after get: ", err)
+func (q limitedQueries) Capabilities() sqlds.QueryCapabilities {
+	return q.caps
+}
+
+func TestQueryCapabilities(t *testing.T) {
+	ctx := context.Background()
+
+	for name, caps := range map[string]sqlds.QueryCapabilities{
+		"all":  sqlds.AllCapabilities,
+		"none": {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := (&Options{}).Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			d := sqlds.NewDatastore(db.DB(), limitedQueries{Queries: NewQueries("blocks"), caps: caps})
+			addTestCases(t, d, testcases)
+
+			rs, err := d.Query(ctx, dsq.Query{Prefix: "/a", Offset: 1, Limit: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectKeyOrderMatches(t, rs, []string{"/a/b/c", "/a/b/d"})
+
+			rs, err = d.Query(ctx, dsq.Query{
+				Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/b"}},
+				Orders:  []dsq.Order{dsq.OrderByKey{}},
+				Limit:   2,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectKeyOrderMatches(t, rs, []string{"/a/b", "/a/b/c"})
+
+			n, err := d.QueryCount(ctx, dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 5 {
+				t.Fatalf("expected 5 keys, got %d", n)
+			}
+
+			size, err := d.GetSize(ctx, ds.NewKey("/a/b/c"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != 3 {
+				t.Fatalf("expected size 3, got %d", size)
+			}
+
+			deleted, err := d.DeletePrefix(ctx, ds.NewKey("/a/b"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != 2 {
+				t.Fatalf("expected 2 deleted keys, got %d", deleted)
+			}
+		})
 	}
+}
 
-	if !have {
-		t.Fatal("should have key foo, has returned false")
+func TestQueryOrderByValue(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	for k, v := range map[string][]byte{
+		"/1": {0x03},
+		"/2": {0x01, 0xff},
+		"/3": {0x02},
+		"/4": {0x01},
+		"/5": {0xff, 0x00},
+	} {
+		if err := d.Put(ctx, ds.NewKey(k), v); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	size, err = d.GetSize(ctx, k)
+	rs, err := d.Query(ctx, dsq.Query{Orders: []dsq.Order{dsq.OrderByValue{}}, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{"/4", "/2", "/3"})
+
+	rs, err = d.Query(ctx, dsq.Query{Orders: []dsq.Order{dsq.OrderByValueDescending{}}, Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{"/1", "/3"})
+
+	// prefixed queries are sorted naively
+	rs, err = d.Query(ctx, dsq.Query{Prefix: "/", Orders: []dsq.Order{dsq.OrderByValue{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{"/4", "/2", "/3", "/1", "/5"})
+}
+
+func TestQueryOrderByCreatedAt(t *testing.T) {
+	for _, hashed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("hashed=%v", hashed), func(t *testing.T) {
+			opts := &Options{DSN: ":memory:", TrackCreatedAt: true, HashKeys: hashed, UsesSizeColumn: !hashed}
+			d, db, err := opts.create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			// every connection to :memory: is a different database
+			db.SetMaxOpenConns(1)
+
+			ctx := context.Background()
+			for i, k := range []string{"/a/3", "/a/1", "/b/1", "/a/2"} {
+				if err := d.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+					t.Fatal(err)
+				}
+				// the column has a resolution of a second
+				if _, err := db.Exec("UPDATE blocks SET created_at = created_at + $1 WHERE key = $2", i, k); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// overwriting a value keeps its insertion time
+			if err := d.Put(ctx, ds.NewKey("/b/1"), []byte("/b/1")); err != nil {
+				t.Fatal(err)
+			}
+
+			rs, err := d.Query(ctx, dsq.Query{Orders: []dsq.Order{sqlds.OrderByCreatedAt{}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectKeyOrderMatches(t, rs, []string{"/a/3", "/a/1", "/b/1", "/a/2"})
+
+			rs, err = d.Query(ctx, dsq.Query{Orders: []dsq.Order{sqlds.OrderByCreatedAtDesc{}}, Limit: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectKeyOrderMatches(t, rs, []string{"/a/2", "/b/1"})
+
+			rs, err = d.Query(ctx, dsq.Query{Prefix: "/a", Orders: []dsq.Order{sqlds.OrderByCreatedAtDesc{}}, Offset: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectKeyOrderMatches(t, rs, []string{"/a/1", "/a/3"})
+		})
+	}
+
+	// without the column the entries are ordered by key
+	d, done := newDS(t)
+	defer done()
+	addTestCases(t, d, map[string]string{"/b": "b", "/a": "a", "/c": "c"})
+	rs, err := d.Query(context.Background(), dsq.Query{Orders: []dsq.Order{sqlds.OrderByCreatedAtDesc{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{"/c", "/b", "/a"})
+}
+
+func TestReadOnly(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "ro.sqlite")
+	ctx := context.Background()
+
+	d, err := (&Options{DSN: dsn}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	ro, err := (&Options{DSN: dsn, ReadOnly: true}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	if v, err := ro.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+		t.Fatalf("expected a, got %q, %v", v, err)
+	}
+	rs, err := ro.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/a"}, rs)
+
+	if err := ro.Put(ctx, ds.NewKey("/b"), []byte("b")); !errors.Is(err, sqlds.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.Delete(ctx, ds.NewKey("/a")); !errors.Is(err, sqlds.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err := ro.Batch(ctx); !errors.Is(err, sqlds.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []ds.Key
+	for i := 0; i < 2500; i++ {
+		k := ds.NewKey(fmt.Sprintf("/many/%d", i))
+		keys = append(keys, k)
+		if err := b.Put(ctx, k, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// more keys than fit in a statement, and some missing ones
+	n, err := d.DeleteMany(ctx, append(keys[:2000:2000], ds.NewKey("/missing")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2000 {
+		t.Fatalf("expected 2000 deleted rows, got %d", n)
+	}
+
+	if n, err := d.DeleteMany(ctx, nil); err != nil || n != 0 {
+		t.Fatalf("expected no deleted rows, got %d, %v", n, err)
+	}
+
+	// batched deletes go through DeleteMany
+	b, err = d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys[2000:2400] {
+		if err := b.Delete(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := d.QueryCount(ctx, dsq.Query{Prefix: "/many"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 100 {
+		t.Fatalf("expected 100 remaining rows, got %d", count)
+	}
+}
+
+func TestPutManyGetMany(t *testing.T) {
+	for name, opts := range map[string]*Options{
+		"plain":     {},
+		"size":      {UsesSizeColumn: true},
+		"hashed":    {HashKeys: true},
+		"createdAt": {TrackCreatedAt: true},
+		"checksum":  {UsesChecksumColumn: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts.DSN = filepath.Join(t.TempDir(), "many.sqlite")
+			d, db, err := opts.create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			ctx := context.Background()
+			if err := d.Put(ctx, ds.NewKey("/many/0"), []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+
+			// more rows than fit in a statement, and a key given twice
+			var keys []ds.Key
+			var values [][]byte
+			for i := 0; i < 1200; i++ {
+				keys = append(keys, ds.NewKey(fmt.Sprintf("/many/%d", i)))
+				values = append(values, []byte(fmt.Sprintf("v%d", i)))
+			}
+			keys = append(keys, ds.NewKey("/many/1"))
+			values = append(values, []byte("last"))
+			if err := d.PutMany(ctx, keys, values); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := d.GetMany(ctx, append(keys[:1000:1000], ds.NewKey("/missing")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1000 {
+				t.Fatalf("expected 1000 values, got %d", len(got))
+			}
+			for i, k := range keys[:1000] {
+				expected := fmt.Sprintf("v%d", i)
+				if i == 1 {
+					expected = "last"
+				}
+				if string(got[k]) != expected {
+					t.Fatalf("expected %s for %s, got %q", expected, k, got[k])
+				}
+			}
+
+			if size, err := d.GetSize(ctx, ds.NewKey("/many/1199")); err != nil || size != 5 {
+				t.Fatalf("expected a size of 5, got %d, %v", size, err)
+			}
+			if err := d.PutMany(ctx, keys[:1], nil); err == nil {
+				t.Fatal("expected an error for mismatched keys and values")
+			}
+		})
+	}
+}
+
+func TestCreateTableExtraColumns(t *testing.T) {
+	opts := &Options{
+		DSN:          filepath.Join(t.TempDir(), "extra.sqlite"),
+		ExtraColumns: []sqlds.ColumnDef{{Name: "created_at", Type: "INTEGER", Default: "(unixepoch())"}},
+	}
+	d, db, err := opts.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	var createdAt int64
+	if err := db.QueryRow("SELECT created_at FROM blocks WHERE key = '/a'").Scan(&createdAt); err != nil {
+		t.Fatal(err)
+	}
+	if createdAt == 0 {
+		t.Fatal("expected created_at to default to the current time")
+	}
+
+	custom := &Options{
+		DSN:            filepath.Join(t.TempDir(), "custom.sqlite"),
+		Table:          "custom",
+		CreateTableSQL: "CREATE TABLE IF NOT EXISTS custom (key TEXT PRIMARY KEY, data BLOB, meta TEXT)",
+	}
+	cd, err := custom.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cd.Close()
+	if err := cd.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// unreachableDriver opens connections whose Ping fails, like those of a
+// database gone away.
+type unreachableDriver struct{}
+
+func (unreachableDriver) Open(name string) (driver.Conn, error) {
+	return unreachableConn{}, nil
+}
+
+type unreachableConn struct{}
+
+func (unreachableConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, driver.ErrBadConn
+}
+
+func (unreachableConn) Close() error {
+	return nil
+}
+
+func (unreachableConn) Begin() (driver.Tx, error) {
+	return nil, driver.ErrBadConn
+}
+
+func (unreachableConn) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func init() {
+	sql.Register("unreachable", unreachableDriver{})
+}
+
+func TestHealthCheck(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	check := d.HealthChecker()
+	if err := check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.DB().Exec("DROP TABLE blocks"); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(ctx); err == nil || !strings.Contains(err.Error(), "no such table") {
+		t.Fatalf("expected the missing table to be reported, got %v", err)
+	}
+
+	db, err := sql.Open("unreachable", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := sqlds.NewDatastore(db, NewQueries("blocks"))
+	defer unreachable.Close()
+	if err := unreachable.HealthCheck(ctx); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expected the ping error, got %v", err)
+	}
+}
+
+// flakyPingDriver opens connections whose every third ping fails.
+type flakyPingDriver struct {
+	pings atomic.Int32
+}
+
+func (d *flakyPingDriver) Open(name string) (driver.Conn, error) {
+	return flakyPingConn{d: d}, nil
+}
+
+type flakyPingConn struct {
+	unreachableConn
+	d *flakyPingDriver
+}
+
+func (c flakyPingConn) Ping(ctx context.Context) error {
+	if c.d.pings.Add(1)%3 == 0 {
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+func (d *flakyPingDriver) Connect(ctx context.Context) (driver.Conn, error) {
+	return d.Open("")
+}
+
+func (d *flakyPingDriver) Driver() driver.Driver {
+	return d
+}
+
+func TestWithPing(t *testing.T) {
+	flaky := &flakyPingDriver{}
+	db := sql.OpenDB(flaky)
+
+	var buf bytes.Buffer
+	d := sqlds.WithLogger(sqlds.NewDatastore(db, NewQueries("blocks")), slog.New(slog.NewTextHandler(&buf, nil)))
+	pd := sqlds.WithPing(d, time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for flaky.pings.Load() < 6 {
+		if time.Now().After(deadline) {
+			t.Fatal("the database is not pinged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := pd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := buf.String()
+	if !strings.Contains(logs, `level=WARN msg="failed to ping database" db.operation=Ping error="connection reset by peer"`) {
+		t.Fatalf("expected the failed pings to be logged:\n%s", logs)
+	}
+	if n, pings := strings.Count(logs, "failed to ping database"), int(flaky.pings.Load()); n != pings/3 {
+		t.Fatalf("expected %d warnings for %d pings, got %d", pings/3, pings, n)
+	}
+
+	// the non-positive intervals are replaced by the default one
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := sqlds.WithPing(d, interval).Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newMemoryDS returns a datastore of a :memory: database, every connection
+// to which is a different database.
+func newMemoryDS(t *testing.T) *sqlds.Datastore {
+	t.Helper()
+
+	d, db, err := (&Options{}).create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	return d
+}
+
+func TestCopyTo(t *testing.T) {
+	src, dst := newMemoryDS(t), newMemoryDS(t)
+	defer dst.Close()
+	defer src.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 2500; i++ {
+		if err := src.Put(ctx, ds.NewKey(fmt.Sprintf("/a/%d", i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addTestCases(t, src, map[string]string{"/private/a": "x", "/private/b": "y"})
+
+	public := func(k ds.Key) bool { return !ds.NewKey("/private").IsAncestorOf(k) }
+	if err := src.CopyTo(ctx, dst, public); err != nil {
+		t.Fatal(err)
+	}
+	other := newMemoryDS(t)
+	defer other.Close()
+	if err := src.CopyTo(ctx, other, nil); err == nil {
+		t.Fatal("expected a datastore to be copied once")
+	}
+
+	// the entries of d under /a, the filtered out keys being checked apart
+	contents := func(d *sqlds.Datastore) map[string]string {
+		t.Helper()
+		res, err := d.Query(ctx, dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]string)
+		for _, e := range entries {
+			m[e.Key] = string(e.Value)
+		}
+		return m
+	}
+	compare := func() {
+		t.Helper()
+		for start := time.Now(); src.ReplicationLag() != 0; time.Sleep(time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("replication lag still %d", src.ReplicationLag())
+			}
+		}
+
+		want, got := contents(src), contents(dst)
+		if len(got) != len(want) {
+			t.Fatalf("expected %d entries, got %d", len(want), len(got))
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Fatalf("expected %q for %s, got %q", v, k, got[k])
+			}
+		}
+		if has, err := dst.Has(ctx, ds.NewKey("/private/a")); err != nil || has {
+			t.Fatalf("expected the filtered out keys not to be copied, got %v, %v", has, err)
+		}
+	}
+	compare()
+
+	// the subsequent writes are replicated
+	if err := src.Put(ctx, ds.NewKey("/a/0"), []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Delete(ctx, ds.NewKey("/a/1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Put(ctx, ds.NewKey("/private/c"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := src.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/a/new"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, ds.NewKey("/a/2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pb, err := src.ParallelBatch(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.Put(ctx, ds.NewKey("/a/parallel"), []byte("parallel")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.Delete(ctx, ds.NewKey("/a/3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.CompareAndSwap(ctx, ds.NewKey("/a/4"), []byte("4"), []byte("swapped")); err != nil {
+		t.Fatal(err)
+	}
+	if inserted, err := src.PutIfAbsent(ctx, ds.NewKey("/a/absent"), []byte("absent")); err != nil || !inserted {
+		t.Fatalf("expected the key to be inserted, got %v, %v", inserted, err)
+	}
+	if _, err := src.DeleteMany(ctx, []ds.Key{ds.NewKey("/a/5"), ds.NewKey("/a/6")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the writes of the wrappers
+	if err := createIndexTable(src.DB(), "blocks"); err != nil {
+		t.Fatal(err)
+	}
+	xd := sqlds.WithIndex(src, NewIndexQueries("blocks"), func([]byte) (map[string]any, error) { return nil, nil })
+	if err := xd.Put(ctx, ds.NewKey("/a/indexed"), []byte("indexed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := xd.Delete(ctx, ds.NewKey("/a/7")); err != nil {
+		t.Fatal(err)
+	}
+	xb, err := xd.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xb.Put(ctx, ds.NewKey("/a/indexed batch"), []byte("indexed batch")); err != nil {
+		t.Fatal(err)
+	}
+	if err := xb.Delete(ctx, ds.NewKey("/a/8")); err != nil {
+		t.Fatal(err)
+	}
+	if err := xb.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := src.DB().Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddAuditTable("blocks")(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	ad := sqlds.WithAudit(src, NewAuditQueries("blocks"))
+	if err := ad.Put(ctx, ds.NewKey("/a/audited"), []byte("audited")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ad.Delete(ctx, ds.NewKey("/a/9")); err != nil {
+		t.Fatal(err)
+	}
+	compare()
+
+	if v, err := dst.Get(ctx, ds.NewKey("/a/0")); err != nil || string(v) != "updated" {
+		t.Fatalf("expected the updated value, got %q, %v", v, err)
+	}
+	if has, err := dst.Has(ctx, ds.NewKey("/a/2")); err != nil || has {
+		t.Fatalf("expected the deletion of the batch to be replicated, got %v, %v", has, err)
+	}
+	if has, err := dst.Has(ctx, ds.NewKey("/a/3")); err != nil || has {
+		t.Fatalf("expected the deletion of the parallel batch to be replicated, got %v, %v", has, err)
+	}
+}
+
+func init() {
+	// sleep(ms) sleeps for ms milliseconds
+	sql.Register("sqlite3-sleep", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("sleep", func(ms int64) int64 {
+				time.Sleep(time.Duration(ms) * time.Millisecond)
+				return 0
+			}, false)
+		},
+	})
+}
+
+// slowQueries sleep for 10ms per row.
+type slowQueries struct {
+	Queries
+}
+
+func (q slowQueries) Query() string {
+	return q.Queries.Query() + " WHERE sleep(10) = 0"
+}
+
+func (q slowQueries) Get() string {
+	return "SELECT data FROM blocks WHERE key = $1 AND sleep(200) = 0"
+}
+
+func TestWithQueryTimeout(t *testing.T) {
+	db, err := sql.Open("sqlite3-sleep", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(NewQueries("blocks").TableSchema()); err != nil {
+		t.Fatal(err)
+	}
+
+	// composed with the other wrappers
+	d := sqlds.WithQueryTimeout(sqlds.NewDatastore(db, slowQueries{NewQueries("blocks")}), 100*time.Millisecond)
+	d = sqlds.WithMaxValueSize(d, 1024)
+	defer d.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, ds.NewKey(strconv.Itoa(i)), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sqlite interrupts the statement once sleep returns
+	if _, err := d.Get(ctx, ds.NewKey("1")); !errors.Is(err, sqlds.ErrQueryTimeout) {
+		t.Fatalf("expected ErrQueryTimeout, got %v", err)
+	}
+
+	// the scan of the 100 rows takes a second
+	res, err := d.Query(ctx, dsq.Query{})
+	if err == nil {
+		_, err = res.Rest()
+	}
+	if !errors.Is(err, sqlds.ErrQueryTimeout) {
+		t.Fatalf("expected ErrQueryTimeout, got %v", err)
+	}
+
+	// the operations completing in time are not affected
+	if has, err := d.Has(ctx, ds.NewKey("1")); err != nil || !has {
+		t.Fatalf("expected the key to exist, got %v, %v", has, err)
+	}
+	res, err = d.Query(ctx, dsq.Query{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := res.Rest(); err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d, %v", len(entries), err)
+	}
+
+	// the deadline of the context is not a query timeout
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := d.Get(cctx, ds.NewKey("1")); err == nil || errors.Is(err, sqlds.ErrQueryTimeout) {
+		t.Fatalf("expected the error of the context, got %v", err)
+	}
+}
+
+func TestQueryReturnsSizes(t *testing.T) {
+	d, db, err := (&Options{}).create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// every connection to :memory: is a different database
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+	const count, valueSize = 64, 64 << 10
+	for i := 0; i < count; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/sizes/%02d", i)), make([]byte, valueSize+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, q := range map[string]dsq.Query{
+		"sizes":        {Prefix: "/sizes", KeysOnly: true, ReturnsSizes: true},
+		"key filter":   {KeysOnly: true, ReturnsSizes: true, Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThanOrEqual, Key: "/sizes/00"}}},
+		"value order":  {KeysOnly: true, ReturnsSizes: true, Orders: []dsq.Order{dsq.OrderByValue{}}},
+		"value filter": {Prefix: "/sizes", KeysOnly: true, ReturnsSizes: true, Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.NotEqual, Value: []byte("x")}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			res, err := d.Query(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			runtime.ReadMemStats(&after)
+
+			if len(entries) != count {
+				t.Fatalf("expected %d entries, got %d", count, len(entries))
+			}
+			for _, e := range entries {
+				var i int
+				if _, err := fmt.Sscanf(e.Key, "/sizes/%d", &i); err != nil {
+					t.Fatal(err)
+				}
+				if e.Size != valueSize+i || e.Value != nil {
+					t.Fatalf("expected the size %d without the value, got %d, %d bytes", valueSize+i, e.Size, len(e.Value))
+				}
+			}
+
+			// the values filtered on the results are read
+			if name == "value filter" {
+				return
+			}
+			if n := after.TotalAlloc - before.TotalAlloc; n > valueSize {
+				t.Fatalf("expected the values not to be read, %d bytes were allocated", n)
+			}
+		})
+	}
+}
+
+func TestQueryKeysOnly(t *testing.T) {
+	d, db, err := (&Options{}).create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// every connection to :memory: is a different database
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+	const count, valueSize = 64, 64 << 10
+	for i := 0; i < count; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/keys/%02d", i)), make([]byte, valueSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, q := range map[string]dsq.Query{
+		"keys":         {Prefix: "/keys", KeysOnly: true, Limit: count},
+		"key order":    {KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKeyDescending{}}},
+		"value filter": {Prefix: "/keys", KeysOnly: true, Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.NotEqual, Value: []byte("x")}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			res, err := d.Query(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			runtime.ReadMemStats(&after)
+
+			if len(entries) != count {
+				t.Fatalf("expected %d entries, got %d", count, len(entries))
+			}
+			for _, e := range entries {
+				if e.Value != nil || e.Size != 0 {
+					t.Fatalf("expected the key only, got %d bytes of size %d", len(e.Value), e.Size)
+				}
+			}
+
+			// the values filtered on the results are read
+			if name == "value filter" {
+				return
+			}
+			if n := after.TotalAlloc - before.TotalAlloc; n > valueSize {
+				t.Fatalf("expected the values not to be read, %d bytes were allocated", n)
+			}
+		})
+	}
+}
+
+func TestQueryCancellation(t *testing.T) {
+	db, err := sql.Open("sqlite3-sleep", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(NewQueries("blocks").TableSchema()); err != nil {
+		t.Fatal(err)
+	}
+	d := sqlds.NewDatastore(db, slowQueries{NewQueries("blocks")})
+	defer d.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, ds.NewKey(strconv.Itoa(i)), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the scan of the 100 rows takes a second, sorting them by value
+	// before returning the first one
+	qctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	res, err := d.Query(qctx, dsq.Query{Orders: []dsq.Order{dsq.OrderByValue{}}})
+	if err == nil {
+		_, err = res.Rest()
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("the query was not interrupted, it took %s", elapsed)
+	}
+	if n := db.Stats().InUse; n != 0 {
+		t.Fatalf("%d connections still in use", n)
+	}
+
+	// QueryWithParams runs the statement with the context as well
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := sqlds.QueryWithParams(cctx, db, NewQueries("blocks"), dsq.Query{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	for name, opts := range map[string]*Options{
+		"plain":     {UsesChecksumColumn: true},
+		"hashed":    {UsesChecksumColumn: true, HashKeys: true, UsesSizeColumn: true},
+		"createdAt": {UsesChecksumColumn: true, TrackCreatedAt: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d, db, err := opts.create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			// every connection to :memory: is a different database
+			db.SetMaxOpenConns(1)
+
+			ctx := context.Background()
+			for _, k := range []string{"/a", "/b", "/c"} {
+				if err := d.PutWithChecksum(ctx, ds.NewKey(k), []byte("value of "+k)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if v, err := d.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "value of /a" {
+				t.Fatalf("expected the value of /a, got %q, %v", v, err)
+			}
+
+			// a partial write
+			if _, err := db.Exec("UPDATE blocks SET data = x'00' WHERE key IN ('/a', '/b')"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.Get(ctx, ds.NewKey("/a")); !errors.Is(err, sqlds.ErrChecksumMismatch) {
+				t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+			}
+
+			// the other writes clear the checksum
+			if err := d.Put(ctx, ds.NewKey("/b"), []byte("unverified")); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := d.Get(ctx, ds.NewKey("/b")); err != nil || string(v) != "unverified" {
+				t.Fatalf("expected the value without checksum, got %q, %v", v, err)
+			}
+
+			if err := d.Scrub(ctx); !errors.Is(err, sqlds.ErrChecksumMismatch) || !strings.Contains(err.Error(), "/a") {
+				t.Fatalf("expected the checksum mismatch of /a, got %v", err)
+			}
+
+			if n, err := d.Repair(ctx); err != nil || n != 1 {
+				t.Fatalf("expected 1 repaired row, got %d, %v", n, err)
+			}
+			if err := d.Scrub(ctx); err != nil {
+				t.Fatalf("expected no corrupt rows, got %v", err)
+			}
+			if _, err := d.Get(ctx, ds.NewKey("/a")); err != ds.ErrNotFound {
+				t.Fatalf("expected the corrupt row to be deleted, got %v", err)
+			}
+			for _, k := range []string{"/b", "/c"} {
+				if has, err := d.Has(ctx, ds.NewKey(k)); err != nil || !has {
+					t.Fatalf("expected %s to be kept, got %v, %v", k, has, err)
+				}
+			}
+		})
+	}
+
+	// the table has no checksum column
+	d, done := newDS(t)
+	defer done()
+	if err := d.PutWithChecksum(context.Background(), ds.NewKey("/a"), nil); !errors.Is(err, sqlds.ErrNotImplemented) {
+		t.Fatalf("expected ErrNotImplemented, got %v", err)
+	}
+	if _, err := d.Repair(context.Background()); !errors.Is(err, sqlds.ErrNotImplemented) {
+		t.Fatalf("expected ErrNotImplemented, got %v", err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	bd := sqlds.NewDatastore(d.DB(), NewQueries("blocks"), sqlds.WithKeyEncoder(sqlds.Base32KeyEncoder{}), sqlds.WithSharedDB())
+	for _, k := range []string{"/a", "/b"} {
+		if err := bd.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bd.Scrub(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a key which is not base32
+	if _, err := d.DB().Exec("INSERT INTO blocks (key, data) VALUES ('/not base32!', x'00')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bd.Scrub(ctx); err == nil || !strings.Contains(err.Error(), "/not base32!") {
+		t.Fatalf("expected the undecodable key to be reported, got %v", err)
+	}
+	rs, err := bd.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Rest(); err == nil {
+		t.Fatal("expected the query to report the undecodable key")
+	}
+}
+
+func TestSecureDelete(t *testing.T) {
+	ctx := context.Background()
+	value := func(k string) []byte {
+		return bytes.Repeat([]byte("secret value of "+k+"|"), 20)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+		// secure deletes with SecureDelete rather than Delete
+		secure bool
+	}{
+		{"SecureDelete", Options{}, true},
+		{"hashed", Options{HashKeys: true}, true},
+		{"pragma", Options{SecureDelete: true}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "secure.sqlite")
+			opts := tc.opts
+			opts.DSN = path
+			d, err := opts.Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			// fileContains reports whether the database file contains b
+			fileContains := func(b []byte) bool {
+				t.Helper()
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return bytes.Contains(data, b)
+			}
+
+			for _, k := range []string{"/a", "/b", "/c"} {
+				if err := d.Put(ctx, ds.NewKey(k), value(k)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !fileContains(value("/b")) {
+				t.Fatal("expected the value of /b in the database file")
+			}
+
+			if tc.secure {
+				err = d.SecureDelete(ctx, ds.NewKey("/b"))
+			} else {
+				err = d.Delete(ctx, ds.NewKey("/b"))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := d.Get(ctx, ds.NewKey("/b")); !errors.Is(err, ds.ErrNotFound) {
+				t.Fatalf("expected ds.ErrNotFound, got %v", err)
+			}
+			if fileContains(value("/b")) {
+				t.Fatal("the value of /b remains in the database file")
+			}
+			if !fileContains(value("/a")) || !fileContains(value("/c")) {
+				t.Fatal("expected the other values in the database file")
+			}
+		})
+	}
+
+	// a plain delete leaves the value in the freed space
+	path := filepath.Join(t.TempDir(), "plain.sqlite")
+	d, err := (&Options{DSN: path}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, k := range []string{"/a", "/b", "/c"} {
+		if err := d.Put(ctx, ds.NewKey(k), value(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Delete(ctx, ds.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, value("/b")) {
+		t.Fatal("expected a plain delete to leave the value in the database file")
+	}
+}
+
+func TestDB(t *testing.T) {
+	d, err := (&Options{DSN: filepath.Join(t.TempDir(), "db.sqlite")}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	var size int
+	if err := d.DB().QueryRowContext(ctx, "SELECT sum(length(data)) FROM blocks").Scan(&size); err != nil {
+		t.Fatal(err)
+	}
+	if size != 3 {
+		t.Fatalf("expected 3 bytes, got %d", size)
+	}
+	if _, err := d.DB().ExecContext(ctx, "ANALYZE"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncCheckpointsWAL(t *testing.T) {
+	dir := t.TempDir()
+	dsn := filepath.Join(dir, "sync.sqlite")
+
+	d, err := (&Options{DSN: dsn, JournalMode: "WAL"}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// copying the database file without its WAL simulates a crash losing
+	// the WAL, the checkpointed data must be in the database file
+	data, err := os.ReadFile(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := filepath.Join(dir, "copy.sqlite")
+	if err := os.WriteFile(cp, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := (&Options{DSN: cp, NoCreate: true}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if v, err := c.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+		t.Fatalf("expected a, got %q, %v", v, err)
+	}
+}
+
+func TestTableSchema(t *testing.T) {
+	for name, tc := range map[string]struct {
+		queries sqlds.Queries
+		opts    []sqlds.Option
+	}{
+		"plain":      {queries: NewQueries("blocks")},
+		"hashed":     {queries: NewHashedQueries("blocks"), opts: []sqlds.Option{sqlds.WithHashedKeys()}},
+		"softdelete": {queries: NewSoftDeleteQueries("blocks")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", ":memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.SetMaxOpenConns(1)
+			if _, err := db.Exec(tc.queries.TableSchema()); err != nil {
+				t.Fatal(err)
+			}
+
+			var d ds.Datastore = sqlds.NewDatastore(db, tc.queries, tc.opts...)
+			if q, ok := tc.queries.(SoftDeleteQueries); ok {
+				d = sqlds.NewSoftDeleteDatastore(db, q)
+			}
+			defer d.Close()
+
+			ctx := context.Background()
+			if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := d.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+				t.Fatalf("expected a, got %q, %v", v, err)
+			}
+			if err := d.Delete(ctx, ds.NewKey("/a")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.Get(ctx, ds.NewKey("/a")); err != ds.ErrNotFound {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+
+	opts := &Options{HashKeys: true}
+	opts.setDefaults()
+	if stmt := opts.createTableSQL(); stmt != NewHashedQueries("blocks").TableSchema() {
+		t.Fatalf("expected Create to use the schema of the queries, got %s", stmt)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	d, err := (&Options{
+		DSN:        filepath.Join(t.TempDir(), "soft.sqlite"),
+		Migrations: []sqlds.Migration{AddDeletedAtColumn("blocks")},
+	}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	sd := sqlds.NewSoftDeleteDatastore(d.DB(), NewSoftDeleteQueries("blocks"))
+	ctx := context.Background()
+	for _, k := range []string{"/a", "/b/c", "/b/d"} {
+		if err := sd.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := sd.Delete(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sd.Get(ctx, ds.NewKey("/a")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if has, err := sd.Has(ctx, ds.NewKey("/a")); err != nil || has {
+		t.Fatalf("expected no /a, got %v, %v", has, err)
+	}
+	// the row is still there
+	if _, err := d.Get(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sd.DeletePrefix(ctx, ds.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := sd.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{}, rs)
+
+	if err := sd.Undelete(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.Undelete(ctx, ds.NewKey("/a")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if v, err := sd.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "/a" {
+		t.Fatalf("expected /a, got %q, %v", v, err)
+	}
+
+	// putting a deleted key restores it
+	if err := sd.Put(ctx, ds.NewKey("/b/c"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	rs, err = sd.Query(ctx, dsq.Query{Prefix: "/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/b/c"}, rs)
+
+	// a deleted key is absent
+	if inserted, err := sd.PutIfAbsent(ctx, ds.NewKey("/b/d"), []byte("d")); err != nil || !inserted {
+		t.Fatalf("expected /b/d to be inserted, got %v, %v", inserted, err)
+	}
+	if err := sd.Delete(ctx, ds.NewKey("/b/d")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := sd.Purge(ctx, time.Hour); err != nil || n != 0 {
+		t.Fatalf("expected no purged rows, got %d, %v", n, err)
+	}
+	if n, err := sd.Purge(ctx, 0); err != nil || n != 1 {
+		t.Fatalf("expected 1 purged row, got %d, %v", n, err)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/b/d")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// a securely deleted row is zeroed, then marked
+	if err := sd.SecureDelete(ctx, ds.NewKey("/b/c")); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := sd.Has(ctx, ds.NewKey("/b/c")); err != nil || has {
+		t.Fatalf("expected no /b/c, got %v, %v", has, err)
+	}
+	if v, err := d.Get(ctx, ds.NewKey("/b/c")); err != nil || !bytes.Equal(v, []byte{0}) {
+		t.Fatalf("expected a zeroed value, got %q, %v", v, err)
+	}
+}
+
+func TestSoftDeleteSuite(t *testing.T) {
+	d, err := (&Options{
+		DSN:        filepath.Join(t.TempDir(), "soft.sqlite"),
+		Migrations: []sqlds.Migration{AddDeletedAtColumn("blocks")},
+		// the suite writes many keys
+		JournalMode: "WAL",
+		Synchronous: "OFF",
+	}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	dstest.SubtestAll(t, sqlds.NewSoftDeleteDatastore(d.DB(), NewSoftDeleteQueries("blocks")))
+}
+
+func TestTTL(t *testing.T) {
+	d, err := (&Options{
+		DSN:        filepath.Join(t.TempDir(), "ttl.sqlite"),
+		Migrations: []sqlds.Migration{AddExpiresAtColumn("blocks")},
+	}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	td := sqlds.NewTTLDatastore(d.DB(), NewTTLQueries("blocks"))
+	ctx := context.Background()
+	if err := td.PutWithTTL(ctx, ds.NewKey("/short"), []byte("short"), 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := td.PutWithTTL(ctx, ds.NewKey("/long"), []byte("long"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := td.Put(ctx, ds.NewKey("/forever"), []byte("forever")); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, err := td.GetExpiration(ctx, ds.NewKey("/long")); err != nil || time.Until(exp) < 59*time.Minute {
+		t.Fatalf("expected an expiration in an hour, got %v, %v", exp, err)
+	}
+	if exp, err := td.GetExpiration(ctx, ds.NewKey("/forever")); err != nil || !exp.IsZero() {
+		t.Fatalf("expected no expiration, got %v, %v", exp, err)
+	}
+	if _, err := td.GetExpiration(ctx, ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := td.SetTTL(ctx, ds.NewKey("/forever"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := td.SetTTL(ctx, ds.NewKey("/missing"), time.Hour); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	rs, err := td.Query(ctx, dsq.Query{ReturnExpirations: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.Expiration.IsZero() {
+			t.Fatalf("expected the expiration of %s", e.Key)
+		}
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := td.Get(ctx, ds.NewKey("/short")); err != ds.ErrNotFound {
+		t.Fatalf("expected the entry to expire, got %v", err)
+	}
+	if has, err := td.Has(ctx, ds.NewKey("/short")); err != nil || has {
+		t.Fatalf("expected no /short, got %v, %v", has, err)
+	}
+	if err := td.SetTTL(ctx, ds.NewKey("/short"), time.Hour); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound for an expired entry, got %v", err)
+	}
+	rs, err = td.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/long", "/forever"}, rs)
+
+	// the expired row is still there until it is overwritten
+	if _, err := d.Get(ctx, ds.NewKey("/short")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := td.PutIfAbsent(ctx, ds.NewKey("/short"), []byte("again")); err != nil || !ok {
+		t.Fatalf("expected the expired entry to be absent, got %v, %v", ok, err)
+	}
+	if exp, err := td.GetExpiration(ctx, ds.NewKey("/short")); err != nil || !exp.IsZero() {
+		t.Fatalf("expected no expiration, got %v, %v", exp, err)
+	}
+
+	if err := td.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	d, err := (&Options{
+		DSN:        filepath.Join(t.TempDir(), "ttl.sqlite"),
+		Migrations: []sqlds.Migration{AddExpiresAtColumn("blocks")},
+	}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	td := sqlds.NewTTLDatastore(d.DB(), NewTTLQueries("blocks"), sqlds.WithSharedDB())
+	ctx := context.Background()
+	for i := range 5 {
+		if err := td.PutWithTTL(ctx, ds.NewKey(fmt.Sprint("/short", i)), []byte("short"), 100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := td.PutWithTTL(ctx, ds.NewKey("/long"), []byte("long"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func() (n int) {
+		if err := d.DB().QueryRow("SELECT count(*) FROM blocks").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if n := count(); n != 6 {
+		t.Fatalf("expected the expired rows to be kept, got %d rows", n)
+	}
+
+	sd := sqlds.WithSweeper(td, sqlds.SweepOptions{Interval: 50 * time.Millisecond, BatchSize: 2})
+	deadline := time.Now().Add(5 * time.Second)
+	for count() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the expired rows to be deleted, got %d rows", count())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := sd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := td.PutWithTTL(ctx, ds.NewKey("/short"), []byte("short"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, batchSize := range []int{0, -1} {
+		if _, err := td.DeleteExpired(ctx, batchSize); err == nil {
+			t.Fatalf("expected an error for a batch size of %d", batchSize)
+		}
+	}
+	if n, err := td.DeleteExpired(ctx, 10); err != nil || n != 1 {
+		t.Fatalf("expected 1 deleted row, got %d, %v", n, err)
+	}
+	if v, err := td.Get(ctx, ds.NewKey("/long")); err != nil || string(v) != "long" {
+		t.Fatalf("expected the live row to be kept, got %q, %v", v, err)
+	}
+}
+
+func TestTTLSuite(t *testing.T) {
+	d, err := (&Options{
+		DSN:        filepath.Join(t.TempDir(), "ttl.sqlite"),
+		Migrations: []sqlds.Migration{AddExpiresAtColumn("blocks")},
+		// the suite writes many keys
+		JournalMode: "WAL",
+		Synchronous: "OFF",
+	}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	dstest.SubtestAll(t, sqlds.NewTTLDatastore(d.DB(), NewTTLQueries("blocks")))
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	key := ds.NewKey("/a")
+	for i, expected := range []bool{true, false, false} {
+		inserted, err := d.PutIfAbsent(ctx, key, []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inserted != expected {
+			t.Fatalf("attempt %d: expected inserted to be %v", i, expected)
+		}
+	}
+
+	// the first value is kept
+	if v, err := d.Get(ctx, key); err != nil || string(v) != "0" {
+		t.Fatalf("expected 0, got %q, %v", v, err)
+	}
+}
+
+func TestBase32KeyEncoder(t *testing.T) {
+	enc := sqlds.Base32KeyEncoder{}
+	for _, k := range []string{"/", "/a", "/a/b/c", "/ünïcode/☃"} {
+		dk, err := enc.Decode(enc.Encode(ds.NewKey(k)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dk.String() != k {
+			t.Fatalf("expected %s, got %s", k, dk)
+		}
+	}
+	if enc.Encode(ds.NewKey("/a/b")) > enc.Encode(ds.NewKey("/a/c")) {
+		t.Fatal("expected the encoding to preserve the key ordering")
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "base32.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(NewQueries("blocks").TableSchema()); err != nil {
+		t.Fatal(err)
+	}
+	d := sqlds.NewDatastore(db, NewQueries("blocks"), sqlds.WithKeyEncoder(enc))
+	defer d.Close()
+
+	addTestCases(t, d, testcases)
+
+	var stored string
+	if err := db.QueryRow("SELECT key FROM blocks ORDER BY key LIMIT 1").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != enc.Encode(ds.NewKey("/a")) {
+		t.Fatalf("expected an encoded key, got %s", stored)
+	}
+
+	ctx := context.Background()
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/a/b", Orders: []dsq.Order{dsq.OrderByKey{}}, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{"/a/b/c"})
+
+	namespaces, err := d.ListNamespaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(namespaces) != "[/a]" {
+		t.Fatalf("unexpected namespaces %v", namespaces)
+	}
+
+	n, err := d.DeletePrefix(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("expected 5 deleted rows, got %d", n)
+	}
+}
+
+func TestBase32KeyEncoderSuite(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "base32.sqlite")+"?_journal_mode=WAL&_sync=OFF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(NewQueries("blocks").TableSchema()); err != nil {
+		t.Fatal(err)
+	}
+	d := sqlds.NewDatastore(db, NewQueries("blocks"), sqlds.WithKeyEncoder(sqlds.Base32KeyEncoder{}))
+	defer d.Close()
+
+	dstest.SubtestAll(t, d)
+}
+
+func TestListNamespaces(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	namespaces, err := d.ListNamespaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(namespaces) != 0 {
+		t.Fatalf("expected no namespace, got %v", namespaces)
+	}
+
+	addTestCases(t, d, testcases)
+	for _, k := range []string{"/blocks/a", "/blocks/b", "/pins/a/b", "/root"} {
+		if err := d.Put(ctx, ds.NewKey(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	namespaces, err = d.ListNamespaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// /e, /f, /g and /root are not namespaces
+	if fmt.Sprint(namespaces) != "[/a /blocks /pins]" {
+		t.Fatalf("unexpected namespaces %v", namespaces)
+	}
+}
+
+func TestAuditedDatastore(t *testing.T) {
+	d, err := (&Options{
+		DSN:        filepath.Join(t.TempDir(), "audit.sqlite"),
+		Migrations: []sqlds.Migration{AddAuditTable("blocks")},
+	}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ad := sqlds.WithAudit(d, NewAuditQueries("blocks"))
+	ctx := context.Background()
+	key := ds.NewKey("/a")
+
+	if err := ad.Put(ctx, key, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ad.Put(ctx, key, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ad.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	// deleting a missing key is not a mutation
+	if err := ad.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ad.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, key, []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ad.QueryAudit(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(v string) []byte {
+		h := sha256.Sum256([]byte(v))
+		return h[:]
+	}
+	expected := []sqlds.AuditEntry{
+		{Key: key, Operation: sqlds.AuditPut, DataHash: hash("1")},
+		{Key: key, Operation: sqlds.AuditPut, DataHash: hash("2")},
+		{Key: key, Operation: sqlds.AuditDelete},
+		{Key: key, Operation: sqlds.AuditPut, DataHash: hash("3")},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d audit entries, got %d", len(expected), len(entries))
+	}
+	for i, e := range entries {
+		if e.Key != expected[i].Key || e.Operation != expected[i].Operation || !bytes.Equal(e.DataHash, expected[i].DataHash) {
+			t.Errorf("entry %d: expected %+v, got %+v", i, expected[i], e)
+		}
+		if e.Timestamp.IsZero() {
+			t.Errorf("entry %d: missing timestamp", i)
+		}
+	}
+}
+
+func TestBatchCommitTwice(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+
+	// empty batch
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); !errors.Is(err, sqlds.ErrAlreadyCommitted) {
+		t.Fatalf("expected ErrAlreadyCommitted, got %v", err)
+	}
+
+	if err := d.Put(ctx, ds.NewKey("/old"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// mixed puts and deletes
+	b, err = d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/new"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, ds.NewKey("/old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); !errors.Is(err, sqlds.ErrAlreadyCommitted) {
+		t.Fatalf("expected ErrAlreadyCommitted, got %v", err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/other"), nil); !errors.Is(err, sqlds.ErrAlreadyCommitted) {
+		t.Fatalf("expected ErrAlreadyCommitted, got %v", err)
+	}
+
+	rs, err := d.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/new"}, rs)
+}
+
+func TestBatchDiscard(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	if err := createIndexTable(d.DB(), "blocks"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := d.DB().Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddAuditTable("blocks")(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := sqlds.WithCache(d, sqlds.CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := sqlds.WithMetrics(d, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrappers := map[string]ds.Batching{
+		"scoped":     sqlds.NewScopedDatastore(d, ds.NewKey("/discard")),
+		"compressed": sqlds.WithCompression(d, sqlds.NewSnappyCodec()),
+		"encrypted":  sqlds.WithEncryption(d, sqlds.DeriveKey([]byte("passphrase"), nil)),
+		"cached":     cached,
+		"indexed":    sqlds.WithIndex(d, NewIndexQueries("blocks"), func([]byte) (map[string]any, error) { return nil, nil }),
+		"audited":    sqlds.WithAudit(d, NewAuditQueries("blocks")),
+		"logged":     sqlds.WithLogging(d, slog.New(slog.DiscardHandler)),
+		"metrics":    metrics,
+		"traced":     sqlds.WithTracing(d, noop.NewTracerProvider().Tracer("test")),
+	}
+
+	newBatches := map[string]func() (ds.Batch, error){
+		"batch":    func() (ds.Batch, error) { return d.Batch(ctx) },
+		"tx":       func() (ds.Batch, error) { return d.BatchWithOptions(&sql.TxOptions{}) },
+		"parallel": func() (ds.Batch, error) { return d.ParallelBatch(2) },
+		"bounded":  func() (ds.Batch, error) { return d.BatchWithMaxSize(2) },
+		"crdb":     func() (ds.Batch, error) { return d.CRDBBatch(sqlds.CRDBOptions{}) },
+	}
+	for name, w := range wrappers {
+		newBatches[name] = func() (ds.Batch, error) { return w.Batch(ctx) }
+	}
+	for name, newBatch := range newBatches {
+		t.Run(name, func(t *testing.T) {
+			b, err := newBatch()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range []string{"/discard/a", "/discard/b", "/discard/c"} {
+				if err := b.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			b.(sqlds.DiscardableBatch).Discard(ctx)
+			if err := b.Put(ctx, ds.NewKey("/discard/d"), nil); !errors.Is(err, sqlds.ErrBatchDiscarded) {
+				t.Fatalf("expected ErrBatchDiscarded, got %v", err)
+			}
+			if err := b.Commit(ctx); !errors.Is(err, sqlds.ErrBatchDiscarded) {
+				t.Fatalf("expected ErrBatchDiscarded, got %v", err)
+			}
+
+			// a bounded batch keeps the operations committed on the way
+			expected := []string{}
+			if name == "bounded" {
+				expected = []string{"/discard/a", "/discard/b"}
+			}
+			rs, err := d.Query(ctx, dsq.Query{Prefix: "/discard"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectMatches(t, expected, rs)
+
+			if _, err := d.DeletePrefix(ctx, ds.NewKey("/discard")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// newParallelDS returns a datastore on a WAL database file, each connection
+// to :memory: opening a distinct database.
+func newParallelDS(tb testing.TB) *sqlds.Datastore {
+	tb.Helper()
+
+	d, err := (&Options{
+		DSN:         filepath.Join(tb.TempDir(), "parallel.sqlite"),
+		JournalMode: "WAL",
+		BusyTimeout: 10 * time.Second,
+	}).Create()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestTxnSuite(t *testing.T) {
+	test.RunTxnDatastoreTests(t, newParallelDS(t))
+}
+
+func TestBatchWithMaxSize(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "bounded.sqlite")
+	d, err := (&Options{DSN: dsn, JournalMode: "WAL", BusyTimeout: 10 * time.Second}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if _, err := d.BatchWithMaxSize(0); err == nil {
+		t.Fatal("expected an error for 0 operations")
+	}
+
+	// another process reading the database
+	other, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	count := func() int {
+		t.Helper()
+		var n int
+		if err := other.QueryRow("SELECT count(*) FROM blocks").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	ctx := context.Background()
+	b, err := d.BatchWithMaxSize(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		if err := b.Put(ctx, ds.NewKey(strconv.Itoa(i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if n := count(); n != (i+1)/10*10 {
+			t.Fatalf("expected %d committed rows after %d puts, got %d", (i+1)/10*10, i+1, n)
+		}
+	}
+	if err := b.Delete(ctx, ds.NewKey("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 24 {
+		t.Fatalf("expected 24 rows, got %d", n)
+	}
+	if err := b.Put(ctx, ds.NewKey("a"), nil); err != sqlds.ErrAlreadyCommitted {
+		t.Fatalf("expected ErrAlreadyCommitted, got %v", err)
+	}
+}
+
+// serializationFailure is the error of a transaction aborted by a conflict,
+// as reported by the PostgreSQL drivers.
+type serializationFailure struct{}
+
+func (serializationFailure) Error() string    { return "restart transaction: serialization failure" }
+func (serializationFailure) SQLState() string { return "40001" }
+
+// conflictingDriver wraps a driver whose commits fail with serialization
+// failures while failures is positive.
+type conflictingDriver struct {
+	driver.Driver
+	failures atomic.Int32
+	commits  atomic.Int32
+}
+
+func (d *conflictingDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return conflictingConn{Conn: c, d: d}, nil
+}
+
+type conflictingConn struct {
+	driver.Conn
+	d *conflictingDriver
+}
+
+func (c conflictingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return conflictingTx{Tx: tx, d: c.d}, nil
+}
+
+type conflictingTx struct {
+	driver.Tx
+	d *conflictingDriver
+}
+
+func (tx conflictingTx) Commit() error {
+	tx.d.commits.Add(1)
+	if tx.d.failures.Add(-1) >= 0 {
+		_ = tx.Tx.Rollback()
+		return serializationFailure{}
+	}
+	return tx.Tx.Commit()
+}
+
+var conflicting = &conflictingDriver{}
+
+func init() {
+	db, err := sql.Open("sqlite3", "")
+	if err != nil {
+		panic(err)
+	}
+	conflicting.Driver = db.Driver()
+	_ = db.Close()
+	sql.Register("sqlite3-conflicting", conflicting)
+}
+
+func TestCRDBBatch(t *testing.T) {
+	d, err := (&Options{Driver: "sqlite3-conflicting", DSN: filepath.Join(t.TempDir(), "crdb.sqlite")}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/b"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := d.CRDBBatch(sqlds.CRDBOptions{MaxRetries: 3, BaseDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, ds.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+
+	conflicting.commits.Store(0)
+	conflicting.failures.Store(3)
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := conflicting.commits.Load(); n != 4 {
+		t.Fatalf("expected 4 commit attempts, got %d", n)
+	}
+	if v, err := d.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+		t.Fatalf("expected a, got %q, %v", v, err)
+	}
+	if has, err := d.Has(ctx, ds.NewKey("/b")); err != nil || has {
+		t.Fatalf("expected /b to be deleted, got %v, %v", has, err)
+	}
+
+	// the failures beyond MaxRetries are returned
+	b, err = d.CRDBBatch(sqlds.CRDBOptions{MaxRetries: 2, BaseDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/c"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	conflicting.commits.Store(0)
+	conflicting.failures.Store(5)
+	if err := b.Commit(ctx); !sqlds.IsSerializationFailure(err) {
+		t.Fatalf("expected a serialization failure, got %v", err)
+	}
+	if n := conflicting.commits.Load(); n != 3 {
+		t.Fatalf("expected 3 commit attempts, got %d", n)
+	}
+	if has, err := d.Has(ctx, ds.NewKey("/c")); err != nil || has {
+		t.Fatalf("expected /c to be absent, got %v, %v", has, err)
+	}
+}
+
+func TestParallelBatch(t *testing.T) {
+	d := newParallelDS(t)
+	ctx := context.Background()
+
+	if _, err := d.ParallelBatch(0); err == nil {
+		t.Fatal("expected an error for 0 workers")
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/old/%d", i)), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := d.ParallelBatch(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := b.Put(ctx, ds.NewKey(fmt.Sprintf("/new/%d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := b.Delete(ctx, ds.NewKey(fmt.Sprintf("/old/%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); !errors.Is(err, sqlds.ErrAlreadyCommitted) {
+		t.Fatalf("expected ErrAlreadyCommitted, got %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		v, err := d.Get(ctx, ds.NewKey(fmt.Sprintf("/new/%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != fmt.Sprint(i) {
+			t.Fatalf("unexpected value %s for key %d", v, i)
+		}
+	}
+	if n, err := d.QueryCount(ctx, dsq.Query{Prefix: "/old"}); err != nil || n != 0 {
+		t.Fatalf("expected the old keys to be deleted, got %d, %v", n, err)
+	}
+
+	// a cancelled commit fails and can be retried
+	b, err = d.ParallelBatch(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/retried"), []byte("r")); err != nil {
+		t.Fatal(err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Commit(cctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/retried")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func benchmarkBatch(b *testing.B, newBatch func(*sqlds.Datastore) (ds.Batch, error)) {
+	d := newParallelDS(b)
+	ctx := context.Background()
+	val := make([]byte, 1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch, err := newBatch(d)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 1000; j++ {
+			if err := batch.Put(ctx, ds.NewKey(fmt.Sprintf("/%d/%d", i, j)), val); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := batch.Commit(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParallelBatch(b *testing.B) {
+	b.Run("batch", func(b *testing.B) {
+		benchmarkBatch(b, func(d *sqlds.Datastore) (ds.Batch, error) {
+			return d.Batch(context.Background())
+		})
+	})
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			benchmarkBatch(b, func(d *sqlds.Datastore) (ds.Batch, error) {
+				return d.ParallelBatch(n)
+			})
+		})
+	}
+}
+
+func TestTxOptions(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+
+	txn, err := d.NewTransaction(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, ds.NewKey("/a"), []byte("a")); !errors.Is(err, sqlds.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err := txn.Delete(ctx, ds.NewKey("/a")); !errors.Is(err, sqlds.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	txn.Discard(ctx)
+
+	txn, err = d.NewTransactionWithOptions(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := d.BatchWithOptions(&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/b"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); !errors.Is(err, sqlds.ErrAlreadyCommitted) {
+		t.Fatalf("expected ErrAlreadyCommitted, got %v", err)
+	}
+
+	rs, err := d.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/b"}, rs)
+}
+
+func TestGetForUpdate(t *testing.T) {
+	ctx := context.Background()
+	key := ds.NewKey("/counter")
+
+	counter := func(t *testing.T, d *sqlds.Datastore) int {
+		t.Helper()
+		v, err := d.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(string(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	t.Run("lost update", func(t *testing.T) {
+		d := newParallelDS(t)
+		if err := d.Put(ctx, key, []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+
+		// both goroutines read the counter before either writes it
+		var read, done sync.WaitGroup
+		read.Add(2)
+		done.Add(2)
+		for range 2 {
+			go func() {
+				defer done.Done()
+				n := counter(t, d)
+				read.Done()
+				read.Wait()
+
+				b, err := d.Batch(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := b.Put(ctx, key, []byte(strconv.Itoa(n+1))); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := b.Commit(ctx); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		done.Wait()
+
+		if n := counter(t, d); n != 1 {
+			t.Fatalf("expected an update to be lost, got %d", n)
+		}
+	})
+
+	t.Run("for update", func(t *testing.T) {
+		d, err := (&Options{
+			DSN:                   filepath.Join(t.TempDir(), "immediate.sqlite"),
+			JournalMode:           "WAL",
+			BusyTimeout:           10 * time.Second,
+			ImmediateTransactions: true,
+		}).Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		if err := d.Put(ctx, key, []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+
+		// the second transaction waits for the first one to commit
+		locked := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		for i := range 2 {
+			go func() {
+				defer wg.Done()
+				if i == 1 {
+					<-locked
+				}
+
+				txn, err := d.NewTransaction(ctx, false)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer txn.Discard(ctx)
+
+				v, err := d.GetForUpdate(ctx, key, txn)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if i == 0 {
+					close(locked)
+					time.Sleep(50 * time.Millisecond)
+				}
+				n, err := strconv.Atoi(string(v))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := txn.Put(ctx, key, []byte(strconv.Itoa(n+1))); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := txn.Commit(ctx); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := counter(t, d); n != 2 {
+			t.Fatalf("expected both updates, got %d", n)
+		}
+	})
+
+	t.Run("foreign transaction", func(t *testing.T) {
+		d, done := newDS(t)
+		defer done()
+		other, closeOther := newDS(t)
+		defer closeOther()
+
+		txn, err := other.NewTransaction(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer txn.Discard(ctx)
+		if _, err := d.GetForUpdate(ctx, key, txn); err == nil {
+			t.Fatal("expected an error for a transaction of another datastore")
+		}
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	src, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	b, err := src.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string][]byte)
+	for i := 0; i < 10000; i++ {
+		k := fmt.Sprintf("/export/%05d", i)
+		v := []byte{byte(i), byte(i >> 8), 0, '\n', '"'}
+		expected[k] = v
+		if err := b.Put(ctx, ds.NewKey(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Export(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), `{"key":"/export/00000","value":"AAAACiI="}`+"\n") {
+		t.Fatalf("unexpected export format: %.60s", buf.String())
+	}
+
+	dst, err := (&Options{DSN: filepath.Join(t.TempDir(), "import.sqlite")}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	n, err := dst.Import(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10000 {
+		t.Fatalf("expected 10000 imported entries, got %d", n)
+	}
+
+	res, err := dst.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+	}
+	for _, e := range entries {
+		if !bytes.Equal(e.Value, expected[e.Key]) {
+			t.Fatalf("unexpected value %v for %s", e.Value, e.Key)
+		}
+	}
+
+	// the transaction of an invalid entry is rolled back
+	n, err = dst.Import(ctx, strings.NewReader(`{"key":"/x","value":""}`+"\nnot json\n"))
+	if err == nil || n != 0 {
+		t.Fatalf("expected an error and no imported entry, got %d, %v", n, err)
+	}
+	if _, err := dst.Get(ctx, ds.NewKey("/x")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMigrateData(t *testing.T) {
+	src, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	b, err := src.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50000; i++ {
+		if err := b.Put(ctx, ds.NewKey(fmt.Sprintf("/migrate/%05d", i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := ds.NewMapDatastore()
+	n, err := sqlds.MigrateData(ctx, src, dst, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 50000 {
+		t.Fatalf("expected 50000 migrated entries, got %d", n)
+	}
+	for _, i := range []int{0, 1, 12345, 49999} {
+		v, err := dst.Get(ctx, ds.NewKey(fmt.Sprintf("/migrate/%05d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != strconv.Itoa(i) {
+			t.Fatalf("unexpected value %s for entry %d", v, i)
+		}
+	}
+
+	// the entries read before the cancellation are committed
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var puts int
+	fs := failstore.NewFailstore(ds.NewMapDatastore(), func(op string) error {
+		if op == "batch-put" {
+			if puts++; puts == 150 {
+				cancel()
+			}
+		}
+		return nil
+	})
+	n, err = sqlds.MigrateData(cctx, src, fs, 100)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if n != 150 {
+		t.Fatalf("expected 150 migrated entries, got %d", n)
+	}
+	rs, err := fs.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 150 {
+		t.Fatalf("expected 150 entries in dst, got %d", len(entries))
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	fill := func(d *sqlds.Datastore) {
+		t.Helper()
+		b, err := d.Batch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10000; i++ {
+			if err := b.Put(ctx, ds.NewKey(fmt.Sprintf("/gc/%d", i)), bytes.Repeat([]byte("v"), 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.DeletePrefix(ctx, ds.NewKey("/gc")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := func(path string) int64 {
+		t.Helper()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+
+	dsn := filepath.Join(dir, "gc.sqlite")
+	d, err := (&Options{DSN: dsn, Synchronous: "OFF"}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	fill(d)
+	before := size(dsn)
+	if err := d.CollectGarbage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if after := size(dsn); after >= before {
+		t.Fatalf("expected the file to shrink, from %d to %d bytes", before, after)
+	}
+
+	// with auto_vacuum the file shrinks on commit
+	autoDSN := filepath.Join(dir, "autogc.sqlite")
+	ad, err := (&Options{DSN: autoDSN, Synchronous: "OFF", AutoGC: true}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ad.Close()
+
+	fill(ad)
+	if auto := size(autoDSN); auto >= before {
+		t.Fatalf("expected auto_vacuum to shrink the file, got %d bytes", auto)
+	}
+}
+
+func TestStat(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+
+	st, err := d.Stat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st != (sqlds.DatastoreStats{}) {
+		t.Fatalf("expected zero stats for an empty table, got %+v", st)
+	}
+
+	for i, v := range []string{"a", "bb", "cccccc"} {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprint(i)), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err = d.Stat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sqlds.DatastoreStats{Count: 3, TotalSize: 9, MinSize: 1, MaxSize: 6, AvgSize: 3}
+	if st != expected {
+		t.Fatalf("expected %+v, got %+v", expected, st)
+	}
+}
+
+// noDiskUsageQueries are sqlite queries without the DiskUsage query.
+type noDiskUsageQueries struct {
+	Queries
+}
+
+func (noDiskUsageQueries) DiskUsage() string {
+	return ""
+}
+
+func TestDiskUsage(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	empty, err := d.DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty == 0 {
+		t.Fatal("expected the pages of the empty table to be counted")
+	}
+
+	value := make([]byte, 1<<20)
+	if err := d.Put(ctx, ds.NewKey("/big"), value); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := d.DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage < empty+1<<20 {
+		t.Fatalf("expected at least %d bytes, got %d", empty+1<<20, usage)
+	}
+
+	// the sizes of the values without the query
+	fd := sqlds.NewDatastore(d.DB(), noDiskUsageQueries{NewQueries("blocks")}, sqlds.WithSharedDB())
+	if usage, err := fd.DiskUsage(ctx); err != nil || usage != 1<<20 {
+		t.Fatalf("expected %d bytes, got %d, %v", 1<<20, usage, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range map[string]struct {
+		opts     *Options
+		expected []string
+	}{
+		"default":   {opts: &Options{}},
+		"hashed":    {opts: &Options{HashKeys: true, UsesSizeColumn: true, TrackCreatedAt: true}},
+		"checksum":  {opts: &Options{UsesChecksumColumn: true}},
+		"no create": {opts: &Options{NoCreate: true}, expected: []string{"the table does not exist"}},
+		"integer key": {
+			opts:     &Options{CreateTableSQL: "CREATE TABLE blocks (key INTEGER PRIMARY KEY, data BLOB)"},
+			expected: []string{"the key column is INTEGER, expected a text column"},
+		},
+		"no primary key": {
+			opts: &Options{UsesSizeColumn: true, CreateTableSQL: "CREATE TABLE blocks (key TEXT, value BLOB)"},
+			expected: []string{
+				"the key column is neither the primary key nor uniquely indexed",
+				"the data column is missing",
+				"the size column is missing",
+			},
+		},
+		"hashed without unique keys": {
+			opts:     &Options{HashKeys: true, CreateTableSQL: "CREATE TABLE blocks (hash BLOB PRIMARY KEY, key TEXT, data BLOB)"},
+			expected: []string{"the key column is neither the primary key nor uniquely indexed"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c.opts.DSN = filepath.Join(t.TempDir(), "check.sqlite")
+			d, db, err := c.opts.create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			err = d.Check(ctx)
+			if len(c.expected) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, sqlds.ErrInvalidSchema) {
+				t.Fatalf("expected ErrInvalidSchema, got %v", err)
+			}
+			for _, e := range c.expected {
+				if !strings.Contains(err.Error(), e) {
+					t.Errorf("expected %q in %v", e, err)
+				}
+			}
+		})
+	}
+
+	// soft delete datastores check the table rather than its live rows
+	d, done := newDS(t)
+	defer done()
+	sd := sqlds.NewDatastore(d.DB(), NewSoftDeleteQueries("soft_check"), sqlds.WithSharedDB())
+	if _, err := d.DB().Exec(NewSoftDeleteQueries("soft_check").TableSchema()); err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	d, err := (&Options{
+		DSN:        filepath.Join(t.TempDir(), "features.sqlite"),
+		Migrations: []sqlds.Migration{AddExpiresAtColumn("blocks")},
+	}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	names := func(features []ds.Feature) (names []string) {
+		for _, f := range features {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	for name, c := range map[string]struct {
+		dstore   interface{ Features() []ds.Feature }
+		expected []string
+	}{
+		"default": {
+			dstore:   d,
+			expected: []string{"Batching", "Checked", "GC", "Persistent", "Scrubbed", "Transaction"},
+		},
+		"read-only": {
+			dstore:   sqlds.NewDatastore(d.DB(), NewQueries("blocks"), sqlds.WithSharedDB(), sqlds.WithReadOnly()),
+			expected: []string{"Batching", "Checked", "Persistent", "Scrubbed", "Transaction"},
+		},
+		"TTL": {
+			dstore:   sqlds.NewTTLDatastore(d.DB(), NewTTLQueries("blocks"), sqlds.WithSharedDB()),
+			expected: []string{"Batching", "Checked", "GC", "Persistent", "Scrubbed", "TTL", "Transaction"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := names(c.dstore.Features()); !slices.Equal(got, c.expected) {
+				t.Fatalf("expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestDatastoreWithStats(t *testing.T) {
+	base, done := newDS(t)
+	defer done()
+
+	d := sqlds.NewDatastoreWithStats(base.DB(), NewQueries("blocks"), sqlds.StatsOptions{
+		Table:    "stats_test",
+		Interval: 10 * time.Millisecond,
+	}, sqlds.WithSharedDB())
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprint(i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Get(ctx, ds.NewKey("0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, ds.NewKey("0")); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := d.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Rest(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := expvar.Get("sqlds.stats_test").(*expvar.Map)
+	if !ok {
+		t.Fatal("expected the stats to be published")
+	}
+	for name, expected := range map[string]string{"Put": "3", "Get": "1", "Delete": "1", "Query": "1"} {
+		if v := m.Get(name); v == nil || v.String() != expected {
+			t.Fatalf("expected %s to be %s, got %v", name, expected, v)
+		}
+	}
+
+	// the pool statistics are updated periodically
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Get("OpenConnections").String() == "0" {
+		if time.Now().After(deadline) {
+			t.Fatal("the pool statistics were not updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, name := range []string{"InUse", "Idle", "WaitCount", "WaitDuration", "MaxIdleClosed"} {
+		if m.Get(name) == nil {
+			t.Fatalf("expected %s to be published", name)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a negative interval is replaced by the default one
+	nd := sqlds.NewDatastoreWithStats(base.DB(), NewQueries("blocks"), sqlds.StatsOptions{
+		Table:    "stats_test",
+		Interval: -time.Second,
+	}, sqlds.WithSharedDB())
+	if err := nd.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexedDatastore(t *testing.T) {
+	d, err := (&Options{
+		DSN:             filepath.Join(t.TempDir(), "index.sqlite"),
+		EnableJSONIndex: true,
+	}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	extract := func(value []byte) (map[string]any, error) {
+		var fields map[string]any
+		err := json.Unmarshal(value, &fields)
+		return fields, err
+	}
+	xd := sqlds.WithIndex(d, NewIndexQueries("blocks"), extract)
+	ctx := context.Background()
+
+	queryKeys := func(field string, value any) []string {
+		t.Helper()
+		rs, err := xd.QueryByIndex(ctx, field, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+
+	for k, v := range map[string]string{
+		"/pins/a": `{"name": "a", "mode": "recursive"}`,
+		"/pins/b": `{"name": "b", "mode": "direct", "size": 3}`,
+		"/pins/c": `{"name": "c", "mode": "recursive"}`,
+	} {
+		if err := xd.Put(ctx, ds.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if keys := queryKeys("mode", "recursive"); fmt.Sprint(keys) != "[/pins/a /pins/c]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if keys := queryKeys("size", 3); fmt.Sprint(keys) != "[/pins/b]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	// an overwrite replaces the indexed fields
+	if err := xd.Put(ctx, ds.NewKey("/pins/a"), []byte(`{"name": "a", "mode": "direct"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if keys := queryKeys("mode", "recursive"); fmt.Sprint(keys) != "[/pins/c]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	// deletes remove the indexed fields, batched or not
+	if err := xd.Delete(ctx, ds.NewKey("/pins/c")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := xd.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, ds.NewKey("/pins/b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/pins/d"), []byte(`{"mode": "recursive"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := queryKeys("mode", "recursive"); fmt.Sprint(keys) != "[/pins/d]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if keys := queryKeys("mode", "direct"); fmt.Sprint(keys) != "[/pins/a]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	var n int
+	if err := d.DB().QueryRow("SELECT count(*) FROM blocks_index").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 indexed fields, got %d", n)
+	}
+
+	// a value the extractor rejects is not stored
+	if err := xd.Put(ctx, ds.NewKey("/pins/e"), []byte("not json")); err == nil {
+		t.Fatal("expected an extraction error")
+	}
+	if has, err := xd.Has(ctx, ds.NewKey("/pins/e")); err != nil || has {
+		t.Fatalf("expected /pins/e to be missing, got %v, %v", has, err)
+	}
+
+	// the keys which are not base32 are reported rather than ending the results
+	bd := sqlds.NewDatastore(d.DB(), NewQueries("blocks"), sqlds.WithKeyEncoder(sqlds.Base32KeyEncoder{}), sqlds.WithSharedDB())
+	bx := sqlds.WithIndex(bd, NewIndexQueries("blocks"), extract)
+	rs, err := bx.QueryByIndex(ctx, "mode", "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Rest(); err == nil {
+		t.Fatal("expected an error decoding the key")
+	}
+}
+
+func TestQueryAbandoned(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/rows/%02d", i)), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitReleased := func(gc bool) {
+		t.Helper()
+		for i := 0; d.DB().Stats().InUse != 0; i++ {
+			if i == 100 {
+				t.Fatalf("%d connections still in use", d.DB().Stats().InUse)
+			}
+			if gc {
+				runtime.GC()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// cancelling the context releases the connection and is reported
+	qctx, cancel := context.WithCancel(ctx)
+	rs, err := d.Query(qctx, dsq.Query{Prefix: "/rows"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := rs.NextSync(); !ok || r.Error != nil {
+		t.Fatalf("unexpected result %v, %v", r, ok)
+	}
+	cancel()
+	waitReleased(false)
+	if r, ok := rs.NextSync(); !ok || !errors.Is(r.Error, context.Canceled) {
+		t.Fatalf("expected a cancellation error, got %v, %v", r, ok)
+	}
+	if _, ok := rs.NextSync(); ok {
+		t.Fatal("expected the results to be exhausted")
+	}
+
+	// results abandoned without closing them are eventually released
+	func() {
+		rs, err := d.Query(ctx, dsq.Query{Prefix: "/rows"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, ok := rs.NextSync(); !ok || r.Error != nil {
+			t.Fatalf("unexpected result %v, %v", r, ok)
+		}
+	}()
+	waitReleased(true)
+}
+
+func TestHas(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	addTestCases(t, d, testcases)
+
+	has, err := d.Has(ctx, ds.NewKey("/a/b/c"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !has {
+		t.Error("Key should be found")
+	}
+
+	has, err = d.Has(ctx, ds.NewKey("/a/b/c/d"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if has {
+		t.Error("Key should not be found")
+	}
+}
+
+func TestNotExistGet(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	addTestCases(t, d, testcases)
+
+	has, err := d.Has(ctx, ds.NewKey("/a/b/c/d"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if has {
+		t.Error("Key should not be found")
+	}
+
+	val, err := d.Get(ctx, ds.NewKey("/a/b/c/d"))
+	if val != nil {
+		t.Error("Key should not be found")
+	}
+
+	if err != ds.ErrNotFound {
+		t.Error("Error was not set to ds.ErrNotFound")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	addTestCases(t, d, testcases)
+
+	has, err := d.Has(ctx, ds.NewKey("/a/b/c"))
+	if err != nil {
+		t.Error(err)
+	}
+	if !has {
+		t.Error("Key should be found")
+	}
+
+	err = d.Delete(ctx, ds.NewKey("/a/b/c"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	has, err = d.Has(ctx, ds.NewKey("/a/b/c"))
+	if err != nil {
+		t.Error(err)
+	}
+	if has {
+		t.Error("Key should not be found")
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	addTestCases(t, d, testcases)
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/a/bc"), []byte("sibling")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := d.DeletePrefix(ctx, ds.NewKey("/a/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 deleted rows, got %d", n)
+	}
+
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/a/b", "/a/bc", "/a/c", "/a/d"}, rs)
+
+	n, err = d.DeletePrefix(ctx, ds.NewKey("/nothing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no deleted row, got %d", n)
+	}
+
+	// scoped datastores only delete in their scope
+	scoped := sqlds.NewScopedDatastore(d, ds.NewKey("/a"))
+	n, err = scoped.DeletePrefix(ctx, ds.NewKey("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("expected 4 deleted rows, got %d", n)
+	}
+
+	rs, err = d.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/a", "/e", "/f", "/g"}, rs)
+
+	// the bound pattern uses the primary key index rather than scanning
+	// the table
+	var id, parent, notused int
+	var detail string
+	plan := "EXPLAIN QUERY PLAN " + NewQueries("blocks").DeletePrefix()
+	if err := d.DB().QueryRowContext(ctx, plan, NewQueries("blocks").PrefixPattern("/a/")).Scan(&id, &parent, &notused, &detail); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(detail, "SEARCH") {
+		t.Fatalf("expected an index search, got %s", detail)
+	}
+}
+
+func TestGetEmpty(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	err := d.Put(ctx, ds.NewKey("/a"), []byte{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	v, err := d.Get(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(v) != 0 {
+		t.Error("expected 0 len []byte form get")
+	}
+}
+
+func TestBatching(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range testcases {
+		err := b.Put(ctx, ds.NewKey(k), []byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = b.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range testcases {
+		val, err := d.Get(ctx, ds.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v != string(val) {
+			t.Fatal("got wrong data!")
+		}
+	}
+
+	//Test delete
+	b, err = d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Delete(ctx, ds.NewKey("/a/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Delete(ctx, ds.NewKey("/a/b/c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectMatches(t, []string{
+		"/a",
+		"/a/b/d",
+		"/a/c",
+		"/a/d",
+		"/e",
+		"/f",
+		"/g",
+	}, rs)
+}
+
+func SubtestBasicPutGet(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	k := ds.NewKey("foo")
+	val := []byte("Hello Datastore!")
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	err := d.Put(ctx, k, val)
+	if err != nil {
+		t.Fatal("error putting to datastore: ", err)
+	}
+
+	have, err := d.Has(ctx, k)
+	if err != nil {
+		t.Fatal("error calling has on key we just put: ", err)
+	}
+
+	if !have {
+		t.Fatal("should have key foo, has returned false")
+	}
+
+	size, err := d.GetSize(ctx, k)
+	if err != nil {
+		t.Fatal("error getting size after put: ", err)
+	}
+	if size != len(val) {
+		t.Fatalf("incorrect size: expected %d, got %d", len(val), size)
+	}
+
+	out, err := d.Get(ctx, k)
+	if err != nil {
+		t.Fatal("error getting value after put: ", err)
+	}
+
+	if !bytes.Equal(out, val) {
+		t.Fatal("value received on get wasnt what we expected:", out)
+	}
+
+	have, err = d.Has(ctx, k)
+	if err != nil {
+		t.Fatal("error calling has after get: ", err)
+	}
+
+	if !have {
+		t.Fatal("should have key foo, has returned false")
+	}
+
+	size, err = d.GetSize(ctx, k)
 	if err != nil {
 		t.Fatal("error getting size after get: ", err)
 	}
-	if size != len(val) {
-		t.Fatalf("incorrect size: expected %d, got %d", len(val), size)
+	if size != len(val) {
+		t.Fatalf("incorrect size: expected %d, got %d", len(val), size)
+	}
+
+	err = d.Delete(ctx, k)
+	if err != nil {
+		t.Fatal("error calling delete: ", err)
+	}
+
+	have, err = d.Has(ctx, k)
+	if err != nil {
+		t.Fatal("error calling has after delete: ", err)
+	}
+
+	if have {
+		t.Fatal("should not have key foo, has returned true")
+	}
+
+	size, err = d.GetSize(ctx, k)
+	switch err {
+	case ds.ErrNotFound:
+	case nil:
+		t.Fatal("expected error getting size after delete")
+	default:
+		t.Fatal("wrong error getting size after delete: ", err)
+	}
+	if size != -1 {
+		t.Fatal("expected missing size to be -1")
+	}
+}
+
+func TestNotFounds(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	badk := ds.NewKey("notreal")
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	val, err := d.Get(ctx, badk)
+	if err != ds.ErrNotFound {
+		t.Fatal("expected ErrNotFound for key that doesnt exist, got: ", err)
+	}
+
+	if val != nil {
+		t.Fatal("get should always return nil for not found values")
+	}
+
+	have, err := d.Has(ctx, badk)
+	if err != nil {
+		t.Fatal("error calling has on not found key: ", err)
+	}
+	if have {
+		t.Fatal("has returned true for key we don't have")
+	}
+
+	size, err := d.GetSize(ctx, badk)
+	switch err {
+	case ds.ErrNotFound:
+	case nil:
+		t.Fatal("expected error getting size after delete")
+	default:
+		t.Fatal("wrong error getting size after delete: ", err)
+	}
+	if size != -1 {
+		t.Fatal("expected missing size to be -1")
+	}
+}
+
+func SubtestManyKeysAndQuery(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	var keys []ds.Key
+	var keystrs []string
+	var values [][]byte
+	count := 100
+	for i := 0; i < count; i++ {
+		s := fmt.Sprintf("%dkey%d", i, i)
+		dsk := ds.NewKey(s)
+		keystrs = append(keystrs, dsk.String())
+		keys = append(keys, dsk)
+		buf := make([]byte, 64)
+		_, _ = rand.Read(buf)
+		values = append(values, buf)
+	}
+
+	t.Logf("putting %d values", count)
+	for i, k := range keys {
+		err := d.Put(ctx, k, values[i])
+		if err != nil {
+			t.Fatalf("error on put[%d]: %s", i, err)
+		}
+	}
+
+	t.Log("getting values back")
+	for i, k := range keys {
+		val, err := d.Get(ctx, k)
+		if err != nil {
+			t.Fatalf("error on get[%d]: %s", i, err)
+		}
+
+		if !bytes.Equal(val, values[i]) {
+			t.Fatal("input value didnt match the one returned from Get")
+		}
+	}
+
+	t.Log("querying values")
+	q := dsq.Query{KeysOnly: true}
+	resp, err := d.Query(ctx, q)
+	if err != nil {
+		t.Fatal("calling query: ", err)
+	}
+
+	t.Log("aggregating query results")
+	var outkeys []string
+	for {
+		res, ok := resp.NextSync()
+		if res.Error != nil {
+			t.Fatal("query result error: ", res.Error)
+		}
+		if !ok {
+			break
+		}
+
+		outkeys = append(outkeys, res.Key)
+	}
+
+	t.Log("verifying query output")
+	sort.Strings(keystrs)
+	sort.Strings(outkeys)
+
+	if len(keystrs) != len(outkeys) {
+		t.Fatal("got wrong number of keys back")
+	}
+
+	for i, s := range keystrs {
+		if outkeys[i] != s {
+			t.Fatalf("in key output, got %s but expected %s", outkeys[i], s)
+		}
+	}
+
+	t.Log("deleting all keys")
+	for _, k := range keys {
+		if err := d.Delete(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Tests from basic_tests from go-datastore
+func TestBasicPutGet(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	k := ds.NewKey("foo")
+	val := []byte("Hello Datastore!")
+
+	err := d.Put(ctx, k, val)
+	if err != nil {
+		t.Fatal("error putting to datastore: ", err)
+	}
+
+	have, err := d.Has(ctx, k)
+	if err != nil {
+		t.Fatal("error calling has on key we just put: ", err)
+	}
+
+	if !have {
+		t.Fatal("should have key foo, has returned false")
+	}
+
+	out, err := d.Get(ctx, k)
+	if err != nil {
+		t.Fatal("error getting value after put: ", err)
+	}
+
+	if !bytes.Equal(out, val) {
+		t.Fatal("value received on get wasnt what we expected:", out)
+	}
+
+	have, err = d.Has(ctx, k)
+	if err != nil {
+		t.Fatal("error calling has after get: ", err)
+	}
+
+	if !have {
+		t.Fatal("should have key foo, has returned false")
+	}
+
+	err = d.Delete(ctx, k)
+	if err != nil {
+		t.Fatal("error calling delete: ", err)
+	}
+
+	have, err = d.Has(ctx, k)
+	if err != nil {
+		t.Fatal("error calling has after delete: ", err)
+	}
+
+	if have {
+		t.Fatal("should not have key foo, has returned true")
+	}
+	SubtestBasicPutGet(t)
+}
+
+func TestManyKeysAndQuery(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	var keys []ds.Key
+	var keystrs []string
+	var values [][]byte
+	count := 100
+	for i := 0; i < count; i++ {
+		s := fmt.Sprintf("%dkey%d", i, i)
+		dsk := ds.NewKey(s)
+		keystrs = append(keystrs, dsk.String())
+		keys = append(keys, dsk)
+		buf := make([]byte, 64)
+		_, _ = rand.Read(buf)
+		values = append(values, buf)
+	}
+
+	t.Logf("putting %d values", count)
+	for i, k := range keys {
+		err := d.Put(ctx, k, values[i])
+		if err != nil {
+			t.Fatalf("error on put[%d]: %s", i, err)
+		}
+	}
+
+	t.Log("getting values back")
+	for i, k := range keys {
+		val, err := d.Get(ctx, k)
+		if err != nil {
+			t.Fatalf("error on get[%d]: %s", i, err)
+		}
+
+		if !bytes.Equal(val, values[i]) {
+			t.Fatal("input value didnt match the one returned from Get")
+		}
+	}
+
+	t.Log("querying values")
+	q := dsq.Query{KeysOnly: true}
+	resp, err := d.Query(ctx, q)
+	if err != nil {
+		t.Fatal("calling query: ", err)
+	}
+
+	t.Log("aggregating query results")
+	var outkeys []string
+	for {
+		res, ok := resp.NextSync()
+		if res.Error != nil {
+			t.Fatal("query result error: ", res.Error)
+		}
+		if !ok {
+			break
+		}
+
+		outkeys = append(outkeys, res.Key)
+	}
+
+	t.Log("verifying query output")
+	sort.Strings(keystrs)
+	sort.Strings(outkeys)
+
+	if len(keystrs) != len(outkeys) {
+		t.Fatalf("got wrong number of keys back, %d != %d", len(keystrs), len(outkeys))
+	}
+
+	for i, s := range keystrs {
+		if outkeys[i] != s {
+			t.Fatalf("in key output, got %s but expected %s", outkeys[i], s)
+		}
+	}
+
+	t.Log("deleting all keys")
+	for _, k := range keys {
+		if err := d.Delete(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	SubtestManyKeysAndQuery(t)
+}
+
+func TestSuite(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	dstest.SubtestAll(t, d)
+}
+
+func TestMigrations(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "migrate.sqlite")
+	ctx := context.Background()
+
+	var applied []int
+	migrations := []sqlds.Migration{
+		func(tx *sql.Tx) error {
+			applied = append(applied, 1)
+			_, err := tx.Exec("ALTER TABLE blocks ADD COLUMN extra TEXT")
+			return err
+		},
+		func(tx *sql.Tx) error {
+			applied = append(applied, 2)
+			_, err := tx.Exec("CREATE INDEX blocks_extra_idx ON blocks (extra)")
+			return err
+		},
+	}
+
+	d, err := (&Options{DSN: dsn, Migrations: migrations}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 {
+		t.Fatalf("expected 2 migrations to run, got %v", applied)
+	}
+
+	// re-opening at the current version must not run anything
+	d, err = (&Options{DSN: dsn, Migrations: migrations}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 {
+		t.Fatalf("expected no migration to run on re-open, got %v", applied)
+	}
+
+	// a failing migration must roll back every pending migration
+	failing := append(migrations,
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec("ALTER TABLE blocks ADD COLUMN other TEXT")
+			return err
+		},
+		func(tx *sql.Tx) error {
+			return errors.New("boom")
+		},
+	)
+	if _, err := (&Options{DSN: dsn, Migrations: failing}).Create(); err == nil {
+		t.Fatal("expected failing migration to return an error")
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("expected schema version 2 after failed migration, got %d", version)
+	}
+	if _, err := db.Exec("SELECT other FROM blocks"); err == nil {
+		t.Fatal("expected failed migration to be rolled back")
+	}
+
+	// a database newer than the known migrations must be rejected
+	if _, err := (&Options{DSN: dsn, Migrations: migrations[:1]}).Create(); err == nil {
+		t.Fatal("expected an error opening a newer schema version")
+	}
+
+	// nothing is applied with a context which is done
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := sqlds.MigrateContext(cctx, db, userVersion{}, failing[:3]); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("expected schema version 2 after a cancelled migration, got %d", version)
+	}
+}
+
+func TestScopedDatastore(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+
+	ipfs := sqlds.NewScopedDatastore(d, ds.NewKey("/ipfs"))
+	ipns := sqlds.NewScopedDatastore(d, ds.NewKey("/ipns"))
+
+	if ipfs.Prefix().String() != "/ipfs" {
+		t.Fatalf("unexpected prefix %s", ipfs.Prefix())
+	}
+
+	if err := ipfs.Put(ctx, ds.NewKey("/a"), []byte("ipfs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipns.Put(ctx, ds.NewKey("/a"), []byte("ipns")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipns.Put(ctx, ds.NewKey("/b"), []byte("ipns")); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := ipfs.Get(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "ipfs" {
+		t.Fatalf("expected ipfs, got %s", v)
+	}
+
+	has, err := ipfs.Has(ctx, ds.NewKey("/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has {
+		t.Fatal("key of another scope should not be found")
+	}
+
+	v, err = d.Get(ctx, ds.NewKey("/ipns/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "ipns" {
+		t.Fatalf("expected ipns, got %s", v)
+	}
+
+	rs, err := ipns.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{"/a", "/b"})
+
+	rs, err = ipns.Query(ctx, dsq.Query{Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{"/b"})
+
+	if err := ipfs.Delete(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	has, err = ipns.Has(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Fatal("delete should not affect another scope")
+	}
+
+	// the root scope is the whole datastore
+	root := sqlds.NewScopedDatastore(d, ds.NewKey("/"))
+	if v, err := root.Get(ctx, ds.NewKey("/ipns/b")); err != nil || string(v) != "ipns" {
+		t.Fatalf("expected ipns, got %q, %v", v, err)
+	}
+	rs, err = root.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{"/ipns/a", "/ipns/b"})
+}
+
+func TestScopedConcurrentBatches(t *testing.T) {
+	d := newParallelDS(t)
+	ctx := context.Background()
+
+	scopes := []*sqlds.ScopedDatastore{
+		sqlds.NewScopedDatastore(d, ds.NewKey("/ipfs")),
+		sqlds.NewScopedDatastore(d, ds.NewKey("/ipns")),
+	}
+
+	// the same keys are written and deleted in both scopes
+	var wg sync.WaitGroup
+	errs := make(chan error, len(scopes))
+	for _, s := range scopes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 10; round++ {
+				b, err := s.Batch(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for i := 0; i < 100; i++ {
+					k := ds.NewKey(fmt.Sprint(i))
+					if i%2 == 0 && round%2 == 1 {
+						err = b.Delete(ctx, k)
+					} else {
+						err = b.Put(ctx, k, []byte(s.Prefix().String()))
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+				if err := b.Commit(ctx); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for _, s := range scopes {
+		rs, err := s.Query(ctx, dsq.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 50 {
+			t.Fatalf("expected 50 entries in %s, got %d", s.Prefix(), len(entries))
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Key, s.Prefix().String()) {
+				t.Fatalf("expected the scope prefix to be stripped from %s", e.Key)
+			}
+			if string(e.Value) != s.Prefix().String() {
+				t.Fatalf("unexpected value %s in %s", e.Value, s.Prefix())
+			}
+		}
+	}
+}
+
+func TestScopedSuite(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	dstest.SubtestAll(t, sqlds.NewScopedDatastore(d, ds.NewKey("/scope")))
+}
+
+func TestCompressedDatastore(t *testing.T) {
+	zstdCodec, err := sqlds.NewZstdCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codecs := map[string]sqlds.Codec{
+		"snappy": sqlds.NewSnappyCodec(),
+		"zstd":   zstdCodec,
+	}
+
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			d, done := newDS(t)
+			defer done()
+
+			ctx := context.Background()
+			cd := sqlds.WithCompression(d, codec)
+
+			val := bytes.Repeat([]byte("compressible "), 1024)
+			if err := cd.Put(ctx, ds.NewKey("/a"), val); err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := cd.Get(ctx, ds.NewKey("/a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, val) {
+				t.Fatal("round-tripped value differs")
+			}
+
+			size, err := cd.GetSize(ctx, ds.NewKey("/a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != len(val) {
+				t.Fatalf("expected decompressed size %d, got %d", len(val), size)
+			}
+
+			stored, err := d.GetSize(ctx, ds.NewKey("/a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored >= len(val) {
+				t.Fatalf("expected stored size to be smaller than %d, got %d", len(val), stored)
+			}
+
+			rs, err := cd.Query(ctx, dsq.Query{ReturnsSizes: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := rs.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || !bytes.Equal(entries[0].Value, val) || entries[0].Size != len(val) {
+				t.Fatal("query did not return the decompressed value")
+			}
+
+			// a tampered blob must not decode silently
+			if err := d.Put(ctx, ds.NewKey("/a"), []byte("not compressed")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cd.Get(ctx, ds.NewKey("/a")); err == nil {
+				t.Fatal("expected an error reading a tampered value")
+			}
+			rs, err = cd.Query(ctx, dsq.Query{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := rs.Rest(); err == nil {
+				t.Fatal("expected an error querying a tampered value")
+			}
+		})
+	}
+}
+
+func TestCompressedSuite(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	dstest.SubtestAll(t, sqlds.WithCompression(d, sqlds.NewSnappyCodec()))
+}
+
+func TestEncryptedDatastore(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	key := sqlds.DeriveKey([]byte("passphrase"), []byte("salt"))
+	if key != sqlds.DeriveKey([]byte("passphrase"), []byte("salt")) {
+		t.Fatal("expected the derived key to be deterministic")
+	}
+	if key == sqlds.DeriveKey([]byte("passphrase"), []byte("other salt")) {
+		t.Fatal("expected the salt to change the derived key")
+	}
+	ed := sqlds.WithEncryption(d, key)
+
+	val := []byte("a very secret value")
+	if err := ed.Put(ctx, ds.NewKey("/a"), val); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ed.Get(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, val) {
+		t.Fatal("round-tripped value differs")
+	}
+
+	size, err := ed.GetSize(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(val) {
+		t.Fatalf("expected cleartext size %d, got %d", len(val), size)
+	}
+
+	// the plaintext cannot be read from the table
+	var raw []byte
+	if err := d.DB().QueryRow("SELECT data FROM blocks WHERE key = $1", "/a").Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, val) || bytes.Contains(raw, []byte("secret")) {
+		t.Fatal("the stored value contains the plaintext")
+	}
+
+	// the same value is encrypted with a different nonce every time
+	if err := ed.Put(ctx, ds.NewKey("/b"), val); err != nil {
+		t.Fatal(err)
+	}
+	var rawB []byte
+	if err := d.DB().QueryRow("SELECT data FROM blocks WHERE key = $1", "/b").Scan(&rawB); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(raw, rawB) {
+		t.Fatal("expected different ciphertexts for the same value")
+	}
+
+	rs, err := ed.Query(ctx, dsq.Query{ReturnsSizes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !bytes.Equal(entries[0].Value, val) || entries[0].Size != len(val) {
+		t.Fatal("query did not return the decrypted value")
+	}
+
+	rs, err = ed.Query(ctx, dsq.Query{KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Value != nil || entries[0].Size != len(val) {
+		t.Fatalf("unexpected keys only entries %+v", entries)
+	}
+
+	// a value encrypted with another key must not decrypt
+	other := sqlds.WithEncryption(d, sqlds.DeriveKey([]byte("other"), []byte("salt")))
+	if _, err := other.Get(ctx, ds.NewKey("/a")); err == nil {
+		t.Fatal("expected an error decrypting with another key")
+	}
+
+	// a tampered blob must not decrypt silently
+	raw[len(raw)-1] ^= 0xff
+	if _, err := d.DB().Exec("UPDATE blocks SET data = $1 WHERE key = $2", raw, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ed.Get(ctx, ds.NewKey("/a")); err == nil {
+		t.Fatal("expected an error reading a tampered value")
+	}
+	rs, err = ed.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Rest(); err == nil {
+		t.Fatal("expected an error querying a tampered value")
+	}
+}
+
+func TestEncryptedSuite(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	dstest.SubtestAll(t, sqlds.WithEncryption(d, sqlds.DeriveKey([]byte("passphrase"), nil)))
+}
+
+// countingDatastore counts the reads reaching the wrapped datastore.
+type countingDatastore struct {
+	ds.Batching
+	gets int
+}
+
+func (c *countingDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	c.gets++
+	return c.Batching.Get(ctx, key)
+}
+
+func TestCachedDatastore(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	child := &countingDatastore{Batching: d}
+	cd, err := sqlds.WithCache(child, sqlds.CacheOptions{Capacity: 2, MaxValueSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get after Put hits the cache
+	if err := cd.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := cd.Get(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "a" || child.gets != 0 {
+		t.Fatalf("expected a cached value, got %s after %d gets", v, child.gets)
+	}
+	if size, err := cd.GetSize(ctx, ds.NewKey("/a")); err != nil || size != 1 {
+		t.Fatalf("unexpected size %d, %v", size, err)
+	}
+
+	// a miss fills the cache
+	if err := d.Put(ctx, ds.NewKey("/b"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if v, err := cd.Get(ctx, ds.NewKey("/b")); err != nil || string(v) != "b" {
+			t.Fatalf("unexpected value %s, %v", v, err)
+		}
+	}
+	if child.gets != 1 {
+		t.Fatalf("expected 1 get, got %d", child.gets)
+	}
+
+	// Delete evicts
+	if err := cd.Delete(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cd.Get(ctx, ds.NewKey("/a")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if has, err := cd.Has(ctx, ds.NewKey("/a")); err != nil || has {
+		t.Fatalf("expected the deleted key to be missing, got %v, %v", has, err)
+	}
+
+	// large values are not cached
+	child.gets = 0
+	if err := cd.Put(ctx, ds.NewKey("/large"), []byte("too large")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cd.Get(ctx, ds.NewKey("/large")); err != nil {
+		t.Fatal(err)
+	}
+	if child.gets != 1 {
+		t.Fatalf("expected the large value to be read from the datastore, got %d gets", child.gets)
+	}
+
+	// committed batches evict their keys
+	b, err := cd.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/b"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cd.Get(ctx, ds.NewKey("/b")); err != nil || string(v) != "new" {
+		t.Fatalf("unexpected value %s, %v", v, err)
+	}
+}
+
+func TestCachedSuite(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	cd, err := sqlds.WithCache(d, sqlds.CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstest.SubtestAll(t, cd)
+}
+
+// recordingDatastore appends its name to calls on Get.
+type recordingDatastore struct {
+	ds.Batching
+	name  string
+	calls *[]string
+}
+
+func (r *recordingDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	*r.calls = append(*r.calls, r.name)
+	return r.Batching.Get(ctx, key)
+}
+
+func TestChain(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	recording := func(name string) sqlds.Middleware {
+		return func(d ds.Batching) (ds.Batching, error) {
+			return &recordingDatastore{Batching: d, name: name, calls: &calls}, nil
+		}
+	}
+
+	chained, err := sqlds.Chain(d, recording("inner"), recording("middle"), recording("outer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chained.Get(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ",") != "outer,middle,inner" {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+
+	// a failing middleware fails the chain
+	failing := func(ds.Batching) (ds.Batching, error) { return nil, errors.New("boom") }
+	if _, err := sqlds.Chain(d, recording("inner"), failing); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestChainSuite(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	var logs bytes.Buffer
+	chained, err := sqlds.Chain(d,
+		sqlds.RetryMiddleware(sqlds.DefaultRetryPolicy),
+		sqlds.LoggingMiddleware(slog.New(slog.NewTextHandler(&logs, nil))),
+		sqlds.TracingMiddleware(noop.NewTracerProvider().Tracer("test")),
+		sqlds.CacheMiddleware(128),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dstest.SubtestAll(t, chained)
+}
+
+func TestReplicaDatastore(t *testing.T) {
+	primary, err := (&Options{}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := (&Options{}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each connection to :memory: is a separate database
+	primary.DB().SetMaxOpenConns(1)
+	replica.DB().SetMaxOpenConns(1)
+
+	rd := sqlds.NewReplicaDatastore(primary.DB(), []*sql.DB{replica.DB()}, NewQueries("blocks"))
+	defer func() {
+		if err := rd.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	key := ds.NewKey("/a")
+
+	// writes go to the primary, reads to the replica
+	if err := rd.Put(ctx, key, []byte("primary")); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := replica.Has(ctx, key); err != nil || has {
+		t.Fatalf("expected the put to not reach the replica, got %v, %v", has, err)
+	}
+	if _, err := rd.Get(ctx, key); err != ds.ErrNotFound {
+		t.Fatalf("expected the get to be served by the replica, got %v", err)
+	}
+
+	if err := replica.Put(ctx, key, []byte("replica")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := rd.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "replica" {
+		t.Fatalf("expected the replica value, got %s", v)
+	}
+	if has, err := rd.Has(ctx, key); err != nil || !has {
+		t.Fatalf("expected the key in the replica, got %v, %v", has, err)
+	}
+	if size, err := rd.GetSize(ctx, key); err != nil || size != len("replica") {
+		t.Fatalf("expected the replica size, got %d, %v", size, err)
+	}
+	rs, err := rd.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/a"}, rs)
+
+	// transactions read from the primary
+	txn, err := rd.NewTransaction(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = txn.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "primary" {
+		t.Fatalf("expected the primary value in the transaction, got %s", v)
+	}
+	txn.Discard(ctx)
+
+	if err := rd.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := primary.Has(ctx, key); err != nil || has {
+		t.Fatalf("expected the delete to reach the primary, got %v, %v", has, err)
+	}
+}
+
+func TestExtraDSNParams(t *testing.T) {
+	opts := &Options{
+		DSN:            "file:params.sqlite?mode=memory",
+		ExtraDSNParams: map[string]string{"_busy_timeout": "5000", "_foreign_keys": "on"},
+	}
+	opts.setDefaults()
+	if dsn := opts.dsn(); dsn != "file:params.sqlite?mode=memory&_busy_timeout=5000&_foreign_keys=on" {
+		t.Fatalf("unexpected dsn %s", dsn)
+	}
+	if opts.ExtraDSNParams["_busy_timeout"] != "5000" || len(opts.ExtraDSNParams) != 2 {
+		t.Fatalf("unexpected params %v", opts.ExtraDSNParams)
+	}
+
+	d, err := (&Options{ExtraDSNParams: map[string]string{"_busy_timeout": "5000"}}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var timeout int
+	if err := d.DB().QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil {
+		t.Fatal(err)
+	}
+	if timeout != 5000 {
+		t.Fatalf("expected a busy timeout of 5000, got %d", timeout)
+	}
+}
+
+func TestWALMode(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "wal.sqlite")
+
+	d, err := (&Options{
+		DSN:         dsn,
+		JournalMode: "wal",
+		Synchronous: "normal",
+		BusyTimeout: 5 * time.Second,
+		CacheSize:   -2000,
+	}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// journal_mode is persisted in the database file
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Fatalf("expected journal mode wal, got %s", mode)
+	}
+
+	ctx := context.Background()
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/w%d/%d", w, i)), []byte("v")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				rs, err := d.Query(ctx, dsq.Query{Prefix: "/w0"})
+				if err == nil {
+					_, err = rs.Rest()
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if _, err := (&Options{JournalMode: "bogus"}).Create(); err == nil {
+		t.Fatal("expected an invalid journal mode to be rejected")
+	}
+}
+
+// recordingTracer records the names of the spans started by a noop tracer.
+type recordingTracer struct {
+	trace.Tracer
+	spans []string
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	r.spans = append(r.spans, name)
+	return r.Tracer.Start(ctx, name, opts...)
+}
+
+func TestTracedDatastore(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	rec := &recordingTracer{Tracer: noop.NewTracerProvider().Tracer("test")}
+	td := sqlds.WithTracing(d, rec)
+	ctx := context.Background()
+
+	if err := td.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := td.Get(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := td.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Rest(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := td.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"sqlds.Put", "sqlds.Get", "sqlds.Query", "sqlds.Batch", "sqlds.Batch.Commit"}
+	if strings.Join(rec.spans, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected spans %v, got %v", expected, rec.spans)
+	}
+}
+
+func TestTracedSuite(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	dstest.SubtestAll(t, sqlds.WithTracing(d, noop.NewTracerProvider().Tracer("test")))
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	d, err := (&Options{DSN: filepath.Join(dir, "live.sqlite")}).CreateExtended()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := b.Put(ctx, ds.NewKey(fmt.Sprintf("/backup/%d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// keep writing while the backup runs
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = d.Put(ctx, ds.NewKey(fmt.Sprintf("/other/%d", i)), []byte("v"))
+		}
+	}()
+
+	dst := filepath.Join(dir, "backup.sqlite")
+	err = d.Backup(ctx, dst)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := (&Options{DSN: dst}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+
+	for i := 0; i < 1000; i++ {
+		v, err := backup.Get(ctx, ds.NewKey(fmt.Sprintf("/backup/%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != fmt.Sprint(i) {
+			t.Fatalf("unexpected value %s for key %d", v, i)
+		}
 	}
 
-	err = d.Delete(ctx, k)
+	// backing up again replaces the previous backup
+	if err := d.Backup(ctx, dst); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupInMemory(t *testing.T) {
+	d, err := (&Options{}).CreateExtended()
 	if err != nil {
-		t.Fatal("error calling delete: ", err)
+		t.Fatal(err)
 	}
+	defer d.Close()
+	// every connection to :memory: is a different database
+	d.DB().SetMaxOpenConns(1)
 
-	have, err = d.Has(ctx, k)
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the online backup API can copy an in-memory database
+	dst := filepath.Join(t.TempDir(), "backup.sqlite")
+	if err := d.Backup(ctx, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := (&Options{DSN: dst}).Create()
 	if err != nil {
-		t.Fatal("error calling has after delete: ", err)
+		t.Fatal(err)
 	}
+	defer backup.Close()
+	if v, err := backup.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+		t.Fatalf("expected a, got %q, %v", v, err)
+	}
+}
 
-	if have {
-		t.Fatal("should not have key foo, has returned true")
+// noBackupConn is a sqlite3 connection without the online backup API.
+type noBackupConn struct {
+	driver.Conn
+}
+
+// noBackupDriver opens noBackupConns.
+type noBackupDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (d *noBackupDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
 	}
+	return noBackupConn{c}, nil
+}
 
-	size, err = d.GetSize(ctx, k)
-	switch err {
-	case ds.ErrNotFound:
-	case nil:
-		t.Fatal("expected error getting size after delete")
-	default:
-		t.Fatal("wrong error getting size after delete: ", err)
+func init() {
+	sql.Register("sqlite3-nobackup", &noBackupDriver{})
+}
+
+func TestBackupCopy(t *testing.T) {
+	for _, mode := range []string{"WAL", "DELETE"} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			ctx := context.Background()
+
+			d, err := (&Options{
+				Driver:      "sqlite3-nobackup",
+				DSN:         filepath.Join(dir, "live.sqlite"),
+				JournalMode: mode,
+			}).CreateExtended()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			for i := 0; i < 100; i++ {
+				if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/backup/%d", i)), []byte(fmt.Sprint(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dst := filepath.Join(dir, "backup.sqlite")
+			if err := d.Backup(ctx, dst); err != nil {
+				t.Fatal(err)
+			}
+
+			backup, err := (&Options{DSN: dst}).Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backup.Close()
+			for i := 0; i < 100; i++ {
+				if v, err := backup.Get(ctx, ds.NewKey(fmt.Sprintf("/backup/%d", i))); err != nil || string(v) != fmt.Sprint(i) {
+					t.Fatalf("expected %d, got %q, %v", i, v, err)
+				}
+			}
+		})
 	}
-	if size != -1 {
-		t.Fatal("expected missing size to be -1")
+}
+
+func TestPeriodicBackup(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "backup.sqlite")
+
+	d, err := (&Options{
+		DSN:            filepath.Join(dir, "live.sqlite"),
+		BackupPath:     dst,
+		BackupInterval: 10 * time.Millisecond,
+		OnBackupError:  func(err error) { t.Error(err) },
+	}).CreateExtended()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(dst); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no periodic backup was written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestNotFounds(t *testing.T) {
+func TestWatch(t *testing.T) {
+	d, err := (&Options{}).CreateWatchable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := d.Put(ctx, ds.NewKey("/watched/old"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := d.Watch(ctx, ds.NewKey("/watched"), 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Put(ctx, ds.NewKey("/other"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/watched/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := <-events
+	if ev.Err != nil || ev.Key.String() != "/watched/a" || ev.Operation != sqlds.WatchPut || string(ev.Value) != "a" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	if err := d.Put(ctx, ds.NewKey("/watched/a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	ev = <-events
+	if ev.Err != nil || ev.Key.String() != "/watched/a" || ev.Operation != sqlds.WatchPut || string(ev.Value) != "b" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	if err := d.Delete(ctx, ds.NewKey("/watched/old")); err != nil {
+		t.Fatal(err)
+	}
+	ev = <-events
+	if ev.Err != nil || ev.Key.String() != "/watched/old" || ev.Operation != sqlds.WatchDelete {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	// closing the datastore stops the watchers
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for ev := range events {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+}
+
+func TestIncrementalVacuum(t *testing.T) {
+	d, err := (&Options{
+		DSN:                   filepath.Join(t.TempDir(), "vacuum.sqlite"),
+		AutoIncrementalVacuum: true,
+		VacuumInterval:        time.Hour,
+	}).CreateExtended()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	val := make([]byte, 4096)
+	for i := 0; i < 200; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprint(i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i += 2 {
+		if err := d.Delete(ctx, ds.NewKey(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	freelist := func() int {
+		t.Helper()
+		var n int
+		if err := d.DB().QueryRow("PRAGMA freelist_count").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	before := freelist()
+	if before == 0 {
+		t.Fatal("expected free pages after deleting rows")
+	}
+
+	if err := d.IncrementalVacuum(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	partial := freelist()
+	if partial != max(before-10, 0) {
+		t.Fatalf("expected %d free pages, got %d", max(before-10, 0), partial)
+	}
+
+	if err := d.IncrementalVacuum(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := freelist(); n != 0 {
+		t.Fatalf("expected no free pages, got %d", n)
+	}
+
+	// CollectGarbage releases the free pages instead of rebuilding the file
+	if q := (&Options{Table: "blocks", AutoIncrementalVacuum: true}).queries().Vacuum(); q != "PRAGMA incremental_vacuum" {
+		t.Fatalf("expected an incremental vacuum, got %s", q)
+	}
+	for i := 1; i < 200; i += 2 {
+		if err := d.Delete(ctx, ds.NewKey(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if freelist() == 0 {
+		t.Fatal("expected free pages after deleting rows")
+	}
+	if err := d.CollectGarbage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := freelist(); n != 0 {
+		t.Fatalf("expected no free pages after collecting garbage, got %d", n)
+	}
+}
+
+func TestPeriodicIncrementalVacuum(t *testing.T) {
+	d, err := (&Options{
+		DSN:                   filepath.Join(t.TempDir(), "vacuum.sqlite"),
+		AutoIncrementalVacuum: true,
+		VacuumInterval:        10 * time.Millisecond,
+		OnVacuumError:         func(err error) { t.Error(err) },
+	}).CreateExtended()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprint(i)), make([]byte, 4096)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.DeletePrefix(ctx, ds.NewKey("/")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var n int
+		if err := d.DB().QueryRow("PRAGMA freelist_count").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d free pages were not reclaimed", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryDatastore(t *testing.T) {
 	d, done := newDS(t)
 	defer done()
 
-	badk := ds.NewKey("notreal")
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
+	// fails twice with a transient error, then succeeds
+	var calls int
+	fs := failstore.NewFailstore(d, func(op string) error {
+		calls++
+		if calls <= 2 {
+			return errors.New("database is locked")
+		}
+		return nil
+	})
 
-	val, err := d.Get(ctx, badk)
-	if err != ds.ErrNotFound {
-		t.Fatal("expected ErrNotFound for key that doesnt exist, got: ", err)
+	rd := sqlds.WithRetry(fs, sqlds.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	v, err := rd.Get(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "a" {
+		t.Fatalf("expected a, got %s", v)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+
+	// gives up after MaxAttempts
+	calls = 0
+	rd = sqlds.WithRetry(fs, sqlds.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond})
+	if err := rd.Put(ctx, ds.NewKey("/b"), []byte("b")); err == nil {
+		t.Fatal("expected the error of the last attempt")
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", calls)
+	}
+
+	// non transient errors are not retried
+	calls = 0
+	perm := failstore.NewFailstore(d, func(op string) error {
+		calls++
+		return errors.New("syntax error")
+	})
+	rd = sqlds.WithRetry(perm, sqlds.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	if _, err := rd.Has(ctx, ds.NewKey("/a")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single attempt, got %d", calls)
+	}
+}
+
+func TestReturnExpirations(t *testing.T) {
+	opts := &Options{
+		DSN:          filepath.Join(t.TempDir(), "expirations.sqlite"),
+		ExtraColumns: []sqlds.ColumnDef{{Name: "expires_at", Type: "TIMESTAMP"}},
+	}
+	d, err := opts.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	for _, k := range []string{"/a", "/b"} {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiration := time.Now().Add(time.Hour).UTC()
+	if _, err := d.DB().Exec("UPDATE blocks SET expires_at = $1 WHERE key = '/a'", expiration); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(d *sqlds.Datastore, q dsq.Query) []dsq.Entry {
+		t.Helper()
+		res, err := d.Query(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("expected 2 entries, got %d", len(entries))
+		}
+		return entries
+	}
+
+	ed := sqlds.NewDatastore(d.DB(), NewQueries("blocks"), sqlds.WithExpirationColumn(), sqlds.WithSharedDB())
+	entries := query(ed, dsq.Query{ReturnExpirations: true, Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if delta := entries[0].Expiration.Sub(expiration).Abs(); delta > time.Second {
+		t.Fatalf("expected the expiration %s, got %s", expiration, entries[0].Expiration)
+	}
+	if string(entries[0].Value) != "/a" {
+		t.Fatalf("expected the value /a, got %q", entries[0].Value)
+	}
+	if !entries[1].Expiration.IsZero() {
+		t.Fatalf("expected no expiration for /b, got %s", entries[1].Expiration)
+	}
+
+	// the column is only selected if asked for and known to exist
+	for _, e := range query(ed, dsq.Query{}) {
+		if !e.Expiration.IsZero() {
+			t.Fatalf("unexpected expiration %s", e.Expiration)
+		}
+	}
+	for _, e := range query(d, dsq.Query{ReturnExpirations: true}) {
+		if !e.Expiration.IsZero() {
+			t.Fatalf("unexpected expiration %s", e.Expiration)
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	const rows = 100000
+
+	d, err := (&Options{DSN: filepath.Join(t.TempDir(), "foreach.sqlite"), JournalMode: "WAL"}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	b, err := d.BatchWithOptions(&sql.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < rows; i++ {
+		if err := b.Put(ctx, ds.NewKey(strconv.Itoa(i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make([]bool, rows)
+	n := 0
+	if err := d.ForEach(ctx, func(key ds.Key, value []byte) error {
+		i, err := strconv.Atoi(key.Name())
+		if err != nil {
+			return err
+		}
+		if string(value) != key.Name() || seen[i] {
+			return fmt.Errorf("unexpected row %s: %q", key, value)
+		}
+		seen[i] = true
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != rows {
+		t.Fatalf("expected %d rows, got %d", rows, n)
+	}
+
+	// stops at the first error
+	stop := errors.New("stop")
+	n = 0
+	if err := d.ForEach(ctx, func(ds.Key, []byte) error {
+		if n++; n == 10 {
+			return stop
+		}
+		return nil
+	}); err != stop || n != 10 {
+		t.Fatalf("expected to stop after 10 rows with the error of fn, got %d rows and %v", n, err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	n = 0
+	if err := d.ForEach(cctx, func(ds.Key, []byte) error {
+		if n++; n == 10 {
+			cancel()
+		}
+		return nil
+	}); !errors.Is(err, context.Canceled) || n >= rows {
+		t.Fatalf("expected the iteration to be canceled, got %d rows and %v", n, err)
+	}
+
+	// the rows are not materialized: the allocations per row are those of
+	// the cursor and the key, fewer than those of a query
+	allocs := func(iterate func()) float64 {
+		return testing.AllocsPerRun(1, iterate) / rows
+	}
+	forEach := allocs(func() {
+		_ = d.ForEach(ctx, func(ds.Key, []byte) error { return nil })
+	})
+	query := allocs(func() {
+		res, _ := d.Query(ctx, dsq.Query{})
+		_, _ = res.Rest()
+	})
+	if forEach >= query {
+		t.Fatalf("expected fewer allocations per row than a query (%.1f), got %.1f", query, forEach)
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	// written directly, before the limit is set
+	if err := d.Put(ctx, ds.NewKey("/large"), make([]byte, 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	md := sqlds.WithMaxValueSize(d, 10)
+	if err := md.Put(ctx, ds.NewKey("/a"), make([]byte, 11)); !errors.Is(err, sqlds.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+	if err := md.Put(ctx, ds.NewKey("/a"), make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := md.PutIfAbsent(ctx, ds.NewKey("/b"), make([]byte, 11)); !errors.Is(err, sqlds.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+
+	b, err := md.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	if val != nil {
-		t.Fatal("get should always return nil for not found values")
+	if err := b.Put(ctx, ds.NewKey("/c"), make([]byte, 11)); !errors.Is(err, sqlds.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/c"), make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := md.Has(ctx, ds.NewKey("/c")); err != nil || !has {
+		t.Fatalf("expected /c to be stored, got %v, %v", has, err)
 	}
 
-	have, err := d.Has(ctx, badk)
+	pb, err := md.ParallelBatch(2)
 	if err != nil {
-		t.Fatal("error calling has on not found key: ", err)
+		t.Fatal(err)
 	}
-	if have {
-		t.Fatal("has returned true for key we don't have")
+	if err := pb.Put(ctx, ds.NewKey("/d"), make([]byte, 11)); !errors.Is(err, sqlds.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+	// checked before the audit table is written
+	ad := sqlds.WithAudit(md, NewAuditQueries("blocks"))
+	if err := ad.Put(ctx, ds.NewKey("/e"), make([]byte, 11)); !errors.Is(err, sqlds.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+	xd := sqlds.WithIndex(md, NewIndexQueries("blocks"), func([]byte) (map[string]any, error) { return nil, nil })
+	if err := xd.Put(ctx, ds.NewKey("/f"), make([]byte, 11)); !errors.Is(err, sqlds.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+	xb, err := xd.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xb.Put(ctx, ds.NewKey("/f"), make([]byte, 11)); !errors.Is(err, sqlds.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
 	}
 
-	size, err := d.GetSize(ctx, badk)
-	switch err {
-	case ds.ErrNotFound:
-	case nil:
-		t.Fatal("expected error getting size after delete")
-	default:
-		t.Fatal("wrong error getting size after delete: ", err)
+	// oversized values are still readable
+	if size, err := md.GetSize(ctx, ds.NewKey("/large")); err != nil || size != 20 {
+		t.Fatalf("expected a size of 20, got %d, %v", size, err)
 	}
-	if size != -1 {
-		t.Fatal("expected missing size to be -1")
+	if v, err := md.Get(ctx, ds.NewKey("/large")); err != nil || len(v) != 20 {
+		t.Fatalf("expected 20 bytes, got %d, %v", len(v), err)
 	}
 }
 
-func SubtestManyKeysAndQuery(t *testing.T) {
+func TestDatastoreWithLogger(t *testing.T) {
 	d, done := newDS(t)
 	defer done()
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ld := sqlds.WithLogger(d, logger)
 
-	var keys []ds.Key
-	var keystrs []string
-	var values [][]byte
-	count := 100
-	for i := 0; i < count; i++ {
-		s := fmt.Sprintf("%dkey%d", i, i)
-		dsk := ds.NewKey(s)
-		keystrs = append(keystrs, dsk.String())
-		keys = append(keys, dsk)
-		buf := make([]byte, 64)
-		_, _ = rand.Read(buf)
-		values = append(values, buf)
+	ctx := context.Background()
+	if err := ld.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
 	}
-
-	t.Logf("putting %d values", count)
-	for i, k := range keys {
-		err := d.Put(ctx, k, values[i])
-		if err != nil {
-			t.Fatalf("error on put[%d]: %s", i, err)
+	for _, s := range []string{"level=DEBUG", "db.operation=Put", "datastore.key=/a", "db.statement="} {
+		if !strings.Contains(logs.String(), s) {
+			t.Fatalf("expected %q in %s", s, logs.String())
 		}
 	}
 
-	t.Log("getting values back")
-	for i, k := range keys {
-		val, err := d.Get(ctx, k)
-		if err != nil {
-			t.Fatalf("error on get[%d]: %s", i, err)
-		}
-
-		if !bytes.Equal(val, values[i]) {
-			t.Fatal("input value didnt match the one returned from Get")
-		}
+	// the datastore given to WithLogger does not log
+	logs.Reset()
+	if _, err := d.Get(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
 	}
-
-	t.Log("querying values")
-	q := dsq.Query{KeysOnly: true}
-	resp, err := d.Query(ctx, q)
-	if err != nil {
-		t.Fatal("calling query: ", err)
+	if logs.Len() != 0 {
+		t.Fatalf("unexpected logs: %s", logs.String())
 	}
 
-	t.Log("aggregating query results")
-	var outkeys []string
-	for {
-		res, ok := resp.NextSync()
-		if res.Error != nil {
-			t.Fatal("query result error: ", res.Error)
-		}
-		if !ok {
-			break
-		}
-
-		outkeys = append(outkeys, res.Key)
+	if _, err := d.DB().Exec("DROP TABLE blocks"); err != nil {
+		t.Fatal(err)
 	}
-
-	t.Log("verifying query output")
-	sort.Strings(keystrs)
-	sort.Strings(outkeys)
-
-	if len(keystrs) != len(outkeys) {
-		t.Fatal("got wrong number of keys back")
+	if err := ld.Put(ctx, ds.NewKey("/b"), []byte("b")); err == nil {
+		t.Fatal("expected the put to fail")
 	}
-
-	for i, s := range keystrs {
-		if outkeys[i] != s {
-			t.Fatalf("in key output, got %s but expected %s", outkeys[i], s)
+	for _, s := range []string{"level=ERROR", "db.operation=Put", "datastore.key=/b", "no such table"} {
+		if !strings.Contains(logs.String(), s) {
+			t.Fatalf("expected %q in %s", s, logs.String())
 		}
 	}
 
-	t.Log("deleting all keys")
-	for _, k := range keys {
-		if err := d.Delete(ctx, k); err != nil {
-			t.Fatal(err)
-		}
+	b, err := ld.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, ds.NewKey("/c"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+	if !strings.Contains(logs.String(), "db.operation=Batch.Commit") {
+		t.Fatalf("expected the failed commit in %s", logs.String())
 	}
 }
 
-// Tests from basic_tests from go-datastore
-func TestBasicPutGet(t *testing.T) {
+func TestRetryLogger(t *testing.T) {
 	d, done := newDS(t)
 	defer done()
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
+	var calls int
+	fs := failstore.NewFailstore(d, func(op string) error {
+		calls++
+		if calls == 1 {
+			return errors.New("database is locked")
+		}
+		return nil
+	})
 
-	k := ds.NewKey("foo")
-	val := []byte("Hello Datastore!")
+	var logs bytes.Buffer
+	rd := sqlds.WithRetry(fs, sqlds.RetryPolicy{
+		MaxAttempts: 2,
+		BaseDelay:   time.Millisecond,
+		Logger:      slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+	if err := rd.Put(context.Background(), ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"level=WARN", "db.operation=Put", "attempt=1", `error="database is locked"`} {
+		if !strings.Contains(logs.String(), s) {
+			t.Fatalf("expected %q in %s", s, logs.String())
+		}
+	}
+}
 
-	err := d.Put(ctx, k, val)
+func TestSizeColumn(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "size.sqlite")
+	ctx := context.Background()
+
+	// an existing table without the size column
+	d, err := (&Options{DSN: dsn}).Create()
 	if err != nil {
-		t.Fatal("error putting to datastore: ", err)
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/old"), []byte("old value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
 	}
 
-	have, err := d.Has(ctx, k)
+	d, err = (&Options{
+		DSN:            dsn,
+		UsesSizeColumn: true,
+		Migrations:     []sqlds.Migration{AddSizeColumn("blocks")},
+	}).Create()
 	if err != nil {
-		t.Fatal("error calling has on key we just put: ", err)
+		t.Fatal(err)
 	}
+	defer d.Close()
 
-	if !have {
-		t.Fatal("should have key foo, has returned false")
+	size, err := d.GetSize(ctx, ds.NewKey("/old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len("old value") {
+		t.Fatalf("expected backfilled size %d, got %d", len("old value"), size)
 	}
 
-	out, err := d.Get(ctx, k)
+	if err := d.Put(ctx, ds.NewKey("/new"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	size, err = d.GetSize(ctx, ds.NewKey("/new"))
 	if err != nil {
-		t.Fatal("error getting value after put: ", err)
+		t.Fatal(err)
+	}
+	if size != 3 {
+		t.Fatalf("expected size 3, got %d", size)
 	}
 
-	if !bytes.Equal(out, val) {
-		t.Fatal("value received on get wasnt what we expected:", out)
+	if _, err := d.GetSize(ctx, ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Fatalf("expected ds.ErrNotFound, got %v", err)
 	}
+}
 
-	have, err = d.Has(ctx, k)
+func TestSizeColumnSuite(t *testing.T) {
+	d, err := (&Options{UsesSizeColumn: true}).Create()
 	if err != nil {
-		t.Fatal("error calling has after get: ", err)
+		t.Fatal(err)
 	}
+	defer d.Close()
 
-	if !have {
-		t.Fatal("should have key foo, has returned false")
-	}
+	dstest.SubtestAll(t, d)
+}
 
-	err = d.Delete(ctx, k)
+func benchmarkGetSize(b *testing.B, opts *Options) {
+	opts.DSN = filepath.Join(b.TempDir(), "bench.sqlite")
+	d, err := opts.Create()
 	if err != nil {
-		t.Fatal("error calling delete: ", err)
+		b.Fatal(err)
 	}
+	defer d.Close()
 
-	have, err = d.Has(ctx, k)
-	if err != nil {
-		t.Fatal("error calling has after delete: ", err)
+	ctx := context.Background()
+	val := make([]byte, 1<<20)
+	for i := 0; i < 16; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprint(i)), val); err != nil {
+			b.Fatal(err)
+		}
 	}
 
-	if have {
-		t.Fatal("should not have key foo, has returned true")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.GetSize(ctx, ds.NewKey(fmt.Sprint(i%16))); err != nil {
+			b.Fatal(err)
+		}
 	}
-	SubtestBasicPutGet(t)
 }
 
-func TestManyKeysAndQuery(t *testing.T) {
-	d, done := newDS(t)
-	defer done()
-
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
+func BenchmarkGetSize(b *testing.B) {
+	b.Run("length", func(b *testing.B) {
+		benchmarkGetSize(b, &Options{})
+	})
+	b.Run("column", func(b *testing.B) {
+		benchmarkGetSize(b, &Options{UsesSizeColumn: true})
+	})
+}
 
-	var keys []ds.Key
-	var keystrs []string
-	var values [][]byte
-	count := 100
-	for i := 0; i < count; i++ {
-		s := fmt.Sprintf("%dkey%d", i, i)
-		dsk := ds.NewKey(s)
-		keystrs = append(keystrs, dsk.String())
-		keys = append(keys, dsk)
-		buf := make([]byte, 64)
-		_, _ = rand.Read(buf)
-		values = append(values, buf)
+func TestHashKeys(t *testing.T) {
+	d, err := (&Options{HashKeys: true, UsesSizeColumn: true}).Create()
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer d.Close()
 
-	t.Logf("putting %d values", count)
-	for i, k := range keys {
-		err := d.Put(ctx, k, values[i])
-		if err != nil {
-			t.Fatalf("error on put[%d]: %s", i, err)
-		}
-	}
+	ctx := context.Background()
+	addTestCases(t, d, testcases)
 
-	t.Log("getting values back")
-	for i, k := range keys {
-		val, err := d.Get(ctx, k)
-		if err != nil {
-			t.Fatalf("error on get[%d]: %s", i, err)
-		}
+	// rows are stored under the hash of their key
+	var n int
+	if err := d.DB().QueryRow("SELECT count(*) FROM blocks WHERE length(hash) = 32").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(testcases) {
+		t.Fatalf("expected %d hashed rows, got %d", len(testcases), n)
+	}
 
-		if !bytes.Equal(val, values[i]) {
-			t.Fatal("input value didnt match the one returned from Get")
-		}
+	if size, err := d.GetSize(ctx, ds.NewKey("/a/b/c")); err != nil || size != 3 {
+		t.Fatalf("expected a size of 3, got %d, %v", size, err)
+	}
+	if has, err := d.Has(ctx, ds.NewKey("/a/b")); err != nil || !has {
+		t.Fatalf("expected /a/b to exist, got %v, %v", has, err)
+	}
+	if ok, err := d.PutIfAbsent(ctx, ds.NewKey("/a"), []byte("x")); err != nil || ok {
+		t.Fatalf("expected /a to not be replaced, got %v, %v", ok, err)
 	}
 
-	t.Log("querying values")
-	q := dsq.Query{KeysOnly: true}
-	resp, err := d.Query(ctx, q)
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/a/b"})
 	if err != nil {
-		t.Fatal("calling query: ", err)
+		t.Fatal(err)
 	}
+	expectKeyOrderMatches(t, rs, []string{"/a/b/c", "/a/b/d"})
 
-	t.Log("aggregating query results")
-	var outkeys []string
-	for {
-		res, ok := resp.NextSync()
-		if res.Error != nil {
-			t.Fatal("query result error: ", res.Error)
-		}
-		if !ok {
-			break
-		}
+	if n, err := d.DeleteMany(ctx, []ds.Key{ds.NewKey("/e"), ds.NewKey("/f")}); err != nil || n != 2 {
+		t.Fatalf("expected 2 deleted rows, got %d, %v", n, err)
+	}
+	if err := d.Delete(ctx, ds.NewKey("/g")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/g")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
 
-		outkeys = append(outkeys, res.Key)
+func TestHashKeysSuite(t *testing.T) {
+	d, err := (&Options{HashKeys: true}).Create()
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer d.Close()
 
-	t.Log("verifying query output")
-	sort.Strings(keystrs)
-	sort.Strings(outkeys)
+	dstest.SubtestAll(t, d)
+}
 
-	if len(keystrs) != len(outkeys) {
-		t.Fatalf("got wrong number of keys back, %d != %d", len(keystrs), len(outkeys))
+// hashKeysBenchRows is the number of rows of BenchmarkHashKeys.
+//
+// With 1M rows of 60 bytes keys, random lookups took 16µs by hash against
+// 38µs by key in one run, and the database file was three times larger (228
+// against 76 bytes per row) since the keys are indexed by the unique key
+// column as well.
+const hashKeysBenchRows = 100000
+
+func benchmarkHashKeys(b *testing.B, opts *Options) {
+	opts.DSN = filepath.Join(b.TempDir(), "bench.sqlite")
+	d, err := opts.Create()
+	if err != nil {
+		b.Fatal(err)
 	}
+	defer d.Close()
 
-	for i, s := range keystrs {
-		if outkeys[i] != s {
-			t.Fatalf("in key output, got %s but expected %s", outkeys[i], s)
+	ctx := context.Background()
+	keys := make([]ds.Key, hashKeysBenchRows)
+	// in a single transaction, batches commit every put otherwise
+	batch, err := d.BatchWithOptions(&sql.TxOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := range keys {
+		// the length of a CIDv1 in base32
+		id := make([]byte, 32)
+		_, _ = rand.Read(id)
+		keys[i] = ds.NewKey("/blocks/" + strings.ToUpper(fmt.Sprintf("%x", id)[:52]))
+		if err := batch.Put(ctx, keys[i], []byte("v")); err != nil {
+			b.Fatal(err)
 		}
 	}
+	if err := batch.Commit(ctx); err != nil {
+		b.Fatal(err)
+	}
 
-	t.Log("deleting all keys")
-	for _, k := range keys {
-		if err := d.Delete(ctx, k); err != nil {
-			t.Fatal(err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.Get(ctx, keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
 		}
 	}
+	b.StopTimer()
 
-	SubtestManyKeysAndQuery(t)
+	if st, err := os.Stat(opts.DSN); err == nil {
+		b.ReportMetric(float64(st.Size())/hashKeysBenchRows, "file-B/row")
+	}
 }
 
-func TestSuite(t *testing.T) {
-	d, done := newDS(t)
-	defer done()
-
-	dstest.SubtestAll(t, d)
+func BenchmarkHashKeys(b *testing.B) {
+	b.Run("key", func(b *testing.B) {
+		benchmarkHashKeys(b, &Options{})
+	})
+	b.Run("hash", func(b *testing.B) {
+		benchmarkHashKeys(b, &Options{HashKeys: true})
+	})
 }
 
 func expectMatches(t *testing.T, expect []string, actualR dsq.Results) {
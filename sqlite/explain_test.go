@@ -0,0 +1,69 @@
+//go:build cgo && debug
+
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+func TestLogQueryPlans(t *testing.T) {
+	d, err := (&Options{DSN: filepath.Join(t.TempDir(), "plans.sqlite"), LogQueryPlans: true}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var buf bytes.Buffer
+	ld := sqlds.WithLogger(d, slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	ctx := context.Background()
+	for _, k := range []string{"/a/b", "/a/c", "/b"} {
+		if err := ld.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := ld.Get(ctx, ds.NewKey("/a/b")); err != nil || string(v) != "/a/b" {
+		t.Fatalf("expected /a/b, got %q, %v", v, err)
+	}
+	if size, err := ld.GetSize(ctx, ds.NewKey("/b")); err != nil || size != 2 {
+		t.Fatalf("expected a size of 2, got %d, %v", size, err)
+	}
+
+	res, err := ld.Query(ctx, dsq.Query{Prefix: "/a", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "/a/b" || entries[1].Key != "/a/c" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	if err := ld.Delete(ctx, ds.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := ld.Has(ctx, ds.NewKey("/b")); err != nil || has {
+		t.Fatalf("expected /b to be deleted, got %v, %v", has, err)
+	}
+
+	logs := buf.String()
+	for _, op := range []string{"Put", "Get", "GetSize", "Query", "Delete"} {
+		if !strings.Contains(logs, `msg="query plan" db.operation=`+op+" ") {
+			t.Errorf("expected the plan of %s to be logged:\n%s", op, logs)
+		}
+	}
+	if !strings.Contains(logs, "SEARCH blocks USING PRIMARY KEY") {
+		t.Errorf("expected the plan of a lookup by key:\n%s", logs)
+	}
+}
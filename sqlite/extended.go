@@ -0,0 +1,338 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// ExtendedDatastore is a sqlite datastore with sqlite specific operations and
+// background maintenance tasks.
+type ExtendedDatastore struct {
+	*sqlds.Datastore
+
+	db *sql.DB
+	// encrypted is set for sqlcipher databases, backed up by copying their
+	// encrypted file
+	encrypted bool
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// CreateExtended returns an extended datastore connected to sqlite, running
+// the background tasks configured in the options until it is closed.
+func (opts *Options) CreateExtended() (*ExtendedDatastore, error) {
+	d, db, err := opts.create()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ed := &ExtendedDatastore{Datastore: d, db: db, encrypted: len(opts.Key) != 0, cancel: cancel}
+
+	if opts.BackupPath != "" {
+		ed.every(ctx, opts.BackupInterval, func(ctx context.Context) {
+			// a backup interrupted by Close is not an error
+			if err := ed.Backup(ctx, opts.BackupPath); err != nil && ctx.Err() == nil && opts.OnBackupError != nil {
+				opts.OnBackupError(err)
+			}
+		})
+	}
+
+	if opts.AutoIncrementalVacuum {
+		ed.every(ctx, opts.VacuumInterval, func(ctx context.Context) {
+			if err := ed.IncrementalVacuum(ctx, opts.VacuumPages); err != nil && ctx.Err() == nil && opts.OnVacuumError != nil {
+				opts.OnVacuumError(err)
+			}
+		})
+	}
+
+	return ed, nil
+}
+
+// every runs fn on every interval tick until ctx is done.
+func (ed *ExtendedDatastore) every(ctx context.Context, interval time.Duration, fn func(context.Context)) {
+	ed.wg.Add(1)
+	go func() {
+		defer ed.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn(ctx)
+			}
+		}
+	}()
+}
+
+// Backup writes a consistent snapshot of the live database to dst, replacing
+// it if it exists, and is safe to call while other goroutines read and write
+// the store. It uses the online backup API of sqlite (sqlite3_backup_init)
+// with the drivers providing it, such as mattn/go-sqlite3 and its forks.
+// With the other drivers, and for sqlcipher databases, it checkpoints the WAL
+// and copies the database file in a read transaction.
+func (ed *ExtendedDatastore) Backup(ctx context.Context, dst string) error {
+	tmp := dst + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	conn, err := ed.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var done bool
+	if !ed.encrypted {
+		err = conn.Raw(func(src any) (err error) {
+			done, err = onlineBackup(ctx, ed.db.Driver(), src, tmp)
+			return err
+		})
+	}
+	if err == nil && !done {
+		err = copyBackup(ctx, conn, tmp)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to backup database: %w", err)
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// backupStepper is a backup of the online backup API, the *SQLiteBackup of
+// mattn/go-sqlite3.
+type backupStepper interface {
+	Step(pages int) (bool, error)
+	Finish() error
+}
+
+var (
+	backupStepperType = reflect.TypeFor[backupStepper]()
+	errorType         = reflect.TypeFor[error]()
+)
+
+// backupMethod returns the Backup(dest string, src Conn, src string)
+// (backupStepper, error) method of conn, the method of the connections of
+// mattn/go-sqlite3, which the package does not import to let the user choose
+// the driver.
+func backupMethod(conn any) (reflect.Value, bool) {
+	m := reflect.ValueOf(conn).MethodByName("Backup")
+	if !m.IsValid() {
+		return m, false
+	}
+	t := m.Type()
+	ok := t.NumIn() == 3 && t.In(0).Kind() == reflect.String && t.In(1) == reflect.TypeOf(conn) && t.In(2).Kind() == reflect.String &&
+		t.NumOut() == 2 && t.Out(0).Implements(backupStepperType) && t.Out(1) == errorType
+	return m, ok
+}
+
+// onlineBackup copies the database of the src driver connection to the file
+// dst with the online backup API. It returns false if the connections of drv
+// do not provide it.
+func onlineBackup(ctx context.Context, drv driver.Driver, src any, dst string) (bool, error) {
+	if _, ok := backupMethod(src); !ok {
+		return false, nil
+	}
+
+	dc, err := drv.Open(dst)
+	if err != nil {
+		return true, err
+	}
+	defer dc.Close()
+	backup, ok := backupMethod(dc)
+	if !ok || reflect.TypeOf(dc) != reflect.TypeOf(src) {
+		return false, nil
+	}
+
+	out := backup.Call([]reflect.Value{reflect.ValueOf("main"), reflect.ValueOf(src), reflect.ValueOf("main")})
+	if err, _ := out[1].Interface().(error); err != nil {
+		return true, err
+	}
+	b := out[0].Interface().(backupStepper)
+
+	for {
+		// all the pages in one step, a backup in several steps restarting
+		// when the database is written in between
+		done, err := b.Step(-1)
+		if err != nil {
+			_ = b.Finish()
+			return true, err
+		}
+		if done {
+			return true, b.Finish()
+		}
+
+		// the database is locked by a writer
+		select {
+		case <-ctx.Done():
+			_ = b.Finish()
+			return true, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// maxCopyAttempts is the number of times copyBackup checkpoints the WAL
+// before giving up when writers keep adding to it.
+const maxCopyAttempts = 10
+
+// copyBackup copies the database file of conn to dst. The WAL is
+// checkpointed first and the file is copied in a read transaction started
+// while the WAL is empty: the database file then holds the whole snapshot of
+// the transaction, and the writers can neither checkpoint into it nor, in
+// the rollback journal modes, commit until the copy is done.
+func copyBackup(ctx context.Context, conn *sql.Conn, dst string) error {
+	var seq int
+	var name, file string
+	if err := conn.QueryRowContext(ctx, "PRAGMA database_list").Scan(&seq, &name, &file); err != nil {
+		return err
+	}
+	if file == "" {
+		return errors.New("an in-memory database can not be copied")
+	}
+
+	for attempt := 1; ; attempt++ {
+		// a noop in the rollback journal modes
+		if _, err := conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			return err
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		// the read starts the snapshot of the transaction
+		var n int
+		if err := tx.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master").Scan(&n); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		// committed between the checkpoint and the read
+		if fi, err := os.Stat(file + "-wal"); err == nil && fi.Size() > 0 {
+			_ = tx.Rollback()
+			if attempt == maxCopyAttempts {
+				return fmt.Errorf("the WAL is still written after %d checkpoints", attempt)
+			}
+			continue
+		}
+
+		err = copyFile(file, dst)
+		_ = tx.Rollback()
+		return err
+	}
+}
+
+// copyFile copies the file src to dst, synced to disk.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// IncrementalVacuum reclaims up to pages free pages of a database created
+// with auto_vacuum = INCREMENTAL, all of them if pages is not positive. It is
+// a noop in the other auto_vacuum modes.
+func (ed *ExtendedDatastore) IncrementalVacuum(ctx context.Context, pages int) error {
+	if pages < 0 {
+		pages = 0
+	}
+	// the pragma reclaims a page on every step, the rows must be drained
+	rows, err := ed.db.QueryContext(ctx, fmt.Sprintf("PRAGMA incremental_vacuum(%d)", pages))
+	if err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	return nil
+}
+
+// Rekey re-encrypts the sqlcipher database with newKey, a 32 bytes key like
+// Options.Key. It must be called without active transactions, and the
+// datastore must then be closed and reopened with the new key: the other
+// connections of the pool, and those it opens, use the key of the options.
+func (ed *ExtendedDatastore) Rekey(newKey []byte) error {
+	if len(newKey) != 32 {
+		return fmt.Errorf("bad key length, expected 32 bytes, got %d", len(newKey))
+	}
+	return ed.rekey(fmt.Sprintf("x'%s'", hex.EncodeToString(newKey)))
+}
+
+// RemoveEncryption rekeys the sqlcipher database with an empty key, see
+// Rekey. The datastore must then be reopened without Options.Key.
+func (ed *ExtendedDatastore) RemoveEncryption() error {
+	return ed.rekey("''")
+}
+
+// rekey sets the key of the database to the key literal in a transaction.
+func (ed *ExtendedDatastore) rekey(key string) error {
+	ctx := context.Background()
+	conn, err := ed.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// sqlite ignores the unknown pragmas, rekey included
+	var version string
+	if err := conn.QueryRowContext(ctx, "PRAGMA cipher_version").Scan(&version); errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("rekey without sqlcipher: %w", sqlds.ErrNotImplemented)
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("PRAGMA rekey = " + key); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to rekey database: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Close stops the background tasks and closes the database.
+func (ed *ExtendedDatastore) Close() error {
+	ed.cancel()
+	ed.wg.Wait()
+	return ed.Datastore.Close()
+}
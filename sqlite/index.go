@@ -0,0 +1,60 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// IndexQueries are the sqlite queries of the <table>_index table of an
+// indexed datastore.
+type IndexQueries struct {
+	deleteQuery string
+	insertQuery string
+	selectQuery string
+}
+
+// NewIndexQueries creates a new sqlite set of index queries for the passed
+// datastore table, see Options.EnableJSONIndex.
+func NewIndexQueries(tbl string) IndexQueries {
+	return IndexQueries{
+		deleteQuery: fmt.Sprintf("DELETE FROM %s_index WHERE key = $1", tbl),
+		insertQuery: fmt.Sprintf("INSERT INTO %s_index (key, field, value) VALUES ($1, $2, $3)", tbl),
+		selectQuery: fmt.Sprintf("SELECT t.key, t.data FROM %s AS t JOIN %s_index AS i ON i.key = t.key WHERE i.field = $1 AND i.value = $2 ORDER BY t.key", tbl, tbl),
+	}
+}
+
+// DeleteIndex returns the sqlite query for removing the indexed fields of a
+// key.
+func (q IndexQueries) DeleteIndex() string {
+	return q.deleteQuery
+}
+
+// InsertIndex returns the sqlite query for indexing a field of a key.
+func (q IndexQueries) InsertIndex() string {
+	return q.insertQuery
+}
+
+// QueryIndex returns the sqlite query for getting the rows by indexed field.
+func (q IndexQueries) QueryIndex() string {
+	return q.selectQuery
+}
+
+// createIndexTable creates the <table>_index table used by indexed
+// datastores if it does not exist. The rows left by DeletePrefix are ignored
+// by the queries, which join the datastore table.
+func createIndexTable(db *sql.DB, table string) error {
+	if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_index (
+		key TEXT NOT NULL,
+		field TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (field, value, key)
+	) WITHOUT ROWID`, table)); err != nil {
+		return err
+	}
+	_, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_index_key ON %s_index (key)", table, table))
+	return err
+}
+
+var _ sqlds.IndexQueries = IndexQueries{}
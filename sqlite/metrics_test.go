@@ -0,0 +1,60 @@
+//go:build cgo && !nometrics
+
+package sqlite
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/prometheus/client_golang/prometheus"
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+func TestMetricsDatastore(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	reg := prometheus.NewRegistry()
+	md, err := sqlds.WithMetrics(d, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := md.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := md.Get(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// wrapping again with the same registry must reuse the collectors
+	if _, err := sqlds.WithMetrics(d, reg); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var observations, total uint64
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			switch mf.GetName() {
+			case "sqlds_operation_duration_seconds":
+				observations += m.GetHistogram().GetSampleCount()
+			case "sqlds_operations_total":
+				total += uint64(m.GetCounter().GetValue())
+			}
+		}
+	}
+
+	if observations != 2 {
+		t.Fatalf("expected 2 observations, got %d", observations)
+	}
+	if total != 2 {
+		t.Fatalf("expected 2 operations, got %d", total)
+	}
+}
@@ -0,0 +1,63 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// userVersion stores the schema version in the database header using
+// PRAGMA user_version.
+type userVersion struct{}
+
+// SchemaVersion returns the value of PRAGMA user_version.
+func (userVersion) SchemaVersion(tx *sql.Tx) (int, error) {
+	var version int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// SetSchemaVersion sets PRAGMA user_version, pragmas do not accept bind parameters.
+func (userVersion) SetSchemaVersion(tx *sql.Tx, version int) error {
+	_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	return err
+}
+
+// AddSizeColumn returns a migration adding the size column used by
+// Options.UsesSizeColumn to the table, unless it already exists, and
+// backfilling it from the values.
+func AddSizeColumn(table string) sqlds.Migration {
+	return func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow("SELECT count(*) > 0 FROM pragma_table_info($1) WHERE name = 'size'", table).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN size INTEGER", table)); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET size = length(data) WHERE size IS NULL", table))
+		return err
+	}
+}
+
+// AddChecksumColumn returns a migration adding the checksum column used by
+// Options.UsesChecksumColumn to the table, unless it already exists. The
+// existing rows have no checksum.
+func AddChecksumColumn(table string) sqlds.Migration {
+	return func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow("SELECT count(*) > 0 FROM pragma_table_info($1) WHERE name = 'checksum'", table).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, checksumColumn))
+		return err
+	}
+}
@@ -0,0 +1,145 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var journalModes = map[string]bool{
+	"DELETE": true, "TRUNCATE": true, "PERSIST": true, "MEMORY": true, "WAL": true, "OFF": true,
+}
+
+var synchronousModes = map[string]bool{
+	"OFF": true, "NORMAL": true, "FULL": true, "EXTRA": true,
+}
+
+// pragmas returns the PRAGMA statements to execute on every new connection.
+func (opts *Options) pragmas() ([]string, error) {
+	var pragmas []string
+
+	// set first, so that the other pragmas wait for locks
+	if opts.BusyTimeout > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d", opts.BusyTimeout.Milliseconds()))
+	}
+
+	// must be set before the tables are created
+	switch {
+	case opts.AutoGC && opts.AutoIncrementalVacuum:
+		return nil, errors.New("the AutoGC and AutoIncrementalVacuum options are mutually exclusive")
+	case opts.AutoGC:
+		pragmas = append(pragmas, "PRAGMA auto_vacuum = FULL")
+	case opts.AutoIncrementalVacuum:
+		pragmas = append(pragmas, "PRAGMA auto_vacuum = INCREMENTAL")
+	}
+
+	if opts.JournalMode != "" {
+		mode := strings.ToUpper(opts.JournalMode)
+		if !journalModes[mode] {
+			return nil, fmt.Errorf("invalid journal mode %q", opts.JournalMode)
+		}
+		pragmas = append(pragmas, "PRAGMA journal_mode = "+mode)
+	}
+
+	if opts.Synchronous != "" {
+		mode := strings.ToUpper(opts.Synchronous)
+		if !synchronousModes[mode] {
+			return nil, fmt.Errorf("invalid synchronous mode %q", opts.Synchronous)
+		}
+		pragmas = append(pragmas, "PRAGMA synchronous = "+mode)
+	}
+
+	if opts.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size = %d", opts.CacheSize))
+	}
+
+	if opts.SecureDelete {
+		pragmas = append(pragmas, "PRAGMA secure_delete = ON")
+	}
+
+	if opts.MmapSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA mmap_size = %d", opts.MmapSize))
+	}
+
+	return pragmas, nil
+}
+
+// openWithPragmas opens the database so that the given pragmas are executed
+// on each connection of the pool, most of them being per connection settings.
+func openWithPragmas(driverName, dsn string, pragmas []string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil || len(pragmas) == 0 {
+		return db, err
+	}
+
+	drv := db.Driver()
+	_ = db.Close()
+
+	var connector driver.Connector = dsnConnector{dsn: dsn, driver: drv}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		if connector, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	}
+
+	return sql.OpenDB(&pragmaConnector{Connector: connector, pragmas: pragmas}), nil
+}
+
+// dsnConnector is a driver.Connector for drivers not implementing driver.DriverContext.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// pragmaConnector executes pragmas on every connection it opens.
+type pragmaConnector struct {
+	driver.Connector
+	pragmas []string
+}
+
+func (c *pragmaConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range c.pragmas {
+		if err := execConn(ctx, conn, p); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to execute %q: %w", p, err)
+		}
+	}
+
+	return conn, nil
+}
+
+// execConn executes a statement without arguments on a driver connection.
+func execConn(ctx context.Context, conn driver.Conn, query string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, query, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	//lint:ignore SA1019 the statement has no arguments, Exec is the common denominator
+	_, err = stmt.Exec(nil)
+	return err
+}
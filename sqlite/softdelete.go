@@ -0,0 +1,75 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// SoftDeleteQueries are the sqlite queries of a soft delete datastore for a
+// given table.
+type SoftDeleteQueries struct {
+	Queries
+
+	undeleteQuery string
+	purgeQuery    string
+}
+
+// NewSoftDeleteQueries creates a new sqlite set of soft delete queries for the
+// passed table, which needs a deleted_at column (see AddDeletedAtColumn).
+func NewSoftDeleteQueries(tbl string) SoftDeleteQueries {
+	// reads only see the rows which are not deleted
+	q := NewQueries(fmt.Sprintf("(SELECT * FROM %s WHERE deleted_at IS NULL) AS %s", tbl, tbl))
+
+	// INSERT OR REPLACE on the table clears the deleted mark
+	w := NewQueries(tbl)
+	q.putQuery = w.putQuery
+	q.putWithSizeQuery = w.putWithSizeQuery
+	// a deleted row is absent
+	q.putIfAbsentQuery = fmt.Sprintf("INSERT INTO %s(key, data) VALUES($1, $2) ON CONFLICT(key) DO UPDATE SET data = excluded.data, deleted_at = NULL WHERE deleted_at IS NOT NULL", tbl)
+	// the value of a securely deleted row is zeroed before it is marked
+	q.zeroValueQuery = w.zeroValueQuery
+	q.columnsQuery = w.columnsQuery
+
+	q.deleteQuery = fmt.Sprintf("UPDATE %s SET deleted_at = CURRENT_TIMESTAMP WHERE key = $1 AND deleted_at IS NULL", tbl)
+	q.deletePrefixQuery = fmt.Sprintf("UPDATE %s SET deleted_at = CURRENT_TIMESTAMP WHERE key GLOB $1 AND deleted_at IS NULL", tbl)
+	q.deleteManyQuery = fmt.Sprintf("UPDATE %s SET deleted_at = CURRENT_TIMESTAMP WHERE deleted_at IS NULL AND key IN (%%s)", tbl)
+	q.tableSchemaQuery = tableSchema(tbl, append(slices.Clip(tableColumns), "deleted_at TIMESTAMP"))
+
+	return SoftDeleteQueries{
+		Queries:       q,
+		undeleteQuery: fmt.Sprintf("UPDATE %s SET deleted_at = NULL WHERE key = $1 AND deleted_at IS NOT NULL", tbl),
+		purgeQuery:    fmt.Sprintf("DELETE FROM %s WHERE deleted_at <= datetime('now', -$1 || ' seconds')", tbl),
+	}
+}
+
+// Undelete returns the sqlite query for restoring a deleted row.
+func (q SoftDeleteQueries) Undelete() string {
+	return q.undeleteQuery
+}
+
+// Purge returns the sqlite query for removing the rows deleted a given number
+// of seconds ago.
+func (q SoftDeleteQueries) Purge() string {
+	return q.purgeQuery
+}
+
+// AddDeletedAtColumn returns a migration adding the deleted_at column used by
+// soft delete datastores to the table, unless it already exists.
+func AddDeletedAtColumn(table string) sqlds.Migration {
+	return func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow("SELECT count(*) > 0 FROM pragma_table_info($1) WHERE name = 'deleted_at'", table).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN deleted_at TIMESTAMP", table))
+		return err
+	}
+}
+
+var _ sqlds.SoftDeleteQueries = SoftDeleteQueries{}
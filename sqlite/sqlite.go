@@ -4,8 +4,13 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"maps"
+	"net/url"
+	"slices"
 	"strings"
+	"time"
 
+	dsq "github.com/ipfs/go-datastore/query"
 	sqlds "github.com/vkost/go-ds-sql"
 	// we don't import a specific driver to let the user choose
 )
@@ -18,37 +23,260 @@ type Options struct {
 	// Don't try to create table
 	NoCreate bool
 
+	// CreateTableSQL replaces the built-in CREATE TABLE statement when set,
+	// it is executed verbatim and must create at least the key and data
+	// columns.
+	CreateTableSQL string
+	// ExtraColumns are added to the table created by the built-in statement.
+	ExtraColumns []sqlds.ColumnDef
+
+	// UsesSizeColumn stores the size of the values in a size INTEGER column
+	// so that GetSize does not read the values. New tables are created with
+	// the column, existing ones need the AddSizeColumn migration.
+	//
+	// sqlite computes length() of a blob from the record header already, and
+	// the column being stored after the data it is actually slower to read,
+	// see BenchmarkGetSize. It is mostly useful for a schema shared with
+	// PostgreSQL.
+	UsesSizeColumn bool
+
+	// Migrations are applied in order by Create after the table has been
+	// created, the schema version is stored in PRAGMA user_version.
+	Migrations []sqlds.Migration
+
+	// EnableJSONIndex makes Create add the <table>_index table used by
+	// sqlds.IndexedDatastore with NewIndexQueries.
+	EnableJSONIndex bool
+
+	// ReadOnly opens the database with mode=ro and makes the write
+	// operations fail with sqlds.ErrReadOnly. The table is neither created
+	// nor migrated.
+	ReadOnly bool
+
+	// ImmediateTransactions starts the transactions with BEGIN IMMEDIATE,
+	// with the _txlock parameter of the mattn driver, so that they lock
+	// the database for writing until they end: a transaction reading a key
+	// with sqlds.Datastore.GetForUpdate then blocks the other transactions
+	// up to BusyTimeout. Read only transactions lock the database as well.
+	ImmediateTransactions bool
+
+	// HashKeys creates the table with the SHA-256 hash of the keys as its
+	// primary key and the keys in a unique key column, rows being looked
+	// up by hash with NewHashedQueries. The index entries of the primary
+	// key have a fixed width, which speeds up random lookups in large
+	// tables, but the key column keeps a variable width index for prefix
+	// queries, which makes the database much larger: see BenchmarkHashKeys.
+	HashKeys bool
+
+	// TrackCreatedAt creates the table with a created_at column holding the
+	// insertion time of the rows, in seconds, so that queries can be
+	// ordered with sqlds.OrderByCreatedAt. Existing tables need the column.
+	// The rows are upserted rather than replaced, keeping their insertion
+	// time when their values are overwritten.
+	TrackCreatedAt bool
+
+	// UsesChecksumColumn creates the table with a checksum column holding
+	// the SHA-256 checksums of the values written by
+	// sqlds.Datastore.PutWithChecksum, verified by Get. The other writes
+	// clear the checksum. Existing tables need the AddChecksumColumn
+	// migration.
+	UsesChecksumColumn bool
+
+	// LogQueryPlans logs the plan of the statements before running them,
+	// with EXPLAIN QUERY PLAN, in binaries built with the debug build tag,
+	// see sqlds.WithQueryPlans.
+	LogQueryPlans bool
+
+	// ExtraDSNParams are appended to the query parameters of DSN, such as
+	// the _busy_timeout or _foreign_keys parameters of the mattn driver.
+	ExtraDSNParams map[string]string
+
 	// sqlcipher extension specific
 	Key            []byte
 	CipherPageSize uint
+
+	// PRAGMA settings applied to every connection, the SQLite defaults are
+	// kept for zero values.
+	JournalMode string        // DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF
+	Synchronous string        // OFF, NORMAL, FULL or EXTRA
+	CacheSize   int           // pages if positive, KiB if negative
+	BusyTimeout time.Duration // how long to wait for a lock before returning SQLITE_BUSY
+	MmapSize    int64         // maximum number of bytes used for memory-mapped I/O
+	// AutoGC enables PRAGMA auto_vacuum = FULL, which only takes effect on
+	// new databases, shrinking the file on every commit.
+	AutoGC bool
+	// SecureDelete enables PRAGMA secure_delete, overwriting the content
+	// deleted from the database file with zeros, at the cost of more I/O.
+	SecureDelete bool
+
+	// AutoIncrementalVacuum enables PRAGMA auto_vacuum = INCREMENTAL, which
+	// only takes effect on new databases, and makes datastores returned by
+	// CreateExtended reclaim VacuumPages free pages (all of them if zero)
+	// every VacuumInterval (one hour by default). Vacuum errors are passed
+	// to OnVacuumError if set.
+	AutoIncrementalVacuum bool
+	VacuumInterval        time.Duration
+	VacuumPages           int
+	OnVacuumError         func(error)
+
+	// BackupPath enables periodic backups of the database to this file in
+	// datastores returned by CreateExtended, every BackupInterval (one hour
+	// by default). Backup errors are passed to OnBackupError if set.
+	BackupPath     string
+	BackupInterval time.Duration
+	OnBackupError  func(error)
 }
 
 // Queries are the sqlite queries for a given table.
 type Queries struct {
-	deleteQuery  string
-	existsQuery  string
-	getQuery     string
-	putQuery     string
-	queryQuery   string
-	prefixQuery  string
-	limitQuery   string
-	offsetQuery  string
-	getSizeQuery string
+	deleteQuery       string
+	existsQuery       string
+	getQuery          string
+	putQuery          string
+	queryQuery        string
+	queryExpiryQuery  string
+	querySizesQuery   string
+	queryKeysQuery    string
+	prefixQuery       string
+	patternQuery      string
+	limitQuery        string
+	offsetQuery       string
+	getSizeQuery      string
+	countQuery        string
+	getForUpdateQuery string
+	deletePrefixQuery string
+	queryPageQuery    string
+	putWithSizeQuery  string
+	sizeColumnQuery   string
+	deleteManyQuery   string
+	getManyQuery      string
+	putIfAbsentQuery  string
+	namespacesQuery   string
+	vacuumQuery       string
+	statQuery         string
+	tableStatsQuery   string
+	diskUsageQuery    string
+	tableSchemaQuery  string
+	columnsQuery      string
+	explainQuery      string
+	zeroValueQuery    string
+
+	orderByCreatedAtQuery     string
+	orderByCreatedAtDescQuery string
+	setChecksumQuery          string
+	getChecksumQuery          string
+	queryChecksumsQuery       string
+}
+
+// tableColumns are the columns of the tables of NewQueries, and
+// hashedTableColumns those of the tables of NewHashedQueries.
+var (
+	tableColumns       = []string{"key TEXT PRIMARY KEY", "data BLOB"}
+	hashedTableColumns = []string{"hash BLOB PRIMARY KEY", "key TEXT NOT NULL UNIQUE", "data BLOB"}
+)
+
+// createdAtColumn is the column of the tables of Options.TrackCreatedAt, and
+// checksumColumn that of Options.UsesChecksumColumn.
+const (
+	createdAtColumn = "created_at INTEGER DEFAULT (strftime('%s', 'now'))"
+	checksumColumn  = "checksum BLOB"
+)
+
+// tableSchema returns the statement creating tbl with columns if it does not
+// exist.
+func tableSchema(tbl string, columns []string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) WITHOUT ROWID", tbl, strings.Join(columns, ", "))
 }
 
 // NewQueries creates a new sqlite set of queries for the passed table
 func NewQueries(tbl string) Queries {
 	return Queries{
-		deleteQuery:  fmt.Sprintf("DELETE FROM %s WHERE key = $1", tbl),
-		existsQuery:  fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE key=$1)", tbl),
-		getQuery:     fmt.Sprintf("SELECT data FROM %s WHERE key = $1", tbl),
-		putQuery:     fmt.Sprintf("INSERT OR REPLACE INTO %s(key, data) VALUES($1, $2)", tbl),
-		queryQuery:   fmt.Sprintf("SELECT key, data FROM %s", tbl),
-		prefixQuery:  ` WHERE key GLOB '%s*' ORDER BY key`,
-		limitQuery:   ` LIMIT %d`,
-		offsetQuery:  ` OFFSET %d`,
-		getSizeQuery: fmt.Sprintf("SELECT length(data) FROM %s WHERE key = $1", tbl),
+		deleteQuery:       fmt.Sprintf("DELETE FROM %s WHERE key = $1", tbl),
+		existsQuery:       fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE key=$1)", tbl),
+		getQuery:          fmt.Sprintf("SELECT data FROM %s WHERE key = $1", tbl),
+		putQuery:          fmt.Sprintf("INSERT OR REPLACE INTO %s(key, data) VALUES($1, $2)", tbl),
+		queryQuery:        fmt.Sprintf("SELECT key, data FROM %s", tbl),
+		queryExpiryQuery:  fmt.Sprintf("SELECT key, data, expires_at FROM %s", tbl),
+		querySizesQuery:   fmt.Sprintf("SELECT key, length(data) FROM %s", tbl),
+		queryKeysQuery:    fmt.Sprintf("SELECT key FROM %s", tbl),
+		prefixQuery:       `key GLOB %s`,
+		patternQuery:      ` WHERE key GLOB $1 ORDER BY key`,
+		limitQuery:        ` LIMIT %s`,
+		offsetQuery:       ` OFFSET %s`,
+		getSizeQuery:      fmt.Sprintf("SELECT length(data) FROM %s WHERE key = $1", tbl),
+		countQuery:        `SELECT count(*) FROM (%s) AS q`,
+		deletePrefixQuery: fmt.Sprintf("DELETE FROM %s WHERE key GLOB $1", tbl),
+		queryPageQuery:    fmt.Sprintf("SELECT key, data FROM %s WHERE key > $1 ORDER BY key LIMIT $2", tbl),
+		putWithSizeQuery:  fmt.Sprintf("INSERT OR REPLACE INTO %s(key, data, size) VALUES($1, $2, length($2))", tbl),
+		sizeColumnQuery:   fmt.Sprintf("SELECT coalesce(size, length(data)) FROM %s WHERE key = $1", tbl),
+		deleteManyQuery:   fmt.Sprintf("DELETE FROM %s WHERE key IN (%%s)", tbl),
+		getManyQuery:      fmt.Sprintf("SELECT key, data FROM %s WHERE key IN (%%s)", tbl),
+		putIfAbsentQuery:  fmt.Sprintf("INSERT OR IGNORE INTO %s(key, data) VALUES($1, $2)", tbl),
+		namespacesQuery:   fmt.Sprintf("SELECT DISTINCT substr(key, 1, instr(substr(key, 2), '/')) FROM %s WHERE instr(substr(key, 2), '/') > 0 ORDER BY 1", tbl),
+		vacuumQuery:       "VACUUM",
+		statQuery:         fmt.Sprintf("SELECT count(*), coalesce(sum(length(data)), 0), coalesce(min(length(data)), 0), coalesce(max(length(data)), 0) FROM %s", tbl),
+		diskUsageQuery:    "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()",
+		getForUpdateQuery: fmt.Sprintf("SELECT data FROM %s WHERE key = $1", tbl),
+		tableSchemaQuery:  tableSchema(tbl, tableColumns),
+		columnsQuery:      fmt.Sprintf(`SELECT c.name, c.type, EXISTS (SELECT 1 FROM pragma_index_list('%[1]s') AS l WHERE l."unique" AND (SELECT group_concat(i.name) FROM pragma_index_info(l.name) AS i) = c.name) FROM pragma_table_info('%[1]s') AS c`, tbl),
+		explainQuery:      "EXPLAIN QUERY PLAN %s",
+		zeroValueQuery:    fmt.Sprintf("UPDATE %s SET data = zeroblob(length(data)) WHERE key = $1", tbl),
+	}
+}
+
+// NewHashedQueries creates a new sqlite set of queries for the passed table
+// whose primary key is the SHA-256 hash of the keys, see Options.HashKeys.
+func NewHashedQueries(tbl string) Queries {
+	q := NewQueries(tbl)
+	q.deleteQuery = fmt.Sprintf("DELETE FROM %s WHERE hash = $1", tbl)
+	q.existsQuery = fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE hash = $1)", tbl)
+	q.getQuery = fmt.Sprintf("SELECT data FROM %s WHERE hash = $1", tbl)
+	q.putQuery = fmt.Sprintf("INSERT OR REPLACE INTO %s(hash, data, key) VALUES($1, $2, $3)", tbl)
+	q.getSizeQuery = fmt.Sprintf("SELECT length(data) FROM %s WHERE hash = $1", tbl)
+	q.putWithSizeQuery = fmt.Sprintf("INSERT OR REPLACE INTO %s(hash, data, key, size) VALUES($1, $2, $3, length($2))", tbl)
+	q.sizeColumnQuery = fmt.Sprintf("SELECT coalesce(size, length(data)) FROM %s WHERE hash = $1", tbl)
+	q.deleteManyQuery = fmt.Sprintf("DELETE FROM %s WHERE hash IN (%%s)", tbl)
+	q.getManyQuery = fmt.Sprintf("SELECT key, data FROM %s WHERE hash IN (%%s)", tbl)
+	q.putIfAbsentQuery = fmt.Sprintf("INSERT OR IGNORE INTO %s(hash, data, key) VALUES($1, $2, $3)", tbl)
+	q.getForUpdateQuery = fmt.Sprintf("SELECT data FROM %s WHERE hash = $1", tbl)
+	q.zeroValueQuery = fmt.Sprintf("UPDATE %s SET data = zeroblob(length(data)) WHERE hash = $1", tbl)
+	q.tableSchemaQuery = tableSchema(tbl, hashedTableColumns)
+	return q
+}
+
+// trackCreatedAt sets the queries of q for tbl with the created_at column of
+// Options.TrackCreatedAt, hashed being true for the queries of
+// NewHashedQueries. INSERT OR REPLACE deleting the previous row, the puts
+// update the values of existing rows instead.
+func (q *Queries) trackCreatedAt(tbl string, hashed bool) {
+	if hashed {
+		q.putQuery = fmt.Sprintf("INSERT INTO %s(hash, data, key) VALUES($1, $2, $3) ON CONFLICT(hash) DO UPDATE SET data = excluded.data", tbl)
+		q.putWithSizeQuery = fmt.Sprintf("INSERT INTO %s(hash, data, key, size) VALUES($1, $2, $3, length($2)) ON CONFLICT(hash) DO UPDATE SET data = excluded.data, size = excluded.size", tbl)
+	} else {
+		q.putQuery = fmt.Sprintf("INSERT INTO %s(key, data) VALUES($1, $2) ON CONFLICT(key) DO UPDATE SET data = excluded.data", tbl)
+		q.putWithSizeQuery = fmt.Sprintf("INSERT INTO %s(key, data, size) VALUES($1, $2, length($2)) ON CONFLICT(key) DO UPDATE SET data = excluded.data, size = excluded.size", tbl)
 	}
+	q.orderByCreatedAtQuery = ` ORDER BY created_at ASC, key ASC`
+	q.orderByCreatedAtDescQuery = ` ORDER BY created_at DESC, key DESC`
+}
+
+// trackChecksums sets the queries of q for tbl with the checksum column of
+// Options.UsesChecksumColumn, hashed being true for the queries of
+// NewHashedQueries and upserted for those of trackCreatedAt, which have to
+// clear the checksum that INSERT OR REPLACE resets.
+func (q *Queries) trackChecksums(tbl string, hashed, upserted bool) {
+	keyColumn := "key"
+	if hashed {
+		keyColumn = "hash"
+	}
+	if upserted {
+		q.putQuery += ", checksum = NULL"
+		q.putWithSizeQuery += ", checksum = NULL"
+	}
+	// sqlite numbers the $ parameters in order of appearance
+	q.setChecksumQuery = fmt.Sprintf("UPDATE %s SET checksum = ?2 WHERE %s = ?1", tbl, keyColumn)
+	q.getChecksumQuery = fmt.Sprintf("SELECT data, checksum FROM %s WHERE %s = $1", tbl, keyColumn)
+	q.queryChecksumsQuery = fmt.Sprintf("SELECT key, data, checksum FROM %s WHERE checksum IS NOT NULL", tbl)
 }
 
 // Delete returns the sqlite query for deleting a row.
@@ -76,17 +304,60 @@ func (q Queries) Query() string {
 	return q.queryQuery
 }
 
-// Prefix returns the sqlite query fragment for getting a rows with a key prefix.
+// QueryWithExpiry returns the sqlite query for getting multiple rows along with
+// their expiration.
+func (q Queries) QueryWithExpiry() string {
+	return q.queryExpiryQuery
+}
+
+// QueryKeysAndSizes returns the sqlite query for getting multiple rows
+// along with the sizes of their values, without the values.
+func (q Queries) QueryKeysAndSizes() string {
+	return q.querySizesQuery
+}
+
+// QueryKeys returns the sqlite query for getting the keys of multiple rows,
+// without the values.
+func (q Queries) QueryKeys() string {
+	return q.queryKeysQuery
+}
+
+// Prefix returns the sqlite predicate matching the keys with a prefix, given
+// as the parameter formatted into it, see PrefixPattern.
 func (q Queries) Prefix() string {
 	return q.prefixQuery
 }
 
-// Limit returns the sqlite query fragment for limiting results.
+// PatternMatch returns the sqlite query fragment for matching the keys
+// with a GLOB pattern, given as a parameter.
+func (q Queries) PatternMatch() string {
+	return q.patternQuery
+}
+
+// globEscaper escapes the wildcards of GLOB patterns, a bracket expression
+// matching the character itself.
+var globEscaper = strings.NewReplacer("[", "[[]", "*", "[*]", "?", "[?]")
+
+// EscapePattern returns s with the GLOB wildcards escaped, so that the
+// DeletePrefix pattern matches it literally.
+func (q Queries) EscapePattern(s string) string {
+	return globEscaper.Replace(s)
+}
+
+// PrefixPattern returns the GLOB pattern matching the keys starting with
+// prefix, bound to the parameter of the Prefix fragment.
+func (q Queries) PrefixPattern(prefix string) string {
+	return globEscaper.Replace(prefix) + "*"
+}
+
+// Limit returns the sqlite query fragment for limiting results, given as the
+// parameter formatted into it.
 func (q Queries) Limit() string {
 	return q.limitQuery
 }
 
-// Offset returns the sqlite query fragment for returning rows from a given offset.
+// Offset returns the sqlite query fragment for returning rows from a given
+// offset, given as the parameter formatted into it.
 func (q Queries) Offset() string {
 	return q.offsetQuery
 }
@@ -96,52 +367,372 @@ func (q Queries) GetSize() string {
 	return q.getSizeQuery
 }
 
+// Count returns the sqlite query for counting the rows returned by a query, %s
+// being replaced by the query.
+func (q Queries) Count() string {
+	return q.countQuery
+}
+
+// GetForUpdate returns the sqlite query for getting a row in a transaction,
+// sqlite has no row locks, the database is locked by the writing transaction.
+func (q Queries) GetForUpdate() string {
+	return q.getForUpdateQuery
+}
+
+// DeletePrefix returns the sqlite query for deleting the rows whose key
+// matches the PrefixPattern parameter.
+func (q Queries) DeletePrefix() string {
+	return q.deletePrefixQuery
+}
+
+// QueryPage returns the sqlite query for getting a page of rows after a cursor key.
+func (q Queries) QueryPage() string {
+	return q.queryPageQuery
+}
+
+// PutWithSize returns the sqlite query for putting a row and the size of its value.
+func (q Queries) PutWithSize() string {
+	return q.putWithSizeQuery
+}
+
+// GetSizeFromColumn returns the sqlite query for getting the size of a value
+// from the size column.
+func (q Queries) GetSizeFromColumn() string {
+	return q.sizeColumnQuery
+}
+
+// OrderByValue returns the sqlite query fragment for ordering rows by value,
+// ties being ordered by key.
+func (q Queries) OrderByValue(desc bool) string {
+	if desc {
+		return ` ORDER BY data DESC, key DESC`
+	}
+	return ` ORDER BY data ASC, key ASC`
+}
+
+// OrderByKey returns the sqlite query fragment for ordering rows by key, the
+// BINARY collation of the key column sorting keys like go-datastore.
+func (q Queries) OrderByKey(desc bool) string {
+	if desc {
+		return ` ORDER BY key DESC`
+	}
+	return ` ORDER BY key ASC`
+}
+
+// KeyCompare returns the sqlite predicate comparing the keys to the
+// parameter formatted into it with op, the BINARY collation of the key column
+// comparing keys like go-datastore, or an empty string for unknown operators.
+func (q Queries) KeyCompare(op dsq.Op) string {
+	switch op {
+	case dsq.Equal, dsq.NotEqual, dsq.GreaterThan, dsq.GreaterThanOrEqual, dsq.LessThan, dsq.LessThanOrEqual:
+		return `key ` + string(op) + ` %s`
+	}
+	return ""
+}
+
+// OrderByCreatedAt returns the sqlite query fragment for ordering rows by
+// insertion time, oldest first, empty unless the table has the created_at
+// column of Options.TrackCreatedAt.
+func (q Queries) OrderByCreatedAt() string {
+	return q.orderByCreatedAtQuery
+}
+
+// OrderByCreatedAtDesc returns the sqlite query fragment for ordering rows by
+// insertion time, newest first, empty unless the table has the created_at
+// column of Options.TrackCreatedAt.
+func (q Queries) OrderByCreatedAtDesc() string {
+	return q.orderByCreatedAtDescQuery
+}
+
+// SetChecksum returns the sqlite query for setting the checksum of a row,
+// empty unless the table has the checksum column of
+// Options.UsesChecksumColumn.
+func (q Queries) SetChecksum() string {
+	return q.setChecksumQuery
+}
+
+// GetWithChecksum returns the sqlite query for getting a row along with its
+// checksum, empty unless the table has the checksum column.
+func (q Queries) GetWithChecksum() string {
+	return q.getChecksumQuery
+}
+
+// QueryChecksums returns the sqlite query for getting the rows which have a
+// checksum, empty unless the table has the checksum column.
+func (q Queries) QueryChecksums() string {
+	return q.queryChecksumsQuery
+}
+
+// GetMany returns the sqlite query for getting the keys and values of the rows
+// of n keys.
+func (q Queries) GetMany(n int) string {
+	params := make([]string, n)
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return fmt.Sprintf(q.getManyQuery, strings.Join(params, ", "))
+}
+
+// DeleteMany returns the sqlite query for deleting the rows of n keys.
+func (q Queries) DeleteMany(n int) string {
+	params := make([]string, n)
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return fmt.Sprintf(q.deleteManyQuery, strings.Join(params, ", "))
+}
+
+// Sync returns the sqlite query for flushing writes to durable storage, it
+// checkpoints the WAL into the database file and is a noop in other journal
+// modes.
+func (q Queries) Sync() string {
+	return `PRAGMA wal_checkpoint(FULL)`
+}
+
+// PutIfAbsent returns the sqlite query for inserting a row unless the key exists.
+func (q Queries) PutIfAbsent() string {
+	return q.putIfAbsentQuery
+}
+
+// ListNamespaces returns the sqlite query for listing the distinct top-level
+// namespaces of the keys.
+func (q Queries) ListNamespaces() string {
+	return q.namespacesQuery
+}
+
+// Vacuum returns the sqlite query for reclaiming the space of deleted rows,
+// which rebuilds the whole database file, or releases its free pages with
+// Options.AutoIncrementalVacuum.
+func (q Queries) Vacuum() string {
+	return q.vacuumQuery
+}
+
+// Optimize returns the sqlite query for updating the statistics of the query
+// planner which are likely to be stale.
+func (q Queries) Optimize() string {
+	return "PRAGMA optimize"
+}
+
+// Capabilities returns the optional SQL features supported by sqlite, all of
+// them.
+func (q Queries) Capabilities() sqlds.QueryCapabilities {
+	return sqlds.AllCapabilities
+}
+
+// Stat returns the sqlite query for getting the number of rows and the
+// total, minimum and maximum sizes of their values.
+func (q Queries) Stat() string {
+	return q.statQuery
+}
+
+// TableStats returns an empty query, sqlite keeping no statistics of the
+// tuples of a table.
+func (q Queries) TableStats() string {
+	return q.tableStatsQuery
+}
+
+// DiskUsage returns the sqlite query for getting the size of the database
+// file, shared by the tables of the database.
+func (q Queries) DiskUsage() string {
+	return q.diskUsageQuery
+}
+
+// SetAutovacuum returns no query, sqlite has no background maintenance of
+// the tables.
+func (q Queries) SetAutovacuum(enabled bool) string {
+	return ""
+}
+
+// TableSchema returns the sqlite statement creating the table if it does not
+// exist.
+func (q Queries) TableSchema() string {
+	return q.tableSchemaQuery
+}
+
+// Columns returns the sqlite query for listing the name and type of the
+// columns of the table, and whether each is the only column of a unique
+// index.
+func (q Queries) Columns() string {
+	return q.columnsQuery
+}
+
+// Explain returns the sqlite query for getting the plan of a statement.
+func (q Queries) Explain() string {
+	return q.explainQuery
+}
+
+// ZeroValue returns the sqlite query for overwriting the value of a row with
+// zeros of the same length.
+func (q Queries) ZeroValue() string {
+	return q.zeroValueQuery
+}
+
+// EstimateCount returns no query, sqlite keeping no row count statistics.
+func (q Queries) EstimateCount() string {
+	return ""
+}
+
+// DeclareCursor returns no query, sqlite reading the rows of a statement as
+// it is stepped through.
+func (q Queries) DeclareCursor() string {
+	return ""
+}
+
+// FetchCursor returns no query, see DeclareCursor.
+func (q Queries) FetchCursor(n int) string {
+	return ""
+}
+
 // Create returns a datastore connected to sqlite
 func (opts *Options) Create() (*sqlds.Datastore, error) {
+	d, _, err := opts.create()
+	return d, err
+}
+
+func (opts *Options) create() (*sqlds.Datastore, *sql.DB, error) {
 	opts.setDefaults()
 
-	args := []string{}
-	if len(opts.Key) != 0 {
-		// sqlcipher expects a 32 bytes key
-		if len(opts.Key) != 32 {
-			return nil, fmt.Errorf("bad key length, expected 32 bytes, got %d", len(opts.Key))
-		}
-		args = append(args, fmt.Sprintf("_pragma_key=x'%s'", hex.EncodeToString(opts.Key)))
-		args = append(args, fmt.Sprintf("_pragma_cipher_page_size=%d", opts.CipherPageSize))
+	// sqlcipher expects a 32 bytes key
+	if len(opts.Key) != 0 && len(opts.Key) != 32 {
+		return nil, nil, fmt.Errorf("bad key length, expected 32 bytes, got %d", len(opts.Key))
 	}
-	dsn := opts.DSN
-	if len(args) != 0 {
-		if strings.ContainsRune(dsn, '?') {
-			dsn += "&"
-		} else {
-			dsn += "?"
-		}
-		dsn += strings.Join(args, "&")
+	dsn := opts.dsn()
+
+	pragmas, err := opts.pragmas()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	db, err := sql.Open(opts.Driver, dsn)
+	db, err := openWithPragmas(opts.Driver, dsn, pragmas)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	if err := db.Ping(); err != nil {
 		_ = db.Close()
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+		return nil, nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	if !opts.NoCreate {
-		if _, err := db.Exec(fmt.Sprintf(`
-			CREATE TABLE IF NOT EXISTS %s (
-				key TEXT PRIMARY KEY,
-				data BLOB
-			) WITHOUT ROWID;
-		`, opts.Table)); err != nil {
+	if !opts.NoCreate && !opts.ReadOnly {
+		if _, err := db.Exec(opts.createTableSQL()); err != nil {
 			_ = db.Close()
-			return nil, fmt.Errorf("failed to ensure table exists: %w", err)
+			return nil, nil, fmt.Errorf("failed to ensure table exists: %w", err)
 		}
 	}
 
-	return sqlds.NewDatastore(db, NewQueries(opts.Table)), nil
+	if opts.EnableJSONIndex && !opts.ReadOnly {
+		if err := createIndexTable(db, opts.Table); err != nil {
+			_ = db.Close()
+			return nil, nil, fmt.Errorf("failed to create the json index: %w", err)
+		}
+	}
+
+	if len(opts.Migrations) != 0 && !opts.ReadOnly {
+		if err := sqlds.Migrate(db, userVersion{}, opts.Migrations); err != nil {
+			_ = db.Close()
+			return nil, nil, fmt.Errorf("failed to migrate database: %w", err)
+		}
+	}
+
+	var dsOpts []sqlds.Option
+	if opts.UsesSizeColumn {
+		dsOpts = append(dsOpts, sqlds.WithSizeColumn())
+	}
+	if opts.ReadOnly {
+		dsOpts = append(dsOpts, sqlds.WithReadOnly())
+	}
+	if opts.HashKeys {
+		dsOpts = append(dsOpts, sqlds.WithHashedKeys())
+	}
+	if opts.LogQueryPlans {
+		dsOpts = append(dsOpts, sqlds.WithQueryPlans())
+	}
+
+	return sqlds.NewDatastore(db, opts.queries(), dsOpts...), db, nil
+}
+
+// queries returns the queries of the datastore.
+func (opts *Options) queries() Queries {
+	q := NewQueries(opts.Table)
+	if opts.HashKeys {
+		q = NewHashedQueries(opts.Table)
+	}
+	if opts.TrackCreatedAt {
+		q.trackCreatedAt(opts.Table, opts.HashKeys)
+	}
+	if opts.UsesChecksumColumn {
+		q.trackChecksums(opts.Table, opts.HashKeys, opts.TrackCreatedAt)
+	}
+	if opts.AutoIncrementalVacuum {
+		q.vacuumQuery = "PRAGMA incremental_vacuum"
+	}
+	q.tableSchemaQuery = tableSchema(opts.Table, opts.columns())
+	return q
+}
+
+// columns returns the columns of the table created by Create.
+func (opts *Options) columns() []string {
+	columns := tableColumns
+	if opts.HashKeys {
+		columns = hashedTableColumns
+	}
+	columns = slices.Clip(columns)
+
+	if opts.UsesSizeColumn {
+		columns = append(columns, "size INTEGER")
+	}
+	for _, c := range opts.ExtraColumns {
+		columns = append(columns, c.String())
+	}
+	if opts.TrackCreatedAt {
+		columns = append(columns, createdAtColumn)
+	}
+	if opts.UsesChecksumColumn {
+		columns = append(columns, checksumColumn)
+	}
+	return columns
+}
+
+// dsn returns the data source name of the database, DSN with the query
+// parameters of the options appended.
+func (opts *Options) dsn() string {
+	args := []string{}
+	if len(opts.Key) != 0 {
+		args = append(args, fmt.Sprintf("_pragma_key=x'%s'", hex.EncodeToString(opts.Key)))
+		args = append(args, fmt.Sprintf("_pragma_cipher_page_size=%d", opts.CipherPageSize))
+	}
+	if opts.ImmediateTransactions {
+		args = append(args, "_txlock=immediate")
+	}
+	dsn := opts.DSN
+	if opts.ReadOnly {
+		// URI parameters are only honored by sqlite for file: URIs
+		if !strings.HasPrefix(dsn, "file:") {
+			dsn = "file:" + dsn
+		}
+		args = append(args, "mode=ro")
+	}
+	for _, k := range slices.Sorted(maps.Keys(opts.ExtraDSNParams)) {
+		args = append(args, url.QueryEscape(k)+"="+url.QueryEscape(opts.ExtraDSNParams[k]))
+	}
+	if len(args) == 0 {
+		return dsn
+	}
+
+	if strings.ContainsRune(dsn, '?') {
+		dsn += "&"
+	} else {
+		dsn += "?"
+	}
+	return dsn + strings.Join(args, "&")
+}
+
+// createTableSQL returns the statement creating the table if it does not exist.
+func (opts *Options) createTableSQL() string {
+	if opts.CreateTableSQL != "" {
+		return opts.CreateTableSQL
+	}
+	return opts.queries().TableSchema()
 }
 
 func (opts *Options) setDefaults() {
@@ -160,4 +751,12 @@ func (opts *Options) setDefaults() {
 	if opts.Table == "" {
 		opts.Table = "blocks"
 	}
+
+	if opts.BackupPath != "" && opts.BackupInterval == 0 {
+		opts.BackupInterval = time.Hour
+	}
+
+	if opts.AutoIncrementalVacuum && opts.VacuumInterval == 0 {
+		opts.VacuumInterval = time.Hour
+	}
 }
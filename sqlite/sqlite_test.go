@@ -0,0 +1,176 @@
+//go:build cgo
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+func TestMain(m *testing.M) {
+	if !slices.Contains(sql.Drivers(), "sqlite3") {
+		fmt.Println("skipping sqlite tests, the sqlite3 driver is not available")
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// recordingDriver is a driver recording the DSNs it is opened with, its
+// connections do not support any statement.
+type recordingDriver struct {
+	mu   sync.Mutex
+	dsns []string
+}
+
+func (d *recordingDriver) Open(dsn string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dsns = append(d.dsns, dsn)
+	return recordingConn{}, nil
+}
+
+type recordingConn struct{}
+
+func (recordingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (recordingConn) Close() error                        { return nil }
+func (recordingConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+var cipherDriver = &recordingDriver{}
+
+func init() {
+	sql.Register("sqlds-recording", cipherDriver)
+}
+
+func TestCipherKey(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+	d, err := (&Options{Driver: "sqlds-recording", DSN: "enc.db", Key: key, NoCreate: true}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	cipherDriver.mu.Lock()
+	dsn := cipherDriver.dsns[len(cipherDriver.dsns)-1]
+	cipherDriver.mu.Unlock()
+
+	expected := fmt.Sprintf("enc.db?_pragma_key=x'%x'&_pragma_cipher_page_size=4096", key)
+	if dsn != expected {
+		t.Fatalf("expected dsn %s, got %s", expected, dsn)
+	}
+
+	if _, err := (&Options{Driver: "sqlds-recording", Key: []byte("short")}).Create(); err == nil {
+		t.Fatal("expected an error for a bad key length")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "enc.db")
+	key := []byte(strings.Repeat("k", 32))
+	newKey := []byte(strings.Repeat("n", 32))
+
+	ed, err := (&Options{DSN: dsn, Key: key}).CreateExtended()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := ed.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ed.Rekey([]byte("short")); err == nil {
+		t.Fatal("expected an error for a bad key length")
+	}
+
+	var version string
+	if err := ed.DB().QueryRow("PRAGMA cipher_version").Scan(&version); errors.Is(err, sql.ErrNoRows) {
+		if err := ed.Rekey(newKey); !errors.Is(err, sqlds.ErrNotImplemented) {
+			t.Fatalf("expected ErrNotImplemented without sqlcipher, got %v", err)
+		}
+		_ = ed.Close()
+		t.Skip("the sqlite3 driver is not sqlcipher")
+	}
+
+	if err := ed.Rekey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := ed.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&Options{DSN: dsn, Key: key}).Create(); err == nil {
+		t.Fatal("expected the old key to be rejected")
+	}
+	ed, err = (&Options{DSN: dsn, Key: newKey}).CreateExtended()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ed.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+		t.Fatalf("expected a, got %q, %v", v, err)
+	}
+
+	if err := ed.RemoveEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ed.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := (&Options{DSN: dsn}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if v, err := d.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+		t.Fatalf("expected a, got %q, %v", v, err)
+	}
+}
+
+func TestNoCreate(t *testing.T) {
+	d, err := (&Options{NoCreate: true}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.Get(ctx, ds.NewKey("/a")); err == nil || errors.Is(err, ds.ErrNotFound) {
+		t.Fatalf("expected a missing table error, got %v", err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err == nil || !strings.Contains(err.Error(), "no such table") {
+		t.Fatalf("expected a missing table error, got %v", err)
+	}
+}
+
+func BenchmarkPutGet(b *testing.B) {
+	d, err := (&Options{DSN: filepath.Join(b.TempDir(), "bench.sqlite"), JournalMode: "WAL"}).Create()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	value := []byte(strings.Repeat("v", 256))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := ds.NewKey(fmt.Sprintf("/bench/%d", i))
+		if err := d.Put(ctx, key, value); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := d.Get(ctx, key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
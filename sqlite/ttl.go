@@ -0,0 +1,97 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// TTLQueries are the sqlite queries of a TTL datastore for a given table.
+type TTLQueries struct {
+	Queries
+
+	putWithTTLQuery    string
+	setTTLQuery        string
+	getExpirationQuery string
+	deleteExpiredQuery string
+}
+
+// liveRows is the condition of the rows which have not expired, the
+// expirations being stored in UTC like the current time of sqlite.
+const liveRows = "(expires_at IS NULL OR expires_at > datetime('now', 'subsec'))"
+
+// NewTTLQueries creates a new sqlite set of TTL queries for the passed table,
+// which needs an expires_at column (see AddExpiresAtColumn).
+func NewTTLQueries(tbl string) TTLQueries {
+	// reads only see the rows which have not expired
+	live := fmt.Sprintf("(SELECT * FROM %s WHERE %s) AS %s", tbl, liveRows, tbl)
+	q := NewQueries(live)
+
+	// INSERT OR REPLACE on the table clears the expiration
+	w := NewQueries(tbl)
+	q.putQuery = w.putQuery
+	q.putWithSizeQuery = w.putWithSizeQuery
+	// an expired row is absent
+	q.putIfAbsentQuery = fmt.Sprintf("INSERT INTO %s(key, data) VALUES($1, $2) ON CONFLICT(key) DO UPDATE SET data = excluded.data, expires_at = NULL WHERE NOT %s", tbl, liveRows)
+	q.zeroValueQuery = w.zeroValueQuery
+	q.columnsQuery = w.columnsQuery
+
+	// the expired rows are deleted along with the live ones
+	q.deleteQuery = w.deleteQuery
+	q.deletePrefixQuery = w.deletePrefixQuery
+	q.deleteManyQuery = w.deleteManyQuery
+	q.tableSchemaQuery = tableSchema(tbl, append(slices.Clip(tableColumns), "expires_at TIMESTAMP"))
+
+	return TTLQueries{
+		Queries:         q,
+		putWithTTLQuery: fmt.Sprintf("INSERT OR REPLACE INTO %s(key, data, expires_at) VALUES($1, $2, $3)", tbl),
+		// sqlite numbers the $ parameters in order of appearance
+		setTTLQuery:        fmt.Sprintf("UPDATE %s SET expires_at = ?2 WHERE key = ?1 AND %s", tbl, liveRows),
+		getExpirationQuery: fmt.Sprintf("SELECT expires_at FROM %s WHERE key = $1", live),
+		// DELETE ... LIMIT needs a build option of sqlite
+		deleteExpiredQuery: fmt.Sprintf("DELETE FROM %[1]s WHERE key IN (SELECT key FROM %[1]s WHERE NOT %[2]s LIMIT $1)", tbl, liveRows),
+	}
+}
+
+// PutWithTTL returns the sqlite query for upserting a row with an
+// expiration.
+func (q TTLQueries) PutWithTTL() string {
+	return q.putWithTTLQuery
+}
+
+// SetTTL returns the sqlite query for setting the expiration of a live row.
+func (q TTLQueries) SetTTL() string {
+	return q.setTTLQuery
+}
+
+// GetExpiration returns the sqlite query for getting the expiration of a
+// live row.
+func (q TTLQueries) GetExpiration() string {
+	return q.getExpirationQuery
+}
+
+// DeleteExpired returns the sqlite query for removing a given number of
+// expired rows.
+func (q TTLQueries) DeleteExpired() string {
+	return q.deleteExpiredQuery
+}
+
+// AddExpiresAtColumn returns a migration adding the expires_at column used by
+// TTL datastores to the table, unless it already exists.
+func AddExpiresAtColumn(table string) sqlds.Migration {
+	return func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow("SELECT count(*) > 0 FROM pragma_table_info($1) WHERE name = 'expires_at'", table).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN expires_at TIMESTAMP", table))
+		return err
+	}
+}
+
+var _ sqlds.TTLQueries = TTLQueries{}
@@ -0,0 +1,183 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// WatchableDatastore is a sqlite datastore whose changes can be watched by
+// polling, sqlite having no notification mechanism.
+type WatchableDatastore struct {
+	*sqlds.Datastore
+
+	db         *sql.DB
+	watchQuery string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// CreateWatchable returns a watchable datastore connected to sqlite.
+func (opts *Options) CreateWatchable() (*WatchableDatastore, error) {
+	d, db, err := opts.create()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WatchableDatastore{
+		Datastore:  d,
+		db:         db,
+		watchQuery: fmt.Sprintf("SELECT key, data FROM %s WHERE key = $1 OR key GLOB $2", opts.Table),
+		ctx:        ctx,
+		cancel:     cancel,
+	}, nil
+}
+
+// snapshot returns the hashes of the values of the keys under prefix.
+func (wd *WatchableDatastore) snapshot(ctx context.Context, prefix ds.Key) (map[string][sha256.Size]byte, error) {
+	p := prefix.String()
+	glob := globEscaper.Replace(p) + "/*"
+	if p == "/" {
+		glob = "/*"
+	}
+
+	rows, err := wd.db.QueryContext(ctx, wd.watchQuery, p, glob)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snap := make(map[string][sha256.Size]byte)
+	for rows.Next() {
+		var key string
+		var data []byte
+		if err := rows.Scan(&key, &data); err != nil {
+			return nil, err
+		}
+		snap[key] = sha256.Sum256(data)
+	}
+	return snap, rows.Err()
+}
+
+// Watch returns the changes made to the keys under prefix, polled every
+// interval. The table being created WITHOUT ROWID, changes are found by
+// comparing the hashes of the values with those of the previous poll, which
+// reads every value under prefix: it is meant for tests and single process
+// use. Changes made and reverted between two polls are not reported, and put
+// events carry the value of their key at the time of the poll.
+//
+// The channel is closed when ctx is done or the datastore is closed, a poll
+// error being reported by the last event.
+func (wd *WatchableDatastore) Watch(ctx context.Context, prefix ds.Key, interval time.Duration) (<-chan sqlds.WatchEvent, error) {
+	if wd.ctx.Err() != nil {
+		return nil, errors.New("datastore is closed")
+	}
+
+	// stop the watcher when the datastore is closed
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(wd.ctx, cancel)
+
+	seen, err := wd.snapshot(ctx, prefix)
+	if err != nil {
+		stop()
+		cancel()
+		return nil, err
+	}
+
+	events := make(chan sqlds.WatchEvent)
+	wd.wg.Add(1)
+	go func() {
+		defer wd.wg.Done()
+		defer close(events)
+		defer cancel()
+		defer stop()
+
+		send := func(ev sqlds.WatchEvent) bool {
+			select {
+			case events <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			snap, err := wd.snapshot(ctx, prefix)
+			if err != nil {
+				if ctx.Err() == nil {
+					send(sqlds.WatchEvent{Err: err})
+				}
+				return
+			}
+
+			for _, ev := range diffSnapshots(seen, snap) {
+				if ev.Operation == sqlds.WatchPut {
+					if ev.Value, err = wd.Get(ctx, ev.Key); err == ds.ErrNotFound {
+						// deleted since the poll, neither the put nor the
+						// delete are reported
+						delete(snap, ev.Key.String())
+						continue
+					} else if err != nil {
+						if ctx.Err() == nil {
+							send(sqlds.WatchEvent{Err: err})
+						}
+						return
+					}
+				}
+				if !send(ev) {
+					return
+				}
+			}
+			seen = snap
+		}
+	}()
+
+	return events, nil
+}
+
+// diffSnapshots returns the events turning snapshot from into snapshot to,
+// sorted by key and without values.
+func diffSnapshots(from, to map[string][sha256.Size]byte) []sqlds.WatchEvent {
+	var events []sqlds.WatchEvent
+	for k, h := range to {
+		if prev, ok := from[k]; !ok || prev != h {
+			events = append(events, sqlds.WatchEvent{Key: ds.RawKey(k), Operation: sqlds.WatchPut})
+		}
+	}
+	for k := range from {
+		if _, ok := to[k]; !ok {
+			events = append(events, sqlds.WatchEvent{Key: ds.RawKey(k), Operation: sqlds.WatchDelete})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Key.Less(events[j].Key)
+	})
+	return events
+}
+
+// Close stops the watchers and closes the database.
+func (wd *WatchableDatastore) Close() error {
+	wd.cancel()
+	wd.wg.Wait()
+	return wd.Datastore.Close()
+}
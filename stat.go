@@ -0,0 +1,77 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DatastoreStats are statistics of the table of a datastore.
+type DatastoreStats struct {
+	// Count is the number of keys.
+	Count int64
+	// TotalSize, MinSize, MaxSize and AvgSize are computed from the sizes of
+	// the values, they are zero for an empty table.
+	TotalSize int64
+	MinSize   int64
+	MaxSize   int64
+	AvgSize   float64
+
+	// LiveTuples, DeadTuples and LastAutovacuum are the statistics kept by
+	// the backend about the table, they are zero if it keeps none. A zero
+	// LastAutovacuum means the table has never been autovacuumed.
+	LiveTuples     int64
+	DeadTuples     int64
+	LastAutovacuum time.Time
+}
+
+// Stat returns the statistics of the table, with the Stat query of the
+// backend and its TableStats query unless empty. Computing the sizes reads
+// the length of every value.
+func (d *Datastore) Stat(ctx context.Context) (DatastoreStats, error) {
+	var st DatastoreStats
+	if err := d.db.QueryRowContext(ctx, d.queries.Stat()).Scan(&st.Count, &st.TotalSize, &st.MinSize, &st.MaxSize); err != nil {
+		return DatastoreStats{}, err
+	}
+	if st.Count > 0 {
+		st.AvgSize = float64(st.TotalSize) / float64(st.Count)
+	}
+
+	q := d.queries.TableStats()
+	if q == "" {
+		return st, nil
+	}
+
+	var vacuumed sql.NullTime
+	switch err := d.db.QueryRowContext(ctx, q).Scan(&st.LiveTuples, &st.DeadTuples, &vacuumed); err {
+	case sql.ErrNoRows:
+		// the statistics are not collected yet
+	case nil:
+		st.LastAutovacuum = vacuumed.Time
+	default:
+		return DatastoreStats{}, err
+	}
+
+	return st, nil
+}
+
+// DiskUsage returns the number of bytes used by the datastore on disk, with
+// the DiskUsage query of the backend, so that the datastore implements
+// ds.PersistentDatastore. It falls back to the total size of the values
+// computed by Stat when the query is empty.
+func (d *Datastore) DiskUsage(ctx context.Context) (uint64, error) {
+	q := d.queries.DiskUsage()
+	if q == "" {
+		st, err := d.Stat(ctx)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(st.TotalSize), nil
+	}
+
+	var size int64
+	if err := d.db.QueryRowContext(ctx, q).Scan(&size); err != nil {
+		return 0, err
+	}
+	return uint64(size), nil
+}
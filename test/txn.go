@@ -0,0 +1,269 @@
+// Package test provides test suites for datastores, complementing those of
+// github.com/ipfs/go-datastore/test.
+package test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// RunTxnDatastoreTests runs the transaction tests against d, each in its own
+// sub-test. The tests write keys under /txntest, and need d to allow a read
+// transaction while a write transaction is in progress, such as a sqlite
+// database in WAL mode.
+//
+// go-datastore transactions can not start transactions, the nesting tests
+// check that finished transactions reject further operations.
+func RunTxnDatastoreTests(t *testing.T, d ds.TxnDatastore) {
+	t.Run("Commit", func(t *testing.T) { subtestCommit(t, d) })
+	t.Run("Discard", func(t *testing.T) { subtestDiscard(t, d) })
+	t.Run("ReadYourOwnWrites", func(t *testing.T) { subtestReadYourOwnWrites(t, d) })
+	t.Run("Isolation", func(t *testing.T) { subtestIsolation(t, d) })
+	t.Run("ReadOnlySnapshot", func(t *testing.T) { subtestReadOnlySnapshot(t, d) })
+	t.Run("RollbackOnError", func(t *testing.T) { subtestRollbackOnError(t, d) })
+	t.Run("ReadOnly", func(t *testing.T) { subtestReadOnly(t, d) })
+	t.Run("FinishedTxnRejected", func(t *testing.T) { subtestFinishedTxnRejected(t, d) })
+}
+
+func newTxn(t *testing.T, d ds.TxnDatastore, readOnly bool) ds.Txn {
+	t.Helper()
+	txn, err := d.NewTransaction(context.Background(), readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+// expectValue fails t unless r has the value v for key, or no value if v
+// is nil.
+func expectValue(t *testing.T, r ds.Read, key ds.Key, v []byte) {
+	t.Helper()
+	ctx := context.Background()
+
+	got, err := r.Get(ctx, key)
+	if v == nil {
+		if err != ds.ErrNotFound {
+			t.Fatalf("expected %s to be absent, got %q, %v", key, got, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("failed to get %s: %v", key, err)
+	}
+	if !bytes.Equal(got, v) {
+		t.Fatalf("expected %q for %s, got %q", v, key, got)
+	}
+}
+
+func subtestCommit(t *testing.T, d ds.TxnDatastore) {
+	ctx := context.Background()
+	a, b := ds.NewKey("/txntest/commit/a"), ds.NewKey("/txntest/commit/b")
+	if err := d.Put(ctx, b, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := newTxn(t, d, false)
+	if err := txn.Put(ctx, a, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, d, a, nil)
+	expectValue(t, d, b, []byte("b"))
+
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, d, a, []byte("a"))
+	expectValue(t, d, b, nil)
+}
+
+func subtestDiscard(t *testing.T, d ds.TxnDatastore) {
+	ctx := context.Background()
+	a, b := ds.NewKey("/txntest/discard/a"), ds.NewKey("/txntest/discard/b")
+	if err := d.Put(ctx, b, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := newTxn(t, d, false)
+	if err := txn.Put(ctx, a, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	txn.Discard(ctx)
+
+	expectValue(t, d, a, nil)
+	expectValue(t, d, b, []byte("b"))
+}
+
+func subtestReadYourOwnWrites(t *testing.T, d ds.TxnDatastore) {
+	ctx := context.Background()
+	a, b := ds.NewKey("/txntest/ryow/a"), ds.NewKey("/txntest/ryow/b")
+	if err := d.Put(ctx, b, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := newTxn(t, d, false)
+	defer txn.Discard(ctx)
+
+	if err := txn.Put(ctx, a, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, txn, a, []byte("value"))
+	if has, err := txn.Has(ctx, a); err != nil || !has {
+		t.Fatalf("expected %s to exist in the transaction, got %v, %v", a, has, err)
+	}
+	if size, err := txn.GetSize(ctx, a); err != nil || size != len("value") {
+		t.Fatalf("expected a size of %d, got %d, %v", len("value"), size, err)
+	}
+
+	if err := txn.Delete(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, txn, b, nil)
+	if has, err := txn.Has(ctx, b); err != nil || has {
+		t.Fatalf("expected %s to be absent in the transaction, got %v, %v", b, has, err)
+	}
+
+	// queries see the writes of the transaction
+	res, err := txn.Query(ctx, dsq.Query{Prefix: "/txntest/ryow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != a.String() || string(entries[0].Value) != "value" {
+		t.Fatalf("expected only %s in the transaction, got %v", a, entries)
+	}
+}
+
+func subtestIsolation(t *testing.T, d ds.TxnDatastore) {
+	ctx := context.Background()
+	a := ds.NewKey("/txntest/isolation/a")
+
+	writer := newTxn(t, d, false)
+	defer writer.Discard(ctx)
+	if err := writer.Put(ctx, a, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newTxn(t, d, true)
+	expectValue(t, reader, a, nil)
+	// the reader ends first, sqlite commits wait for the readers of a
+	// database without WAL
+	reader.Discard(ctx)
+
+	if err := writer.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	reader = newTxn(t, d, true)
+	defer reader.Discard(ctx)
+	expectValue(t, reader, a, []byte("a"))
+}
+
+func subtestReadOnlySnapshot(t *testing.T, d ds.TxnDatastore) {
+	ctx := context.Background()
+	a, b := ds.NewKey("/txntest/snapshot/a"), ds.NewKey("/txntest/snapshot/b")
+	if err := d.Put(ctx, a, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newTxn(t, d, true)
+	defer reader.Discard(ctx)
+	expectValue(t, reader, a, []byte("1"))
+
+	// the writes committed after the first read are not seen
+	if err := d.Put(ctx, a, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, b, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, reader, a, []byte("1"))
+	expectValue(t, reader, b, nil)
+
+	res, err := reader.Query(ctx, dsq.Query{Prefix: "/txntest/snapshot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != a.String() || string(entries[0].Value) != "1" {
+		t.Fatalf("expected the snapshot of the first read, got %v", entries)
+	}
+}
+
+func subtestRollbackOnError(t *testing.T, d ds.TxnDatastore) {
+	a, b := ds.NewKey("/txntest/rollback/a"), ds.NewKey("/txntest/rollback/b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	txn, err := d.NewTransaction(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, a, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := txn.Put(ctx, b, []byte("b")); err == nil {
+		t.Fatal("expected a put with a canceled context to fail")
+	}
+	if err := txn.Commit(context.Background()); err == nil {
+		t.Fatal("expected the commit of a failed transaction to fail")
+	}
+
+	expectValue(t, d, a, nil)
+	expectValue(t, d, b, nil)
+}
+
+func subtestReadOnly(t *testing.T, d ds.TxnDatastore) {
+	ctx := context.Background()
+	a := ds.NewKey("/txntest/readonly/a")
+
+	txn := newTxn(t, d, true)
+	defer txn.Discard(ctx)
+
+	if err := txn.Put(ctx, a, []byte("a")); err == nil {
+		t.Fatal("expected a put in a read-only transaction to fail")
+	}
+	expectValue(t, d, a, nil)
+}
+
+func subtestFinishedTxnRejected(t *testing.T, d ds.TxnDatastore) {
+	ctx := context.Background()
+	a, b := ds.NewKey("/txntest/finished/a"), ds.NewKey("/txntest/finished/b")
+
+	txn := newTxn(t, d, false)
+	if err := txn.Put(ctx, a, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, b, []byte("b")); err == nil {
+		t.Fatal("expected a put in a committed transaction to fail")
+	}
+	if err := txn.Commit(ctx); err == nil {
+		t.Fatal("expected a second commit to fail")
+	}
+
+	txn = newTxn(t, d, false)
+	txn.Discard(ctx)
+	if err := txn.Put(ctx, b, []byte("b")); err == nil {
+		t.Fatal("expected a put in a discarded transaction to fail")
+	}
+	expectValue(t, d, b, nil)
+}
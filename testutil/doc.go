@@ -0,0 +1,3 @@
+// Package testutil helps testing code using sqlds datastores, with in-memory
+// sqlite datastores and queries whose methods can be overridden.
+package testutil
@@ -0,0 +1,24 @@
+//go:build cgo
+
+package testutil
+
+import (
+	sqlds "github.com/vkost/go-ds-sql"
+	"github.com/vkost/go-ds-sql/sqlite"
+
+	_ "github.com/mattn/go-sqlite3" // sqlite driver
+)
+
+// NewInMemoryDatastore returns a datastore of a new in-memory sqlite
+// database, with the mattn/go-sqlite3 driver, ready for tests. Every
+// connection to :memory: opening a distinct database, the datastore uses a
+// single connection: an operation made while the results of a query are
+// being read blocks until they are closed.
+func NewInMemoryDatastore() (*sqlds.Datastore, error) {
+	d, err := (&sqlite.Options{Driver: "sqlite3", DSN: ":memory:"}).Create()
+	if err != nil {
+		return nil, err
+	}
+	d.DB().SetMaxOpenConns(1)
+	return d, nil
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+
+package testutil
+
+import (
+	"errors"
+
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// NewInMemoryDatastore returns an error, the sqlite driver needing cgo.
+func NewInMemoryDatastore() (*sqlds.Datastore, error) {
+	return nil, errors.New("testutil: NewInMemoryDatastore needs cgo for the mattn/go-sqlite3 driver")
+}
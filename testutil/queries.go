@@ -0,0 +1,595 @@
+package testutil
+
+import (
+	dsq "github.com/ipfs/go-datastore/query"
+	sqlds "github.com/vkost/go-ds-sql"
+)
+
+// MockQueries is a sqlds.Queries whose methods can be overridden one by one:
+// a method calls its function field if set, such as GetFn for Get, or the
+// same method of Queries otherwise. Without both, the methods return the
+// empty query of the unsupported features, the pattern unescaped and no
+// capabilities.
+type MockQueries struct {
+	// Queries are the queries of the methods which are not overridden.
+	Queries sqlds.Queries
+
+	DeleteFn               func() string
+	ExistsFn               func() string
+	GetFn                  func() string
+	PutFn                  func() string
+	QueryFn                func() string
+	QueryWithExpiryFn      func() string
+	QueryKeysAndSizesFn    func() string
+	QueryKeysFn            func() string
+	PrefixFn               func() string
+	PatternMatchFn         func() string
+	EscapePatternFn        func(string) string
+	PrefixPatternFn        func(string) string
+	LimitFn                func() string
+	OffsetFn               func() string
+	GetSizeFn              func() string
+	CountFn                func() string
+	EstimateCountFn        func() string
+	GetForUpdateFn         func() string
+	DeletePrefixFn         func() string
+	QueryPageFn            func() string
+	PutWithSizeFn          func() string
+	GetSizeFromColumnFn    func() string
+	OrderByValueFn         func(bool) string
+	OrderByKeyFn           func(bool) string
+	KeyCompareFn           func(dsq.Op) string
+	OrderByCreatedAtFn     func() string
+	OrderByCreatedAtDescFn func() string
+	SetChecksumFn          func() string
+	GetWithChecksumFn      func() string
+	QueryChecksumsFn       func() string
+	DeleteManyFn           func(int) string
+	GetManyFn              func(int) string
+	SyncFn                 func() string
+	PutIfAbsentFn          func() string
+	ListNamespacesFn       func() string
+	VacuumFn               func() string
+	OptimizeFn             func() string
+	StatFn                 func() string
+	DiskUsageFn            func() string
+	TableStatsFn           func() string
+	SetAutovacuumFn        func(bool) string
+	TableSchemaFn          func() string
+	ColumnsFn              func() string
+	ExplainFn              func() string
+	ZeroValueFn            func() string
+	DeclareCursorFn        func() string
+	FetchCursorFn          func(int) string
+	CapabilitiesFn         func() sqlds.QueryCapabilities
+}
+
+// Delete returns the result of DeleteFn, see MockQueries.
+func (q *MockQueries) Delete() string {
+	switch {
+	case q.DeleteFn != nil:
+		return q.DeleteFn()
+	case q.Queries != nil:
+		return q.Queries.Delete()
+	}
+	return ""
+}
+
+// Exists returns the result of ExistsFn, see MockQueries.
+func (q *MockQueries) Exists() string {
+	switch {
+	case q.ExistsFn != nil:
+		return q.ExistsFn()
+	case q.Queries != nil:
+		return q.Queries.Exists()
+	}
+	return ""
+}
+
+// Get returns the result of GetFn, see MockQueries.
+func (q *MockQueries) Get() string {
+	switch {
+	case q.GetFn != nil:
+		return q.GetFn()
+	case q.Queries != nil:
+		return q.Queries.Get()
+	}
+	return ""
+}
+
+// Put returns the result of PutFn, see MockQueries.
+func (q *MockQueries) Put() string {
+	switch {
+	case q.PutFn != nil:
+		return q.PutFn()
+	case q.Queries != nil:
+		return q.Queries.Put()
+	}
+	return ""
+}
+
+// Query returns the result of QueryFn, see MockQueries.
+func (q *MockQueries) Query() string {
+	switch {
+	case q.QueryFn != nil:
+		return q.QueryFn()
+	case q.Queries != nil:
+		return q.Queries.Query()
+	}
+	return ""
+}
+
+// QueryWithExpiry returns the result of QueryWithExpiryFn, see MockQueries.
+func (q *MockQueries) QueryWithExpiry() string {
+	switch {
+	case q.QueryWithExpiryFn != nil:
+		return q.QueryWithExpiryFn()
+	case q.Queries != nil:
+		return q.Queries.QueryWithExpiry()
+	}
+	return ""
+}
+
+// QueryKeysAndSizes returns the result of QueryKeysAndSizesFn, see MockQueries.
+func (q *MockQueries) QueryKeysAndSizes() string {
+	switch {
+	case q.QueryKeysAndSizesFn != nil:
+		return q.QueryKeysAndSizesFn()
+	case q.Queries != nil:
+		return q.Queries.QueryKeysAndSizes()
+	}
+	return ""
+}
+
+// QueryKeys returns the result of QueryKeysFn, see MockQueries.
+func (q *MockQueries) QueryKeys() string {
+	switch {
+	case q.QueryKeysFn != nil:
+		return q.QueryKeysFn()
+	case q.Queries != nil:
+		return q.Queries.QueryKeys()
+	}
+	return ""
+}
+
+// Prefix returns the result of PrefixFn, see MockQueries.
+func (q *MockQueries) Prefix() string {
+	switch {
+	case q.PrefixFn != nil:
+		return q.PrefixFn()
+	case q.Queries != nil:
+		return q.Queries.Prefix()
+	}
+	return ""
+}
+
+// PatternMatch returns the result of PatternMatchFn, see MockQueries.
+func (q *MockQueries) PatternMatch() string {
+	switch {
+	case q.PatternMatchFn != nil:
+		return q.PatternMatchFn()
+	case q.Queries != nil:
+		return q.Queries.PatternMatch()
+	}
+	return ""
+}
+
+// EscapePattern returns the result of EscapePatternFn, see MockQueries.
+func (q *MockQueries) EscapePattern(s string) string {
+	switch {
+	case q.EscapePatternFn != nil:
+		return q.EscapePatternFn(s)
+	case q.Queries != nil:
+		return q.Queries.EscapePattern(s)
+	}
+	return s
+}
+
+// PrefixPattern returns the result of PrefixPatternFn, see MockQueries.
+func (q *MockQueries) PrefixPattern(prefix string) string {
+	switch {
+	case q.PrefixPatternFn != nil:
+		return q.PrefixPatternFn(prefix)
+	case q.Queries != nil:
+		return q.Queries.PrefixPattern(prefix)
+	}
+	return prefix
+}
+
+// Limit returns the result of LimitFn, see MockQueries.
+func (q *MockQueries) Limit() string {
+	switch {
+	case q.LimitFn != nil:
+		return q.LimitFn()
+	case q.Queries != nil:
+		return q.Queries.Limit()
+	}
+	return ""
+}
+
+// Offset returns the result of OffsetFn, see MockQueries.
+func (q *MockQueries) Offset() string {
+	switch {
+	case q.OffsetFn != nil:
+		return q.OffsetFn()
+	case q.Queries != nil:
+		return q.Queries.Offset()
+	}
+	return ""
+}
+
+// GetSize returns the result of GetSizeFn, see MockQueries.
+func (q *MockQueries) GetSize() string {
+	switch {
+	case q.GetSizeFn != nil:
+		return q.GetSizeFn()
+	case q.Queries != nil:
+		return q.Queries.GetSize()
+	}
+	return ""
+}
+
+// Count returns the result of CountFn, see MockQueries.
+func (q *MockQueries) Count() string {
+	switch {
+	case q.CountFn != nil:
+		return q.CountFn()
+	case q.Queries != nil:
+		return q.Queries.Count()
+	}
+	return ""
+}
+
+// EstimateCount returns the result of EstimateCountFn, see MockQueries.
+func (q *MockQueries) EstimateCount() string {
+	switch {
+	case q.EstimateCountFn != nil:
+		return q.EstimateCountFn()
+	case q.Queries != nil:
+		return q.Queries.EstimateCount()
+	}
+	return ""
+}
+
+// GetForUpdate returns the result of GetForUpdateFn, see MockQueries.
+func (q *MockQueries) GetForUpdate() string {
+	switch {
+	case q.GetForUpdateFn != nil:
+		return q.GetForUpdateFn()
+	case q.Queries != nil:
+		return q.Queries.GetForUpdate()
+	}
+	return ""
+}
+
+// DeletePrefix returns the result of DeletePrefixFn, see MockQueries.
+func (q *MockQueries) DeletePrefix() string {
+	switch {
+	case q.DeletePrefixFn != nil:
+		return q.DeletePrefixFn()
+	case q.Queries != nil:
+		return q.Queries.DeletePrefix()
+	}
+	return ""
+}
+
+// QueryPage returns the result of QueryPageFn, see MockQueries.
+func (q *MockQueries) QueryPage() string {
+	switch {
+	case q.QueryPageFn != nil:
+		return q.QueryPageFn()
+	case q.Queries != nil:
+		return q.Queries.QueryPage()
+	}
+	return ""
+}
+
+// PutWithSize returns the result of PutWithSizeFn, see MockQueries.
+func (q *MockQueries) PutWithSize() string {
+	switch {
+	case q.PutWithSizeFn != nil:
+		return q.PutWithSizeFn()
+	case q.Queries != nil:
+		return q.Queries.PutWithSize()
+	}
+	return ""
+}
+
+// GetSizeFromColumn returns the result of GetSizeFromColumnFn, see MockQueries.
+func (q *MockQueries) GetSizeFromColumn() string {
+	switch {
+	case q.GetSizeFromColumnFn != nil:
+		return q.GetSizeFromColumnFn()
+	case q.Queries != nil:
+		return q.Queries.GetSizeFromColumn()
+	}
+	return ""
+}
+
+// OrderByValue returns the result of OrderByValueFn, see MockQueries.
+func (q *MockQueries) OrderByValue(desc bool) string {
+	switch {
+	case q.OrderByValueFn != nil:
+		return q.OrderByValueFn(desc)
+	case q.Queries != nil:
+		return q.Queries.OrderByValue(desc)
+	}
+	return ""
+}
+
+// OrderByKey returns the result of OrderByKeyFn, see MockQueries.
+func (q *MockQueries) OrderByKey(desc bool) string {
+	switch {
+	case q.OrderByKeyFn != nil:
+		return q.OrderByKeyFn(desc)
+	case q.Queries != nil:
+		return q.Queries.OrderByKey(desc)
+	}
+	return ""
+}
+
+// KeyCompare returns the result of KeyCompareFn, see MockQueries.
+func (q *MockQueries) KeyCompare(op dsq.Op) string {
+	switch {
+	case q.KeyCompareFn != nil:
+		return q.KeyCompareFn(op)
+	case q.Queries != nil:
+		return q.Queries.KeyCompare(op)
+	}
+	return ""
+}
+
+// OrderByCreatedAt returns the result of OrderByCreatedAtFn, see MockQueries.
+func (q *MockQueries) OrderByCreatedAt() string {
+	switch {
+	case q.OrderByCreatedAtFn != nil:
+		return q.OrderByCreatedAtFn()
+	case q.Queries != nil:
+		return q.Queries.OrderByCreatedAt()
+	}
+	return ""
+}
+
+// OrderByCreatedAtDesc returns the result of OrderByCreatedAtDescFn, see MockQueries.
+func (q *MockQueries) OrderByCreatedAtDesc() string {
+	switch {
+	case q.OrderByCreatedAtDescFn != nil:
+		return q.OrderByCreatedAtDescFn()
+	case q.Queries != nil:
+		return q.Queries.OrderByCreatedAtDesc()
+	}
+	return ""
+}
+
+// SetChecksum returns the result of SetChecksumFn, see MockQueries.
+func (q *MockQueries) SetChecksum() string {
+	switch {
+	case q.SetChecksumFn != nil:
+		return q.SetChecksumFn()
+	case q.Queries != nil:
+		return q.Queries.SetChecksum()
+	}
+	return ""
+}
+
+// GetWithChecksum returns the result of GetWithChecksumFn, see MockQueries.
+func (q *MockQueries) GetWithChecksum() string {
+	switch {
+	case q.GetWithChecksumFn != nil:
+		return q.GetWithChecksumFn()
+	case q.Queries != nil:
+		return q.Queries.GetWithChecksum()
+	}
+	return ""
+}
+
+// QueryChecksums returns the result of QueryChecksumsFn, see MockQueries.
+func (q *MockQueries) QueryChecksums() string {
+	switch {
+	case q.QueryChecksumsFn != nil:
+		return q.QueryChecksumsFn()
+	case q.Queries != nil:
+		return q.Queries.QueryChecksums()
+	}
+	return ""
+}
+
+// DeleteMany returns the result of DeleteManyFn, see MockQueries.
+func (q *MockQueries) DeleteMany(n int) string {
+	switch {
+	case q.DeleteManyFn != nil:
+		return q.DeleteManyFn(n)
+	case q.Queries != nil:
+		return q.Queries.DeleteMany(n)
+	}
+	return ""
+}
+
+// GetMany returns the result of GetManyFn, see MockQueries.
+func (q *MockQueries) GetMany(n int) string {
+	switch {
+	case q.GetManyFn != nil:
+		return q.GetManyFn(n)
+	case q.Queries != nil:
+		return q.Queries.GetMany(n)
+	}
+	return ""
+}
+
+// Sync returns the result of SyncFn, see MockQueries.
+func (q *MockQueries) Sync() string {
+	switch {
+	case q.SyncFn != nil:
+		return q.SyncFn()
+	case q.Queries != nil:
+		return q.Queries.Sync()
+	}
+	return ""
+}
+
+// PutIfAbsent returns the result of PutIfAbsentFn, see MockQueries.
+func (q *MockQueries) PutIfAbsent() string {
+	switch {
+	case q.PutIfAbsentFn != nil:
+		return q.PutIfAbsentFn()
+	case q.Queries != nil:
+		return q.Queries.PutIfAbsent()
+	}
+	return ""
+}
+
+// ListNamespaces returns the result of ListNamespacesFn, see MockQueries.
+func (q *MockQueries) ListNamespaces() string {
+	switch {
+	case q.ListNamespacesFn != nil:
+		return q.ListNamespacesFn()
+	case q.Queries != nil:
+		return q.Queries.ListNamespaces()
+	}
+	return ""
+}
+
+// Vacuum returns the result of VacuumFn, see MockQueries.
+func (q *MockQueries) Vacuum() string {
+	switch {
+	case q.VacuumFn != nil:
+		return q.VacuumFn()
+	case q.Queries != nil:
+		return q.Queries.Vacuum()
+	}
+	return ""
+}
+
+// Optimize returns the result of OptimizeFn, see MockQueries.
+func (q *MockQueries) Optimize() string {
+	switch {
+	case q.OptimizeFn != nil:
+		return q.OptimizeFn()
+	case q.Queries != nil:
+		return q.Queries.Optimize()
+	}
+	return ""
+}
+
+// Stat returns the result of StatFn, see MockQueries.
+func (q *MockQueries) Stat() string {
+	switch {
+	case q.StatFn != nil:
+		return q.StatFn()
+	case q.Queries != nil:
+		return q.Queries.Stat()
+	}
+	return ""
+}
+
+// DiskUsage returns the result of DiskUsageFn, see MockQueries.
+func (q *MockQueries) DiskUsage() string {
+	switch {
+	case q.DiskUsageFn != nil:
+		return q.DiskUsageFn()
+	case q.Queries != nil:
+		return q.Queries.DiskUsage()
+	}
+	return ""
+}
+
+// TableStats returns the result of TableStatsFn, see MockQueries.
+func (q *MockQueries) TableStats() string {
+	switch {
+	case q.TableStatsFn != nil:
+		return q.TableStatsFn()
+	case q.Queries != nil:
+		return q.Queries.TableStats()
+	}
+	return ""
+}
+
+// SetAutovacuum returns the result of SetAutovacuumFn, see MockQueries.
+func (q *MockQueries) SetAutovacuum(enabled bool) string {
+	switch {
+	case q.SetAutovacuumFn != nil:
+		return q.SetAutovacuumFn(enabled)
+	case q.Queries != nil:
+		return q.Queries.SetAutovacuum(enabled)
+	}
+	return ""
+}
+
+// TableSchema returns the result of TableSchemaFn, see MockQueries.
+func (q *MockQueries) TableSchema() string {
+	switch {
+	case q.TableSchemaFn != nil:
+		return q.TableSchemaFn()
+	case q.Queries != nil:
+		return q.Queries.TableSchema()
+	}
+	return ""
+}
+
+// Columns returns the result of ColumnsFn, see MockQueries.
+func (q *MockQueries) Columns() string {
+	switch {
+	case q.ColumnsFn != nil:
+		return q.ColumnsFn()
+	case q.Queries != nil:
+		return q.Queries.Columns()
+	}
+	return ""
+}
+
+// Explain returns the result of ExplainFn, see MockQueries.
+func (q *MockQueries) Explain() string {
+	switch {
+	case q.ExplainFn != nil:
+		return q.ExplainFn()
+	case q.Queries != nil:
+		return q.Queries.Explain()
+	}
+	return ""
+}
+
+// ZeroValue returns the result of ZeroValueFn, see MockQueries.
+func (q *MockQueries) ZeroValue() string {
+	switch {
+	case q.ZeroValueFn != nil:
+		return q.ZeroValueFn()
+	case q.Queries != nil:
+		return q.Queries.ZeroValue()
+	}
+	return ""
+}
+
+// DeclareCursor returns the result of DeclareCursorFn, see MockQueries.
+func (q *MockQueries) DeclareCursor() string {
+	switch {
+	case q.DeclareCursorFn != nil:
+		return q.DeclareCursorFn()
+	case q.Queries != nil:
+		return q.Queries.DeclareCursor()
+	}
+	return ""
+}
+
+// FetchCursor returns the result of FetchCursorFn, see MockQueries.
+func (q *MockQueries) FetchCursor(n int) string {
+	switch {
+	case q.FetchCursorFn != nil:
+		return q.FetchCursorFn(n)
+	case q.Queries != nil:
+		return q.Queries.FetchCursor(n)
+	}
+	return ""
+}
+
+// Capabilities returns the result of CapabilitiesFn, see MockQueries.
+func (q *MockQueries) Capabilities() sqlds.QueryCapabilities {
+	switch {
+	case q.CapabilitiesFn != nil:
+		return q.CapabilitiesFn()
+	case q.Queries != nil:
+		return q.Queries.Capabilities()
+	}
+	return sqlds.QueryCapabilities{}
+}
+
+var _ sqlds.Queries = (*MockQueries)(nil)
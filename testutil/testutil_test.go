@@ -0,0 +1,82 @@
+//go:build cgo
+
+package testutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/vkost/go-ds-sql"
+	"github.com/vkost/go-ds-sql/sqlite"
+)
+
+func TestNewInMemoryDatastore(t *testing.T) {
+	d, err := NewInMemoryDatastore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := d.Get(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "a" {
+		t.Fatalf("expected a, got %q", v)
+	}
+
+	// every datastore has its own database
+	d2, err := NewInMemoryDatastore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	if _, err := d2.Get(ctx, ds.NewKey("/a")); !errors.Is(err, ds.ErrNotFound) {
+		t.Fatalf("expected ds.ErrNotFound, got %v", err)
+	}
+}
+
+func TestMockQueries(t *testing.T) {
+	d, err := NewInMemoryDatastore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	q := &MockQueries{
+		Queries: sqlite.NewQueries("blocks"),
+		GetFn: func() string {
+			calls++
+			return `SELECT 'mocked' FROM blocks WHERE key = $1`
+		},
+	}
+	md := sqlds.NewDatastore(d.DB(), q)
+
+	v, err := md.Get(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "mocked" || calls == 0 {
+		t.Fatalf("expected the overridden query to be used, got %q", v)
+	}
+	// the other methods fall back to Queries
+	if ok, err := md.Has(ctx, ds.NewKey("/a")); err != nil || !ok {
+		t.Fatalf("expected /a to exist, got %v, %v", ok, err)
+	}
+
+	if got := (&MockQueries{}).EscapePattern("a*"); got != "a*" {
+		t.Fatalf("expected the pattern unescaped, got %q", got)
+	}
+}
@@ -0,0 +1,77 @@
+package sqlds
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// ErrQueryTimeout is returned by the operations exceeding the timeout set
+// with WithQueryTimeout.
+var ErrQueryTimeout = errors.New("query timeout exceeded")
+
+// WithQueryTimeout returns a copy of d bounding the duration of its Get, Has,
+// GetSize, Put, Delete and Query operations by timeout, within the deadline
+// of their context. The statement of an operation exceeding it is
+// interrupted and the operation returns ErrQueryTimeout. The timeout of a
+// query covers the iteration of its results, which then end with
+// ErrQueryTimeout. Batches and transactions are only bounded by their
+// contexts. The copy shares the database of d.
+func WithQueryTimeout(d *Datastore, timeout time.Duration) *Datastore {
+	td := *d
+	td.queryTimeout = timeout
+	return &td
+}
+
+// withQueryTimeout returns ctx bounded by the timeout of WithQueryTimeout,
+// and the function releasing it, which replaces *err with ErrQueryTimeout if
+// the timeout expired.
+func (d *Datastore) withQueryTimeout(ctx context.Context, err *error) (context.Context, func()) {
+	if d.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, d.queryTimeout)
+	return tctx, func() {
+		*err = queryTimeoutError(ctx, tctx, *err)
+		cancel()
+	}
+}
+
+// queryTimeoutError returns ErrQueryTimeout if err follows the expiry of the
+// timeout of tctx, derived from ctx, and err otherwise.
+func queryTimeoutError(ctx, tctx context.Context, err error) error {
+	if err != nil && ctx.Err() == nil && errors.Is(tctx.Err(), context.DeadlineExceeded) {
+		return ErrQueryTimeout
+	}
+	return err
+}
+
+// queryWithTimeout runs query with ctx bounded by the timeout of
+// WithQueryTimeout until its results are closed.
+func (d *Datastore) queryWithTimeout(ctx context.Context, query func(context.Context) (dsq.Results, error)) (dsq.Results, error) {
+	if d.queryTimeout <= 0 {
+		return query(ctx)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, d.queryTimeout)
+	res, err := query(tctx)
+	if err != nil {
+		cancel()
+		return nil, queryTimeoutError(ctx, tctx, err)
+	}
+
+	return dsq.ResultsFromIterator(res.Query(), dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := res.NextSync()
+			r.Error = queryTimeoutError(ctx, tctx, r.Error)
+			return r, ok
+		},
+		Close: func() error {
+			defer cancel()
+			return res.Close()
+		},
+	}), nil
+}
@@ -0,0 +1,191 @@
+package sqlds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracedDatastore creates an OpenTelemetry span for every operation of the
+// wrapped datastore.
+type TracedDatastore struct {
+	child  ds.Batching
+	tracer trace.Tracer
+
+	// set when the wrapped datastore is a *Datastore
+	queries Queries
+	system  string
+}
+
+// WithTracing wraps d so that every operation is traced with tracer. When d
+// is a *Datastore the spans also carry the SQL statement template.
+func WithTracing(d ds.Batching, tracer trace.Tracer) *TracedDatastore {
+	t := &TracedDatastore{child: d, tracer: tracer, system: "other_sql"}
+	if sd, ok := d.(*Datastore); ok {
+		t.queries = sd.queries
+		t.system = dbSystem(sd)
+	}
+	return t
+}
+
+// dbSystem guesses the OpenTelemetry db.system of the datastore from its driver.
+func dbSystem(d *Datastore) string {
+	drv := strings.ToLower(fmt.Sprintf("%T", d.db.Driver()))
+	switch {
+	case strings.Contains(drv, "pq"), strings.Contains(drv, "pgx"):
+		return "postgresql"
+	case strings.Contains(drv, "sqlite"):
+		return "sqlite"
+	default:
+		return "other_sql"
+	}
+}
+
+func (t *TracedDatastore) start(ctx context.Context, op string, stmt func(Queries) string, key *ds.Key) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", t.system),
+		attribute.String("db.operation", op),
+	}
+	if t.queries != nil && stmt != nil {
+		attrs = append(attrs, attribute.String("db.statement", stmt(t.queries)))
+	}
+	if key != nil {
+		attrs = append(attrs, attribute.String("datastore.key", key.String()))
+	}
+
+	return t.tracer.Start(ctx, "sqlds."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on span, ds.ErrNotFound is not an error.
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != ds.ErrNotFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Get retrieves a value from the wrapped datastore.
+func (t *TracedDatastore) Get(ctx context.Context, key ds.Key) (value []byte, err error) {
+	ctx, span := t.start(ctx, "Get", Queries.Get, &key)
+	defer func() { endSpan(span, err) }()
+	return t.child.Get(ctx, key)
+}
+
+// Has determines if a value for the given key exists in the wrapped datastore.
+func (t *TracedDatastore) Has(ctx context.Context, key ds.Key) (exists bool, err error) {
+	ctx, span := t.start(ctx, "Has", Queries.Exists, &key)
+	defer func() { endSpan(span, err) }()
+	return t.child.Has(ctx, key)
+}
+
+// GetSize determines the size of the value of the given key.
+func (t *TracedDatastore) GetSize(ctx context.Context, key ds.Key) (size int, err error) {
+	ctx, span := t.start(ctx, "GetSize", Queries.GetSize, &key)
+	defer func() { endSpan(span, err) }()
+	return t.child.GetSize(ctx, key)
+}
+
+// Put stores a value in the wrapped datastore.
+func (t *TracedDatastore) Put(ctx context.Context, key ds.Key, value []byte) (err error) {
+	ctx, span := t.start(ctx, "Put", Queries.Put, &key)
+	defer func() { endSpan(span, err) }()
+	return t.child.Put(ctx, key, value)
+}
+
+// Delete removes a value from the wrapped datastore.
+func (t *TracedDatastore) Delete(ctx context.Context, key ds.Key) (err error) {
+	ctx, span := t.start(ctx, "Delete", Queries.Delete, &key)
+	defer func() { endSpan(span, err) }()
+	return t.child.Delete(ctx, key)
+}
+
+// Query queries the wrapped datastore, the span ends when the results are closed.
+func (t *TracedDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	ctx, span := t.start(ctx, "Query", Queries.Query, nil)
+	span.SetAttributes(attribute.String("datastore.query", q.String()))
+
+	res, err := t.child.Query(ctx, q)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	var iterErr error
+	return dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := res.NextSync()
+			if r.Error != nil {
+				iterErr = r.Error
+			}
+			return r, ok
+		},
+		Close: func() error {
+			err := res.Close()
+			if err == nil {
+				err = iterErr
+			}
+			endSpan(span, err)
+			return err
+		},
+	}), nil
+}
+
+// Sync flushes the given prefix of the wrapped datastore.
+func (t *TracedDatastore) Sync(ctx context.Context, prefix ds.Key) (err error) {
+	ctx, span := t.start(ctx, "Sync", nil, &prefix)
+	defer func() { endSpan(span, err) }()
+	return t.child.Sync(ctx, prefix)
+}
+
+// Close closes the wrapped datastore.
+func (t *TracedDatastore) Close() error {
+	return t.child.Close()
+}
+
+// Batch creates a batch whose commit is traced.
+func (t *TracedDatastore) Batch(ctx context.Context) (_ ds.Batch, err error) {
+	ctx, span := t.start(ctx, "Batch", nil, nil)
+	defer func() { endSpan(span, err) }()
+
+	b, err := t.child.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedBatch{b: b, t: t}, nil
+}
+
+type tracedBatch struct {
+	b ds.Batch
+	t *TracedDatastore
+}
+
+func (tb *tracedBatch) Put(ctx context.Context, key ds.Key, val []byte) error {
+	return tb.b.Put(ctx, key, val)
+}
+
+func (tb *tracedBatch) Delete(ctx context.Context, key ds.Key) error {
+	return tb.b.Delete(ctx, key)
+}
+
+func (tb *tracedBatch) Commit(ctx context.Context) (err error) {
+	ctx, span := tb.t.start(ctx, "Batch.Commit", nil, nil)
+	defer func() { endSpan(span, err) }()
+	return tb.b.Commit(ctx)
+}
+
+// Discard discards the wrapped batch, see DiscardableBatch.
+func (tb *tracedBatch) Discard(ctx context.Context) {
+	discardBatch(ctx, tb.b)
+}
+
+var (
+	_ ds.Batching      = (*TracedDatastore)(nil)
+	_ DiscardableBatch = (*tracedBatch)(nil)
+)
@@ -0,0 +1,214 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// TTLQueries are the queries of a TTLDatastore. Their read queries skip the
+// rows whose expires_at column is in the past, and their put queries clear
+// the expiration of the rows.
+type TTLQueries interface {
+	Queries
+	// PutWithTTL upserts the row of key $1 with value $2, expiring at $3.
+	PutWithTTL() string
+	// SetTTL sets the expiration of the live row of key $1 to $2.
+	SetTTL() string
+	// GetExpiration selects the expiration of the live row of key $1, NULL
+	// if it does not expire.
+	GetExpiration() string
+	// DeleteExpired removes at most $1 expired rows.
+	DeleteExpired() string
+}
+
+// TTLDatastore is a Datastore whose entries can expire, implementing
+// ds.TTLDatastore. The expired rows are hidden from the reads until they are
+// deleted, and the queries with ReturnExpirations return the expirations of
+// the entries.
+type TTLDatastore struct {
+	*Datastore
+	queries TTLQueries
+}
+
+// NewTTLDatastore returns a new SQL datastore with expiring entries, the
+// table needs an expires_at column.
+func NewTTLDatastore(db *sql.DB, queries TTLQueries, opts ...Option) *TTLDatastore {
+	opts = append([]Option{WithExpirationColumn()}, opts...)
+	return &TTLDatastore{Datastore: NewDatastore(db, queries, opts...), queries: queries}
+}
+
+// PutWithTTL upserts a row expiring after ttl.
+func (d *TTLDatastore) PutWithTTL(ctx context.Context, key ds.Key, value []byte, ttl time.Duration) (err error) {
+	defer func(start time.Time) { d.log(ctx, "PutWithTTL", d.queries.PutWithTTL(), &key, start, err) }(time.Now())
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if err := d.checkValueSize(key, value); err != nil {
+		return err
+	}
+	if d.stats != nil {
+		d.stats.puts.Add(1)
+	}
+
+	if _, err := d.db.ExecContext(ctx, d.queries.PutWithTTL(), append(d.putArgs(key, value), expiresAt(ttl))...); err != nil {
+		return err
+	}
+	d.replicate(key, value, false)
+	return nil
+}
+
+// SetTTL makes the entry of key expire after ttl, it returns ds.ErrNotFound
+// if there is no entry for the key.
+func (d *TTLDatastore) SetTTL(ctx context.Context, key ds.Key, ttl time.Duration) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	res, err := d.db.ExecContext(ctx, d.queries.SetTTL(), d.keyArg(key), expiresAt(ttl))
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ds.ErrNotFound
+	}
+	return nil
+}
+
+// GetExpiration returns the expiration of the entry of key, the zero time if
+// it does not expire, and ds.ErrNotFound if there is no entry for the key.
+func (d *TTLDatastore) GetExpiration(ctx context.Context, key ds.Key) (time.Time, error) {
+	var expiration sql.NullTime
+	switch err := d.db.QueryRowContext(ctx, d.queries.GetExpiration(), d.keyArg(key)).Scan(&expiration); err {
+	case sql.ErrNoRows:
+		return time.Time{}, ds.ErrNotFound
+	case nil:
+		return expiration.Time, nil
+	default:
+		return time.Time{}, err
+	}
+}
+
+// DeleteExpired removes the expired rows, batchSize rows at a time, and
+// returns the number of removed rows. batchSize must be positive.
+func (d *TTLDatastore) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	if batchSize < 1 {
+		return 0, fmt.Errorf("DeleteExpired: invalid batch size %d", batchSize)
+	}
+
+	var deleted int64
+	for {
+		res, err := d.db.ExecContext(ctx, d.queries.DeleteExpired(), batchSize)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		if n < int64(batchSize) {
+			return deleted, nil
+		}
+	}
+}
+
+// SweepOptions configures the expiration sweeper of WithSweeper.
+type SweepOptions struct {
+	// Interval is the period of the sweeps, one minute by default.
+	Interval time.Duration
+	// Jitter bounds the random delay added to every interval, so that the
+	// sweeps of the nodes sharing a database spread out. It is a tenth of
+	// Interval by default.
+	Jitter time.Duration
+	// BatchSize is the number of rows deleted by a statement, 1000 by
+	// default, keeping the locks of a sweep short.
+	BatchSize int
+}
+
+// sweeper deletes the expired rows of a datastore in the background.
+type sweeper struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// WithSweeper returns a copy of d deleting its expired rows with
+// DeleteExpired every interval of opts, plus a random jitter, until it is
+// closed, rather than letting them accumulate in the table. Failed sweeps are
+// logged at the warning level, with the logger set by WithLogger or the
+// default one. The copy shares the database of d.
+func WithSweeper(d *TTLDatastore, opts SweepOptions) *TTLDatastore {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.Jitter <= 0 {
+		opts.Jitter = opts.Interval / 10
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	dd := *d.Datastore
+	sd := &TTLDatastore{Datastore: &dd, queries: d.queries}
+	ctx, cancel := context.WithCancel(context.Background())
+	sd.sweeper = &sweeper{cancel: cancel}
+
+	logger := sd.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	sd.sweeper.wg.Add(1)
+	go func() {
+		defer sd.sweeper.wg.Done()
+
+		for {
+			t := time.NewTimer(opts.Interval + rand.N(opts.Jitter))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+
+			if _, err := sd.DeleteExpired(ctx, opts.BatchSize); err != nil && ctx.Err() == nil {
+				logger.LogAttrs(ctx, slog.LevelWarn, "failed to delete expired rows",
+					slog.String("db.operation", "DeleteExpired"),
+					slog.Any("error", err),
+				)
+			}
+		}
+	}()
+
+	return sd
+}
+
+// stopSweeper stops the deletion of the expired rows.
+func (d *Datastore) stopSweeper() {
+	if d.sweeper != nil {
+		d.sweeper.cancel()
+		d.sweeper.wg.Wait()
+	}
+}
+
+// expiresAt returns the expiration of an entry expiring after ttl, in UTC so
+// that sqlite compares it with its own clock.
+func expiresAt(ttl time.Duration) time.Time {
+	return time.Now().Add(ttl).UTC()
+}
+
+var _ ds.TTLDatastore = (*TTLDatastore)(nil)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	datastore "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
@@ -14,25 +15,54 @@ import (
 var ErrNotImplemented = fmt.Errorf("not implemented")
 
 type txn struct {
-	db      *sql.DB
-	queries Queries
-	txn     *sql.Tx
-	ds      *Datastore
+	db       *sql.DB
+	queries  Queries
+	txn      *sql.Tx
+	ds       *Datastore
+	readOnly bool
 }
 
 var _ dsextensions.TxnExt = (*txn)(nil)
 
-// NewTransaction creates a new database transaction, note the readOnly parameter is ignored by this implementation.
-func (ds *Datastore) NewTransaction(ctx context.Context, _ bool) (datastore.Txn, error) {
-	return ds.newTransaction(ctx)
+// WithReadOnlyIsolation makes the datastore start its read-only
+// transactions with the isolation level, such as sql.LevelRepeatableRead
+// for the Gets and Queries of a transaction to read the same snapshot of
+// the database. The default level of the driver is used otherwise.
+func WithReadOnlyIsolation(level sql.IsolationLevel) Option {
+	return func(d *Datastore) {
+		d.readOnlyIsolation = level
+	}
+}
+
+// NewTransaction creates a new database transaction, the writes of a
+// read-only transaction fail with ErrReadOnly. Read-only transactions are
+// started read-only in the database as well, with the isolation level of
+// WithReadOnlyIsolation.
+func (ds *Datastore) NewTransaction(ctx context.Context, readOnly bool) (datastore.Txn, error) {
+	return ds.newTransaction(ctx, ds.txOptions(readOnly))
+}
+
+func (ds *Datastore) NewTransactionExtended(ctx context.Context, readOnly bool) (dsextensions.TxnExt, error) {
+	return ds.newTransaction(ctx, ds.txOptions(readOnly))
+}
+
+// txOptions returns the options of the transactions of NewTransaction.
+func (ds *Datastore) txOptions(readOnly bool) *sql.TxOptions {
+	if readOnly {
+		return &sql.TxOptions{ReadOnly: true, Isolation: ds.readOnlyIsolation}
+	}
+	return &sql.TxOptions{}
 }
 
-func (ds *Datastore) NewTransactionExtended(ctx context.Context, _ bool) (dsextensions.TxnExt, error) {
-	return ds.newTransaction(ctx)
+// NewTransactionWithOptions creates a new database transaction started with
+// opts, to choose its isolation level. A nil opts uses the defaults of the
+// driver.
+func (ds *Datastore) NewTransactionWithOptions(ctx context.Context, opts *sql.TxOptions) (dsextensions.TxnExt, error) {
+	return ds.newTransaction(ctx, opts)
 }
 
-func (ds *Datastore) newTransaction(ctx context.Context) (dsextensions.TxnExt, error) {
-	sqlTxn, err := ds.db.BeginTx(ctx, nil)
+func (ds *Datastore) newTransaction(ctx context.Context, opts *sql.TxOptions) (dsextensions.TxnExt, error) {
+	sqlTxn, err := ds.db.BeginTx(ctx, opts)
 	if err != nil {
 		if sqlTxn != nil {
 			// nothing we can do about this error.
@@ -43,15 +73,43 @@ func (ds *Datastore) newTransaction(ctx context.Context) (dsextensions.TxnExt, e
 	}
 
 	return &txn{
-		db:      ds.db,
-		queries: ds.queries,
-		txn:     sqlTxn,
-		ds:      ds,
+		db:       ds.db,
+		queries:  ds.queries,
+		txn:      sqlTxn,
+		ds:       ds,
+		readOnly: opts != nil && opts.ReadOnly,
 	}, nil
 }
 
+// GetForUpdate retrieves the value of key within tx, a transaction of the
+// datastore, locking the row until tx ends: concurrent GetForUpdate calls
+// block until then, so that the value can be updated from the one read
+// without losing the updates of other transactions.
+//
+// SQLite has no row locks, its transactions must be started with BEGIN
+// IMMEDIATE to lock the database, see the ImmediateTransactions option of
+// the sqlite package.
+func (ds *Datastore) GetForUpdate(ctx context.Context, key datastore.Key, tx datastore.Txn) ([]byte, error) {
+	t, ok := tx.(*txn)
+	if !ok || t.db != ds.db {
+		return nil, fmt.Errorf("not a transaction of the datastore: %T", tx)
+	}
+
+	row := t.txn.QueryRowContext(ctx, ds.queries.GetForUpdate(), ds.keyArg(key))
+	var out []byte
+
+	switch err := row.Scan(&out); err {
+	case sql.ErrNoRows:
+		return nil, datastore.ErrNotFound
+	case nil:
+		return out, nil
+	default:
+		return nil, err
+	}
+}
+
 func (t *txn) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
-	row := t.txn.QueryRowContext(ctx, t.queries.Get(), key.String())
+	row := t.txn.QueryRowContext(ctx, t.queries.Get(), t.ds.keyArg(key))
 	var out []byte
 
 	switch err := row.Scan(&out); err {
@@ -65,7 +123,7 @@ func (t *txn) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
 }
 
 func (t *txn) Has(ctx context.Context, key datastore.Key) (bool, error) {
-	row := t.txn.QueryRowContext(ctx, t.queries.Exists(), key.String())
+	row := t.txn.QueryRowContext(ctx, t.queries.Exists(), t.ds.keyArg(key))
 	var exists bool
 
 	switch err := row.Scan(&exists); err {
@@ -79,7 +137,15 @@ func (t *txn) Has(ctx context.Context, key datastore.Key) (bool, error) {
 }
 
 func (t *txn) GetSize(ctx context.Context, key datastore.Key) (int, error) {
-	row := t.txn.QueryRowContext(ctx, t.queries.GetSize(), key.String())
+	if !t.queries.Capabilities().SupportsSize {
+		v, err := t.Get(ctx, key)
+		if err != nil {
+			return -1, err
+		}
+		return len(v), nil
+	}
+
+	row := t.txn.QueryRowContext(ctx, t.ds.getSizeQuery(), t.ds.keyArg(key))
 	var size int
 
 	switch err := row.Scan(&size); err {
@@ -92,27 +158,30 @@ func (t *txn) GetSize(ctx context.Context, key datastore.Key) (int, error) {
 	}
 }
 
+// Query returns the entries matching q, read within the transaction: they
+// include its uncommitted writes. The results must be closed before the
+// transaction ends.
 func (t *txn) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
-	var qe dsextensions.QueryExt
-	qe.Query = q
-	return t.ds.query(ctx, qe)
-	//return nil, ErrNotImplemented
+	return t.QueryExtended(ctx, dsextensions.QueryExt{Query: q})
 }
 
 func (t *txn) QueryExtended(ctx context.Context, q dsextensions.QueryExt) (dsq.Results, error) {
-	//t.lock.Lock()
-	//defer t.lock.Unlock()
-	//if t.finalized {
-	//	return nil, ErrTxnFinalized
-	//}
-	//return t.m.query(t.ctx, q)
-	return t.ds.query(ctx, q)
-	//return nil, ErrNotImplemented
+	raw, naive, err := t.ds.rawQuery(ctx, t.txn, seekQuery(q))
+	if err != nil {
+		return nil, err
+	}
+	return dsq.NaiveQueryApply(naive, raw), nil
 }
 
 // Put adds a value to the datastore identified by the given key.
 func (t *txn) Put(ctx context.Context, key datastore.Key, val []byte) error {
-	_, err := t.txn.ExecContext(ctx, t.queries.Put(), key.String(), val)
+	if t.ds.readOnly || t.readOnly {
+		return ErrReadOnly
+	}
+	if err := t.ds.checkValueSize(key, val); err != nil {
+		return err
+	}
+	_, err := t.txn.ExecContext(ctx, t.ds.putQuery(), t.ds.putArgs(key, val)...)
 	if err != nil {
 		_ = t.txn.Rollback()
 		return err
@@ -122,7 +191,10 @@ func (t *txn) Put(ctx context.Context, key datastore.Key, val []byte) error {
 
 // Delete removes a value from the datastore that matches the given key.
 func (t *txn) Delete(ctx context.Context, key datastore.Key) error {
-	_, err := t.txn.ExecContext(ctx, t.queries.Delete(), key.String())
+	if t.ds.readOnly || t.readOnly {
+		return ErrReadOnly
+	}
+	_, err := t.txn.ExecContext(ctx, t.queries.Delete(), t.ds.keyArg(key))
 	if err != nil {
 		_ = t.txn.Rollback()
 		return err
@@ -131,8 +203,9 @@ func (t *txn) Delete(ctx context.Context, key datastore.Key) error {
 }
 
 // Commit finalizes a transaction.
-func (t *txn) Commit(ctx context.Context) error {
-	err := t.txn.Commit()
+func (t *txn) Commit(ctx context.Context) (err error) {
+	defer func(start time.Time) { t.ds.log(ctx, "Txn.Commit", "", nil, start, err) }(time.Now())
+	err = t.txn.Commit()
 	if err != nil {
 		_ = t.txn.Rollback()
 		return err
@@ -0,0 +1,25 @@
+package sqlds
+
+import (
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Watched operations.
+const (
+	WatchPut    = "put"
+	WatchDelete = "delete"
+)
+
+// WatchEvent is a change of a key observed by a watcher. The last event of a
+// watch carries the error that stopped it, if any.
+type WatchEvent struct {
+	Key       ds.Key
+	Operation string // WatchPut or WatchDelete
+	Value     []byte // nil for deletions
+	Err       error
+}
+
+// IsUnder reports whether key is prefix or one of its descendants.
+func IsUnder(key, prefix ds.Key) bool {
+	return prefix.String() == "/" || key.Equal(prefix) || prefix.IsAncestorOf(key)
+}